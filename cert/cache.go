@@ -0,0 +1,211 @@
+package cert
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is the default max number of certificates in a Cache
+const DefaultCacheSize = 4096
+
+//leafRenewBefore a cached leaf certificate is renewed this long before it expires,
+//or a quarter of its lifetime before if the lifetime is short
+const leafRenewBefore = time.Hour
+
+//Store persistent store of the certificates cached,
+//so the certificates survive restarts
+type Store interface {
+	//Load loads the certificate of key, nil certificate is returned if not found,
+	//key is the host name, or the fingerprint of the upstream certificate mimicked
+	Load(key string) (*tls.Certificate, error)
+	//Save saves the certificate of key
+	Save(key string, cert *tls.Certificate) error
+}
+
+// Cache caches the leaf certificates signed by CA, keyed by hostname.
+//
+// A certificate is generated only once for concurrent requests of the same
+// host, and is renewed before it expires.
+//
+// It is safe calling Cache methods from concurrently running goroutines.
+type Cache struct {
+	//CA the CA certificate which signs the cached certificates
+	CA *tls.Certificate
+
+	//MaxSize max number of certificates cached in memory,
+	//the least recently used one is evicted if exceeded,
+	//DefaultCacheSize is used if not set
+	MaxSize int
+
+	//Store optional persistent store, e.g. a DiskStore
+	Store Store
+
+	//Options options of generating certificates, nil means the default options,
+	//certificates are keyed by the wildcard name if Wildcard is enabled
+	Options *Options
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+	calls   map[string]*certCall
+}
+
+type cacheEntry struct {
+	key     string
+	cert    *tls.Certificate
+	renewAt time.Time
+}
+
+//certCall an in-flight generation of a certificate
+type certCall struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// Get returns the certificate of host signed by CA,
+// the certificate is generated if not cached or about to expire.
+func (c *Cache) Get(host string) (*tls.Certificate, error) {
+	host = c.Options.Name(strings.ToLower(host))
+	if len(host) == 0 {
+		return nil, errors.New("empty host provided")
+	}
+	return c.get(host, func() (*tls.Certificate, error) {
+		return GenCertWithOptions(c.CA, []string{host}, c.Options)
+	})
+}
+
+// GetForUpstream returns the certificate mimicking the upstream's
+// leaf certificate, see GenCertFromUpstream,
+// the certificate is keyed by the SHA-256 fingerprint of upstream.
+func (c *Cache) GetForUpstream(upstream *x509.Certificate) (*tls.Certificate, error) {
+	fingerprint := sha256.Sum256(upstream.Raw)
+	return c.get("sha256-"+hex.EncodeToString(fingerprint[:]), func() (*tls.Certificate, error) {
+		return GenCertFromUpstream(c.CA, upstream, c.Options)
+	})
+}
+
+//get returns the certificate of key, gen generates the certificate if not found
+func (c *Cache) get(key string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	if c.CA == nil {
+		return nil, errors.New("nil CA certificate provided")
+	}
+	c.lock.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+		c.calls = make(map[string]*certCall)
+	}
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		if time.Now().Before(entry.renewAt) {
+			c.lru.MoveToFront(e)
+			c.lock.Unlock()
+			return entry.cert, nil
+		}
+		c.lru.Remove(e)
+		delete(c.entries, key)
+	}
+	//wait for the generation in flight
+	if call, ok := c.calls[key]; ok {
+		c.lock.Unlock()
+		<-call.done
+		return call.cert, call.err
+	}
+	call := &certCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.lock.Unlock()
+
+	call.cert, call.err = c.load(key, gen)
+	c.lock.Lock()
+	if call.err == nil {
+		c.add(key, call.cert)
+	}
+	delete(c.calls, key)
+	c.lock.Unlock()
+	close(call.done)
+	return call.cert, call.err
+}
+
+// Pregenerate generates and caches the certificates of hosts in advance,
+// e.g. the hosts which are known to be decrypted
+func (c *Cache) Pregenerate(hosts ...string) error {
+	for _, host := range hosts {
+		if _, err := c.Get(host); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of certificates cached in memory
+func (c *Cache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+//load loads the certificate from store, or generates a new one by gen
+func (c *Cache) load(key string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	if c.Store != nil {
+		if cert, err := c.Store.Load(key); err == nil && c.usable(cert) {
+			return cert, nil
+		}
+	}
+	cert, err := gen()
+	if err != nil {
+		return nil, err
+	}
+	if c.Store != nil {
+		//the certificate is still usable even it fails to be saved
+		c.Store.Save(key, cert)
+	}
+	return cert, nil
+}
+
+//usable test if the certificate loaded from store can be served, i.e. it's signed
+//by CA, valid now rather than about to expire, and in the key type of Options
+func (c *Cache) usable(cert *tls.Certificate) bool {
+	if cert == nil || cert.Leaf == nil || cert.Leaf.CheckSignatureFrom(c.CA.Leaf) != nil {
+		return false
+	}
+	now := time.Now()
+	return !now.Before(cert.Leaf.NotBefore) && now.Before(renewTime(cert)) &&
+		c.Options.matchKey(cert.PrivateKey)
+}
+
+//add adds the certificate into cache, evicts the least recently used one if full
+func (c *Cache) add(key string, cert *tls.Certificate) {
+	c.entries[key] = c.lru.PushFront(&cacheEntry{
+		key:     key,
+		cert:    cert,
+		renewAt: renewTime(cert),
+	})
+	maxSize := c.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultCacheSize
+	}
+	for c.lru.Len() > maxSize {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*cacheEntry).key)
+	}
+}
+
+//renewTime time to renew the certificate, which is before its expiration
+func renewTime(cert *tls.Certificate) time.Time {
+	if cert.Leaf == nil {
+		return time.Time{}
+	}
+	renewBefore := leafRenewBefore
+	if lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore); lifetime/4 < renewBefore {
+		renewBefore = lifetime / 4
+	}
+	return cert.Leaf.NotAfter.Add(-renewBefore)
+}
@@ -0,0 +1,159 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testCA(t *testing.T) *tls.Certificate {
+	certPEM, keyPEM, err := GenCA("fastproxy test CA")
+	if err != nil {
+		t.Fatalf("fail to generate CA: %s", err)
+	}
+	ca, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("fail to load CA: %s", err)
+	}
+	if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+		t.Fatalf("fail to parse CA: %s", err)
+	}
+	return &ca
+}
+
+func TestCacheGet(t *testing.T) {
+	c := &Cache{CA: testCA(t), MaxSize: 2}
+
+	//concurrent requests share the same certificate
+	var wg sync.WaitGroup
+	certs := make([]*tls.Certificate, 8)
+	for i := range certs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cert, err := c.Get("www.example.com")
+			if err != nil {
+				t.Errorf("fail to get certificate: %s", err)
+			}
+			certs[i] = cert
+		}(i)
+	}
+	wg.Wait()
+	for _, cert := range certs {
+		if cert != certs[0] {
+			t.Fatalf("certificate generated more than once")
+		}
+	}
+	if err := certs[0].Leaf.VerifyHostname("www.example.com"); err != nil {
+		t.Fatalf("unexpected certificate: %s", err)
+	}
+
+	//hostname is case insensitive
+	if cert, _ := c.Get("WWW.Example.com"); cert != certs[0] {
+		t.Fatalf("certificate of the same host is not cached")
+	}
+
+	//the least recently used one is evicted
+	c.Get("a.example.com")
+	c.Get("b.example.com")
+	if c.Len() != 2 {
+		t.Fatalf("unexpected cache size %d, expecting 2", c.Len())
+	}
+	if cert, _ := c.Get("www.example.com"); cert == certs[0] {
+		t.Fatalf("certificate is not evicted")
+	}
+}
+
+func TestCacheDiskStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastproxy-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := testCA(t)
+	c1 := &Cache{CA: ca, Store: &DiskStore{Dir: dir}}
+	cert1, err := c1.Get("www.example.com")
+	if err != nil {
+		t.Fatalf("fail to get certificate: %s", err)
+	}
+	//a new cache loads the saved certificate
+	c2 := &Cache{CA: ca, Store: &DiskStore{Dir: dir}}
+	cert2, err := c2.Get("www.example.com")
+	if err != nil {
+		t.Fatalf("fail to get certificate: %s", err)
+	}
+	if !cert1.Leaf.Equal(cert2.Leaf) {
+		t.Fatalf("certificate is not loaded from disk")
+	}
+	//certificates signed by another CA are not used
+	c3 := &Cache{CA: testCA(t), Store: &DiskStore{Dir: dir}}
+	cert3, err := c3.Get("www.example.com")
+	if err != nil {
+		t.Fatalf("fail to get certificate: %s", err)
+	}
+	if cert1.Leaf.Equal(cert3.Leaf) {
+		t.Fatalf("certificate signed by another CA is loaded")
+	}
+}
+
+func TestCacheDiskStoreOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastproxy-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := testCA(t)
+	store := &DiskStore{Dir: dir}
+	c1 := &Cache{CA: ca, Store: store, Options: &Options{KeyType: KeyTypeECDSAP256}}
+	cert1, err := c1.Get("www.example.com")
+	if err != nil {
+		t.Fatalf("fail to get certificate: %s", err)
+	}
+	//certificates in another key type are not used
+	c2 := &Cache{CA: ca, Store: store, Options: &Options{KeyType: KeyTypeEd25519}}
+	cert2, err := c2.Get("www.example.com")
+	if err != nil {
+		t.Fatalf("fail to get certificate: %s", err)
+	}
+	if cert1.Leaf.Equal(cert2.Leaf) {
+		t.Fatalf("certificate in another key type is loaded")
+	}
+	//certificates about to expire are not used
+	expiring, err := GenCertWithOptions(ca, []string{"api.example.com"}, &Options{LeafMaxAge: time.Minute})
+	if err != nil {
+		t.Fatalf("fail to generate certificate: %s", err)
+	}
+	if err := store.Save("api.example.com", expiring); err != nil {
+		t.Fatalf("fail to save certificate: %s", err)
+	}
+	c3 := &Cache{CA: ca, Store: store}
+	cert3, err := c3.Get("api.example.com")
+	if err != nil {
+		t.Fatalf("fail to get certificate: %s", err)
+	}
+	if cert3.Leaf.Equal(expiring.Leaf) {
+		t.Fatalf("certificate about to expire is loaded")
+	}
+}
+
+func TestDiskStorePath(t *testing.T) {
+	store := &DiskStore{}
+	paths := make(map[string]string)
+	for _, key := range []string{"www.example.com", "*.example.com", "_.example.com", "_2a.example.com",
+		"WWW.example.com", "xn--fiqs8s.example.com", "sha256-0123456789abcdef"} {
+		path := store.path(key)
+		if other, ok := paths[path]; ok {
+			t.Fatalf("keys %q and %q share the same file %s", key, other, path)
+		}
+		paths[path] = key
+	}
+	if path := store.path("*.example.com"); path != "_2a.example.com.pem" {
+		t.Fatalf("unexpected path %s", path)
+	}
+}
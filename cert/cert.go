@@ -1,9 +1,12 @@
 package cert
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -11,10 +14,12 @@ import (
 	"errors"
 	"math/big"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/haxii/fastproxy/util"
+	"golang.org/x/net/publicsuffix"
 )
 
 const (
@@ -30,31 +35,166 @@ const (
 	leafUsage = caUsage
 )
 
+//KeyType key algorithm of the generated certificates
+type KeyType int
+
+const (
+	//KeyTypeECDSAP521 ECDSA with curve P-521, the default key type
+	KeyTypeECDSAP521 KeyType = iota
+	//KeyTypeECDSAP384 ECDSA with curve P-384
+	KeyTypeECDSAP384
+	//KeyTypeECDSAP256 ECDSA with curve P-256
+	KeyTypeECDSAP256
+	//KeyTypeRSA2048 RSA with 2048 bits
+	KeyTypeRSA2048
+	//KeyTypeEd25519 Ed25519
+	KeyTypeEd25519
+)
+
+//Options options of generating certificates, nil means the default options
+type Options struct {
+	//KeyType key algorithm of the certificate, KeyTypeECDSAP521 by default
+	KeyType KeyType
+
+	//LeafMaxAge lifetime of the leaf certificates, 24 hours by default
+	LeafMaxAge time.Duration
+
+	//Wildcard collapses a host name into a wildcard one,
+	//e.g. `www.example.com` into `*.example.com`,
+	//so all the sibling hosts share the same certificate,
+	//a host name is never collapsed at or above its registrable domain
+	//in the public suffix list, e.g. `example.co.uk` is kept as is
+	//rather than `*.co.uk`, which is rejected by browsers
+	Wildcard bool
+}
+
+func (o *Options) keyType() KeyType {
+	if o == nil {
+		return KeyTypeECDSAP521
+	}
+	return o.KeyType
+}
+
+//matchKey test if key is in the key type of options
+func (o *Options) matchKey(key crypto.PrivateKey) bool {
+	keyType := o.keyType()
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P521():
+			return keyType == KeyTypeECDSAP521
+		case elliptic.P384():
+			return keyType == KeyTypeECDSAP384
+		case elliptic.P256():
+			return keyType == KeyTypeECDSAP256
+		}
+	case *rsa.PrivateKey:
+		return keyType == KeyTypeRSA2048 && k.N.BitLen() == 2048
+	case ed25519.PrivateKey:
+		return keyType == KeyTypeEd25519
+	}
+	return false
+}
+
+func (o *Options) leafMaxAge() time.Duration {
+	if o == nil || o.LeafMaxAge <= 0 {
+		return leafMaxAge
+	}
+	return o.LeafMaxAge
+}
+
+//Name the name in certificate of host,
+//i.e. the wildcard name of host if Wildcard is enabled
+func (o *Options) Name(host string) string {
+	if o == nil || !o.Wildcard || net.ParseIP(host) != nil || strings.HasPrefix(host, "*.") {
+		return host
+	}
+	dot := strings.IndexByte(host, '.')
+	if dot < 0 {
+		return host
+	}
+	//the parent domain replaced by wildcard should be the registrable domain or below
+	registrable, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil || len(host)-dot-1 < len(registrable) {
+		return host
+	}
+	return "*" + host[dot:]
+}
+
 //GenCert gen host's certificate
 func GenCert(ca *tls.Certificate, names []string) (*tls.Certificate, error) {
-	now := time.Now().Add(-1 * time.Hour).UTC()
+	return GenCertWithOptions(ca, names, nil)
+}
+
+//GenCertWithOptions gen host's certificate with options,
+//the names parsed as IP are set as IP SANs, others as DNS SANs
+func GenCertWithOptions(ca *tls.Certificate, names []string, opts *Options) (*tls.Certificate, error) {
+	now := time.Now().UTC()
 	if !ca.Leaf.IsCA {
 		return nil, errors.New("CA cert is not a CA")
 	}
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if len(names) == 0 {
+		return nil, errors.New("no names provided")
+	}
+	serialNumber, err := genSerialNumber()
 	if err != nil {
-		return nil, util.ErrWrapper(err, "failed to generate serial number")
+		return nil, err
 	}
 	template := &x509.Certificate{
 		SerialNumber:          serialNumber,
-		Subject:               pkix.Name{CommonName: names[0]},
-		NotBefore:             now,
-		NotAfter:              now.Add(leafMaxAge),
+		Subject:               pkix.Name{CommonName: opts.Name(names[0])},
+		NotBefore:             now.Add(-1 * time.Hour),
+		NotAfter:              now.Add(opts.leafMaxAge()),
 		KeyUsage:              leafUsage,
 		BasicConstraintsValid: true,
-		DNSNames:              names,
-		SignatureAlgorithm:    x509.ECDSAWithSHA512,
 	}
-	key, err := genKeyPair()
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, opts.Name(name))
+		}
+	}
+	key, err := genKeyPair(opts.keyType())
+	if err != nil {
+		return nil, err
+	}
+	return signCert(template, ca, key)
+}
+
+//GenCertFromUpstream gen a certificate mimicking the upstream's leaf certificate,
+//i.e. the subject, SANs, validity window and key usage are copied from upstream,
+//the certificate is signed by CA with a new key in key type of options
+func GenCertFromUpstream(ca *tls.Certificate, upstream *x509.Certificate, opts *Options) (*tls.Certificate, error) {
+	if !ca.Leaf.IsCA {
+		return nil, errors.New("CA cert is not a CA")
+	}
+	serialNumber, err := genSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               upstream.Subject,
+		NotBefore:             upstream.NotBefore,
+		NotAfter:              upstream.NotAfter,
+		KeyUsage:              upstream.KeyUsage,
+		ExtKeyUsage:           upstream.ExtKeyUsage,
+		BasicConstraintsValid: true,
+		DNSNames:              upstream.DNSNames,
+		IPAddresses:           upstream.IPAddresses,
+		EmailAddresses:        upstream.EmailAddresses,
+		URIs:                  upstream.URIs,
+	}
+	key, err := genKeyPair(opts.keyType())
 	if err != nil {
 		return nil, err
 	}
+	return signCert(template, ca, key)
+}
+
+//signCert signs the certificate template with CA
+func signCert(template *x509.Certificate, ca *tls.Certificate, key crypto.Signer) (*tls.Certificate, error) {
 	x, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, key.Public(), ca.PrivateKey)
 	if err != nil {
 		return nil, err
@@ -66,12 +206,39 @@ func GenCert(ca *tls.Certificate, names []string) (*tls.Certificate, error) {
 	return cert, nil
 }
 
-func genKeyPair() (*ecdsa.PrivateKey, error) {
-	return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+func genSerialNumber() (*big.Int, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, util.ErrWrapper(err, "failed to generate serial number")
+	}
+	return serialNumber, nil
+}
+
+func genKeyPair(keyType KeyType) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeECDSAP521:
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case KeyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, errors.New("unknown key type " + strconv.Itoa(int(keyType)))
 }
 
 //GenCA gen a new root ca.cer and private key
 func GenCA(name string) (certPEM, keyPEM []byte, err error) {
+	return GenCAWithOptions(name, nil)
+}
+
+//GenCAWithOptions gen a new root ca.cer and private key with the key type in options
+func GenCAWithOptions(name string, opts *Options) (certPEM, keyPEM []byte, err error) {
 	now := time.Now().UTC()
 	template := &x509.Certificate{
 		SerialNumber:          big.NewInt(1),
@@ -80,11 +247,10 @@ func GenCA(name string) (certPEM, keyPEM []byte, err error) {
 		NotAfter:              now.Add(caMaxAge),
 		KeyUsage:              caUsage,
 		BasicConstraintsValid: true,
-		IsCA:               true,
-		MaxPathLen:         2,
-		SignatureAlgorithm: x509.ECDSAWithSHA512,
+		IsCA:                  true,
+		MaxPathLen:            2,
 	}
-	key, err := genKeyPair()
+	key, err := genKeyPair(opts.keyType())
 	if err != nil {
 		return
 	}
@@ -92,7 +258,7 @@ func GenCA(name string) (certPEM, keyPEM []byte, err error) {
 	if err != nil {
 		return
 	}
-	keyDER, err := x509.MarshalECPrivateKey(key)
+	keyBlock, err := marshalKey(key)
 	if err != nil {
 		return
 	}
@@ -100,16 +266,33 @@ func GenCA(name string) (certPEM, keyPEM []byte, err error) {
 		Type:  "CERTIFICATE",
 		Bytes: certDER,
 	})
-	keyPEM = pem.EncodeToMemory(&pem.Block{
-		Type:  "ECDSA PRIVATE KEY",
-		Bytes: keyDER,
-	})
+	keyPEM = pem.EncodeToMemory(keyBlock)
 	return
 }
 
+//marshalKey marshals the private key into a PEM block
+func marshalKey(key crypto.Signer) (*pem.Block, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		keyDER, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "ECDSA PRIVATE KEY", Bytes: keyDER}, nil
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, nil
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}, nil
+}
+
 //MakeClientTLSConfig make a client TLS config based on host and servername
-//servername is 1st used to generate the config then from client tls
-func MakeClientTLSConfig(host, serverName string) *tls.Config {
+//servername is 1st used to generate the config then from client tls,
+//nextProtos are the ALPN protocols offered in preference order, e.g. h2
+func MakeClientTLSConfig(host, serverName string, nextProtos ...string) *tls.Config {
 	tlsServerName := func(addr string) string {
 		if !strings.Contains(addr, ":") {
 			return addr
@@ -122,6 +305,7 @@ func MakeClientTLSConfig(host, serverName string) *tls.Config {
 	}
 	tlsConfig := &tls.Config{}
 	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	tlsConfig.NextProtos = nextProtos
 
 	if len(serverName) == 0 {
 		hostName := tlsServerName(host)
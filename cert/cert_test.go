@@ -0,0 +1,97 @@
+package cert
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestGenCertWithOptions(t *testing.T) {
+	for _, keyType := range []KeyType{KeyTypeECDSAP521, KeyTypeECDSAP384,
+		KeyTypeECDSAP256, KeyTypeRSA2048, KeyTypeEd25519} {
+		opts := &Options{KeyType: keyType}
+		certPEM, keyPEM, err := GenCAWithOptions("fastproxy test CA", opts)
+		if err != nil {
+			t.Fatalf("fail to generate CA of key type %d: %s", keyType, err)
+		}
+		ca, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatalf("fail to load CA of key type %d: %s", keyType, err)
+		}
+		ca.Leaf, _ = x509.ParseCertificate(ca.Certificate[0])
+
+		cert, err := GenCertWithOptions(&ca, []string{"www.example.com"}, opts)
+		if err != nil {
+			t.Fatalf("fail to generate certificate of key type %d: %s", keyType, err)
+		}
+		if err := cert.Leaf.CheckSignatureFrom(ca.Leaf); err != nil {
+			t.Fatalf("certificate of key type %d is not signed by CA: %s", keyType, err)
+		}
+		var ok bool
+		switch keyType {
+		case KeyTypeRSA2048:
+			_, ok = cert.PrivateKey.(*rsa.PrivateKey)
+		case KeyTypeEd25519:
+			_, ok = cert.PrivateKey.(ed25519.PrivateKey)
+		default:
+			_, ok = cert.PrivateKey.(*ecdsa.PrivateKey)
+		}
+		if !ok {
+			t.Fatalf("unexpected private key %T of key type %d", cert.PrivateKey, keyType)
+		}
+	}
+}
+
+func TestGenCertNames(t *testing.T) {
+	ca := testCA(t)
+	opts := &Options{Wildcard: true, LeafMaxAge: time.Hour}
+	cert, err := GenCertWithOptions(ca, []string{"www.example.com", "example.com", "127.0.0.1"}, opts)
+	if err != nil {
+		t.Fatalf("fail to generate certificate: %s", err)
+	}
+	for _, host := range []string{"www.example.com", "api.example.com", "example.com", "127.0.0.1"} {
+		if err := cert.Leaf.VerifyHostname(host); err != nil {
+			t.Fatalf("unexpected certificate for %s: %s", host, err)
+		}
+	}
+	if len(cert.Leaf.IPAddresses) != 1 {
+		t.Fatalf("unexpected IP SANs %v", cert.Leaf.IPAddresses)
+	}
+	if lifetime := time.Until(cert.Leaf.NotAfter); lifetime > time.Hour {
+		t.Fatalf("unexpected lifetime %s", lifetime)
+	}
+}
+
+func TestOptionsName(t *testing.T) {
+	opts := &Options{Wildcard: true}
+	tests := []struct {
+		host    string
+		expName string
+	}{
+		{"www.example.com", "*.example.com"},
+		{"a.b.example.com", "*.b.example.com"},
+		{"example.com", "example.com"},
+		{"com", "com"},
+		{"localhost", "localhost"},
+		{"example.co.uk", "example.co.uk"},
+		{"www.example.co.uk", "*.example.co.uk"},
+		{"foo.github.io", "foo.github.io"},
+		{"www.foo.github.io", "*.foo.github.io"},
+		{"*.example.com", "*.example.com"},
+		{"127.0.0.1", "127.0.0.1"},
+		{"::1", "::1"},
+	}
+	for _, test := range tests {
+		if name := opts.Name(test.host); name != test.expName {
+			t.Fatalf("unexpected name %q of %q, expecting %q", name, test.host, test.expName)
+		}
+	}
+	var nilOpts *Options
+	if name := nilOpts.Name("www.example.com"); name != "www.example.com" {
+		t.Fatalf("unexpected name %q without wildcard", name)
+	}
+}
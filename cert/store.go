@@ -0,0 +1,99 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/haxii/fastproxy/util"
+)
+
+// DiskStore stores certificates in the directory Dir,
+// each certificate is saved with its private key in a PEM file named by key,
+// the chars other than lower case letters, digits, `.` and `-` are escaped
+// as `_` and the hex code, e.g. `_2a.example.com.pem` of `*.example.com`.
+type DiskStore struct {
+	Dir string
+}
+
+// Load loads the certificate of key, nil certificate is returned if not found
+func (s *DiskStore) Load(key string) (*tls.Certificate, error) {
+	data, err := ioutil.ReadFile(s.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	//both the certificate and the key are in the same file
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, util.ErrWrapper(err, "invalid certificate file of "+key)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// Save saves the certificate of key
+func (s *DiskStore) Save(key string, cert *tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("empty certificate provided")
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	for _, certDER := range cert.Certificate {
+		data = append(data, pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: certDER,
+		})...)
+	}
+	data = append(data, pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: keyDER,
+	})...)
+
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	//write to a temp file then rename it, so a partial file is never loaded
+	path := s.path(key)
+	tmp, err := ioutil.TempFile(s.Dir, ".cert-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+//path file path of key's certificate, the escaping is reversible, so every key
+//has its own file name, which is safe on case-insensitive file systems as well
+func (s *DiskStore) path(key string) string {
+	const hexDigits = "0123456789abcdef"
+	name := make([]byte, 0, len(key)+4)
+	for i := 0; i < len(key); i++ {
+		switch b := key[i]; {
+		case b >= 'a' && b <= 'z', b >= '0' && b <= '9', b == '.', b == '-':
+			name = append(name, b)
+		default:
+			name = append(name, '_', hexDigits[b>>4], hexDigits[b&0xf])
+		}
+	}
+	return filepath.Join(s.Dir, string(name)+".pem")
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"io"
@@ -13,10 +14,12 @@ import (
 	"github.com/haxii/fastproxy/bufiopool"
 	"github.com/haxii/fastproxy/bytebufferpool"
 	"github.com/haxii/fastproxy/cert"
+	basehttp "github.com/haxii/fastproxy/http"
 	"github.com/haxii/fastproxy/proxy/http"
 	"github.com/haxii/fastproxy/servertime"
 	"github.com/haxii/fastproxy/superproxy"
 	"github.com/haxii/fastproxy/transport"
+	"golang.org/x/net/http2"
 )
 
 // ErrConnectionClosed may be returned from client methods if the server
@@ -116,6 +119,31 @@ type Client struct {
 	// By default request write timeout is unlimited.
 	WriteTimeout time.Duration
 
+	// HostProtocol returns the protocol used for the https requests to
+	// hostWithPort, h2 streams of a host are multiplexed over a single connection.
+	//
+	// ProtocolHTTP1 is used if not set, and for the requests via super proxies.
+	HostProtocol func(hostWithPort string) Protocol
+
+	// ResponseLimits limits of the responses read from upstreams,
+	// the default ones are used if not set, see http.Limits.
+	ResponseLimits basehttp.Limits
+
+	// ExceededResponseLimits counts the responses exceeding ResponseLimits,
+	// nothing is counted if not set.
+	ExceededResponseLimits *basehttp.LimitCounter
+
+	// ContinueTimeout maximum duration waiting for the upstream's `100 Continue`
+	// after the header of a request expecting it is sent, the body is sent anyway
+	// after that, the upstream may refuse the body with a final response before.
+	//
+	// DefaultContinueTimeout is used if not set, negative sends the body without waiting.
+	ContinueTimeout time.Duration
+
+	// RetryPolicy policy of retrying the failed requests,
+	// DefaultRetryPolicy is used if not set.
+	RetryPolicy *RetryPolicy
+
 	hostClientsLock sync.Mutex
 	//refers to all possibilities of requestType i.e. isTLS x isProxy
 	hostClientsList [5]hostClients
@@ -169,6 +197,15 @@ const (
 // ErrNoFreeConns is returned if all Client.MaxConnsPerHost connections
 // to the requested host are busy.
 func (c *Client) Do(req Request, resp Response) error {
+	return c.DoContext(context.Background(), req, resp)
+}
+
+// DoContext performs the given http request like Do, the request is
+// canceled once ctx is done, including dialing, handshaking, making the
+// tunnel via the super proxy and reading the response, then ctx.Err() is returned.
+//
+// The timeouts of the request may be set in ctx by WithTimeouts.
+func (c *Client) DoContext(ctx context.Context, req Request, resp Response) error {
 	if req == nil {
 		return errors.New("nil request")
 	}
@@ -178,6 +215,19 @@ func (c *Client) Do(req Request, resp Response) error {
 	if c.BufioPool == nil {
 		return errors.New("nil buffer io pool")
 	}
+	//the host client is got for every attempt, as the super proxy may be switched
+	return c.RetryPolicy.do(ctx, switchProxyOf(req), func(policy *RetryPolicy,
+		buffer *bytebufferpool.ByteBuffer, last bool) (RetryClass, error) {
+		hc, err := c.hostClient(req)
+		if err != nil {
+			return 0, err
+		}
+		return hc.attempt(ctx, req, resp, policy, buffer, last)
+	})
+}
+
+//hostClient adds or gets the host client of req
+func (c *Client) hostClient(req Request) (*HostClient, error) {
 	//fetch request type
 	viaProxy := (req.GetProxy() != nil)
 	reqType := parseRequestType(req.GetProxy(), req.IsTLS())
@@ -187,12 +237,16 @@ func (c *Client) Do(req Request, resp Response) error {
 	if viaProxy {
 		hostWithPort = req.GetProxy().HostWithPort()
 		if len(hostWithPort) == 0 {
-			return errors.New("nil superproxy proxy host provided")
+			return nil, errors.New("nil superproxy proxy host provided")
 		}
 	} else {
 		hostWithPort = req.HostInfo().HostWithPort()
 		if len(hostWithPort) == 0 {
-			return errors.New("nil target host provided")
+			return nil, errors.New("nil target host provided")
+		}
+		//the pinned target is dialed, which is kept apart from the host's own
+		if target := req.HostInfo().TargetWithPort(); target != hostWithPort {
+			hostWithPort += " " + target
 		}
 	}
 
@@ -208,14 +262,21 @@ func (c *Client) Do(req Request, resp Response) error {
 	hc := c.hostClientsList[reqType.Value()][hostWithPort]
 	if hc == nil {
 		hc = &HostClient{
-			BufioPool:    c.BufioPool,
-			ReadTimeout:  c.ReadTimeout,
-			WriteTimeout: c.WriteTimeout,
+			BufioPool:              c.BufioPool,
+			ReadTimeout:            c.ReadTimeout,
+			WriteTimeout:           c.WriteTimeout,
+			ResponseLimits:         c.ResponseLimits,
+			ExceededResponseLimits: c.ExceededResponseLimits,
+			ContinueTimeout:        c.ContinueTimeout,
+			RetryPolicy:            c.RetryPolicy,
 			ConnManager: transport.ConnManager{
 				MaxConns:            c.MaxConnsPerHost,
 				MaxIdleConnDuration: c.MaxIdleConnDuration,
 			},
 		}
+		if reqType == requestDirectHTTPS && c.HostProtocol != nil {
+			hc.Protocol = c.HostProtocol(hostWithPort)
+		}
 		hostClients[hostWithPort] = hc
 		if len(hostClients) == 1 {
 			startCleaner = true
@@ -226,8 +287,7 @@ func (c *Client) Do(req Request, resp Response) error {
 	if startCleaner {
 		go c.mCleaner(hostClients)
 	}
-
-	return hc.Do(req, resp)
+	return hc, nil
 }
 
 func (c *Client) mCleaner(m map[string]*HostClient) {
@@ -283,6 +343,39 @@ type HostClient struct {
 	//ConnManager manager of the connections
 	ConnManager transport.ConnManager
 
+	// Protocol protocol used for https requests, the requests via
+	// super proxies always use HTTP/1.1
+	Protocol Protocol
+
+	// ResponseLimits limits of the responses read from the host,
+	// the default ones are used if not set, see http.Limits.
+	ResponseLimits basehttp.Limits
+
+	// ExceededResponseLimits counts the responses exceeding ResponseLimits,
+	// nothing is counted if not set.
+	ExceededResponseLimits *basehttp.LimitCounter
+
+	// ContinueTimeout maximum duration waiting for the upstream's `100 Continue`
+	// after the header of a request expecting it is sent, the body is sent anyway
+	// after that, the upstream may refuse the body with a final response before.
+	//
+	// DefaultContinueTimeout is used if not set, negative sends the body without waiting.
+	ContinueTimeout time.Duration
+
+	// RetryPolicy policy of retrying the failed requests,
+	// DefaultRetryPolicy is used if not set.
+	RetryPolicy *RetryPolicy
+
+	//the h2 connection shared by requests
+	http2Lock      sync.Mutex
+	http2Conn      *http2.ClientConn
+	http2Transport *http2.Transport
+	http2TLSConfig *tls.Config
+	//http2Unsupported the upstream doesn't negotiate h2 in ProtocolAuto
+	http2Unsupported bool
+	//http2Dialing closed once the h2 connection being dialed is done, nil if not dialing
+	http2Dialing chan struct{}
+
 	lastUseTime uint32
 
 	pendingRequests uint64
@@ -303,6 +396,12 @@ func (c *HostClient) LastUseTime() time.Time {
 // ErrNoFreeConns is returned if all HostClient.MaxConns connections
 // to the host are busy.
 func (c *HostClient) Do(req Request, resp Response) error {
+	return c.DoContext(context.Background(), req, resp)
+}
+
+// DoContext performs the given http request like Do, the request is
+// canceled once ctx is done, see Client.DoContext.
+func (c *HostClient) DoContext(ctx context.Context, req Request, resp Response) error {
 	if req == nil {
 		return errors.New("nil request")
 	}
@@ -312,43 +411,18 @@ func (c *HostClient) Do(req Request, resp Response) error {
 	if c.BufioPool == nil {
 		return errors.New("nil buffer io pool")
 	}
-	var err error
-	var retry bool
-	const maxAttempts = 5
-	attempts := 0
+	return c.RetryPolicy.do(ctx, nil, func(policy *RetryPolicy,
+		buffer *bytebufferpool.ByteBuffer, last bool) (RetryClass, error) {
+		return c.attempt(ctx, req, resp, policy, buffer, last)
+	})
+}
 
+//attempt makes an attempt of the request, see attemptFunc
+func (c *HostClient) attempt(ctx context.Context, req Request, resp Response,
+	policy *RetryPolicy, buffer *bytebufferpool.ByteBuffer, last bool) (RetryClass, error) {
 	atomic.AddUint64(&c.pendingRequests, 1)
-	buffer := bytebufferpool.Get()
-	for {
-		retry, err = c.do(req, resp, buffer)
-		if err == nil || !retry {
-			break
-		}
-
-		if isHeadOrGet(req.Method()) {
-			// Retry non-idempotent requests if the server closes
-			// the connection before sending the response.
-			//
-			// This case is possible if the server closes the idle
-			// keep-alive connection on timeout.
-			//
-			// Apache and Nginx usually do this.
-			if err != io.EOF {
-				break
-			}
-		}
-		attempts++
-		if attempts >= maxAttempts {
-			break
-		}
-	}
-	bytebufferpool.Put(buffer)
-	atomic.AddUint64(&c.pendingRequests, ^uint64(0))
-
-	if err == io.EOF {
-		err = ErrConnectionClosed
-	}
-	return err
+	defer atomic.AddUint64(&c.pendingRequests, ^uint64(0))
+	return c.do(ctx, req, resp, policy, buffer, last)
 }
 
 // PendingRequests returns the current number of requests the client
@@ -360,8 +434,9 @@ func (c *HostClient) PendingRequests() int {
 	return int(atomic.LoadUint64(&c.pendingRequests))
 }
 
-func (c *HostClient) do(req Request, resp Response,
-	reqCacheForRetry *bytebufferpool.ByteBuffer) (bool, error) {
+//do makes an attempt of the request, see attemptFunc
+func (c *HostClient) do(ctx context.Context, req Request, resp Response, policy *RetryPolicy,
+	reqCacheForRetry *bytebufferpool.ByteBuffer, last bool) (RetryClass, error) {
 	//set hostclient's last used time
 	atomic.StoreUint32(&c.lastUseTime, uint32(servertime.CoarseTimeNow().Unix()-startTimeUnix))
 
@@ -369,6 +444,21 @@ func (c *HostClient) do(req Request, resp Response,
 	viaProxy := (req.GetProxy() != nil)
 	reqType := parseRequestType(req.GetProxy(), req.IsTLS())
 
+	//probeConn the TLS connection probing h2 of the upstream only speaking HTTP/1.1,
+	//which is used rather than dialing again
+	var probeConn net.Conn
+	if reqType == requestDirectHTTPS && c.Protocol != ProtocolHTTP1 {
+		cc, conn, err := c.acquireHTTP2Conn(ctx, req)
+		if err != nil {
+			return unwrapRetryable(err)
+		}
+		if cc != nil {
+			return 0, c.doHTTP2(ctx, cc, req, resp)
+		}
+		//the upstream only speaks HTTP/1.1
+		probeConn = conn
+	}
+
 	//set https tls config
 	if c.tlsServerConfig == nil {
 		if reqType == requestDirectHTTPS {
@@ -381,35 +471,58 @@ func (c *HostClient) do(req Request, resp Response,
 		}
 	}
 
-	//get the connection
-	dialer := func() (net.Conn, error) {
+	//get the connection, the failure is wrapped in its retry class
+	timeouts := timeoutsFrom(ctx)
+	dialer := func(ctx context.Context) (net.Conn, error) {
+		dialCtx, cancel := withTimeout(ctx, timeouts.Dial)
+		defer cancel()
 		switch reqType {
 		case requestDirectHTTP:
-			return transport.Dial(req.HostInfo().HostWithPort())
+			conn, err := transport.DialContext(dialCtx, req.HostInfo().TargetWithPort())
+			return conn, retryable(RetryDial, err)
 		case requestDirectHTTPS:
-			return transport.DialTLS(req.HostInfo().HostWithPort(), c.tlsServerConfig)
+			if probeConn != nil {
+				conn := probeConn
+				probeConn = nil
+				return conn, nil
+			}
+			conn, err := transport.DialTLSContext(dialCtx, req.HostInfo().TargetWithPort(), c.tlsServerConfig)
+			if err != nil {
+				return nil, retryable(RetryDial, err)
+			}
+			return conn, retryable(RetryTLS, handshake(ctx, conn.(*tls.Conn), timeouts.TLSHandshake))
 		case requestProxyHTTP:
-			return transport.Dial(req.GetProxy().HostWithPort())
+			conn, err := transport.DialContext(dialCtx, req.GetProxy().HostWithPort())
+			return conn, retryable(RetryDial, err)
 		case requestProxyHTTPS:
 			fallthrough
 		case requestProxySOCKS5:
-			tunnelConn, err := req.GetProxy().MakeTunnel(c.BufioPool, req.HostInfo().TargetWithPort())
+			tunnelConn, err := req.GetProxy().MakeTunnelContext(dialCtx, c.BufioPool,
+				req.HostInfo().TargetWithPort())
 			if err != nil {
-				return nil, err
+				return nil, retryable(RetryDial, err)
 			}
 			if reqType == requestProxyHTTPS {
 				conn := tls.Client(tunnelConn, c.tlsServerConfig)
-				return conn, nil
+				return conn, retryable(RetryTLS, handshake(ctx, conn, timeouts.TLSHandshake))
 			}
 			return tunnelConn, nil
 		}
 		return nil, errors.New("request type not implemented")
 	}
-	cc, err := c.ConnManager.AcquireConn(dialer)
+	cc, err := c.ConnManager.AcquireConnContext(ctx, dialer)
+	//the probing connection is not used if an idle one is acquired, or none is free
+	if probeConn != nil {
+		probeConn.Close()
+	}
 	if err != nil {
-		return false, err
+		return unwrapRetryable(err)
 	}
 	conn := cc.Get()
+	reused := cc.Reused()
+	//the connection is closed to interrupt the request once ctx is done
+	stopWatching := transport.WatchContext(ctx, conn)
+	defer stopWatching()
 
 	//pre-setup
 	if c.WriteTimeout > 0 {
@@ -420,7 +533,7 @@ func (c *HostClient) do(req Request, resp Response,
 		if currentTime.Sub(cc.LastWriteDeadlineTime) > (c.WriteTimeout >> 2) {
 			if err = conn.SetWriteDeadline(currentTime.Add(c.WriteTimeout)); err != nil {
 				c.ConnManager.CloseConn(cc)
-				return true, err
+				return RetryEOF, err
 			}
 			cc.LastWriteDeadlineTime = currentTime
 		}
@@ -432,39 +545,46 @@ func (c *HostClient) do(req Request, resp Response,
 		resetConnection = true
 	}
 
-	//write request
-	shouldCacheReqForRetry := (reqCacheForRetry != nil) && isHeadOrGet(req.Method())
-	isCachedReqAvailable := func() bool { return shouldCacheReqForRetry && (reqCacheForRetry.Len() > 0) }
-	if (!shouldCacheReqForRetry) || (!isCachedReqAvailable()) {
-		//determine where the parsed request should write to
-		var reqWriteToTarget io.Writer
-		if shouldCacheReqForRetry {
-			reqWriteToTarget = reqCacheForRetry
-		} else {
-			reqWriteToTarget = conn
+	//write request, the request expecting `100 Continue` is not replayable, as its body
+	//is sent after the upstream's reply, which is read by br before the final response
+	var br *bufio.Reader
+	replayable := false
+	if c.expectContinue(req, resp) {
+		br = c.BufioPool.AcquireReader(conn)
+		err = readFromReqAndWriteToIOWriter(c.BufioPool, req, reqType == requestProxyHTTP, conn,
+			func() (bool, error) { return c.waitContinue(cc, br, resp) })
+	} else {
+		replayable, err = writeReplayableRequest(c.BufioPool, req,
+			reqType == requestProxyHTTP, conn, policy, reqCacheForRetry)
+	}
+	if err != nil {
+		if br != nil {
+			c.BufioPool.ReleaseReader(br)
 		}
-		if err := c.readFromReqAndWriteToIOWriter(req,
-			reqType == requestProxyHTTP, reqWriteToTarget); err != nil {
-			if shouldCacheReqForRetry {
-				reqCacheForRetry.Reset()
-			}
-			c.ConnManager.CloseConn(cc)
-			//cannot even read a complete request, do NOT retry
-			return false, err
+		c.ConnManager.CloseConn(cc)
+		if replayable && reused {
+			//fail to write the cached request, the connection may be closed by remote
+			return RetryEOF, err
 		}
+		//cannot even read a complete request, do NOT retry
+		return 0, err
 	}
-	if isCachedReqAvailable() {
-		//write the cached http requests to conn
-		if err := c.writeData(reqCacheForRetry.Bytes(), conn); err != nil {
-			if err != nil {
-				c.ConnManager.CloseConn(cc)
-				return true, err
-			}
+	//the request is retried only if it's replayable since then,
+	//and on EOF only if the connection is a reused one, see RetryEOF
+	retryClass := func(class RetryClass) RetryClass {
+		if !replayable || (class == RetryEOF && !reused) {
+			return 0
 		}
+		return class
 	}
 
 	//get response
-	if c.ReadTimeout > 0 {
+	if timeouts.ResponseHeader > 0 {
+		if err = c.setReadDeadline(cc, timeouts.ResponseHeader); err != nil {
+			c.ConnManager.CloseConn(cc)
+			return retryClass(RetryEOF), err
+		}
+	} else if c.ReadTimeout > 0 {
 		// Optimization: update read deadline only if more than 25%
 		// of the last read deadline exceeded.
 		// See https://github.com/golang/go/issues/15133 for details.
@@ -472,54 +592,108 @@ func (c *HostClient) do(req Request, resp Response,
 		if currentTime.Sub(cc.LastReadDeadlineTime) > (c.ReadTimeout >> 2) {
 			if err = conn.SetReadDeadline(currentTime.Add(c.ReadTimeout)); err != nil {
 				c.ConnManager.CloseConn(cc)
-				return true, err
+				return retryClass(RetryEOF), err
 			}
 			cc.LastReadDeadlineTime = currentTime
 		}
 	}
-	br := c.BufioPool.AcquireReader(conn)
+	if br == nil {
+		br = c.BufioPool.AcquireReader(conn)
+	}
 	//read a byte from response to test if the connection has been closed by remote
-	if b, err := br.Peek(1); err != nil {
-		if err == io.EOF {
-			return true, io.EOF
+	if b, err := br.Peek(1); err != nil || len(b) == 0 {
+		c.BufioPool.ReleaseReader(br)
+		c.ConnManager.CloseConn(cc)
+		if err == nil || err == io.EOF {
+			return retryClass(RetryEOF), io.EOF
+		}
+		return 0, err
+	}
+	//the header is read within ResponseHeader, then the body within ResponseBody
+	if timeouts.ResponseHeader > 0 || timeouts.ResponseBody > 0 {
+		if err = peekHeader(br); err == nil {
+			err = c.setReadDeadline(cc, timeouts.ResponseBody)
+		}
+		if err != nil {
+			c.BufioPool.ReleaseReader(br)
+			c.ConnManager.CloseConn(cc)
+			return 0, err
 		}
-		return false, err
-	} else if len(b) == 0 {
-		return true, io.EOF
 	}
-	if err = resp.ReadFrom(isHead(req.Method()), br); err != nil {
+	//the 5xx response is left unread for retrying
+	if replayable && policy.retry5xx(last) && isStatus5xx(br) {
+		c.BufioPool.ReleaseReader(br)
+		c.ConnManager.CloseConn(cc)
+		return Retry5xx, errRetryStatus
+	}
+	if err = readResponse(resp, isHead(req.Method()), br,
+		&c.ResponseLimits, c.ExceededResponseLimits); err != nil {
 		c.BufioPool.ReleaseReader(br)
 		c.ConnManager.CloseConn(cc)
-		return false, err
+		return 0, err
 	}
 	c.BufioPool.ReleaseReader(br)
 
-	//release or close connection
-	if viaProxy || resetConnection || req.ConnectionClose() || resp.ConnectionClose() {
+	//release or close connection, the one closed by ctx is not reused
+	if stopWatching() || viaProxy || resetConnection || req.ConnectionClose() || resp.ConnectionClose() {
 		c.ConnManager.CloseConn(cc)
 	} else {
 		c.ConnManager.ReleaseConn(cc)
 	}
 
-	return false, err
+	return 0, err
 }
 
-func (c *HostClient) writeData(data []byte, w io.Writer) error {
-	bw := c.BufioPool.AcquireWriter(w)
-	defer c.BufioPool.ReleaseWriter(bw)
-	if nw, err := bw.Write(data); err != nil {
+//setReadDeadline sets the read deadline of cc timeout later,
+//the one of ReadTimeout is set if timeout is not set
+func (c *HostClient) setReadDeadline(cc *transport.Conn, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = c.ReadTimeout
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	cc.LastReadDeadlineTime = time.Time{}
+	return cc.Get().SetReadDeadline(deadline)
+}
+
+//readFromReqAndWriteToIOWriter writes req to w, the body is written only if
+//waitContinue returns true after the header is flushed if it's provided
+func readFromReqAndWriteToIOWriter(bufioPool *bufiopool.Pool, req Request,
+	isReqProxyHTTP bool, w io.Writer, waitContinue func() (bool, error)) error {
+	bw := bufioPool.AcquireWriter(w)
+	defer bufioPool.ReleaseWriter(bw)
+
+	if err := writeRequestStartLine(bw, req, isReqProxyHTTP); err != nil {
+		return err
+	}
+	//other request headers
+	if err := req.WriteHeaderTo(bw); err != nil {
+		return err
+	}
+	//do not read contents of the requests without a body, e.g. get and head
+	if !hasBody(req) {
+		return bw.Flush()
+	}
+	if waitContinue != nil {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if sendBody, err := waitContinue(); err != nil || !sendBody {
+			return err
+		}
+	}
+	//request body
+	if err := req.WriteBodyTo(bw); err != nil {
 		return err
-	} else if nw != len(data) {
-		return io.ErrShortWrite
 	}
 	return bw.Flush()
 }
 
-func (c *HostClient) readFromReqAndWriteToIOWriter(req Request,
-	isReqProxyHTTP bool, w io.Writer) error {
-	bw := c.BufioPool.AcquireWriter(w)
-	defer c.BufioPool.ReleaseWriter(bw)
-
+//writeRequestStartLine writes the start line of req to bw,
+//with the auth header of the super proxy if the request is sent via a http proxy
+func writeRequestStartLine(bw *bufio.Writer, req Request, isReqProxyHTTP bool) error {
 	//start line
 	if isReqProxyHTTP {
 		nw, _ := writeRequestLine(bw, true, req.Method(),
@@ -542,17 +716,5 @@ func (c *HostClient) readFromReqAndWriteToIOWriter(req Request,
 			req.AddWriteSize(len(authHeader))
 		}
 	}
-	//other request headers
-	if err := req.WriteHeaderTo(bw); err != nil {
-		return err
-	}
-	//do not read contents for get and head
-	if isHeadOrGet(req.Method()) {
-		return bw.Flush()
-	}
-	//request body
-	if err := req.WriteBodyTo(bw); err != nil {
-		return err
-	}
-	return bw.Flush()
+	return nil
 }
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"time"
+)
+
+//Timeouts timeouts of a request performed by DoContext, which are set in its
+//context by WithTimeouts, the ones not set are not applied
+type Timeouts struct {
+	//Dial max duration of dialing the upstream or the super proxy, including
+	//making the tunnel via the super proxy, transport.DefaultDialTimeout if not set
+	Dial time.Duration
+	//TLSHandshake max duration of handshaking with the upstream,
+	//transport.DefaultDialTimeout if not set
+	TLSHandshake time.Duration
+	//ResponseHeader max duration waiting for the response header after the request is written
+	ResponseHeader time.Duration
+	//ResponseBody max duration of reading the response body after its header
+	ResponseBody time.Duration
+}
+
+type timeoutsKey struct{}
+
+//WithTimeouts returns a copy of ctx carrying the timeouts of the request performed by DoContext
+func WithTimeouts(ctx context.Context, timeouts Timeouts) context.Context {
+	return context.WithValue(ctx, timeoutsKey{}, timeouts)
+}
+
+//timeoutsFrom the timeouts carried by ctx, see WithTimeouts
+func timeoutsFrom(ctx context.Context) Timeouts {
+	timeouts, _ := ctx.Value(timeoutsKey{}).(Timeouts)
+	return timeouts
+}
+
+//withTimeout ctx limited by timeout, it's not limited if timeout is not set
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+//sleepContext sleeps for d unless ctx is done before
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var (
+	headerEnd   = []byte("\r\n\r\n")
+	headerEndLF = []byte("\n\n")
+)
+
+//peekHeader peeks until the response header is buffered in br, the header
+//bigger than the buffer of br is left for parsing, which fails then
+func peekHeader(br *bufio.Reader) error {
+	for n := 1; ; n = br.Buffered() + 1 {
+		b, err := br.Peek(n)
+		if err == bufio.ErrBufferFull {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(b, headerEnd) || bytes.Contains(b, headerEndLF) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"bufio"
+	"net"
+	"time"
+
+	"github.com/haxii/fastproxy/transport"
+)
+
+//DefaultContinueTimeout default duration waiting for the `100 Continue`
+//of a request expecting it, before the request body is sent anyway
+const DefaultContinueTimeout = time.Second
+
+//continueRequest the request which may wait for `100 Continue` before sending
+//the body, e.g. http.Request
+type continueRequest interface {
+	ExpectContinue() bool
+}
+
+//continueResponse the response which reads the interim responses before the
+//request body is sent, e.g. http.Response
+type continueResponse interface {
+	ReadContinueFrom(br *bufio.Reader) (bool, error)
+}
+
+//expectContinue if the body of req is sent after the upstream's `100 Continue`
+func (c *HostClient) expectContinue(req Request, resp Response) bool {
+	if c.ContinueTimeout < 0 || !hasBody(req) {
+		return false
+	}
+	continueReq, ok := req.(continueRequest)
+	if !ok || !continueReq.ExpectContinue() {
+		return false
+	}
+	_, ok = resp.(continueResponse)
+	return ok
+}
+
+//waitContinue waits for the upstream's response to the request header sent until
+//ContinueTimeout, the interim responses are read by resp, returns if the request
+//body should be sent, i.e. `100 Continue` is read or timed out
+func (c *HostClient) waitContinue(cc *transport.Conn, br *bufio.Reader, resp Response) (bool, error) {
+	timeout := c.ContinueTimeout
+	if timeout == 0 {
+		timeout = DefaultContinueTimeout
+	}
+	conn := cc.Get()
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return false, err
+	}
+	_, err := br.Peek(1)
+	//the read deadline of the response is set later
+	cc.LastReadDeadlineTime = time.Time{}
+	if e := conn.SetReadDeadline(time.Time{}); e != nil {
+		return false, e
+	}
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return true, nil
+		}
+		return false, err
+	}
+	limitedResp, ok := resp.(limitedResponse)
+	if ok {
+		limitedResp.SetLimits(&c.ResponseLimits)
+	}
+	continued, err := resp.(continueResponse).ReadContinueFrom(br)
+	if err != nil && ok {
+		if limitErr := limitedResp.ExceededLimit(); limitErr != nil {
+			c.ExceededResponseLimits.Add(limitErr.Limit)
+		}
+	}
+	return continued, err
+}
@@ -0,0 +1,199 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	nethttp "net/http"
+	"time"
+
+	"github.com/haxii/fastproxy/cert"
+	"github.com/haxii/fastproxy/transport"
+	"golang.org/x/net/http2"
+)
+
+//Protocol http protocol used for talking to the upstream
+type Protocol int
+
+const (
+	//ProtocolHTTP1 HTTP/1.1 only, the default one
+	ProtocolHTTP1 Protocol = iota
+	//ProtocolAuto h2 if the upstream negotiates it by ALPN, HTTP/1.1 otherwise
+	ProtocolAuto
+	//ProtocolHTTP2 h2 only, requests fail if the upstream doesn't negotiate it
+	ProtocolHTTP2
+)
+
+//ErrHTTP2Unsupported is returned in ProtocolHTTP2 if the upstream doesn't negotiate h2
+var ErrHTTP2Unsupported = errors.New("h2 is not negotiated by the upstream")
+
+//connectionHeaders connection-specific headers not allowed in h2
+var connectionHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection",
+	"Transfer-Encoding", "Upgrade"}
+
+//acquireHTTP2Conn returns the h2 connection shared by the requests of host,
+//nil connection is returned if the upstream only speaks HTTP/1.1 in ProtocolAuto,
+//with the TLS connection probing it if it's just dialed for the request.
+//The h2 connection is dialed by a single request without holding the lock,
+//while the others wait for it, the failure of dialing or handshaking
+//is wrapped in its retry class
+func (c *HostClient) acquireHTTP2Conn(ctx context.Context, req Request) (*http2.ClientConn, net.Conn, error) {
+	for {
+		c.http2Lock.Lock()
+		if c.http2Unsupported {
+			c.http2Lock.Unlock()
+			return nil, nil, nil
+		}
+		if cc := c.http2Conn; cc != nil && cc.CanTakeNewRequest() {
+			c.http2Lock.Unlock()
+			return cc, nil, nil
+		}
+		if dialing := c.http2Dialing; dialing != nil {
+			c.http2Lock.Unlock()
+			select {
+			case <-dialing:
+				continue
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+		dialing := make(chan struct{})
+		c.http2Dialing = dialing
+		if c.http2TLSConfig == nil {
+			nextProtos := []string{http2.NextProtoTLS}
+			if c.Protocol == ProtocolAuto {
+				nextProtos = append(nextProtos, "http/1.1")
+			}
+			c.http2TLSConfig = cert.MakeClientTLSConfig(req.HostInfo().HostWithPort(),
+				req.TLSServerName(), nextProtos...)
+		}
+		if c.http2Transport == nil {
+			idleConnTimeout := c.ConnManager.MaxIdleConnDuration
+			if idleConnTimeout <= 0 {
+				idleConnTimeout = transport.DefaultMaxIdleConnDuration
+			}
+			c.http2Transport = &http2.Transport{IdleConnTimeout: idleConnTimeout}
+		}
+		tlsConfig, t := c.http2TLSConfig, c.http2Transport
+		c.http2Lock.Unlock()
+
+		cc, probeConn, err := c.dialHTTP2(ctx, req, tlsConfig, t)
+
+		c.http2Lock.Lock()
+		c.http2Dialing = nil
+		close(dialing)
+		if cc != nil {
+			//the previous one is full or closing, close it after its streams are done
+			if c.http2Conn != nil {
+				go c.http2Conn.Shutdown(context.Background())
+			}
+			c.http2Conn = cc
+		} else if probeConn != nil {
+			c.http2Unsupported = true
+		}
+		c.http2Lock.Unlock()
+		return cc, probeConn, err
+	}
+}
+
+//dialHTTP2 dials the upstream then makes the h2 connection with t, the TLS
+//connection is returned instead if the upstream doesn't negotiate h2 in ProtocolAuto
+func (c *HostClient) dialHTTP2(ctx context.Context, req Request, tlsConfig *tls.Config,
+	t *http2.Transport) (*http2.ClientConn, net.Conn, error) {
+	timeouts := timeoutsFrom(ctx)
+	dialCtx, cancel := withTimeout(ctx, timeouts.Dial)
+	defer cancel()
+	conn, err := transport.DialTLSContext(dialCtx, req.HostInfo().TargetWithPort(), tlsConfig)
+	if err != nil {
+		return nil, nil, retryable(RetryDial, err)
+	}
+	tlsConn := conn.(*tls.Conn)
+	if err := handshake(ctx, tlsConn, timeouts.TLSHandshake); err != nil {
+		return nil, nil, retryable(RetryTLS, err)
+	}
+	if tlsConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		if c.Protocol == ProtocolHTTP2 {
+			conn.Close()
+			return nil, nil, ErrHTTP2Unsupported
+		}
+		return nil, conn, nil
+	}
+	cc, err := t.NewClientConn(tlsConn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return cc, nil, nil
+}
+
+//doHTTP2 performs the request over the h2 connection,
+//the request is converted into h2, then the response is converted back,
+//the stream is reset once ctx is done or a timeout carried by ctx is exceeded
+func (c *HostClient) doHTTP2(ctx context.Context, cc *http2.ClientConn, req Request, resp Response) error {
+	//convert the request by parsing the HTTP/1.1 one written by the request itself
+	reqStream, reqStreamWriter := io.Pipe()
+	reqWritten := make(chan struct{})
+	go func() {
+		reqStreamWriter.CloseWithError(readFromReqAndWriteToIOWriter(c.BufioPool, req,
+			false, reqStreamWriter, nil))
+		close(reqWritten)
+	}()
+	defer func() {
+		reqStream.Close()
+		<-reqWritten
+	}()
+	reqReader := c.BufioPool.AcquireReader(reqStream)
+	defer c.BufioPool.ReleaseReader(reqReader)
+	h2Req, err := nethttp.ReadRequest(reqReader)
+	if err != nil {
+		return err
+	}
+	h2Req.RequestURI = ""
+	h2Req.URL.Scheme = "https"
+	h2Req.URL.Host = req.HostInfo().HostWithPort()
+	for _, name := range connectionHeaders {
+		h2Req.Header.Del(name)
+	}
+	ctx, cancel := withTimeout(ctx, c.ReadTimeout)
+	defer cancel()
+	ctx, cancelStream := context.WithCancel(ctx)
+	defer cancelStream()
+	h2Req = h2Req.WithContext(ctx)
+
+	timeouts := timeoutsFrom(ctx)
+	var headerTimer *time.Timer
+	if timeouts.ResponseHeader > 0 {
+		headerTimer = time.AfterFunc(timeouts.ResponseHeader, cancelStream)
+	}
+	h2Resp, err := cc.RoundTrip(h2Req)
+	if headerTimer != nil {
+		headerTimer.Stop()
+	}
+	if err != nil {
+		return err
+	}
+	defer h2Resp.Body.Close()
+	if timeouts.ResponseBody > 0 {
+		bodyTimer := time.AfterFunc(timeouts.ResponseBody, cancelStream)
+		defer bodyTimer.Stop()
+	}
+
+	//convert the response by writing it in HTTP/1.1
+	h2Resp.ProtoMajor, h2Resp.ProtoMinor = 1, 1
+	respStream, respStreamWriter := io.Pipe()
+	respWritten := make(chan struct{})
+	go func() {
+		respStreamWriter.CloseWithError(h2Resp.Write(respStreamWriter))
+		close(respWritten)
+	}()
+	defer func() {
+		respStream.Close()
+		<-respWritten
+	}()
+	respReader := c.BufioPool.AcquireReader(respStream)
+	defer c.BufioPool.ReleaseReader(respReader)
+	return readResponse(resp, isHead(req.Method()), respReader,
+		&c.ResponseLimits, c.ExceededResponseLimits)
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	gohttp "net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/bufiopool"
+	"golang.org/x/net/http2"
+)
+
+//startTLSUpstream starts a TLS upstream speaking h2 if enableHTTP2, which
+//responds the protocol & the body of the request, the connections are counted in conns
+func startTLSUpstream(t *testing.T, enableHTTP2 bool, conns *int32) *httptest.Server {
+	upstream := httptest.NewUnstartedServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Proto", r.Proto)
+		io.WriteString(w, r.Proto+" "+string(body))
+	}))
+	upstream.EnableHTTP2 = enableHTTP2
+	upstream.Config.ConnState = func(c net.Conn, state gohttp.ConnState) {
+		if state == gohttp.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+//trustUpstream makes the host client of upstream trust its certificate
+func trustUpstream(t *testing.T, c *Client, upstream *httptest.Server) {
+	req := AcquireSimpleRequest()
+	defer ReleaseSimpleRequest(req)
+	req.SetURL(upstream.URL + "/")
+	hc, err := c.hostClient(req)
+	if err != nil {
+		t.Fatalf("fail to get host client: %s", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(upstream.Certificate())
+	nextProtos := []string{http2.NextProtoTLS}
+	if hc.Protocol == ProtocolAuto {
+		nextProtos = append(nextProtos, "http/1.1")
+	}
+	hc.http2TLSConfig = &tls.Config{ServerName: "example.com", RootCAs: roots, NextProtos: nextProtos}
+	hc.tlsServerConfig = &tls.Config{ServerName: "example.com", RootCAs: roots}
+}
+
+//doTLS performs a POST request of body to upstream, returns the response body
+func doTLS(t *testing.T, c *Client, upstream *httptest.Server, body string) (string, error) {
+	req := AcquireSimpleRequest()
+	defer ReleaseSimpleRequest(req)
+	resp := AcquireSimpleResponse()
+	defer ReleaseSimpleResponse(resp)
+	req.SetMethod("POST")
+	req.SetURL(upstream.URL + "/")
+	req.SetBodyString(body)
+	if err := c.Do(req, resp); err != nil {
+		return "", err
+	}
+	if resp.StatusCode() != 200 || string(resp.Header().Peek("X-Proto")) == "" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode(), resp.Header().Peek("X-Proto"))
+	}
+	return string(resp.Body()), nil
+}
+
+func TestHTTP2(t *testing.T) {
+	var conns int32
+	upstream := startTLSUpstream(t, true, &conns)
+	c := &Client{BufioPool: &bufiopool.Pool{},
+		HostProtocol: func(string) Protocol { return ProtocolAuto }}
+	trustUpstream(t, c, upstream)
+
+	//the concurrent requests share a single h2 connection
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if body, err := doTLS(t, c, upstream, "hello"); err != nil || body != "HTTP/2.0 hello" {
+				t.Errorf("unexpected response %q: %v", body, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("upstream is connected %d times, expecting once", n)
+	}
+
+	//HTTP/1.1 is used without HostProtocol
+	c = &Client{BufioPool: &bufiopool.Pool{}}
+	trustUpstream(t, c, upstream)
+	if body, err := doTLS(t, c, upstream, "hello"); err != nil || body != "HTTP/1.1 hello" {
+		t.Fatalf("unexpected response %q: %v", body, err)
+	}
+}
+
+func TestHTTP2Unsupported(t *testing.T) {
+	var conns int32
+	upstream := startTLSUpstream(t, false, &conns)
+
+	//the connection probing h2 is used for HTTP/1.1 in ProtocolAuto,
+	//then it's reused by the next request
+	c := &Client{BufioPool: &bufiopool.Pool{},
+		HostProtocol: func(string) Protocol { return ProtocolAuto }}
+	trustUpstream(t, c, upstream)
+	for i := 0; i < 2; i++ {
+		if body, err := doTLS(t, c, upstream, "hello"); err != nil || body != "HTTP/1.1 hello" {
+			t.Fatalf("unexpected response %q: %v", body, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("upstream is connected %d times, expecting once", n)
+	}
+
+	//the requests fail in ProtocolHTTP2, which is refused in handshake by the
+	//upstream offering ALPN, or ErrHTTP2Unsupported by the ones not
+	c = &Client{BufioPool: &bufiopool.Pool{},
+		HostProtocol: func(string) Protocol { return ProtocolHTTP2 }}
+	trustUpstream(t, c, upstream)
+	if _, err := doTLS(t, c, upstream, "hello"); err == nil {
+		t.Fatalf("request is performed in HTTP/1.1 in ProtocolHTTP2")
+	}
+}
+
+func TestHTTP2DialWaiting(t *testing.T) {
+	//the upstream never handshakes
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("fail to listen: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	c := &Client{BufioPool: &bufiopool.Pool{},
+		HostProtocol: func(string) Protocol { return ProtocolHTTP2 }}
+	do := func(ctx context.Context) error {
+		req := AcquireSimpleRequest()
+		defer ReleaseSimpleRequest(req)
+		resp := AcquireSimpleResponse()
+		defer ReleaseSimpleResponse(resp)
+		req.SetURL("https://" + ln.Addr().String() + "/")
+		return c.DoContext(ctx, req, resp)
+	}
+
+	//the request waiting for another one dialing is canceled once ctx is done
+	dialingCtx, cancelDialing := context.WithCancel(context.Background())
+	dialed := make(chan error, 1)
+	go func() { dialed <- do(dialingCtx) }()
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := do(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error %v, expecting %s", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("waiting request is canceled after %s", elapsed)
+	}
+	cancelDialing()
+	if err := <-dialed; err == nil {
+		t.Fatalf("request is performed without handshaking")
+	}
+}
@@ -0,0 +1,30 @@
+package client
+
+import (
+	"bufio"
+
+	basehttp "github.com/haxii/fastproxy/http"
+)
+
+//limitedResponse the response whose reading is limited, e.g. http.Response
+type limitedResponse interface {
+	SetLimits(limits *basehttp.Limits)
+	ExceededLimit() *basehttp.LimitError
+}
+
+//readResponse reads resp from br within limits if resp is a limitedResponse,
+//then the limit exceeded is counted by exceeded
+func readResponse(resp Response, discardBody bool, br *bufio.Reader,
+	limits *basehttp.Limits, exceeded *basehttp.LimitCounter) error {
+	limitedResp, ok := resp.(limitedResponse)
+	if ok {
+		limitedResp.SetLimits(limits)
+	}
+	err := resp.ReadFrom(discardBody, br)
+	if err != nil && ok {
+		if limitErr := limitedResp.ExceededLimit(); limitErr != nil {
+			exceeded.Add(limitErr.Limit)
+		}
+	}
+	return err
+}
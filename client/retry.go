@@ -0,0 +1,334 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/haxii/fastproxy/bufiopool"
+	"github.com/haxii/fastproxy/bytebufferpool"
+	basehttp "github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/transport"
+)
+
+//RetryClass classes of the failures a request can be retried on, combined by OR
+type RetryClass uint
+
+const (
+	//RetryDial failing to dial the upstream or the super proxy,
+	//including making the tunnel via the super proxy
+	RetryDial RetryClass = 1 << iota
+	//RetryTLS failing to handshake with the upstream or the https super proxy
+	RetryTLS
+	//RetryEOF the reused keep-alive connection is closed before the first byte
+	//of the response, e.g. it's closed by the upstream while idle, the new one is
+	//not retried, as the upstream may have handled the request before closing it
+	RetryEOF
+	//Retry5xx the upstream responds a 5xx status, the last attempt's response is kept
+	Retry5xx
+)
+
+//RetryPolicy policy of retrying the failed requests. A request is retried only if
+//it can be sent again, i.e. it fails before it's written, or it's replayable:
+//the GET & HEAD requests and the ones of ReplayMethods are, unless the body
+//exceeds MaxReplayBodySize.
+//The requests sent over h2 to the direct https upstreams, see Client.HostProtocol,
+//are retried only on failing to get the connection, i.e. RetryDial & RetryTLS,
+//as the stream is not replayable once the request is written to it
+type RetryPolicy struct {
+	//MaxAttempts max number of attempts of a request, the first one included,
+	//a request is attempted once if not set
+	MaxAttempts int
+
+	//Backoff the delay before the 1st retry, which is doubled for each retry then,
+	//no delay if not set
+	Backoff time.Duration
+	//MaxBackoff max delay before a retry, unlimited if not set
+	MaxBackoff time.Duration
+	//Jitter randomizes the delay by up to the fraction of it, e.g. 0.2 for ±20%,
+	//which is clamped to [0, 1]
+	Jitter float64
+
+	//RetryOn classes of the failures retried
+	RetryOn RetryClass
+
+	//MaxReplayBodySize max size of the body buffered for replaying the request with
+	//a body, the bigger ones are not retried once written, 0 buffers nothing
+	MaxReplayBodySize int
+	//ReplayMethods methods replayed besides GET & HEAD, e.g. PUT, the requests of
+	//the other methods are not retried once written, as they may not be idempotent
+	ReplayMethods []string
+
+	//SwitchProxy asks the request for an alternate super proxy before a retry,
+	//e.g. the proxy's handler selects another one by URLProxy, see http.Request.SetProxySwitcher
+	SwitchProxy bool
+}
+
+//DefaultRetryPolicy policy used if not set, which retries the idle keep-alive
+//connections closed by the upstream
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	RetryOn:     RetryEOF,
+}
+
+//proxySwitchingRequest the request which switches to an alternate super proxy
+//for retrying, e.g. http.Request
+type proxySwitchingRequest interface {
+	SwitchProxy()
+}
+
+//replayRequest the request which tells if it can be replayed once written,
+//e.g. http.Request whose header depends on the super proxy switched to
+type replayRequest interface {
+	Replayable() bool
+}
+
+//retryableError error of an attempt which can be retried on class
+type retryableError struct {
+	class RetryClass
+	err   error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+//retryable wraps err in class, nil is returned if err is nil
+func retryable(class RetryClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{class: class, err: err}
+}
+
+//unwrapRetryable the class and the error wrapped by `retryable`
+func unwrapRetryable(err error) (RetryClass, error) {
+	if e, ok := err.(*retryableError); ok {
+		return e.class, e.err
+	}
+	return 0, err
+}
+
+//errRetryStatus the 5xx response left unread for retrying
+var errRetryStatus = errors.New("upstream responded with a 5xx status")
+
+//attemptFunc makes an attempt of a request, buffer caches the request written for
+//replaying, the 5xx response is retried unless it's the last attempt,
+//the class of the failure is returned if the request can be retried
+type attemptFunc func(policy *RetryPolicy, buffer *bytebufferpool.ByteBuffer,
+	last bool) (RetryClass, error)
+
+//do makes the attempts until it succeeds, the policy gives up or ctx is done,
+//switchProxy is called before a retry if SwitchProxy is set,
+//nil policy means the DefaultRetryPolicy
+func (p *RetryPolicy) do(ctx context.Context, switchProxy func(), attempt attemptFunc) error {
+	if p == nil {
+		p = &DefaultRetryPolicy
+	}
+	buffer := bytebufferpool.Get()
+	defer bytebufferpool.Put(buffer)
+	for n := 1; ; n++ {
+		last := n >= p.MaxAttempts
+		class, err := attempt(p, buffer, last)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil || last || class&p.RetryOn == 0 {
+			if err == io.EOF {
+				err = ErrConnectionClosed
+			}
+			return err
+		}
+		if p.SwitchProxy && switchProxy != nil {
+			switchProxy()
+		}
+		if backoff := p.backoff(n); backoff > 0 {
+			if err := sleepContext(ctx, backoff); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+//Dial calls dial until it succeeds or the policy gives up, its failures are
+//retried as RetryDial, e.g. making a tunnel via a super proxy, switchProxy
+//is called before a retry if SwitchProxy is set, nil policy means the DefaultRetryPolicy
+func (p *RetryPolicy) Dial(dial func() (net.Conn, error), switchProxy func()) (net.Conn, error) {
+	return p.DialContext(context.Background(), func(context.Context) (net.Conn, error) {
+		return dial()
+	}, switchProxy)
+}
+
+//DialContext calls dial like Dial until ctx is done, the ctx passed to dial
+//is limited by the Dial timeout carried by ctx, see WithTimeouts
+func (p *RetryPolicy) DialContext(ctx context.Context, dial func(ctx context.Context) (net.Conn, error),
+	switchProxy func()) (net.Conn, error) {
+	var conn net.Conn
+	err := p.do(ctx, switchProxy, func(*RetryPolicy, *bytebufferpool.ByteBuffer, bool) (RetryClass, error) {
+		dialCtx, cancel := withTimeout(ctx, timeoutsFrom(ctx).Dial)
+		defer cancel()
+		var err error
+		conn, err = dial(dialCtx)
+		return RetryDial, err
+	})
+	return conn, err
+}
+
+//switchProxyOf the func switching req to an alternate super proxy, nil if not supported
+func switchProxyOf(req Request) func() {
+	if switchingReq, ok := req.(proxySwitchingRequest); ok {
+		return switchingReq.SwitchProxy
+	}
+	return nil
+}
+
+//backoff the delay before the nth retry
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	backoff := p.Backoff
+	for i := 1; i < n && backoff > 0; i++ {
+		if p.MaxBackoff > 0 && backoff >= p.MaxBackoff {
+			break
+		}
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if jitter := math.Min(p.Jitter, 1); jitter > 0 {
+		backoff += time.Duration(jitter * (2*rand.Float64() - 1) * float64(backoff))
+	}
+	return backoff
+}
+
+//retry5xx if the 5xx response of the attempt should be left unread for retrying
+func (p *RetryPolicy) retry5xx(last bool) bool {
+	return !last && p.RetryOn&Retry5xx != 0
+}
+
+//replayable if req of the method can be replayed, see ReplayMethods
+func (p *RetryPolicy) replayable(req Request) bool {
+	if replayReq, ok := req.(replayRequest); ok && !replayReq.Replayable() {
+		return false
+	}
+	method := req.Method()
+	if isHeadOrGet(method) {
+		return true
+	}
+	for _, m := range p.ReplayMethods {
+		if string(method) == m {
+			return true
+		}
+	}
+	return false
+}
+
+//maxReplaySize max size of the request's header and body cached for replaying,
+//headerSize is the size of the header cached, negative means unlimited
+func (p *RetryPolicy) maxReplaySize(req Request, headerSize int) int {
+	if !hasBody(req) {
+		return -1
+	}
+	return headerSize + p.MaxReplayBodySize
+}
+
+//writeReplayableRequest writes req to w, the header and the body written by req
+//are cached in buffer for replaying in the later attempts, unless the method is not
+//replayable or the body exceeds MaxReplayBodySize of policy, the cached ones are
+//written if buffer is not empty, returns if req is replayable, i.e. cached
+func writeReplayableRequest(bufioPool *bufiopool.Pool, req Request, isReqProxyHTTP bool,
+	w io.Writer, policy *RetryPolicy, buffer *bytebufferpool.ByteBuffer) (bool, error) {
+	bw := bufioPool.AcquireWriter(w)
+	defer bufioPool.ReleaseWriter(bw)
+	if err := writeRequestStartLine(bw, req, isReqProxyHTTP); err != nil {
+		return false, err
+	}
+	if buffer.Len() == 0 {
+		rw := &replayWriter{buffer: buffer, max: -1, w: bw, spilled: !policy.replayable(req)}
+		if err := writeRequestTo(bufioPool, req, policy, rw); err != nil {
+			buffer.Reset()
+			return false, err
+		}
+		if rw.spilled {
+			return false, bw.Flush()
+		}
+	}
+	//write the cached request
+	if _, err := bw.Write(buffer.B); err != nil {
+		return true, err
+	}
+	return true, bw.Flush()
+}
+
+//writeRequestTo writes the header and the body of req to rw,
+//the size cached by rw is limited by policy after the header is written
+func writeRequestTo(bufioPool *bufiopool.Pool, req Request, policy *RetryPolicy,
+	rw *replayWriter) error {
+	bw := bufioPool.AcquireWriter(rw)
+	defer bufioPool.ReleaseWriter(bw)
+	if err := req.WriteHeaderTo(bw); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	rw.max = policy.maxReplaySize(req, rw.buffer.Len())
+	//do not read contents of the requests without a body, e.g. get and head
+	if !hasBody(req) {
+		return nil
+	}
+	if err := req.WriteBodyTo(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+//handshake handshakes the tls connection within timeout, transport.DefaultDialTimeout
+//if not set, the connection is closed if it fails or ctx is done before
+func handshake(ctx context.Context, conn *tls.Conn, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = transport.DefaultDialTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := conn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+//isStatus5xx if the status line next in br is a 5xx one
+func isStatus5xx(br *bufio.Reader) bool {
+	statusCode, err := basehttp.PeekStatusCode(br)
+	return err == nil && statusCode >= 500 && statusCode < 600
+}
+
+//replayWriter caches the request written in buffer for replaying it, once it
+//exceeds max, the cached one is written to w, and it's no longer cached
+type replayWriter struct {
+	buffer *bytebufferpool.ByteBuffer
+	max    int
+	w      io.Writer
+	//spilled if it's written to w
+	spilled bool
+}
+
+func (rw *replayWriter) Write(p []byte) (int, error) {
+	if rw.spilled {
+		return rw.w.Write(p)
+	}
+	if rw.max >= 0 && rw.buffer.Len()+len(p) > rw.max {
+		rw.spilled = true
+		if _, err := rw.w.Write(rw.buffer.B); err != nil {
+			return 0, err
+		}
+		rw.buffer.Reset()
+		return rw.w.Write(p)
+	}
+	return rw.buffer.Write(p)
+}
@@ -0,0 +1,313 @@
+package client
+
+import (
+	"bufio"
+	"io"
+	"net"
+	gohttp "net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/bufiopool"
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+//closingUpstream serves the requests on a local listener, the connection of the
+//closeAt-th request is closed after the request is read, without responding
+type closingUpstream struct {
+	ln      net.Listener
+	closeAt int
+
+	lock   sync.Mutex
+	bodies []string
+}
+
+func startClosingUpstream(t *testing.T, closeAt int) *closingUpstream {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("fail to listen: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	u := &closingUpstream{ln: ln, closeAt: closeAt}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go u.serve(c)
+		}
+	}()
+	return u
+}
+
+func (u *closingUpstream) serve(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	for {
+		req, err := gohttp.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		u.lock.Lock()
+		u.bodies = append(u.bodies, string(body))
+		n := len(u.bodies)
+		u.lock.Unlock()
+		if n == u.closeAt {
+			return
+		}
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n")
+		c.Write(body)
+	}
+}
+
+func (u *closingUpstream) requests() []string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return append([]string(nil), u.bodies...)
+}
+
+//doClosing sends the request of method & body to the upstream by c,
+//the keep-alive connection of the previous request is reused if warm
+func doClosing(t *testing.T, c *Client, upstream *closingUpstream, method, body string,
+	warm bool) (*SimpleResponse, error) {
+	url := "http://" + upstream.ln.Addr().String() + "/"
+	req := AcquireSimpleRequest()
+	defer ReleaseSimpleRequest(req)
+	resp := AcquireSimpleResponse()
+	if warm {
+		req.SetURL(url)
+		if err := c.Do(req, resp); err != nil {
+			t.Fatalf("unexpected error %s of warming", err)
+		}
+		//the connection is released to the pool asynchronously
+		time.Sleep(100 * time.Millisecond)
+		req.Reset()
+		resp.Reset()
+	}
+	req.SetMethod(method)
+	if err := req.SetURL(url); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	req.SetBodyString(body)
+	return resp, c.Do(req, resp)
+}
+
+func TestRetryReplayBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		body          string
+		replayMethods []string
+		expErr        error
+		expTries      int
+	}{
+		{"get", "GET", "", nil, nil, 2},
+		{"under", "POST", "hello", []string{"POST"}, nil, 2},
+		{"at", "POST", "0123456789", []string{"POST"}, nil, 2},
+		//the body exceeding MaxReplayBodySize spills, then it's not retried
+		{"over", "POST", "0123456789a", []string{"POST"}, ErrConnectionClosed, 1},
+		//the methods not in ReplayMethods are not retried, with a body or not
+		{"post", "POST", "hello", nil, ErrConnectionClosed, 1},
+		{"delete", "DELETE", "", []string{"POST"}, ErrConnectionClosed, 1},
+	}
+	for _, test := range tests {
+		//the reused connection is closed by upstream
+		upstream := startClosingUpstream(t, 2)
+		c := &Client{BufioPool: &bufiopool.Pool{}, RetryPolicy: &RetryPolicy{
+			MaxAttempts:       3,
+			RetryOn:           RetryEOF,
+			MaxReplayBodySize: 10,
+			ReplayMethods:     test.replayMethods,
+		}}
+		resp, err := doClosing(t, c, upstream, test.method, test.body, true)
+		if err != test.expErr {
+			t.Fatalf("%s: unexpected error %v, expecting %v", test.name, err, test.expErr)
+		}
+		if err == nil && string(resp.Body()) != test.body {
+			t.Fatalf("%s: unexpected response body %q", test.name, resp.Body())
+		}
+		requests := upstream.requests()[1:]
+		if len(requests) != test.expTries {
+			t.Fatalf("%s: request is sent %d times, expecting %d", test.name, len(requests), test.expTries)
+		}
+		//the replayed body is the same as the first one
+		for _, body := range requests {
+			if body != test.body {
+				t.Fatalf("%s: unexpected body %q sent, expecting %q", test.name, body, test.body)
+			}
+		}
+		ReleaseSimpleResponse(resp)
+	}
+
+	//the new connection closed is not retried, as the upstream may have handled the request
+	upstream := startClosingUpstream(t, 1)
+	c := &Client{BufioPool: &bufiopool.Pool{}}
+	resp, err := doClosing(t, c, upstream, "GET", "", false)
+	if err != ErrConnectionClosed {
+		t.Fatalf("unexpected error %v, expecting %v", err, ErrConnectionClosed)
+	}
+	if n := len(upstream.requests()); n != 1 {
+		t.Fatalf("request is sent %d times on new connection, expecting once", n)
+	}
+	ReleaseSimpleResponse(resp)
+}
+
+func TestRetry5xx(t *testing.T) {
+	var attempts int32
+	upstream := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		n := atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(gohttp.StatusServiceUnavailable)
+		io.WriteString(w, "attempt "+strconv.Itoa(int(n)))
+	}))
+	defer upstream.Close()
+
+	c := &Client{BufioPool: &bufiopool.Pool{}, RetryPolicy: &RetryPolicy{
+		MaxAttempts: 3,
+		RetryOn:     Retry5xx,
+	}}
+	req := AcquireSimpleRequest()
+	defer ReleaseSimpleRequest(req)
+	resp := AcquireSimpleResponse()
+	defer ReleaseSimpleResponse(resp)
+	req.SetURL(upstream.URL)
+	if err := c.Do(req, resp); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	//the response of the last attempt is kept
+	if resp.StatusCode() != gohttp.StatusServiceUnavailable || string(resp.Body()) != "attempt 3" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode(), resp.Body())
+	}
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Fatalf("request is attempted %d times, expecting 3", n)
+	}
+
+	//not retried if not in RetryOn
+	atomic.StoreInt32(&attempts, 0)
+	c.RetryPolicy.RetryOn = RetryEOF
+	resp.Reset()
+	if err := c.Do(req, resp); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if string(resp.Body()) != "attempt 1" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode(), resp.Body())
+	}
+}
+
+//switchingRequest switches to the next super proxy of proxies on SwitchProxy
+type switchingRequest struct {
+	*SimpleRequest
+	proxies  []*superproxy.SuperProxy
+	switches int
+}
+
+func (r *switchingRequest) SwitchProxy() {
+	r.switches++
+	r.SetProxy(r.proxies[r.switches%len(r.proxies)])
+}
+
+func newTestSuperProxy(t *testing.T, hostWithPort string) *superproxy.SuperProxy {
+	host, portStr, _ := net.SplitHostPort(hostWithPort)
+	port, _ := strconv.Atoi(portStr)
+	p, err := superproxy.NewSuperProxy(host, uint16(port), superproxy.ProxyTypeHTTP, "", "", false)
+	if err != nil {
+		t.Fatalf("fail to make super proxy: %s", err)
+	}
+	return p
+}
+
+func TestRetryDialSwitchProxy(t *testing.T) {
+	//the upstream serves the proxied requests of the absolute URI as a super proxy
+	var proxiedURI atomic.Value
+	live := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		proxiedURI.Store(r.RequestURI)
+		io.WriteString(w, "ok")
+	}))
+	defer live.Close()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("fail to listen: %s", err)
+	}
+	deadAddr := ln.Addr().String()
+	ln.Close()
+
+	deadProxy := newTestSuperProxy(t, deadAddr)
+	liveProxy := newTestSuperProxy(t, strings.TrimPrefix(live.URL, "http://"))
+	req := &switchingRequest{SimpleRequest: AcquireSimpleRequest(),
+		proxies: []*superproxy.SuperProxy{deadProxy, liveProxy}}
+	defer ReleaseSimpleRequest(req.SimpleRequest)
+	resp := AcquireSimpleResponse()
+	defer ReleaseSimpleResponse(resp)
+	req.SetURL("http://example.com/path")
+	req.SetProxy(deadProxy)
+
+	c := &Client{BufioPool: &bufiopool.Pool{}, RetryPolicy: &RetryPolicy{
+		MaxAttempts: 2,
+		RetryOn:     RetryDial,
+		SwitchProxy: true,
+	}}
+	if err := c.Do(req, resp); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if req.switches != 1 || string(resp.Body()) != "ok" {
+		t.Fatalf("unexpected response %q after %d switches", resp.Body(), req.switches)
+	}
+	if uri, _ := proxiedURI.Load().(string); uri != "http://example.com/path" {
+		t.Fatalf("unexpected URI %q proxied", uri)
+	}
+	//a host client is made for each super proxy
+	c.hostClientsLock.Lock()
+	hostClients := c.hostClientsList[requestProxyHTTP]
+	_, deadOk := hostClients[deadAddr]
+	_, liveOk := hostClients[liveProxy.HostWithPort()]
+	c.hostClientsLock.Unlock()
+	if !deadOk || !liveOk {
+		t.Fatalf("unexpected host clients %v", hostClients)
+	}
+
+	//not switched without SwitchProxy
+	req.SetProxy(deadProxy)
+	req.switches = 0
+	c.RetryPolicy.SwitchProxy = false
+	resp.Reset()
+	if err := c.Do(req, resp); err == nil || req.switches != 0 {
+		t.Fatalf("unexpected error %v after %d switches", err, req.switches)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := &RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for n, expBackoff := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		if backoff := p.backoff(n + 1); backoff != expBackoff*time.Millisecond {
+			t.Fatalf("unexpected backoff %s of retry %d, expecting %dms", backoff, n+1, expBackoff)
+		}
+	}
+	if backoff := (&RetryPolicy{}).backoff(3); backoff != 0 {
+		t.Fatalf("unexpected backoff %s, expecting none", backoff)
+	}
+
+	//the jitter out of [0, 1] is clamped
+	for _, jitter := range []float64{-1, 0.2, 1, 5} {
+		p.Jitter = jitter
+		clamped := jitter
+		if clamped < 0 {
+			clamped = 0
+		} else if clamped > 1 {
+			clamped = 1
+		}
+		min := time.Duration((1 - clamped) * float64(400*time.Millisecond))
+		max := time.Duration((1 + clamped) * float64(400*time.Millisecond))
+		for i := 0; i < 1000; i++ {
+			if backoff := p.backoff(3); backoff < min || backoff > max {
+				t.Fatalf("backoff %s of jitter %v is out of [%s, %s]", backoff, jitter, min, max)
+			}
+		}
+	}
+}
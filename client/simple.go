@@ -0,0 +1,509 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/haxii/fastproxy/bytebufferpool"
+	basehttp "github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/proxy/http"
+	"github.com/haxii/fastproxy/superproxy"
+	"github.com/haxii/fastproxy/util"
+)
+
+//ErrBodyTooLarge is returned if the body of a SimpleResponse exceeds its max body size
+var ErrBodyTooLarge = errors.New("response body exceeds the max body size")
+
+var (
+	simpleRequestPool  sync.Pool
+	simpleResponsePool sync.Pool
+)
+
+//AcquireSimpleRequest get a request from pool
+func AcquireSimpleRequest() *SimpleRequest {
+	v := simpleRequestPool.Get()
+	if v == nil {
+		return &SimpleRequest{}
+	}
+	return v.(*SimpleRequest)
+}
+
+//ReleaseSimpleRequest put a request back into pool
+func ReleaseSimpleRequest(req *SimpleRequest) {
+	req.Reset()
+	simpleRequestPool.Put(req)
+}
+
+//AcquireSimpleResponse get a response from pool
+func AcquireSimpleResponse() *SimpleResponse {
+	v := simpleResponsePool.Get()
+	if v == nil {
+		return &SimpleResponse{}
+	}
+	return v.(*SimpleResponse)
+}
+
+//ReleaseSimpleResponse put a response back into pool
+func ReleaseSimpleResponse(resp *SimpleResponse) {
+	resp.Reset()
+	simpleResponsePool.Put(resp)
+}
+
+//SimpleRequest http request built in code rather than read from a client,
+//which is performed by Client.Do like the proxied ones, so the connections
+//are pooled, and the request is sent via the super proxy set by SetProxy.
+//
+//	req.SetMethod("POST")
+//	req.SetURL("https://example.com/api")
+//	req.SetHeader("Content-Type", "application/json")
+//	req.SetBodyString(`{"a":1}`)
+//	err := c.Do(req, resp)
+//
+//It's not safe to be used concurrently.
+type SimpleRequest struct {
+	method []byte
+
+	//host `Host` header value, i.e. the host of the URL
+	host     string
+	hostInfo http.HostInfo
+	path     []byte
+
+	isTLS         bool
+	tlsServerName string
+
+	//header header fields set in order
+	header []simpleHeaderField
+	body   bytebufferpool.ByteBuffer
+
+	connectionClose bool
+
+	//proxy super proxy used for target connection
+	proxy *superproxy.SuperProxy
+
+	//byte size of the request body
+	readSize int
+	//byte size written to upstream
+	writeSize int
+}
+
+type simpleHeaderField struct {
+	name, value string
+}
+
+//Reset reset request
+func (r *SimpleRequest) Reset() {
+	r.method = r.method[:0]
+	r.host = ""
+	r.hostInfo.Reset()
+	r.path = r.path[:0]
+	r.isTLS = false
+	r.tlsServerName = ""
+	r.header = r.header[:0]
+	r.body.Reset()
+	r.connectionClose = false
+	r.proxy = nil
+	r.readSize = 0
+	r.writeSize = 0
+}
+
+//SetMethod set request method, GET by default, which must be a token, see SetHeader
+func (r *SimpleRequest) SetMethod(method string) {
+	r.method = append(r.method[:0], strings.ToUpper(method)...)
+}
+
+//SetURL set the url requested, e.g. `https://example.com:8443/path?query`,
+//only http & https schemes are supported, the fragment is not sent
+func (r *SimpleRequest) SetURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return util.ErrWrapper(err, "fail to parse url "+rawURL)
+	}
+	var defaultPort string
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		defaultPort = "80"
+	case "https":
+		defaultPort = "443"
+	default:
+		return errors.New("unsupported url scheme " + u.Scheme)
+	}
+	if len(u.Hostname()) == 0 {
+		return errors.New("nil host provided in url " + rawURL)
+	}
+	port := u.Port()
+	if len(port) == 0 {
+		port = defaultPort
+	}
+	r.host = u.Host
+	r.hostInfo.Reset()
+	r.hostInfo.ParseHostWithPort(net.JoinHostPort(u.Hostname(), port))
+	r.path = append(r.path[:0], u.RequestURI()...)
+	r.isTLS = defaultPort == "443"
+	return nil
+}
+
+//SetTLSServerName set the server name verified in https requests,
+//the host of the url is used if not set
+func (r *SimpleRequest) SetTLSServerName(serverName string) {
+	r.tlsServerName = serverName
+}
+
+//SetHeader set the header field name to value, the fields named name
+//case-insensitively are replaced, `Host` is set to the host of the url
+//if not set, `Content-Length` & `Transfer-Encoding` are ignored as it is set by the body.
+//The name must be a token and the value must not contain CR, LF or other control
+//characters, otherwise the request fails in WriteHeaderTo rather than injecting fields
+func (r *SimpleRequest) SetHeader(name, value string) {
+	r.DelHeader(name)
+	r.AddHeader(name, value)
+}
+
+//AddHeader add a header field, the fields named name are kept,
+//the name and the value are validated like SetHeader
+func (r *SimpleRequest) AddHeader(name, value string) {
+	r.header = append(r.header, simpleHeaderField{name: name, value: value})
+}
+
+//DelHeader removes all the header fields named name case-insensitively
+func (r *SimpleRequest) DelHeader(name string) {
+	fields := r.header[:0]
+	for _, f := range r.header {
+		if !strings.EqualFold(f.name, name) {
+			fields = append(fields, f)
+		}
+	}
+	r.header = fields
+}
+
+//PeekHeader value of the 1st header field named name case-insensitively, empty if not found
+func (r *SimpleRequest) PeekHeader(name string) string {
+	for _, f := range r.header {
+		if strings.EqualFold(f.name, name) {
+			return f.value
+		}
+	}
+	return ""
+}
+
+//SetBody set request body, which is not sent in GET & HEAD requests
+func (r *SimpleRequest) SetBody(body []byte) {
+	r.body.Set(body)
+}
+
+//SetBodyString set request body
+func (r *SimpleRequest) SetBodyString(body string) {
+	r.body.SetString(body)
+}
+
+//Body request body
+func (r *SimpleRequest) Body() []byte {
+	return r.body.B
+}
+
+//SetConnectionClose closes the connection after the request
+func (r *SimpleRequest) SetConnectionClose(close bool) {
+	r.connectionClose = close
+}
+
+//SetProxy set the super proxy the request is sent via, nil sends it directly
+func (r *SimpleRequest) SetProxy(p *superproxy.SuperProxy) {
+	r.proxy = p
+}
+
+//GetProxy get super proxy for this request
+func (r *SimpleRequest) GetProxy() *superproxy.SuperProxy {
+	return r.proxy
+}
+
+//Method request method in UPPER case
+func (r *SimpleRequest) Method() []byte {
+	if len(r.method) == 0 {
+		return methodGet
+	}
+	return r.method
+}
+
+//HostInfo returns host info
+func (r *SimpleRequest) HostInfo() *http.HostInfo {
+	return &r.hostInfo
+}
+
+//PathWithQueryFragment request path with query
+func (r *SimpleRequest) PathWithQueryFragment() []byte {
+	return r.path
+}
+
+var protocolHTTP11 = []byte("HTTP/1.1")
+
+//Protocol HTTP/1.1
+func (r *SimpleRequest) Protocol() []byte {
+	return protocolHTTP11
+}
+
+//WriteHeaderTo write the header fields set, then the ones derived
+//from the url and the body, implements client's request interface
+func (r *SimpleRequest) WriteHeaderTo(writer *bufio.Writer) error {
+	if len(r.host) == 0 {
+		return errors.New("nil url provided")
+	}
+	//the invalid method or fields would inject fields or even requests
+	if !basehttp.IsToken(string(r.Method())) {
+		return errors.New("invalid method " + strconv.Quote(string(r.Method())))
+	}
+	for _, f := range r.header {
+		if !basehttp.IsToken(f.name) || !basehttp.IsFieldValue(f.value) {
+			return errors.New("invalid header field " + strconv.Quote(f.name))
+		}
+	}
+	writeField := func(name, value string) error {
+		n, err := writer.WriteString(name + ": " + value + "\r\n")
+		r.writeSize += n
+		return err
+	}
+	if len(r.PeekHeader("Host")) == 0 {
+		if err := writeField("Host", r.host); err != nil {
+			return err
+		}
+	}
+	for _, f := range r.header {
+		if strings.EqualFold(f.name, "Content-Length") ||
+			strings.EqualFold(f.name, "Transfer-Encoding") {
+			continue
+		}
+		if err := writeField(f.name, f.value); err != nil {
+			return err
+		}
+	}
+	//the body of GET & HEAD requests is not sent by the client
+	if !isHeadOrGet(r.Method()) {
+		if err := writeField("Content-Length", strconv.Itoa(r.body.Len())); err != nil {
+			return err
+		}
+	}
+	if r.connectionClose {
+		if err := writeField("Connection", "close"); err != nil {
+			return err
+		}
+	}
+	n, err := writer.Write(startLineCRLF)
+	r.writeSize += n
+	return err
+}
+
+//WriteBodyTo write the body set, implements client's request interface
+func (r *SimpleRequest) WriteBodyTo(writer *bufio.Writer) error {
+	n, err := writer.Write(r.body.B)
+	r.readSize += n
+	r.writeSize += n
+	return err
+}
+
+//ConnectionClose if the connection is closed after the request,
+//see SetConnectionClose
+func (r *SimpleRequest) ConnectionClose() bool {
+	return r.connectionClose || strings.EqualFold(r.PeekHeader("Connection"), "close")
+}
+
+//IsTLS is https request
+func (r *SimpleRequest) IsTLS() bool {
+	return r.isTLS
+}
+
+//TLSServerName server name verified in https request
+func (r *SimpleRequest) TLSServerName() string {
+	return r.tlsServerName
+}
+
+//GetReadSize byte size of the body written
+func (r *SimpleRequest) GetReadSize() int {
+	return r.readSize
+}
+
+//AddReadSize add read size
+func (r *SimpleRequest) AddReadSize(n int) {
+	r.readSize += n
+}
+
+//GetWriteSize byte size written to upstream
+func (r *SimpleRequest) GetWriteSize() int {
+	return r.writeSize
+}
+
+//AddWriteSize add write size
+func (r *SimpleRequest) AddWriteSize(n int) {
+	r.writeSize += n
+}
+
+//SimpleResponse http response read into memory, the status, header
+//and decoded body can be got once it's read by Client.Do.
+//It's not safe to be used concurrently.
+type SimpleResponse struct {
+	respLine basehttp.ResponseLine
+	header   basehttp.Header
+	body     basehttp.Body
+	//bodyBuffer the decoded body
+	bodyBuffer bytebufferpool.ByteBuffer
+
+	//connectionClose the body is read until the connection is closed
+	connectionClose bool
+
+	//limits limits of reading, see `SetLimits`
+	limits *basehttp.Limits
+	//exceededLimit the limit exceeded in reading
+	exceededLimit *basehttp.LimitError
+	//maxBodySize see `SetMaxBodySize`
+	maxBodySize int
+
+	//size byte size of header and body
+	size int
+}
+
+//Reset reset response, including the max body size
+func (r *SimpleResponse) Reset() {
+	r.reset()
+	r.maxBodySize = 0
+}
+
+//reset resets the response read
+func (r *SimpleResponse) reset() {
+	r.respLine.Reset()
+	r.header.Reset()
+	r.body.Reset()
+	r.bodyBuffer.Reset()
+	r.connectionClose = false
+	r.limits = nil
+	r.exceededLimit = nil
+	r.size = 0
+}
+
+//SetMaxBodySize set the max size of the decoded body, ErrBodyTooLarge is
+//returned if it's exceeded in reading, unlimited if not set
+func (r *SimpleResponse) SetMaxBodySize(max int) {
+	r.maxBodySize = max
+}
+
+//StatusCode status code of the response
+func (r *SimpleResponse) StatusCode() int {
+	return r.respLine.GetStatusCode()
+}
+
+//StatusMessage status message of the response, e.g. `OK`
+func (r *SimpleResponse) StatusMessage() []byte {
+	return r.respLine.GetStatusMessage()
+}
+
+//Protocol protocol of the response, e.g. `HTTP/1.1`
+func (r *SimpleResponse) Protocol() []byte {
+	return r.respLine.GetProtocol()
+}
+
+//Header header fields of the response, see `http.Header.Peek` & `http.Header.VisitAll`
+func (r *SimpleResponse) Header() *basehttp.Header {
+	return &r.header
+}
+
+//Trailer trailer fields of the chunked body, if any
+func (r *SimpleResponse) Trailer() *basehttp.Header {
+	return r.body.Trailer()
+}
+
+//Body the body decoded from the chunked transfer coding,
+//the content coding, e.g. gzip, is kept
+func (r *SimpleResponse) Body() []byte {
+	return r.bodyBuffer.B
+}
+
+//ReadFrom read the response from br, the interim 1xx responses are skipped,
+//implements client's response interface
+func (r *SimpleResponse) ReadFrom(discardBody bool, br *bufio.Reader) error {
+	limits := r.limits
+	r.reset()
+	r.limits = limits
+	rawHeader := bytebufferpool.Get()
+	defer bytebufferpool.Put(rawHeader)
+	for interimCount := 0; ; interimCount++ {
+		//the interim responses are limited, so an upstream can't send them endlessly
+		if err := r.limits.CheckInterimCount(interimCount); err != nil {
+			return r.checkLimit(err)
+		}
+		if err := r.checkLimit(r.respLine.ParseWithLimits(br, r.limits)); err != nil {
+			return util.ErrWrapper(err, "fail to read start line of response")
+		}
+		r.size += len(r.respLine.GetResponseLine())
+		r.header.Reset()
+		r.header.SetLimits(r.limits)
+		rawHeader.Reset()
+		n, err := r.header.ParseHeaderFields(br, rawHeader)
+		r.size += n
+		if err != nil {
+			return util.ErrWrapper(r.checkLimit(err), "fail to parse http headers")
+		}
+		if statusCode := r.StatusCode(); statusCode < 100 || statusCode >= 200 || statusCode == 101 {
+			break
+		}
+	}
+
+	statusCode := r.StatusCode()
+	if discardBody || statusCode < 200 || statusCode == 204 || statusCode == 304 {
+		return nil
+	}
+	bodyType := r.header.BodyType()
+	//the body without the framing headers is read until the connection is closed
+	if bodyType == basehttp.BodyTypeFixedSize && r.header.Peek("Content-Length") == nil {
+		bodyType = basehttp.BodyTypeIdentity
+	}
+	r.connectionClose = bodyType == basehttp.BodyTypeIdentity
+	r.body.SetLimits(r.limits)
+	decode := basehttp.DecodedBodyWrapper(bodyType, r.writeBody)
+	return r.checkLimit(r.body.Parse(br, bodyType, r.header.ContentLength(),
+		func(isChunkHeader bool, data []byte) error {
+			r.size += len(data)
+			return decode(isChunkHeader, data)
+		},
+	))
+}
+
+//writeBody writes the decoded body data within the max body size
+func (r *SimpleResponse) writeBody(data []byte) error {
+	if r.maxBodySize > 0 && r.bodyBuffer.Len()+len(data) > r.maxBodySize {
+		return ErrBodyTooLarge
+	}
+	_, err := r.bodyBuffer.Write(data)
+	return err
+}
+
+//ConnectionClose if the response's "Connection" header value is set as "close",
+//or the body is read until the connection is closed
+func (r *SimpleResponse) ConnectionClose() bool {
+	return r.header.IsConnectionClose() || r.connectionClose
+}
+
+//GetSize byte size of the header and the body read
+func (r *SimpleResponse) GetSize() int {
+	return r.size
+}
+
+//SetLimits set the limits of reading the response, nil means the default ones,
+//which is set by the client from its ResponseLimits
+func (r *SimpleResponse) SetLimits(limits *basehttp.Limits) {
+	r.limits = limits
+}
+
+//ExceededLimit the limit exceeded in reading the response,
+//nil if no limit is exceeded
+func (r *SimpleResponse) ExceededLimit() *basehttp.LimitError {
+	return r.exceededLimit
+}
+
+//checkLimit records the limit exceeded if err is a *http.LimitError
+func (r *SimpleResponse) checkLimit(err error) error {
+	if limitErr, ok := err.(*basehttp.LimitError); ok {
+		r.exceededLimit = limitErr
+	}
+	return err
+}
@@ -0,0 +1,370 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	gohttp "net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/haxii/fastproxy/bufiopool"
+	basehttp "github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+func TestSimpleRequestSetURL(t *testing.T) {
+	tests := []struct {
+		url             string
+		expHostWithPort string
+		expHost         string
+		expPath         string
+		expTLS          bool
+	}{
+		{"http://example.com", "example.com:80", "example.com", "/", false},
+		{"HTTP://example.com/a?b=c#fragment", "example.com:80", "example.com", "/a?b=c", false},
+		{"https://example.com/a", "example.com:443", "example.com", "/a", true},
+		{"https://example.com:8443/", "example.com:8443", "example.com:8443", "/", true},
+		{"http://[::1]/v6", "[::1]:80", "[::1]", "/v6", false},
+		{"https://[2001:db8::1]:8443/v6", "[2001:db8::1]:8443", "[2001:db8::1]:8443", "/v6", true},
+	}
+	req := AcquireSimpleRequest()
+	defer ReleaseSimpleRequest(req)
+	for _, test := range tests {
+		if err := req.SetURL(test.url); err != nil {
+			t.Fatalf("fail to set url %s: %s", test.url, err)
+		}
+		if req.HostInfo().HostWithPort() != test.expHostWithPort ||
+			string(req.PathWithQueryFragment()) != test.expPath || req.IsTLS() != test.expTLS {
+			t.Fatalf("unexpected %s %s tls %v of url %s", req.HostInfo().HostWithPort(),
+				req.PathWithQueryFragment(), req.IsTLS(), test.url)
+		}
+		//the host of the url is sent as is, without the default port
+		var header bytes.Buffer
+		bw := bufio.NewWriter(&header)
+		if err := req.WriteHeaderTo(bw); err != nil {
+			t.Fatalf("fail to write header of url %s: %s", test.url, err)
+		}
+		bw.Flush()
+		if !strings.HasPrefix(header.String(), "Host: "+test.expHost+"\r\n") {
+			t.Fatalf("unexpected header %q of url %s", header.String(), test.url)
+		}
+	}
+
+	for _, url := range []string{"ftp://example.com/", "http:///path", "http://[::1", "example.com"} {
+		if err := req.SetURL(url); err == nil {
+			t.Fatalf("invalid url %s is set", url)
+		}
+	}
+}
+
+//echoHandler responds the method, the Host, the Content-Length & the body of the request
+var echoHandler = gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+	body, _ := io.ReadAll(r.Body)
+	contentLength := "none"
+	if len(r.Header["Content-Length"]) > 0 {
+		contentLength = r.Header.Get("Content-Length")
+	}
+	w.Header().Set("X-Custom", strings.Join(r.Header["X-Custom"], ","))
+	io.WriteString(w, r.Method+" "+r.Host+" "+contentLength+" "+string(body))
+})
+
+func TestSimpleRequestRoundTrip(t *testing.T) {
+	upstream := httptest.NewServer(echoHandler)
+	defer upstream.Close()
+	host := upstream.Listener.Addr().String()
+	c := &Client{BufioPool: &bufiopool.Pool{}}
+
+	tests := []struct {
+		method  string
+		body    string
+		expResp string
+	}{
+		{"POST", "hello", "POST " + host + " 5 hello"},
+		{"post", "", "POST " + host + " 0 "},
+		{"PUT", "put", "PUT " + host + " 3 put"},
+		//the body of GET & HEAD requests is not sent
+		{"", "ignored", "GET " + host + " none "},
+		{"GET", "", "GET " + host + " none "},
+	}
+	for _, test := range tests {
+		req := AcquireSimpleRequest()
+		resp := AcquireSimpleResponse()
+		req.SetMethod(test.method)
+		req.SetURL(upstream.URL + "/path")
+		req.SetBodyString(test.body)
+		req.AddHeader("X-Custom", "a")
+		req.AddHeader("x-custom", "b")
+		//the framing headers are set by the body
+		req.SetHeader("Content-Length", "100")
+		if err := c.Do(req, resp); err != nil {
+			t.Fatalf("fail to %s: %s", test.method, err)
+		}
+		if resp.StatusCode() != 200 || string(resp.Body()) != test.expResp {
+			t.Fatalf("unexpected response %d %q of %s, expecting %q",
+				resp.StatusCode(), resp.Body(), test.method, test.expResp)
+		}
+		if custom := string(resp.Header().Peek("X-Custom")); custom != "a,b" {
+			t.Fatalf("unexpected header fields %q sent", custom)
+		}
+		ReleaseSimpleRequest(req)
+		ReleaseSimpleResponse(resp)
+	}
+
+	//the fields replaced by SetHeader, including Host
+	req := AcquireSimpleRequest()
+	defer ReleaseSimpleRequest(req)
+	resp := AcquireSimpleResponse()
+	defer ReleaseSimpleResponse(resp)
+	req.SetURL(upstream.URL)
+	req.AddHeader("X-Custom", "a")
+	req.SetHeader("x-custom", "c")
+	req.SetHeader("Host", "other.com")
+	if err := c.Do(req, resp); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if string(resp.Body()) != "GET other.com none " || string(resp.Header().Peek("X-Custom")) != "c" {
+		t.Fatalf("unexpected response %q %q", resp.Body(), resp.Header().Peek("X-Custom"))
+	}
+}
+
+func TestSimpleRequestIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not supported: %s", err)
+	}
+	upstream := &httptest.Server{Listener: ln, Config: &gohttp.Server{Handler: echoHandler}}
+	upstream.Start()
+	defer upstream.Close()
+
+	req := AcquireSimpleRequest()
+	defer ReleaseSimpleRequest(req)
+	resp := AcquireSimpleResponse()
+	defer ReleaseSimpleResponse(resp)
+	req.SetURL(upstream.URL)
+	if err := (&Client{BufioPool: &bufiopool.Pool{}}).Do(req, resp); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if expResp := "GET " + ln.Addr().String() + " none "; string(resp.Body()) != expResp {
+		t.Fatalf("unexpected response %q, expecting %q", resp.Body(), expResp)
+	}
+}
+
+func TestSimpleRequestHeaderInjection(t *testing.T) {
+	var requests int32
+	upstream := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer upstream.Close()
+	c := &Client{BufioPool: &bufiopool.Pool{}}
+
+	for _, set := range []func(req *SimpleRequest){
+		func(req *SimpleRequest) { req.SetHeader("X", "a\r\nHost: evil") },
+		func(req *SimpleRequest) { req.AddHeader("X", "a\nb") },
+		func(req *SimpleRequest) { req.SetHeader("X", "a\x00b") },
+		func(req *SimpleRequest) { req.SetHeader("X\r\nHost", "evil") },
+		func(req *SimpleRequest) { req.AddHeader("X Y", "a") },
+		func(req *SimpleRequest) { req.AddHeader("", "a") },
+		func(req *SimpleRequest) { req.SetMethod("GET / HTTP/1.1\r\nHost: evil\r\n\r\nGET") },
+	} {
+		req := AcquireSimpleRequest()
+		resp := AcquireSimpleResponse()
+		req.SetURL(upstream.URL)
+		set(req)
+		if err := c.Do(req, resp); err == nil {
+			t.Fatalf("invalid request %q %v is sent", req.Method(), req.header)
+		}
+		ReleaseSimpleRequest(req)
+		ReleaseSimpleResponse(resp)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("%d requests are served, expecting none", n)
+	}
+
+	//the tab and the obs-text are allowed in values
+	req := AcquireSimpleRequest()
+	defer ReleaseSimpleRequest(req)
+	resp := AcquireSimpleResponse()
+	defer ReleaseSimpleResponse(resp)
+	req.SetURL(upstream.URL)
+	req.SetHeader("X", "a\tb\xff")
+	if err := c.Do(req, resp); err != nil || atomic.LoadInt32(&requests) != 1 {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestSimpleResponseBody(t *testing.T) {
+	upstream := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		switch r.URL.Path {
+		case "/identity":
+			w.Header().Set("Content-Length", "10")
+			io.WriteString(w, "0123456789")
+		case "/chunked":
+			w.Header().Set("Trailer", "X-Checksum")
+			io.WriteString(w, "hello")
+			w.(gohttp.Flusher).Flush()
+			io.WriteString(w, " world")
+			w.Header().Set("X-Checksum", "1234")
+		case "/interim":
+			w.Header().Set("Link", "</a.css>")
+			w.WriteHeader(gohttp.StatusEarlyHints)
+			w.WriteHeader(gohttp.StatusProcessing)
+			w.Header().Del("Link")
+			io.WriteString(w, "final")
+		case "/close":
+			c, rw, _ := w.(gohttp.Hijacker).Hijack()
+			defer c.Close()
+			rw.WriteString("HTTP/1.1 200 OK\r\n\r\nclose delimited")
+			rw.Flush()
+		case "/empty":
+			w.WriteHeader(gohttp.StatusNoContent)
+		}
+	}))
+	defer upstream.Close()
+	c := &Client{BufioPool: &bufiopool.Pool{}}
+
+	tests := []struct {
+		path       string
+		method     string
+		expStatus  int
+		expBody    string
+		expTrailer string
+		expClose   bool
+	}{
+		{"/identity", "GET", 200, "0123456789", "", false},
+		{"/identity", "HEAD", 200, "", "", false},
+		{"/chunked", "GET", 200, "hello world", "1234", false},
+		//the interim responses are skipped
+		{"/interim", "GET", 200, "final", "", false},
+		{"/close", "GET", 200, "close delimited", "", true},
+		{"/empty", "GET", 204, "", "", false},
+	}
+	for _, test := range tests {
+		req := AcquireSimpleRequest()
+		resp := AcquireSimpleResponse()
+		req.SetMethod(test.method)
+		req.SetURL(upstream.URL + test.path)
+		if err := c.Do(req, resp); err != nil {
+			t.Fatalf("fail to %s %s: %s", test.method, test.path, err)
+		}
+		if resp.StatusCode() != test.expStatus || string(resp.Body()) != test.expBody {
+			t.Fatalf("unexpected response %d %q of %s %s", resp.StatusCode(), resp.Body(),
+				test.method, test.path)
+		}
+		if trailer := string(resp.Trailer().Peek("X-Checksum")); trailer != test.expTrailer {
+			t.Fatalf("unexpected trailer %q of %s", trailer, test.path)
+		}
+		if len(resp.Header().Peek("Link")) > 0 {
+			t.Fatalf("header of the interim response is kept")
+		}
+		if resp.ConnectionClose() != test.expClose {
+			t.Fatalf("unexpected connection close %v of %s", resp.ConnectionClose(), test.path)
+		}
+		if size := resp.GetSize(); size <= len(test.expBody) {
+			t.Fatalf("unexpected size %d of %s", size, test.path)
+		}
+		ReleaseSimpleRequest(req)
+		ReleaseSimpleResponse(resp)
+	}
+
+	//the decoded body within the max body size
+	for _, path := range []string{"/identity", "/chunked"} {
+		req := AcquireSimpleRequest()
+		resp := AcquireSimpleResponse()
+		req.SetURL(upstream.URL + path)
+		resp.SetMaxBodySize(11)
+		if err := c.Do(req, resp); err != nil {
+			t.Fatalf("fail to get %s within max body size: %s", path, err)
+		}
+		resp.SetMaxBodySize(9)
+		if err := c.Do(req, resp); err == nil || !strings.Contains(err.Error(), ErrBodyTooLarge.Error()) {
+			t.Fatalf("unexpected error %v of %s, expecting body too large", err, path)
+		}
+		ReleaseSimpleRequest(req)
+		ReleaseSimpleResponse(resp)
+	}
+}
+
+func TestSimpleReset(t *testing.T) {
+	proxy, _ := superproxy.NewSuperProxy("127.0.0.1", 8080, superproxy.ProxyTypeHTTP, "", "", false)
+	req := AcquireSimpleRequest()
+	req.SetMethod("POST")
+	req.SetURL("https://example.com/path")
+	req.SetTLSServerName("example.org")
+	req.SetHeader("X", "1")
+	req.SetBodyString("body")
+	req.SetConnectionClose(true)
+	req.SetProxy(proxy)
+	req.AddReadSize(1)
+	req.AddWriteSize(1)
+	req.Reset()
+	if string(req.Method()) != "GET" || len(req.HostInfo().HostWithPort()) != 0 ||
+		len(req.PathWithQueryFragment()) != 0 || req.IsTLS() || len(req.TLSServerName()) != 0 ||
+		len(req.PeekHeader("X")) != 0 || len(req.Body()) != 0 || req.ConnectionClose() ||
+		req.GetProxy() != nil || req.GetReadSize() != 0 || req.GetWriteSize() != 0 {
+		t.Fatalf("request is not reset: %+v", req)
+	}
+	if err := req.WriteHeaderTo(bufio.NewWriter(io.Discard)); err == nil {
+		t.Fatalf("request without url is written")
+	}
+	ReleaseSimpleRequest(req)
+
+	resp := AcquireSimpleResponse()
+	resp.SetMaxBodySize(1)
+	resp.SetLimits(&basehttp.Limits{MaxInterimCount: 1})
+	if err := resp.ReadFrom(false, bufio.NewReader(strings.NewReader(
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n"+
+			"2\r\nok\r\n0\r\nX-Checksum: 1\r\n\r\n"))); err != ErrBodyTooLarge {
+		t.Fatalf("unexpected error %v, expecting body too large", err)
+	}
+	resp.Reset()
+	if resp.StatusCode() != 0 || len(resp.Body()) != 0 || resp.Header().Len() != 0 ||
+		resp.Trailer().Len() != 0 || resp.ConnectionClose() || resp.GetSize() != 0 ||
+		resp.ExceededLimit() != nil || resp.limits != nil || resp.maxBodySize != 0 {
+		t.Fatalf("response is not reset: %+v", resp)
+	}
+	//the response read again keeps the limits set, but nothing else read before
+	resp.SetLimits(&basehttp.Limits{MaxInterimCount: 1})
+	r := bufio.NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok" +
+		"HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len("again")) + "\r\n\r\nagain"))
+	for _, expBody := range []string{"ok", "again"} {
+		if err := resp.ReadFrom(false, r); err != nil || string(resp.Body()) != expBody {
+			t.Fatalf("unexpected response %q: %v, expecting %q", resp.Body(), err, expBody)
+		}
+		if resp.limits == nil {
+			t.Fatalf("limits are not kept")
+		}
+	}
+	ReleaseSimpleResponse(resp)
+}
+
+func TestSimpleResponseInterimLimit(t *testing.T) {
+	final := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	interim := "HTTP/1.1 103 Early Hints\r\nLink: </a.css>\r\n\r\n"
+	resp := AcquireSimpleResponse()
+	defer ReleaseSimpleResponse(resp)
+
+	resp.SetLimits(&basehttp.Limits{MaxInterimCount: 2})
+	if err := resp.ReadFrom(false, bufio.NewReader(strings.NewReader(
+		strings.Repeat(interim, 2)+final))); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if resp.StatusCode() != 200 || string(resp.Body()) != "ok" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode(), resp.Body())
+	}
+
+	//an upstream sending the interim responses endlessly
+	resp.SetLimits(&basehttp.Limits{MaxInterimCount: 2})
+	err := resp.ReadFrom(false, bufio.NewReader(strings.NewReader(
+		strings.Repeat(interim, 1000)+final)))
+	if limitErr, ok := err.(*basehttp.LimitError); !ok || limitErr.Limit != basehttp.LimitInterimCount {
+		t.Fatalf("unexpected error %v, expecting interim count limit exceeded", err)
+	}
+	if limitErr := resp.ExceededLimit(); limitErr == nil || limitErr.Limit != basehttp.LimitInterimCount {
+		t.Fatalf("unexpected limit %v exceeded", limitErr)
+	}
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/haxii/fastproxy/bufiopool"
+	"github.com/haxii/fastproxy/cert"
+	"github.com/haxii/fastproxy/transport"
+)
+
+// DoUpgrade performs the upgrade request, e.g. a WebSocket handshake,
+// then fills the given http response.
+//
+// The request is sent over a new connection rather than a pooled one,
+// which is returned for forwarding the traffic after the upstream switches
+// protocols, the caller must close it. Requests via super proxies are always
+// sent in tunnels, as the upgraded traffic is no longer http.
+func (c *Client) DoUpgrade(req Request, resp Response) (net.Conn, error) {
+	return c.DoUpgradeContext(context.Background(), req, resp)
+}
+
+// DoUpgradeContext performs the upgrade request like DoUpgrade, the request is
+// canceled once ctx is done until the response is read, including dialing,
+// handshaking and making the tunnel via the super proxy, then ctx.Err() is returned.
+//
+// The dial & TLS handshake timeouts of the request may be set in ctx by WithTimeouts.
+func (c *Client) DoUpgradeContext(ctx context.Context, req Request, resp Response) (net.Conn, error) {
+	if req == nil {
+		return nil, errors.New("nil request")
+	}
+	if resp == nil {
+		return nil, errors.New("nil response")
+	}
+	if c.BufioPool == nil {
+		return nil, errors.New("nil buffer io pool")
+	}
+	hostWithPort := req.HostInfo().HostWithPort()
+	if len(hostWithPort) == 0 {
+		return nil, errors.New("nil target host provided")
+	}
+
+	timeouts := timeoutsFrom(ctx)
+	dialCtx, cancel := withTimeout(ctx, timeouts.Dial)
+	var conn net.Conn
+	var err error
+	if superProxy := req.GetProxy(); superProxy == nil {
+		conn, err = transport.DialContext(dialCtx, req.HostInfo().TargetWithPort())
+	} else {
+		conn, err = superProxy.MakeTunnelContext(dialCtx, c.BufioPool, req.HostInfo().TargetWithPort())
+	}
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if req.IsTLS() {
+		tlsConn := tls.Client(conn, cert.MakeClientTLSConfig(hostWithPort, req.TLSServerName()))
+		if err := handshake(ctx, tlsConn, timeouts.TLSHandshake); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	//the connection is closed to interrupt the request once ctx is done
+	stopWatching := transport.WatchContext(ctx, conn)
+	fail := func(err error) error {
+		conn.Close()
+		if stopWatching() {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	//write request
+	if c.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+	}
+	if err := readFromReqAndWriteToIOWriter(c.BufioPool, req, false, conn, nil); err != nil {
+		return nil, fail(err)
+	}
+
+	//get response
+	if c.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+	}
+	br := c.BufioPool.AcquireReader(conn)
+	if err := readResponse(resp, false, br,
+		&c.ResponseLimits, c.ExceededResponseLimits); err != nil {
+		c.BufioPool.ReleaseReader(br)
+		return nil, fail(err)
+	}
+	if stopWatching() {
+		c.BufioPool.ReleaseReader(br)
+		return nil, ctx.Err()
+	}
+	//the upgraded traffic has no deadline
+	conn.SetDeadline(time.Time{})
+	return &upgradedConn{Conn: conn, r: br, bufioPool: c.BufioPool}, nil
+}
+
+//upgradedConn upgraded connection reads from the reader of the response,
+//so the bytes buffered after the response are not lost
+type upgradedConn struct {
+	net.Conn
+	r         *bufio.Reader
+	bufioPool *bufiopool.Pool
+	closeOnce sync.Once
+}
+
+func (c *upgradedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *upgradedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.bufioPool.ReleaseReader(c.r)
+	})
+	return err
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	gohttp "net/http"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/bufiopool"
+)
+
+//startUpgradeUpstream serves the connections of a local listener with serve,
+//after the request is read from r, returns the address of the listener
+func startUpgradeUpstream(t *testing.T, serve func(c net.Conn, r *bufio.Reader, req *gohttp.Request)) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("fail to listen: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(5 * time.Second))
+				r := bufio.NewReader(c)
+				if req, err := gohttp.ReadRequest(r); err == nil {
+					serve(c, r, req)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestDoUpgrade(t *testing.T) {
+	//the upstream switches protocols, sends a greeting right after the response,
+	//then echoes the bytes of the upgraded traffic
+	addr := startUpgradeUpstream(t, func(c net.Conn, r *bufio.Reader, req *gohttp.Request) {
+		if req.Header.Get("Upgrade") != "echo" || req.Header.Get("Connection") != "Upgrade" {
+			io.WriteString(c, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nhello")
+		io.Copy(c, r)
+	})
+	c := &Client{BufioPool: &bufiopool.Pool{}}
+	req := AcquireSimpleRequest()
+	defer ReleaseSimpleRequest(req)
+	resp := AcquireSimpleResponse()
+	defer ReleaseSimpleResponse(resp)
+	req.SetURL("http://" + addr + "/")
+	req.SetHeader("Connection", "Upgrade")
+	req.SetHeader("Upgrade", "echo")
+	conn, err := c.DoUpgrade(req, resp)
+	if err != nil {
+		t.Fatalf("fail to upgrade: %s", err)
+	}
+	defer conn.Close()
+	if resp.StatusCode() != 101 || string(resp.Header().Peek("Upgrade")) != "echo" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode(), resp.Header().Peek("Upgrade"))
+	}
+	//the bytes buffered after the response are read from the connection returned
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, exp := range []string{"hello", "ping"} {
+		if exp == "ping" {
+			io.WriteString(conn, "ping")
+		}
+		b := make([]byte, len(exp))
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != exp {
+			t.Fatalf("unexpected upgraded traffic %q, expecting %q: %v", b, exp, err)
+		}
+	}
+}
+
+func TestDoUpgradeContext(t *testing.T) {
+	//the upstream never responds
+	addr := startUpgradeUpstream(t, func(c net.Conn, r *bufio.Reader, req *gohttp.Request) {
+		io.Copy(io.Discard, r)
+	})
+	c := &Client{BufioPool: &bufiopool.Pool{}}
+	req := AcquireSimpleRequest()
+	defer ReleaseSimpleRequest(req)
+	resp := AcquireSimpleResponse()
+	defer ReleaseSimpleResponse(resp)
+	req.SetURL("http://" + addr + "/")
+	req.SetHeader("Connection", "Upgrade")
+	req.SetHeader("Upgrade", "echo")
+
+	//the request waiting for the response is canceled once ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.DoUpgradeContext(ctx, req, resp); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error %v, expecting %s", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("request is canceled after %s", elapsed)
+	}
+
+	//the dialing is canceled as well
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.DoUpgradeContext(ctx, req, resp); err == nil {
+		t.Fatalf("request is performed with ctx done")
+	}
+}
@@ -27,6 +27,21 @@ func isHeadOrGet(method []byte) bool {
 	return isHead(method) || isGet(method)
 }
 
+//bodyRequest the request which tells if it has a body regardless of
+//its method, e.g. http.Request of a GET request with a body
+type bodyRequest interface {
+	HasBody() bool
+}
+
+//hasBody if the body of req is written, the requests other than GET & HEAD
+//have one unless req tells by implementing bodyRequest
+func hasBody(req Request) bool {
+	if bodyReq, ok := req.(bodyRequest); ok {
+		return bodyReq.HasBody()
+	}
+	return !isHeadOrGet(req.Method())
+}
+
 var (
 	startLineScheme  = []byte("http://")
 	startLineSP      = byte(' ')
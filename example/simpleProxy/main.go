@@ -37,10 +37,11 @@ func main() {
 				fmt.Printf("allowed connection from %s\n", conn.String())
 				return true
 			},
-			ShouldDecryptHost: func(hostWithPort string) bool {
+			ShouldDecryptHost: func(hostWithPort string, hello *proxy.ClientHello) bool {
 				return true
 			},
-			URLProxy: func(hostWithPort string, uri []byte) *superproxy.SuperProxy {
+			URLProxy: func(user, hostWithPort string, uri []byte,
+				hello *proxy.ClientHello) *superproxy.SuperProxy {
 				if strings.Contains(hostWithPort, "lumtest") {
 					return nil
 				}
@@ -74,7 +75,7 @@ type SimpleHijackerPool struct {
 }
 
 //Get get a simple hijacker from pool
-func (p *SimpleHijackerPool) Get(clientAddr net.Addr,
+func (p *SimpleHijackerPool) Get(clientAddr net.Addr, user string,
 	targetHost string, method, path []byte) hijack.Hijacker {
 	v := p.pool.Get()
 	var h *simpleHijacker
@@ -1,15 +1,17 @@
 package hijack
 
 import (
+	"crypto/x509"
 	"io"
 	"net"
 
 	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/websocket"
 )
 
 //Hijacker hijacker of each http connection and decrypted https connection
 // Sniffer: `OnRequest` & `OnResponse`
-// Modifer: `HijackResponse`
+// Modifer: `HijackResponse`, or the optional `RequestHijacker` & `ResponseHijacker`
 type Hijacker interface {
 	// OnRequest give the request header in parameters then
 	// write request body in the writer returned
@@ -25,10 +27,127 @@ type Hijacker interface {
 	HijackResponse() io.Reader
 }
 
+//UpstreamTLSHijacker optional interface of Hijacker, told the upstream's TLS result in MITM
+type UpstreamTLSHijacker interface {
+	// OnUpstreamTLS give the upstream's certificates and verification error,
+	// it's called before `HijackResponse`
+	OnUpstreamTLS(serverName string, certs []*x509.Certificate, err error)
+}
+
+//RequestHijacker optional interface of Hijacker, which modifies the request
+type RequestHijacker interface {
+	// HijackRequest give the request to modify before `HijackResponse`,
+	// the modifier is only valid inside this call
+	HijackRequest(req RequestModifier)
+}
+
+//RequestModifier modifier of a request, the framing headers are managed by proxy
+type RequestModifier interface {
+	// Method request method in UPPER case
+	Method() []byte
+	// SetMethod replaces the request method
+	SetMethod(method string)
+
+	// PathWithQueryFragment request path with query and fragment
+	PathWithQueryFragment() []byte
+	// SetPathWithQueryFragment replaces the request path with query and fragment
+	SetPathWithQueryFragment(path string)
+
+	// HostWithPort target host with port of the request
+	HostWithPort() string
+	// SetHostWithPort changes the target, the `Host` header and the TLS server name
+	SetHostWithPort(hostWithPort string)
+
+	// Header parsed header info of the original request
+	Header() *http.Header
+	// HeaderValue value of the 1st header field named name
+	HeaderValue(name string) ([]byte, bool)
+	// AddHeaderValue appends value to the header field, added if not present
+	AddHeaderValue(name, value string)
+	// SetHeaderValue replaces the value of the header field, added if not present
+	SetHeaderValue(name, value string)
+	// DelHeader removes all the header fields named name
+	DelHeader(name string)
+
+	// SetBody replaces the body, which is never sent for GET & HEAD
+	SetBody(body []byte)
+	// TransformBody replaces the body with the reader returned by transform,
+	// which reads the original body decoded from chunks
+	TransformBody(transform func(body io.Reader) io.Reader)
+	// TransformBodyWriter is `TransformBody` writing the original body to
+	// the writer returned, which is closed at the end of the body
+	TransformBodyWriter(transform func(w io.Writer) io.WriteCloser)
+}
+
+//ResponseHijacker optional interface of Hijacker, which modifies the upstream's response
+type ResponseHijacker interface {
+	// ModifyResponse give the response to modify before `OnResponse`,
+	// the modifier is only valid inside this call
+	ModifyResponse(resp ResponseModifier)
+}
+
+//ResponseModifier modifier of a response, the framing headers are managed by proxy
+type ResponseModifier interface {
+	// StatusCode status code of the response
+	StatusCode() int
+	// SetStatus replaces the status, the standard message is used if empty
+	SetStatus(statusCode int, statusMessage string)
+
+	// Header parsed header info of the original response
+	Header() *http.Header
+	// HeaderValue value of the 1st header field named name
+	HeaderValue(name string) ([]byte, bool)
+	// AddHeaderValue appends value to the header field, added if not present
+	AddHeaderValue(name, value string)
+	// SetHeaderValue replaces the value of the header field, added if not present
+	SetHeaderValue(name, value string)
+	// DelHeader removes all the header fields named name
+	DelHeader(name string)
+
+	// SetBody replaces the body, which is never sent for HEAD, 1xx, 204 & 304
+	SetBody(body []byte)
+	// TransformBody replaces the body with the reader returned by transform,
+	// which reads the original body decoded from chunks, still content coded
+	TransformBody(transform func(body io.Reader) io.Reader)
+	// TransformBodyWriter is `TransformBody` writing the original body to
+	// the writer returned, which is closed at the end of the body
+	TransformBodyWriter(transform func(w io.Writer) io.WriteCloser)
+}
+
+//TrailerHijacker optional interface of Hijacker, which sniffs the trailer fields
+type TrailerHijacker interface {
+	// OnRequestTrailer give the request's trailer fields after its body
+	OnRequestTrailer(trailer http.Header)
+
+	// OnResponseTrailer give the response's trailer fields after its body
+	OnResponseTrailer(trailer http.Header)
+}
+
 //HijackerPool pooling hijacker instances
 type HijackerPool interface {
-	// Get get a hijacker with client address
-	Get(clientAddr net.Addr, host string, method, path []byte) Hijacker
+	// Get get a hijacker with client address,
+	// user is the authenticated proxy user, empty if proxy auth is disabled
+	Get(clientAddr net.Addr, user string, host string, method, path []byte) Hijacker
 	// Put put a hijacker back to pool
 	Put(Hijacker)
 }
+
+//WebSocketDirection direction of a WebSocket frame
+type WebSocketDirection int
+
+const (
+	//WebSocketClientToServer frames sent by client
+	WebSocketClientToServer WebSocketDirection = iota
+	//WebSocketServerToClient frames sent by server
+	WebSocketServerToClient
+)
+
+//WebSocketHijacker optional interface of Hijacker, which sniffs and modifies the WebSocket frames
+type WebSocketHijacker interface {
+	// OnWebSocketOpen is called once upgraded, inject sends frames to either side
+	OnWebSocketOpen(inject func(direction WebSocketDirection, frame *websocket.Frame) error)
+
+	// OnWebSocketFrame give each reassembled message, returns the frames sent instead,
+	// i.e. itself to pass, nil to drop, it's called concurrently for both directions
+	OnWebSocketFrame(direction WebSocketDirection, frame *websocket.Frame) []*websocket.Frame
+}
@@ -2,16 +2,42 @@ package http
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"math"
+	"strconv"
 
 	"github.com/haxii/fastproxy/bytebufferpool"
 	"github.com/haxii/fastproxy/util"
 )
 
 //Body http body
-type Body struct{}
+type Body struct {
+	//limits limits of parsing, nil means the default ones
+	limits *Limits
+
+	//trailer trailer fields parsed after the last chunk
+	trailer Header
+}
+
+//Reset reset the trailer fields parsed and the limits
+func (b *Body) Reset() {
+	b.limits = nil
+	b.trailer.Reset()
+}
+
+//Trailer trailer fields parsed after the last chunk of the chunked body,
+//which are empty if no trailer fields are sent, see `Header.VisitAll`
+func (b *Body) Trailer() *Header {
+	return &b.trailer
+}
+
+//SetLimits set the limits of `Parse`, nil means the default ones,
+//a *LimitError is returned if the chunk extension size exceeds
+func (b *Body) SetLimits(limits *Limits) {
+	b.limits = limits
+}
 
 //BodyType how http body is formed
 type BodyType int
@@ -28,6 +54,41 @@ const (
 //BodyWrapper body reader helper
 type BodyWrapper func(isChunkHeader bool, data []byte) error
 
+//DecodedBodyWrapper makes a BodyWrapper for body of bodyType,
+//which passes only the body data to w, i.e. the chunk headers and
+//the CRLF ending each chunk are removed from a chunked body
+func DecodedBodyWrapper(bodyType BodyType, w func(data []byte) error) BodyWrapper {
+	if bodyType != BodyTypeChunked {
+		return func(isChunkHeader bool, data []byte) error {
+			return w(data)
+		}
+	}
+	//chunkLeft data size left in current chunk
+	var chunkLeft int64
+	return func(isChunkHeader bool, data []byte) error {
+		if isChunkHeader {
+			//the chunk extensions are ignored
+			if i := bytes.IndexByte(data, ';'); i >= 0 {
+				data = data[:i]
+			}
+			size, err := strconv.ParseInt(string(bytes.TrimSpace(data)), 16, 64)
+			if err != nil {
+				return util.ErrWrapper(err, "fail to parse chunk size")
+			}
+			chunkLeft = size
+			return nil
+		}
+		if int64(len(data)) > chunkLeft {
+			data = data[:chunkLeft]
+		}
+		chunkLeft -= int64(len(data))
+		if len(data) == 0 {
+			return nil
+		}
+		return w(data)
+	}
+}
+
 //Parse parse body from reader and wraps data in BodyWrapper
 func (b *Body) Parse(reader *bufio.Reader, bodyType BodyType,
 	contentLength int64, w BodyWrapper) error {
@@ -37,7 +98,7 @@ func (b *Body) Parse(reader *bufio.Reader, bodyType BodyType,
 			return parseBodyFixedSize(reader, w, contentLength)
 		}
 	case BodyTypeChunked:
-		return parseBodyChunked(reader, w)
+		return b.parseChunked(reader, w)
 	case BodyTypeIdentity:
 		return parseBodyIdentity(reader, w)
 	}
@@ -79,30 +140,69 @@ func parseBodyFixedSize(src *bufio.Reader, w BodyWrapper, contentLength int64) e
 	}
 }
 
-func parseBodyChunked(src *bufio.Reader, w BodyWrapper) error {
+//parseChunked parses the chunks and the trailer section after the last chunk,
+//the trailer fields are parsed into the body's trailer then passed to w as is
+func (b *Body) parseChunked(src *bufio.Reader, w BodyWrapper) error {
 	buffer := bytebufferpool.Get()
 	defer bytebufferpool.Put(buffer)
 
+	maxExtensionSize := b.limits.max(LimitChunkExtensionSize)
 	for {
 		//read and calculate chunk size
 		buffer.Reset()
-		chunkSize, err := parseChunkSize(src, buffer)
+		chunkSize, err := parseChunkSize(src, buffer, maxExtensionSize)
 		if err != nil {
 			return err
 		}
 		if err := w(true, buffer.B); err != nil {
 			return err
 		}
+		if chunkSize == 0 {
+			return b.parseTrailer(src, w, buffer)
+		}
 		//copy the chunk
 		if err := parseBodyFixedSize(src, w,
 			//2 means the length of `\r\n` i.e. CRLF
 			int64(chunkSize+2)); err != nil {
 			return err
 		}
-		if chunkSize == 0 {
-			return nil
+	}
+}
+
+//parseTrailer parses the trailer section ended with an empty line, which is
+//the same as the header fields, then passes the raw section to w as is,
+//as the fields parsed by `ParseHeaderFields` are rewritten, e.g. `Proxy-*` is removed
+func (b *Body) parseTrailer(src *bufio.Reader, w BodyWrapper,
+	buffer *bytebufferpool.ByteBuffer) error {
+	buffer.Reset()
+	maxSize := b.limits.max(LimitHeaderSize)
+	for lineStart := true; ; {
+		line, err := src.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			return util.ErrWrapper(err, "fail to read trailer")
+		}
+		buffer.Write(line)
+		if maxSize >= 0 && buffer.Len() > maxSize {
+			return &LimitError{Limit: LimitHeaderSize, Max: maxSize}
+		}
+		if lineStart && err == nil && (len(line) == 1 || (len(line) == 2 && line[0] == '\r')) {
+			break
+		}
+		lineStart = err == nil
+	}
+
+	//parse the raw section read for inspecting the fields
+	b.trailer.SetLimits(b.limits)
+	parsed := bytebufferpool.Get()
+	defer bytebufferpool.Put(parsed)
+	rawReader := bufio.NewReaderSize(bytes.NewReader(buffer.B), buffer.Len())
+	if _, err := b.trailer.ParseHeaderFields(rawReader, parsed); err != nil {
+		if _, ok := err.(*LimitError); ok {
+			return err
 		}
+		return util.ErrWrapper(err, "fail to parse trailer")
 	}
+	return w(false, buffer.B)
 }
 
 func parseBodyIdentity(src *bufio.Reader, w BodyWrapper) error {
@@ -116,19 +216,34 @@ func parseBodyIdentity(src *bufio.Reader, w BodyWrapper) error {
 	return nil
 }
 
-func parseChunkSize(r *bufio.Reader, buffer *bytebufferpool.ByteBuffer) (int, error) {
+//parseChunkSize parses the chunk size line into buffer, the chunk extensions,
+//e.g. `;name=value`, are kept as is, which are no longer than maxExtensionSize
+func parseChunkSize(r *bufio.Reader, buffer *bytebufferpool.ByteBuffer,
+	maxExtensionSize int) (int, error) {
 	n, err := util.ReadHexInt(r, buffer)
 	if err != nil {
 		return -1, err
 	}
-	c, err := r.ReadByte()
-	if err != nil {
-		return -1, fmt.Errorf("cannot read '\r' char at the end of chunk size: %s", err)
-	}
-	if c != '\r' {
-		return -1, fmt.Errorf("unexpected char %q at the end of chunk size. Expected %q", c, '\r')
+	for extensionSize := 0; ; extensionSize++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return -1, fmt.Errorf("cannot read '\r' char at the end of chunk size: %s", err)
+		}
+		if c == '\r' {
+			break
+		}
+		//the extensions start with `;`, optionally after whitespaces
+		if extensionSize == 0 && c != ';' && c != ' ' && c != '\t' {
+			return -1, fmt.Errorf("unexpected char %q at the end of chunk size. Expected %q", c, '\r')
+		}
+		if maxExtensionSize >= 0 && extensionSize >= maxExtensionSize {
+			return -1, &LimitError{Limit: LimitChunkExtensionSize, Max: maxExtensionSize}
+		}
+		if e := buffer.WriteByte(c); e != nil {
+			return -1, e
+		}
 	}
-	c, err = r.ReadByte()
+	c, err := r.ReadByte()
 	if err != nil {
 		return -1, fmt.Errorf("cannot read '\n' char at the end of chunk size: %s", err)
 	}
@@ -0,0 +1,91 @@
+package http
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestDecodedBodyWrapper(t *testing.T) {
+	testDecodedBody(t, BodyTypeChunked, 0, "5\r\nhello\r\n7\r\n, world\r\n0\r\n\r\n", "hello, world")
+	testDecodedBody(t, BodyTypeChunked, 0, "0\r\n\r\n", "")
+	testDecodedBody(t, BodyTypeChunked, 0, "5;name=value\r\nhello\r\n0\r\n\r\n", "hello")
+	testDecodedBody(t, BodyTypeChunked, 0, "5\r\nhello\r\n0\r\nA: 0\r\n\r\n", "hello")
+	testDecodedBody(t, BodyTypeFixedSize, 5, "hello, world", "hello")
+	testDecodedBody(t, BodyTypeIdentity, 0, "hello, world", "hello, world")
+}
+
+func testDecodedBody(t *testing.T, bodyType BodyType, contentLength int64, raw, expBody string) {
+	var body Body
+	var decoded strings.Builder
+	if err := body.Parse(bufio.NewReaderSize(strings.NewReader(raw), 16), bodyType, contentLength,
+		DecodedBodyWrapper(bodyType, func(data []byte) error {
+			decoded.Write(data)
+			return nil
+		})); err != nil {
+		t.Fatalf("unexpected error %s, expecting nil", err)
+	}
+	if decoded.String() != expBody {
+		t.Fatalf("unexpected body %q, expecting %q", decoded.String(), expBody)
+	}
+}
+
+func TestChunkedBodyTrailer(t *testing.T) {
+	raw := "5\r\nhello\r\n0\r\nGrpc-Status: 0\r\nGrpc-Message: ok\r\n\r\nGET / HTTP/1.1\r\n"
+	reader := bufio.NewReader(strings.NewReader(raw))
+	var body Body
+	var forwarded strings.Builder
+	if err := body.Parse(reader, BodyTypeChunked, 0, func(isChunkHeader bool, data []byte) error {
+		forwarded.Write(data)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error %s, expecting nil", err)
+	}
+	//the trailer section is forwarded as is, the next request is not read
+	if expBody := raw[:len(raw)-len("GET / HTTP/1.1\r\n")]; forwarded.String() != expBody {
+		t.Fatalf("unexpected body %q, expecting %q", forwarded.String(), expBody)
+	}
+	if reader.Buffered() != len("GET / HTTP/1.1\r\n") {
+		t.Fatalf("unexpected bytes %d left", reader.Buffered())
+	}
+	if body.Trailer().Len() != 2 || string(body.Trailer().Peek("grpc-status")) != "0" {
+		t.Fatalf("unexpected trailer fields %d", body.Trailer().Len())
+	}
+
+	body.Reset()
+	if body.Trailer().Len() != 0 {
+		t.Fatalf("trailer fields are not reset")
+	}
+}
+
+func TestChunkedBodyTrailerVerbatim(t *testing.T) {
+	trailer := "X-Checksum:  1234 \r\nproxy-status: error=1\r\nX-Long: " +
+		strings.Repeat("a", 64) + "\r\nconnection: keep-alive\r\n\r\n"
+	raw := "5\r\nhello\r\n0\r\n" + trailer
+	var body Body
+	var forwarded strings.Builder
+	//the small reader splits the trailer lines
+	if err := body.Parse(bufio.NewReaderSize(strings.NewReader(raw), 16), BodyTypeChunked, 0,
+		func(isChunkHeader bool, data []byte) error {
+			forwarded.Write(data)
+			return nil
+		}); err != nil {
+		t.Fatalf("unexpected error %s, expecting nil", err)
+	}
+	//the trailer is forwarded byte for byte, though the fields are rewritten in parsing
+	if forwarded.String() != raw {
+		t.Fatalf("unexpected body %q, expecting %q", forwarded.String(), raw)
+	}
+	if string(body.Trailer().Peek("X-Checksum")) != "1234" {
+		t.Fatalf("unexpected trailer field %q", body.Trailer().Peek("X-Checksum"))
+	}
+
+	//the trailer exceeding the header size limit
+	body.Reset()
+	body.SetLimits(&Limits{MaxHeaderSize: 32})
+	err := body.Parse(bufio.NewReader(strings.NewReader(raw)), BodyTypeChunked, 0,
+		func(isChunkHeader bool, data []byte) error { return nil })
+	if limitErr, ok := err.(*LimitError); !ok || limitErr.Limit != LimitHeaderSize {
+		t.Fatalf("unexpected error %v, expecting header size limit exceeded", err)
+	}
+}
@@ -0,0 +1,103 @@
+package http
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+var errContentDecoderClosed = errors.New("content decoder closed")
+
+// NewContentDecoder makes a writer which decodes the data written to it by the
+// content codings listed in contentEncoding, i.e. the `Content-Encoding` header
+// value, then writes the decoded data to w. gzip, deflate and br are supported.
+//
+// The data is decoded in a goroutine while it's written, so the memory used is
+// bounded regardless of the body size, the writer must be closed at the end of
+// the body, which waits for the decoded data written to w and returns the error
+// of decoding or writing to w. The writing is synchronous, so a slow w throttles
+// the writer. nil is returned if no coding is applied or any coding is unsupported.
+func NewContentDecoder(w io.Writer, contentEncoding string) io.WriteCloser {
+	var codings []string
+	for _, coding := range strings.Split(contentEncoding, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		switch coding {
+		case "", "identity":
+		case "gzip", "x-gzip", "deflate", "br":
+			codings = append(codings, coding)
+		default:
+			return nil
+		}
+	}
+	if len(codings) == 0 {
+		return nil
+	}
+
+	pr, pw := io.Pipe()
+	d := &contentDecoder{w: pw, done: make(chan struct{})}
+	go func() {
+		defer close(d.done)
+		//codings are listed in the order applied, so they're decoded reversely
+		var r io.Reader = pr
+		var err error
+		for i := len(codings) - 1; i >= 0 && err == nil; i-- {
+			r, err = newDecodingReader(codings[i], r)
+		}
+		if err == nil {
+			_, err = io.Copy(w, r)
+		}
+		d.err = err
+		if err == nil {
+			err = errContentDecoderClosed
+		}
+		//stop the writing once decoding ends
+		pr.CloseWithError(err)
+	}()
+	return d
+}
+
+//contentDecoder writes the encoded data to the decoding goroutine
+type contentDecoder struct {
+	w    *io.PipeWriter
+	done chan struct{}
+	//err error of decoding, read once done
+	err error
+}
+
+func (d *contentDecoder) Write(p []byte) (int, error) {
+	return d.w.Write(p)
+}
+
+func (d *contentDecoder) Close() error {
+	d.w.Close()
+	<-d.done
+	return d.err
+}
+
+func newDecodingReader(coding string, r io.Reader) (io.Reader, error) {
+	switch coding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		//deflate is meant to be zlib wrapped, but some servers send the raw one
+		br := bufio.NewReader(r)
+		if header, err := br.Peek(2); err == nil && isZlibHeader(header) {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	case "br":
+		return brotli.NewReader(r), nil
+	}
+	return nil, errors.New("unsupported content coding " + coding)
+}
+
+//isZlibHeader if b starts with a zlib header, RFC 1950 2.2
+func isZlibHeader(b []byte) bool {
+	return b[0]&0x0F == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
@@ -0,0 +1,82 @@
+package http
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestContentDecoder(t *testing.T) {
+	body := strings.Repeat("hello, world ", 10000)
+	encode := func(coding string, data []byte) []byte {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		switch coding {
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "deflate":
+			w = zlib.NewWriter(&buf)
+		case "raw deflate":
+			w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+		case "br":
+			w = brotli.NewWriter(&buf)
+		}
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+	for contentEncoding, encoded := range map[string][]byte{
+		"gzip":          encode("gzip", []byte(body)),
+		"x-gzip":        encode("gzip", []byte(body)),
+		"Deflate":       encode("deflate", []byte(body)),
+		"deflate":       encode("raw deflate", []byte(body)),
+		"br":            encode("br", []byte(body)),
+		"gzip, br":      encode("br", encode("gzip", []byte(body))),
+		"identity, br ": encode("br", []byte(body)),
+	} {
+		var decoded bytes.Buffer
+		d := NewContentDecoder(&decoded, contentEncoding)
+		if d == nil {
+			t.Fatalf("nil decoder of %s", contentEncoding)
+		}
+		//written in small pieces as the body is streamed
+		for i := 0; i < len(encoded); i += 100 {
+			end := i + 100
+			if end > len(encoded) {
+				end = len(encoded)
+			}
+			if _, err := d.Write(encoded[i:end]); err != nil {
+				t.Fatalf("fail to write %s body: %s", contentEncoding, err)
+			}
+		}
+		if err := d.Close(); err != nil {
+			t.Fatalf("fail to decode %s body: %s", contentEncoding, err)
+		}
+		if decoded.String() != body {
+			t.Fatalf("unexpected %s body of size %d, expecting %d", contentEncoding, decoded.Len(), len(body))
+		}
+	}
+
+	for _, contentEncoding := range []string{"", "identity", "compress", "gzip, zstd"} {
+		if NewContentDecoder(&bytes.Buffer{}, contentEncoding) != nil {
+			t.Fatalf("unexpected decoder of %q", contentEncoding)
+		}
+	}
+
+	//corrupted body fails the writing rather than blocking it
+	d := NewContentDecoder(&bytes.Buffer{}, "gzip")
+	for i := 0; i < 10; i++ {
+		if _, err := d.Write([]byte("not a gzip body")); err != nil {
+			break
+		}
+	}
+	if err := d.Close(); err == nil {
+		t.Fatalf("corrupted body is decoded")
+	}
+}
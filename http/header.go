@@ -16,15 +16,51 @@ import (
 type Header struct {
 	isConnectionClose      bool
 	isProxyConnectionClose bool
+	isConnectionUpgrade    bool
+	upgrade                string
+	trailer                string
 	contentLength          int64
 	contentType            string
+	host                   string
+	proxyAuthorization     string
+
+	//fields indexed view of all the header fields parsed, see `Peek` & `VisitAll`,
+	//whose names & values are in fieldsRaw, both are reused after reset
+	fields    []headerField
+	fieldsRaw []byte
+
+	//strict rejects the ambiguous header, see `SetStrictParsing`
+	strict  bool
+	framing strictFraming
+
+	//limits limits of parsing, nil means the default ones
+	limits *Limits
+}
+
+//headerField offsets of a header field's name & value in Header.fieldsRaw
+type headerField struct {
+	nameStart, nameEnd   int
+	valueStart, valueEnd int
 }
 
 //Reset reset header info into default val
 func (header *Header) Reset() {
 	header.isConnectionClose = false
+	header.isConnectionUpgrade = false
+	header.upgrade = ""
+	header.trailer = ""
 	header.contentLength = 0
 	header.contentType = ""
+	header.host = ""
+	header.proxyAuthorization = ""
+	header.resetFields()
+	header.strict = false
+	header.limits = nil
+}
+
+func (header *Header) resetFields() {
+	header.fields = header.fields[:0]
+	header.fieldsRaw = header.fieldsRaw[:0]
 }
 
 //IsConnectionClose is connection header set to `close`
@@ -37,11 +73,66 @@ func (header *Header) IsProxyConnectionClose() bool {
 	return header.isProxyConnectionClose
 }
 
+//IsConnectionUpgrade is connection header set with `upgrade`
+func (header *Header) IsConnectionUpgrade() bool {
+	return header.isConnectionUpgrade
+}
+
+//UpgradeConnection the `Connection` header value sent on upgrading, as the header
+//is removed in parsing, i.e. its tokens but `close` & `keep-alive` with `Upgrade`,
+//e.g. `Upgrade, HTTP2-Settings`
+func (header *Header) UpgradeConnection() string {
+	tokens := []string{"Upgrade"}
+	header.PeekAll("Connection", func(value []byte) {
+		for _, token := range strings.Split(string(value), ",") {
+			token = strings.TrimSpace(token)
+			if len(token) == 0 || strings.EqualFold(token, "upgrade") ||
+				strings.EqualFold(token, "close") || strings.EqualFold(token, "keep-alive") {
+				continue
+			}
+			tokens = append(tokens, token)
+		}
+	})
+	return strings.Join(tokens, ", ")
+}
+
+//Upgrade upgrade header value, e.g. websocket
+func (header *Header) Upgrade() string {
+	return header.upgrade
+}
+
+//Trailer `Trailer` header value, i.e. the names of the trailer fields
+//sent after a chunked body, see `Body.Trailer`
+func (header *Header) Trailer() string {
+	return header.trailer
+}
+
+//IsTrailerDeclared if the field named name is declared in the `Trailer` header
+func (header *Header) IsTrailerDeclared(name string) bool {
+	for _, declared := range strings.Split(header.trailer, ",") {
+		if strings.EqualFold(strings.TrimSpace(declared), name) {
+			return true
+		}
+	}
+	return false
+}
+
 //ContentType content type in header
 func (header *Header) ContentType() string {
 	return header.contentType
 }
 
+//Host `Host` header value
+func (header *Header) Host() string {
+	return header.host
+}
+
+//ProxyAuthorization `Proxy-Authorization` header value,
+//the header itself is removed from the raw header
+func (header *Header) ProxyAuthorization() string {
+	return header.proxyAuthorization
+}
+
 //ContentLength content length header value,
 func (header *Header) ContentLength() int64 {
 	if header.contentLength > 0 {
@@ -62,6 +153,90 @@ func (header *Header) BodyType() BodyType {
 	return BodyTypeFixedSize
 }
 
+// Len number of the header fields parsed.
+//
+// The header fields view, i.e. `Len`, `Field`, `Peek`, `PeekAll` and `VisitAll`,
+// indexes all the fields received in the original order and casing, including
+// the ones removed from the raw header, e.g. `Connection`, it's populated in
+// `ParseHeaderFields`, then the bytes returned are valid until the header is
+// reset or parsed again, which must not be modified.
+func (header *Header) Len() int {
+	return len(header.fields)
+}
+
+//Field name and value of the ith header field
+func (header *Header) Field(i int) (name, value []byte) {
+	f := header.fields[i]
+	return header.fieldsRaw[f.nameStart:f.nameEnd], header.fieldsRaw[f.valueStart:f.valueEnd]
+}
+
+//Peek value of the 1st header field named name case-insensitively, nil if not found
+func (header *Header) Peek(name string) []byte {
+	for i := range header.fields {
+		if n, v := header.Field(i); equalIgnoreCaseString(n, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+//PeekAll calls f with the value of every header field named name case-insensitively,
+//in the original order, e.g. the multiple `Set-Cookie` fields
+func (header *Header) PeekAll(name string, f func(value []byte)) {
+	for i := range header.fields {
+		if n, v := header.Field(i); equalIgnoreCaseString(n, name) {
+			f(v)
+		}
+	}
+}
+
+//VisitAll calls f with every header field in the original order and casing
+func (header *Header) VisitAll(f func(name, value []byte)) {
+	for i := range header.fields {
+		f(header.Field(i))
+	}
+}
+
+//addField indexes the raw header field line
+func (header *Header) addField(rawHeaderLine []byte) {
+	colon := bytes.IndexByte(rawHeaderLine, ':')
+	if colon <= 0 {
+		return
+	}
+	start := len(header.fieldsRaw)
+	header.fieldsRaw = append(header.fieldsRaw, rawHeaderLine...)
+	line := header.fieldsRaw[start:]
+	nameEnd := colon
+	for nameEnd > 0 && isHeaderSpace(line[nameEnd-1]) {
+		nameEnd--
+	}
+	valueStart, valueEnd := colon+1, len(line)
+	for valueStart < valueEnd && isHeaderSpace(line[valueStart]) {
+		valueStart++
+	}
+	for valueEnd > valueStart && (isHeaderSpace(line[valueEnd-1]) ||
+		line[valueEnd-1] == '\r' || line[valueEnd-1] == '\n') {
+		valueEnd--
+	}
+	header.fields = append(header.fields, headerField{
+		nameStart:  start,
+		nameEnd:    start + nameEnd,
+		valueStart: start + valueStart,
+		valueEnd:   start + valueEnd,
+	})
+}
+
+//isHeaderSpace if c is an optional whitespace around header field values
+func isHeaderSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+//SetLimits set the limits of `ParseHeaderFields`, nil means the default ones,
+//a *LimitError is returned if the header size or the header count exceeds
+func (header *Header) SetLimits(limits *Limits) {
+	header.limits = limits
+}
+
 /*
 //IsBodyChunked if body is set `chunked`
 func (header *Header) IsBodyChunked() bool {
@@ -84,19 +259,31 @@ func (header *Header) IsBodyIdentity() bool {
 func (header *Header) ParseHeaderFields(reader *bufio.Reader,
 	buffer *bytebufferpool.ByteBuffer) (int, error) {
 	originalLen := buffer.Len()
+	maxSize := header.limits.max(LimitHeaderSize)
 	n := 1
 	readSize := 0
 	for {
 		rn, err := header.tryRead(reader, buffer, n)
 		readSize += rn
 		if err == nil {
+			if maxSize >= 0 && rn > maxSize {
+				return readSize, &LimitError{Limit: LimitHeaderSize, Max: maxSize}
+			}
 			return readSize, nil
 		}
 		buffer.B = buffer.B[:originalLen]
 		if err != errNeedMore {
+			//the header fields don't fit in the reader's buffer
+			if err == bufio.ErrBufferFull {
+				return readSize, &LimitError{Limit: LimitHeaderSize, Max: reader.Size()}
+			}
 			return readSize, err
 		}
 		n = reader.Buffered() + 1
+		//the header fields buffered are incomplete already
+		if maxSize >= 0 && n > maxSize {
+			return readSize, &LimitError{Limit: LimitHeaderSize, Max: maxSize}
+		}
 	}
 }
 
@@ -130,24 +317,43 @@ func (header *Header) tryRead(reader *bufio.Reader,
 
 func (header *Header) readHeaders(buf []byte,
 	buffer *bytebufferpool.ByteBuffer) (_headerLength int, _err error) {
+	//the fields indexed in the last try are dropped
+	header.resetFields()
+	header.framing.reset()
+	maxCount := header.limits.max(LimitHeaderCount)
+	count := 0
 	parseThenWriteBuffer := func(rawHeaderLine []byte) error {
+		if count++; maxCount >= 0 && count > maxCount {
+			return &LimitError{Limit: LimitHeaderCount, Max: maxCount}
+		}
+		if header.strict {
+			if err := header.checkStrictLine(rawHeaderLine); err != nil {
+				return err
+			}
+		}
+		//index the field before it's changed, e.g. `Connection` in lower case
+		header.addField(rawHeaderLine)
+
 		// Connection, Authenticate and Authorization are single hop Header:
 		// http://www.w3.org/Protocols/rfc2616/rfc2616.txt
 		// 14.10 Connection
 		//   The Connection general-header field allows the sender to specify
 		//   options that are desired for that particular connection and MUST NOT
 		//   be communicated by proxies over further connections.
+		//the line is matched case-insensitively rather than changed in place,
+		//as it's read again from reader if more data is needed
 		if isConnectionHeader(rawHeaderLine) {
-			changeToLowerCase(rawHeaderLine)
-			if bytes.Contains(rawHeaderLine, []byte("close")) {
+			if containsIgnoreCase(rawHeaderLine, "close") {
 				header.isConnectionClose = true
 			}
+			if containsIgnoreCase(rawHeaderLine, "upgrade") {
+				header.isConnectionUpgrade = true
+			}
 			return nil
 		}
 
 		if isProxyConnectionHeader(rawHeaderLine) {
-			changeToLowerCase(rawHeaderLine)
-			if bytes.Contains(rawHeaderLine, []byte("close")) {
+			if containsIgnoreCase(rawHeaderLine, "close") {
 				header.isProxyConnectionClose = true
 			}
 			return nil
@@ -181,6 +387,38 @@ func (header *Header) readHeaders(buf []byte,
 					string(rawHeaderLine[contentTypeBytesIndex+1:]),
 				)
 			}
+		} else if isUpgradeHeader(rawHeaderLine) {
+			upgradeBytesIndex := bytes.IndexByte(rawHeaderLine, ':')
+			if upgradeBytesIndex >= 0 {
+				header.upgrade = strings.TrimSpace(
+					string(rawHeaderLine[upgradeBytesIndex+1:]),
+				)
+			}
+		} else if isTrailerHeader(rawHeaderLine) {
+			trailerBytesIndex := bytes.IndexByte(rawHeaderLine, ':')
+			if trailerBytesIndex >= 0 {
+				trailer := strings.TrimSpace(string(rawHeaderLine[trailerBytesIndex+1:]))
+				if len(header.trailer) > 0 {
+					trailer = header.trailer + ", " + trailer
+				}
+				header.trailer = trailer
+			}
+		} else if isHostHeader(rawHeaderLine) {
+			hostBytesIndex := bytes.IndexByte(rawHeaderLine, ':')
+			if hostBytesIndex >= 0 {
+				header.host = strings.TrimSpace(
+					string(rawHeaderLine[hostBytesIndex+1:]),
+				)
+			}
+		}
+		//keep the proxy credentials before removing the proxy header
+		if isProxyAuthorizationHeader(rawHeaderLine) {
+			authIndex := bytes.IndexByte(rawHeaderLine, ':')
+			if authIndex > 0 {
+				header.proxyAuthorization = strings.TrimSpace(
+					string(rawHeaderLine[authIndex+1:]),
+				)
+			}
 		}
 		//remove proxy header
 		if !isProxyHeader(rawHeaderLine) {
@@ -196,7 +434,11 @@ func (header *Header) readHeaders(buf []byte,
 	}
 	if (n == 1 && buf[0] == '\r') || n == 0 {
 		// empty headers
-		return n + 1, nil
+		if header.strict && n == 0 {
+			return 0, reject(RejectBareLF)
+		}
+		//the empty line is kept to terminate the header written
+		return n + 1, util.WriteWithValidation(buffer, buf[:n+1])
 	}
 	n++
 	if e := parseThenWriteBuffer(buf[:n]); e != nil {
@@ -213,12 +455,20 @@ func (header *Header) readHeaders(buf []byte,
 			return 0, errNeedMore
 		}
 		m++
-		if e := parseThenWriteBuffer(b[:m]); e != nil {
-			return 0, e
-		}
 		n += m
 		if (m == 2 && b[0] == '\r') || m == 1 {
-			return n, nil
+			if header.strict {
+				if m == 1 {
+					return 0, reject(RejectBareLF)
+				}
+				if e := header.checkStrictFraming(); e != nil {
+					return 0, e
+				}
+			}
+			return n, util.WriteWithValidation(buffer, b[:m])
+		}
+		if e := parseThenWriteBuffer(b[:m]); e != nil {
+			return 0, e
 		}
 	}
 }
@@ -254,6 +504,32 @@ func isProxyConnectionHeader(header []byte) bool {
 	return hasPrefixIgnoreCase(header, proxyConnectionHeader)
 }
 
+var hostHeader = []byte("Host:")
+
+func isHostHeader(header []byte) bool {
+	return hasPrefixIgnoreCase(header, hostHeader)
+}
+
+//upgradeHeader colon included, so `Upgrade-Insecure-Requests` is not matched
+var upgradeHeader = []byte("Upgrade:")
+
+func isUpgradeHeader(header []byte) bool {
+	return hasPrefixIgnoreCase(header, upgradeHeader)
+}
+
+//trailerHeader colon included, so `Trailers` is not matched
+var trailerHeader = []byte("Trailer:")
+
+func isTrailerHeader(header []byte) bool {
+	return hasPrefixIgnoreCase(header, trailerHeader)
+}
+
+var proxyAuthorizationHeader = []byte("Proxy-Authorization")
+
+func isProxyAuthorizationHeader(header []byte) bool {
+	return hasPrefixIgnoreCase(header, proxyAuthorizationHeader)
+}
+
 var contentLengthHeader = []byte("Content-Length")
 
 func isContentLengthHeader(header []byte) bool {
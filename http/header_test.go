@@ -0,0 +1,142 @@
+package http
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/haxii/fastproxy/bytebufferpool"
+)
+
+func TestHeaderFields(t *testing.T) {
+	raw := "Host: example.com\r\nUser-Agent:  curl/7.0 \r\nSet-Cookie: a=1\r\n" +
+		"Connection: Keep-Alive\r\nset-cookie: b=2\n\r\n"
+	var header Header
+	//read byte by byte, so the fields are parsed in several tries
+	buffer := bytebufferpool.Get()
+	defer bytebufferpool.Put(buffer)
+	if _, err := header.ParseHeaderFields(bufio.NewReader(iotest.OneByteReader(strings.NewReader(raw))), buffer); err != nil {
+		t.Fatalf("unexpected error %s, expecting nil", err)
+	}
+
+	if header.Len() != 5 {
+		t.Fatalf("unexpected field count %d, expecting 5", header.Len())
+	}
+	if v := header.Peek("user-agent"); string(v) != "curl/7.0" {
+		t.Fatalf("unexpected User-Agent %q", v)
+	}
+	if v := header.Peek("Cookie"); v != nil {
+		t.Fatalf("unexpected Cookie %q", v)
+	}
+	var cookies []string
+	header.PeekAll("SET-COOKIE", func(value []byte) {
+		cookies = append(cookies, string(value))
+	})
+	if strings.Join(cookies, ";") != "a=1;b=2" {
+		t.Fatalf("unexpected Set-Cookie %q", cookies)
+	}
+	var fields []string
+	header.VisitAll(func(name, value []byte) {
+		fields = append(fields, string(name)+"="+string(value))
+	})
+	//the original casing is kept, even of the `Connection` removed from raw header
+	if strings.Join(fields, ",") != "Host=example.com,User-Agent=curl/7.0,"+
+		"Set-Cookie=a=1,Connection=Keep-Alive,set-cookie=b=2" {
+		t.Fatalf("unexpected fields %q", fields)
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		header.Peek("set-cookie")
+		header.VisitAll(func(name, value []byte) {})
+	}); allocs > 0 {
+		t.Fatalf("unexpected allocations %v", allocs)
+	}
+
+	header.Reset()
+	if header.Len() != 0 || header.Peek("Host") != nil {
+		t.Fatalf("header fields are not reset")
+	}
+}
+
+func TestHeaderUpgradeConnection(t *testing.T) {
+	tests := []struct {
+		raw string
+		exp string
+	}{
+		{"Connection: Upgrade\r\n\r\n", "Upgrade"},
+		{"Connection: keep-alive, upgrade, HTTP2-Settings\r\n\r\n", "Upgrade, HTTP2-Settings"},
+		//the tokens of multiple fields are merged
+		{"Connection: Upgrade\r\nconnection: close , X-Token\r\n\r\n", "Upgrade, X-Token"},
+	}
+	for _, test := range tests {
+		var header Header
+		buffer := bytebufferpool.Get()
+		if _, err := header.ParseHeaderFields(bufio.NewReader(strings.NewReader(test.raw)), buffer); err != nil {
+			t.Fatalf("fail to parse %q: %s", test.raw, err)
+		}
+		bytebufferpool.Put(buffer)
+		if v := header.UpgradeConnection(); v != test.exp {
+			t.Fatalf("unexpected Connection %q of %q, expecting %q", v, test.raw, test.exp)
+		}
+	}
+}
+
+func TestHeaderEmpty(t *testing.T) {
+	//e.g. the header of `100 Continue`
+	var header Header
+	buffer := bytebufferpool.Get()
+	defer bytebufferpool.Put(buffer)
+	if _, err := header.ParseHeaderFields(bufio.NewReader(strings.NewReader("\r\nbody")), buffer); err != nil {
+		t.Fatalf("unexpected error %s, expecting nil", err)
+	}
+	if header.Len() != 0 || string(buffer.B) != "\r\n" {
+		t.Fatalf("unexpected header %d %q, expecting the empty line only", header.Len(), buffer.B)
+	}
+}
+
+func TestHeaderStrictParsing(t *testing.T) {
+	parse := func(raw string) (*Header, error) {
+		header := &Header{}
+		header.SetStrictParsing(true)
+		buffer := bytebufferpool.Get()
+		defer bytebufferpool.Put(buffer)
+		_, err := header.ParseHeaderFields(bufio.NewReader(strings.NewReader(raw)), buffer)
+		return header, err
+	}
+
+	rejected := map[string]RejectReason{
+		"Content-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n": RejectContentLengthWithTransferEncoding,
+		"Content-Length: 5\r\nContent-Length: 6\r\n\r\n":          RejectDuplicateContentLength,
+		"Content-Length: 5, 6\r\n\r\n":                            RejectDuplicateContentLength,
+		"Content-Length: +5\r\n\r\n":                              RejectInvalidContentLength,
+		"Content-Length: 5x\r\n\r\n":                              RejectInvalidContentLength,
+		"X-Folded: a\r\n b\r\n\r\n":                               RejectObsFold,
+		"Content-Length : 5\r\n\r\n":                              RejectInvalidFieldName,
+		"X Header: a\r\n\r\n":                                     RejectInvalidFieldName,
+		"Transfer-Encoding: chunked, gzip\r\n\r\n":                RejectNonChunkedTransferEncoding,
+		"Transfer-Encoding: identity\r\n\r\n":                     RejectNonChunkedTransferEncoding,
+		"Host: example.com\n\r\n":                                 RejectBareLF,
+		"Host: example.com\r\n\n":                                 RejectBareLF,
+	}
+	for raw, reason := range rejected {
+		_, err := parse(raw)
+		if rejectErr, ok := err.(*RejectError); !ok || rejectErr.Reason != reason {
+			t.Fatalf("unexpected error %v of %q, expecting %s", err, raw, reason)
+		}
+	}
+
+	header, err := parse("Content-Lengthx: 5\r\nContent-Length: 7, 7\r\n\r\n")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if header.BodyType() != BodyTypeFixedSize || header.ContentLength() != 7 {
+		t.Fatalf("unexpected content length %d", header.ContentLength())
+	}
+	header, err = parse("Transfer-Encoding: gzip\r\nTransfer-Encoding: Chunked\r\n\r\n")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if header.BodyType() != BodyTypeChunked {
+		t.Fatalf("unexpected body type %d", header.BodyType())
+	}
+}
@@ -0,0 +1,161 @@
+package http
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+//Limit a limit of parsing a http message, which bounds the memory used
+type Limit int
+
+const (
+	//LimitStartLineSize limits the size of the request line or the status line
+	LimitStartLineSize Limit = iota
+	//LimitHeaderSize limits the size of the header fields
+	LimitHeaderSize
+	//LimitHeaderCount limits the number of the header fields
+	LimitHeaderCount
+	//LimitChunkExtensionSize limits the size of the extensions of a chunk
+	LimitChunkExtensionSize
+	//LimitInterimCount limits the number of the interim 1xx responses before the final one
+	LimitInterimCount
+
+	//NumLimits number of the limits
+	NumLimits
+)
+
+const (
+	//DefaultMaxStartLineSize default max size of the start line, CRLF included
+	DefaultMaxStartLineSize = 8 * 1024
+	//DefaultMaxHeaderSize default max size of the header fields
+	DefaultMaxHeaderSize = 64 * 1024
+	//DefaultMaxHeaderCount default max number of the header fields
+	DefaultMaxHeaderCount = 100
+	//DefaultMaxChunkExtensionSize default max size of the extensions of a chunk
+	DefaultMaxChunkExtensionSize = 1024
+	//DefaultMaxInterimCount default max number of the interim responses
+	DefaultMaxInterimCount = 5
+)
+
+var limitNames = [NumLimits]string{
+	LimitStartLineSize:      "start line size",
+	LimitHeaderSize:         "header size",
+	LimitHeaderCount:        "header count",
+	LimitChunkExtensionSize: "chunk extension size",
+	LimitInterimCount:       "interim response count",
+}
+
+func (l Limit) String() string {
+	if l < 0 || l >= NumLimits {
+		return "unknown limit " + strconv.Itoa(int(l))
+	}
+	return limitNames[l]
+}
+
+//Limits limits of parsing a http message, the default limit is used if a
+//limit is not set, i.e. zero, a negative limit means unlimited.
+type Limits struct {
+	//MaxStartLineSize max size of the request line or the status line, CRLF included
+	MaxStartLineSize int
+
+	//MaxHeaderSize max size of the header fields, the empty line ending them included,
+	//the header fields must fit in the buffer of the reader as well
+	MaxHeaderSize int
+
+	//MaxHeaderCount max number of the header fields
+	MaxHeaderCount int
+
+	//MaxChunkExtensionSize max size of the extensions of a chunk, e.g. `;name=value`
+	MaxChunkExtensionSize int
+
+	//MaxInterimCount max number of the interim 1xx responses, e.g. `100 Continue`
+	//and `103 Early Hints`, read before the final response
+	MaxInterimCount int
+}
+
+//max the max value of limit, nil limits means the default ones,
+//negative means unlimited
+func (l *Limits) max(limit Limit) int {
+	var max int
+	if l != nil {
+		switch limit {
+		case LimitStartLineSize:
+			max = l.MaxStartLineSize
+		case LimitHeaderSize:
+			max = l.MaxHeaderSize
+		case LimitHeaderCount:
+			max = l.MaxHeaderCount
+		case LimitChunkExtensionSize:
+			max = l.MaxChunkExtensionSize
+		case LimitInterimCount:
+			max = l.MaxInterimCount
+		}
+	}
+	if max != 0 {
+		return max
+	}
+	switch limit {
+	case LimitStartLineSize:
+		return DefaultMaxStartLineSize
+	case LimitHeaderSize:
+		return DefaultMaxHeaderSize
+	case LimitHeaderCount:
+		return DefaultMaxHeaderCount
+	case LimitChunkExtensionSize:
+		return DefaultMaxChunkExtensionSize
+	case LimitInterimCount:
+		return DefaultMaxInterimCount
+	}
+	return -1
+}
+
+//CheckInterimCount returns a *LimitError if count interim responses read
+//exceeds the limit, nil limits means the default ones
+func (l *Limits) CheckInterimCount(count int) error {
+	if max := l.max(LimitInterimCount); max >= 0 && count > max {
+		return &LimitError{Limit: LimitInterimCount, Max: max}
+	}
+	return nil
+}
+
+//LimitError error returned when a limit is exceeded in parsing
+type LimitError struct {
+	Limit Limit
+	//Max the max value of the limit exceeded
+	Max int
+}
+
+func (e *LimitError) Error() string {
+	return "http message exceeds the max " + e.Limit.String() + " " + strconv.Itoa(e.Max)
+}
+
+//LimitCounter counts the messages exceeding each limit,
+//it's safe to be used concurrently
+type LimitCounter struct {
+	counts [NumLimits]uint64
+}
+
+//Add counts a message exceeding limit, nil counter counts nothing
+func (c *LimitCounter) Add(limit Limit) {
+	if c == nil || limit < 0 || limit >= NumLimits {
+		return
+	}
+	atomic.AddUint64(&c.counts[limit], 1)
+}
+
+//Get number of the messages exceeding limit
+func (c *LimitCounter) Get(limit Limit) uint64 {
+	if c == nil || limit < 0 || limit >= NumLimits {
+		return 0
+	}
+	return atomic.LoadUint64(&c.counts[limit])
+}
+
+//Total number of the messages exceeding any limit
+func (c *LimitCounter) Total() uint64 {
+	var total uint64
+	for limit := Limit(0); limit < NumLimits; limit++ {
+		total += c.Get(limit)
+	}
+	return total
+}
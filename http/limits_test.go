@@ -0,0 +1,72 @@
+package http
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/haxii/fastproxy/bytebufferpool"
+)
+
+func TestLimits(t *testing.T) {
+	limits := &Limits{
+		MaxStartLineSize:      32,
+		MaxHeaderSize:         64,
+		MaxHeaderCount:        2,
+		MaxChunkExtensionSize: 8,
+		MaxInterimCount:       2,
+	}
+	expectLimit := func(err error, limit Limit) {
+		t.Helper()
+		if limitErr, ok := err.(*LimitError); !ok || limitErr.Limit != limit {
+			t.Fatalf("unexpected error %v, expecting exceeding %s", err, limit)
+		}
+	}
+
+	var reqLine RequestLine
+	err := reqLine.ParseWithLimits(bufio.NewReader(strings.NewReader(
+		"GET /"+strings.Repeat("a", 32)+" HTTP/1.1\r\n")), limits)
+	expectLimit(err, LimitStartLineSize)
+	//the line longer than the reader's buffer is read as well
+	err = reqLine.ParseWithLimits(bufio.NewReaderSize(strings.NewReader(
+		"GET /"+strings.Repeat("a", 32)+" HTTP/1.1\r\n"), 16), nil)
+	if err != nil || len(reqLine.PathWithQueryFragment()) != 33 {
+		t.Fatalf("unexpected error %v of request line %q", err, reqLine.GetRequestLine())
+	}
+
+	parseHeader := func(raw string) error {
+		var header Header
+		header.SetLimits(limits)
+		buffer := bytebufferpool.Get()
+		defer bytebufferpool.Put(buffer)
+		_, err := header.ParseHeaderFields(bufio.NewReader(strings.NewReader(raw)), buffer)
+		return err
+	}
+	expectLimit(parseHeader("X-Long: "+strings.Repeat("a", 64)+"\r\n\r\n"), LimitHeaderSize)
+	expectLimit(parseHeader("X-Long: "+strings.Repeat("a", 64)), LimitHeaderSize)
+	expectLimit(parseHeader("A: 1\r\nB: 2\r\nC: 3\r\n\r\n"), LimitHeaderCount)
+	if err := parseHeader("A: 1\r\nB: 2\r\n\r\n"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	var body Body
+	body.SetLimits(limits)
+	parseBody := func(raw string) error {
+		return body.Parse(bufio.NewReader(strings.NewReader(raw)), BodyTypeChunked, 0,
+			func(bool, []byte) error { return nil })
+	}
+	expectLimit(parseBody("1;name=value\r\na\r\n0\r\n\r\n"), LimitChunkExtensionSize)
+	if err := parseBody("1;a=b\r\na\r\n0\r\n\r\n"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	expectLimit(limits.CheckInterimCount(3), LimitInterimCount)
+	if err := limits.CheckInterimCount(2); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	var defaultLimits *Limits
+	expectLimit(defaultLimits.CheckInterimCount(DefaultMaxInterimCount+1), LimitInterimCount)
+	if err := (&Limits{MaxInterimCount: -1}).CheckInterimCount(1 << 20); err != nil {
+		t.Fatalf("unexpected error %s of unlimited interim count", err)
+	}
+}
@@ -38,6 +38,26 @@ func (l *ResponseLine) GetStatusMessage() []byte {
 	return l.statusMsg
 }
 
+//SetStatus replaces the status code and message then rebuilds the full line,
+//the standard message of statusCode is used if statusMsg is empty
+func (l *ResponseLine) SetStatus(statusCode int, statusMsg string) {
+	if len(statusMsg) == 0 {
+		statusMsg = StatusMessage(statusCode)
+	}
+	fullLine := make([]byte, 0, len(l.protocol)+len(statusMsg)+7)
+	fullLine = append(fullLine, l.protocol...)
+	fullLine = append(fullLine, ' ')
+	fullLine = strconv.AppendInt(fullLine, int64(statusCode), 10)
+	fullLine = append(fullLine, ' ')
+	fullLine = append(fullLine, statusMsg...)
+	fullLine = append(fullLine, "\r\n"...)
+
+	l.fullLine = fullLine
+	l.protocol = fullLine[:len(l.protocol)]
+	l.statusCode = statusCode
+	l.statusMsg = fullLine[len(fullLine)-len(statusMsg)-2 : len(fullLine)-2]
+}
+
 //Reset reset response line
 func (l *ResponseLine) Reset() {
 	l.fullLine = l.fullLine[:0]
@@ -62,7 +82,12 @@ var (
 // result of the server's attempt to understand and satisfy the client's
 // corresponding request
 func (l *ResponseLine) Parse(reader *bufio.Reader) error {
-	respLineWithCRLF, err := parseStartline(reader)
+	return l.ParseWithLimits(reader, nil)
+}
+
+//ParseWithLimits parse response line within the limits, nil means the default ones
+func (l *ResponseLine) ParseWithLimits(reader *bufio.Reader, limits *Limits) error {
+	respLineWithCRLF, err := parseStartline(reader, limits.max(LimitStartLineSize))
 	if err != nil {
 		return err
 	}
@@ -98,6 +123,21 @@ func (l *ResponseLine) Parse(reader *bufio.Reader) error {
 	return nil
 }
 
+//PeekStatusCode peeks the status code of the status line next in reader without
+//reading it, 0 is returned if it's not a valid status line, which is left for parsing
+func PeekStatusCode(reader *bufio.Reader) (int, error) {
+	const statusCodeEnd = len("HTTP/1.1 100")
+	b, err := reader.Peek(statusCodeEnd)
+	if err != nil {
+		return 0, err
+	}
+	statusCode, err := strconv.Atoi(string(b[statusCodeEnd-3:]))
+	if err != nil {
+		return 0, nil
+	}
+	return statusCode, nil
+}
+
 //RequestLine start line of a http request
 type RequestLine struct {
 	fullLine []byte
@@ -122,7 +162,12 @@ func ParseRequestLine(reader *bufio.Reader) (*RequestLine, error) {
 // (SP), the request-target, another single space (SP), the protocol
 // version, and ends with CRLF.
 func (l *RequestLine) Parse(reader *bufio.Reader) error {
-	reqLineWithCRLF, err := parseStartline(reader)
+	return l.ParseWithLimits(reader, nil)
+}
+
+//ParseWithLimits parse request line within the limits, nil means the default ones
+func (l *RequestLine) ParseWithLimits(reader *bufio.Reader, limits *Limits) error {
+	reqLineWithCRLF, err := parseStartline(reader, limits.max(LimitStartLineSize))
 	if err != nil {
 		return err
 	}
@@ -186,6 +231,11 @@ func (l *RequestLine) PathWithQueryFragment() []byte {
 	return l.uri.PathWithQueryFragment()
 }
 
+//RequestURI the request-target as sent, e.g. the absolute-form `http://host/path`
+func (l *RequestLine) RequestURI() []byte {
+	return l.uri.Full()
+}
+
 //Protocol HTTP/1.0, HTTP/1.1 etc.
 func (l *RequestLine) Protocol() []byte {
 	return l.protocol
@@ -196,10 +246,23 @@ func (l *RequestLine) HostWithPort() string {
 	return l.uri.HostWithPort()
 }
 
-func parseStartline(reader *bufio.Reader) ([]byte, error) {
-	startLineWithCRLF, err := reader.ReadBytes('\n')
-	if err != nil {
-		return nil, util.ErrWrapper(err, "fail to read start line")
+//parseStartline reads the start line no longer than maxSize,
+//negative maxSize means unlimited
+func parseStartline(reader *bufio.Reader, maxSize int) ([]byte, error) {
+	//do NOT use reader.ReadBytes here, which reads the line of any size
+	var startLineWithCRLF []byte
+	for {
+		b, err := reader.ReadSlice('\n')
+		if maxSize >= 0 && len(startLineWithCRLF)+len(b) > maxSize {
+			return nil, &LimitError{Limit: LimitStartLineSize, Max: maxSize}
+		}
+		startLineWithCRLF = append(startLineWithCRLF, b...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, util.ErrWrapper(err, "fail to read start line")
+		}
 	}
 	if len(startLineWithCRLF) <= 2 {
 		return nil, errors.New("not a http start line")
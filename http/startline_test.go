@@ -46,3 +46,20 @@ func testRespLineParse(t *testing.T, line string, expErr error, expProtocol stri
 		t.Fatalf("unexpected status msg %s, expecting %s,", resp.GetStatusMessage(), expMsg)
 	}
 }
+
+func TestRespLineSetStatus(t *testing.T) {
+	resp := &ResponseLine{}
+	if err := resp.Parse(bufio.NewReader(strings.NewReader("HTTP/1.1 200 OK\r\n"))); err != nil {
+		t.Fatalf("unexpected error %s, expecting nil", err)
+	}
+	resp.SetStatus(404, "")
+	if string(resp.GetResponseLine()) != "HTTP/1.1 404 Not Found\r\n" {
+		t.Fatalf("unexpected response line %q", resp.GetResponseLine())
+	}
+	resp.SetStatus(299, "Custom")
+	if string(resp.GetResponseLine()) != "HTTP/1.1 299 Custom\r\n" ||
+		string(resp.GetProtocol()) != "HTTP/1.1" || resp.GetStatusCode() != 299 ||
+		string(resp.GetStatusMessage()) != "Custom" {
+		t.Fatalf("unexpected response line %q", resp.GetResponseLine())
+	}
+}
@@ -0,0 +1,205 @@
+package http
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+//RejectReason why a header is rejected by the strict parsing,
+//which is ambiguous under RFC 7230 and may be used in request smuggling
+type RejectReason int
+
+const (
+	//RejectContentLengthWithTransferEncoding both `Content-Length` and `Transfer-Encoding` are set
+	RejectContentLengthWithTransferEncoding RejectReason = iota
+	//RejectDuplicateContentLength multiple differing `Content-Length` values are set
+	RejectDuplicateContentLength
+	//RejectInvalidContentLength `Content-Length` value is not a decimal number
+	RejectInvalidContentLength
+	//RejectObsFold a header field value is folded into multiple lines
+	RejectObsFold
+	//RejectInvalidFieldName a header field name is empty or not a token,
+	//e.g. whitespace between the field name and colon
+	RejectInvalidFieldName
+	//RejectNonChunkedTransferEncoding the final transfer coding is not `chunked`
+	RejectNonChunkedTransferEncoding
+	//RejectBareLF a header line is ended with LF rather than CRLF
+	RejectBareLF
+
+	//NumRejectReasons number of the reject reasons
+	NumRejectReasons
+)
+
+var rejectReasonNames = [NumRejectReasons]string{
+	RejectContentLengthWithTransferEncoding: "Content-Length with Transfer-Encoding",
+	RejectDuplicateContentLength:            "duplicate Content-Length",
+	RejectInvalidContentLength:              "invalid Content-Length",
+	RejectObsFold:                           "obsolete line folding",
+	RejectInvalidFieldName:                  "invalid header field name",
+	RejectNonChunkedTransferEncoding:        "non-chunked final transfer coding",
+	RejectBareLF:                            "bare LF line ending",
+}
+
+func (r RejectReason) String() string {
+	if r < 0 || r >= NumRejectReasons {
+		return "unknown reason " + strconv.Itoa(int(r))
+	}
+	return rejectReasonNames[r]
+}
+
+//RejectError error returned by `ParseHeaderFields` in strict mode
+type RejectError struct {
+	Reason RejectReason
+}
+
+func (e *RejectError) Error() string {
+	return "header rejected by strict parsing: " + e.Reason.String()
+}
+
+func reject(reason RejectReason) error {
+	return &RejectError{Reason: reason}
+}
+
+//strictFraming the framing headers parsed in strict mode
+type strictFraming struct {
+	//contentLength -1 means no `Content-Length` is set
+	contentLength    int64
+	transferEncoding bool
+	//chunked if the final transfer coding is chunked
+	chunked bool
+}
+
+func (f *strictFraming) reset() {
+	f.contentLength = -1
+	f.transferEncoding = false
+	f.chunked = false
+}
+
+//SetStrictParsing rejects the header ambiguous under RFC 7230 with a
+//*RejectError in `ParseHeaderFields`, rather than guessing what's meant.
+//The `Content-Length` & `Transfer-Encoding` fields are matched by the exact
+//name then, and the framing is parsed from them strictly.
+func (header *Header) SetStrictParsing(strict bool) {
+	header.strict = strict
+}
+
+//checkStrictLine checks the raw header line in strict mode
+func (header *Header) checkStrictLine(rawHeaderLine []byte) error {
+	if !bytes.HasSuffix(rawHeaderLine, crlf) {
+		return reject(RejectBareLF)
+	}
+	if isHeaderSpace(rawHeaderLine[0]) {
+		return reject(RejectObsFold)
+	}
+	colon := bytes.IndexByte(rawHeaderLine, ':')
+	if colon <= 0 {
+		return reject(RejectInvalidFieldName)
+	}
+	name := rawHeaderLine[:colon]
+	for _, c := range name {
+		if !isTokenChar(c) {
+			return reject(RejectInvalidFieldName)
+		}
+	}
+	value := bytes.TrimRight(rawHeaderLine[colon+1:], "\r\n")
+	value = bytes.Trim(value, " \t")
+	switch {
+	case equalIgnoreCase(name, contentLengthHeader):
+		return header.framing.addContentLength(value)
+	case equalIgnoreCase(name, transferEncoding):
+		header.framing.addTransferEncoding(value)
+	}
+	return nil
+}
+
+//addContentLength adds the `Content-Length` value, the same values are allowed
+//to be repeated, either in multiple fields or a comma-separated list
+func (f *strictFraming) addContentLength(value []byte) error {
+	for _, v := range bytes.Split(value, comma) {
+		v = bytes.Trim(v, " \t")
+		if len(v) == 0 {
+			return reject(RejectInvalidContentLength)
+		}
+		for _, c := range v {
+			if c < '0' || c > '9' {
+				return reject(RejectInvalidContentLength)
+			}
+		}
+		length, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return reject(RejectInvalidContentLength)
+		}
+		if f.contentLength >= 0 && f.contentLength != length {
+			return reject(RejectDuplicateContentLength)
+		}
+		f.contentLength = length
+	}
+	return nil
+}
+
+//addTransferEncoding adds the `Transfer-Encoding` value, codings of the
+//multiple fields are applied in order, so the last one is the final coding
+func (f *strictFraming) addTransferEncoding(value []byte) {
+	f.transferEncoding = true
+	codings := bytes.Split(value, comma)
+	final := bytes.Trim(codings[len(codings)-1], " \t")
+	f.chunked = equalIgnoreCaseString(final, "chunked")
+}
+
+//checkStrictFraming checks the framing headers once all the fields parsed,
+//then the framing parsed by prefix is replaced by the strict one
+func (header *Header) checkStrictFraming() error {
+	f := &header.framing
+	if f.transferEncoding {
+		if f.contentLength >= 0 {
+			return reject(RejectContentLengthWithTransferEncoding)
+		}
+		if !f.chunked {
+			return reject(RejectNonChunkedTransferEncoding)
+		}
+		header.contentLength = -1
+	} else if f.contentLength >= 0 {
+		header.contentLength = f.contentLength
+	} else {
+		header.contentLength = 0
+	}
+	return nil
+}
+
+var (
+	crlf  = []byte("\r\n")
+	comma = []byte(",")
+)
+
+//isTokenChar if c is allowed in a token, e.g. a field name, RFC 7230 3.2.6
+func isTokenChar(c byte) bool {
+	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+//IsToken if s is a non-empty token, e.g. a valid method or field name, RFC 7230 3.2.6
+func IsToken(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+//IsFieldValue if s is a valid field value, i.e. it has no control characters
+//but HTAB, so CR & LF can't end the field and inject other ones, RFC 7230 3.2
+func IsFieldValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
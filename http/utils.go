@@ -18,13 +18,14 @@ func changeToUpperCase(s []byte) {
 	}
 }
 
-func changeToLowerCase(s []byte) {
-	for i, b := range s {
-		if 'A' <= b && b <= 'Z' {
-			b += 'a' - 'A'
-			s[i] = b
+//containsIgnoreCase if sub is within s case-insensitively
+func containsIgnoreCase(s []byte, sub string) bool {
+	for i := 0; i+len(sub) <= len(s); i++ {
+		if equalIgnoreCaseString(s[i:i+len(sub)], sub) {
+			return true
 		}
 	}
+	return false
 }
 
 func hasPrefixIgnoreCase(s, prefix []byte) bool {
@@ -58,3 +59,27 @@ func equalIgnoreCase(a, b []byte) bool {
 	}
 	return true
 }
+
+//equalIgnoreCaseString same as equalIgnoreCase, but b is a string,
+//so it's compared without allocation
+func equalIgnoreCaseString(a []byte, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, _a := range a {
+		_b := b[i]
+		if _a == _b {
+			continue
+		}
+		if 'A' <= _a && _a <= 'Z' {
+			_a += 'a' - 'A'
+		}
+		if 'A' <= _b && _b <= 'Z' {
+			_b += 'a' - 'A'
+		}
+		if _a != _b {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/util"
+)
+
+var expectContinue = []byte("100-continue")
+
+//ExpectContinue if the request's `Expect` header is `100-continue`, i.e. the client
+//waits for the `100 Continue` response before sending the body
+func (r *Request) ExpectContinue() bool {
+	return bytes.EqualFold(bytes.TrimSpace(r.header.Peek("Expect")), expectContinue)
+}
+
+//SetDropInterim drops the interim 1xx responses rather than writing them,
+//e.g. for a HTTP/1.0 client which doesn't understand them
+func (r *Response) SetDropInterim(drop bool) {
+	r.dropInterim = drop
+}
+
+//ReadContinueFrom reads the interim responses sent before the request body
+//until `100 Continue` is read, or the final response is next, which is left
+//for `ReadFrom`, returns if `100 Continue` is read
+func (r *Response) ReadContinueFrom(reader *bufio.Reader) (bool, error) {
+	for {
+		statusCode, err := http.PeekStatusCode(reader)
+		if err != nil {
+			return false, util.ErrWrapper(err, "fail to read start line of response")
+		}
+		if !isInterimStatus(statusCode) {
+			return false, nil
+		}
+		if err := r.checkLimit(r.respLine.ParseWithLimits(reader, r.limits)); err != nil {
+			return false, util.ErrWrapper(err, "fail to read start line of response")
+		}
+		if err := r.readInterim(reader); err != nil {
+			return false, err
+		}
+		if statusCode == 100 {
+			return true, nil
+		}
+	}
+}
+
+//readInterim reads the header of the interim response whose status line is parsed,
+//then writes and flushes it to tell the client unless dropped, the number of the
+//interim responses is limited, so an upstream can't send them endlessly
+func (r *Response) readInterim(reader *bufio.Reader) error {
+	r.interimCount++
+	if err := r.limits.CheckInterimCount(r.interimCount); err != nil {
+		return r.checkLimit(err)
+	}
+	var header http.Header
+	header.SetLimits(r.limits)
+	respLineBytes := r.respLine.GetResponseLine()
+	if r.dropInterim {
+		_, err := copyHeader(&header, respLineBytes, reader, ioutil.Discard, nil, func([]byte) {})
+		return r.checkLimit(err)
+	}
+	if _, err := copyHeader(&header, respLineBytes, reader, r.writer, r.rewriteHeader,
+		func(rawHeader []byte) {
+			r.size += len(rawHeader)
+		},
+	); err != nil {
+		return r.checkLimit(err)
+	}
+	r.size += len(respLineBytes)
+	return r.writer.Flush()
+}
+
+//isInterimStatus if statusCode is an interim one followed by the final response,
+//i.e. 1xx except `101 Switching Protocols`, after which the connection is no longer http
+func isInterimStatus(statusCode int) bool {
+	return statusCode >= 100 && statusCode < 200 && statusCode != 101
+}
@@ -0,0 +1,51 @@
+package http
+
+import "github.com/haxii/fastproxy/bytebufferpool"
+
+//HeaderEditAction action of a HeaderEdit
+type HeaderEditAction int
+
+const (
+	//HeaderEditAdd appends the value to the header field, the field is added if not present
+	HeaderEditAdd HeaderEditAction = iota
+	//HeaderEditSet replaces the value of the header field, the field is added if not present
+	HeaderEditSet
+	//HeaderEditRemove removes all the header fields named Name
+	HeaderEditRemove
+)
+
+//HeaderEdit edit of a header field, the framing headers, i.e. `Content-Length`
+//& `Transfer-Encoding`, are managed by proxy, which can't be edited
+type HeaderEdit struct {
+	Action HeaderEditAction
+	Name   string
+	Value  string
+}
+
+//apply applies the edit to the raw header
+func (e *HeaderEdit) apply(rawHeader *bytebufferpool.ByteBuffer) {
+	if len(e.Name) == 0 || isFramingHeader(e.Name) {
+		return
+	}
+	switch e.Action {
+	case HeaderEditAdd:
+		addRawHeaderValue(rawHeader, e.Name, e.Value)
+	case HeaderEditSet:
+		setRawHeaderValue(rawHeader, e.Name, e.Value)
+	case HeaderEditRemove:
+		delRawHeader(rawHeader, e.Name)
+	}
+}
+
+//SetHeaderEdits set the edits applied to the request's header in order,
+//they're applied when the header is written, so they can be set again
+//before a retry, e.g. for the super proxy switched to
+func (r *Request) SetHeaderEdits(edits []HeaderEdit) {
+	r.headerEdits = edits
+}
+
+//SetHeaderEdits set the edits applied to the response's header in order,
+//they're applied when the header is read, before it's written to client
+func (r *Response) SetHeaderEdits(edits []HeaderEdit) {
+	r.headerEdits = edits
+}
@@ -0,0 +1,69 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/haxii/fastproxy/hijack"
+)
+
+var testHeaderEdits = []HeaderEdit{
+	{Action: HeaderEditAdd, Name: "X-A", Value: "3"},
+	{Action: HeaderEditSet, Name: "x-c", Value: "4"},
+	{Action: HeaderEditRemove, Name: "X-B"},
+	//the framing headers are left alone
+	{Action: HeaderEditRemove, Name: "Content-Length"},
+	{Action: HeaderEditSet, Name: "Transfer-Encoding", Value: "chunked"},
+}
+
+func TestRequestHeaderEdits(t *testing.T) {
+	const raw = "POST / HTTP/1.1\r\nHost: a.com\r\nX-A: 1\r\nX-B: 2\r\nContent-Length: 5\r\n\r\nhello"
+	h := &modifyingHijacker{}
+	req, _ := modifyRequest(t, raw, false, h)
+	req.SetHeaderEdits(testHeaderEdits)
+	expHeader := "POST / HTTP/1.1\r\nHost: a.com\r\nX-A: 1, 3\r\nContent-Length: 5\r\nx-c: 4\r\n\r\n"
+	if written := writeRequest(t, req); written != expHeader+"hello" {
+		t.Fatalf("unexpected request written %q, expecting %q", written, expHeader+"hello")
+	}
+
+	//the original header is kept for the edits set again, e.g. for a retry
+	req.SetHeaderEdits(nil)
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	if err := req.WriteHeaderTo(w); err != nil {
+		t.Fatalf("fail to write request header: %s", err)
+	}
+	w.Flush()
+	if exp := "Host: a.com\r\nX-A: 1\r\nX-B: 2\r\nContent-Length: 5\r\n\r\n"; b.String() != exp {
+		t.Fatalf("unexpected header written %q, expecting %q", b.String(), exp)
+	}
+}
+
+func TestResponseHeaderEdits(t *testing.T) {
+	const next = "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	raw := "HTTP/1.1 200 OK\r\nX-A: 1\r\nX-B: 2\r\nContent-Length: 5\r\n\r\nhello" + next
+	//a hijacker not modifying the response, so the header is copied as is
+	h := &modifyingHijacker{}
+	resp := &Response{}
+	resp.SetHijacker(struct{ hijack.Hijacker }{h})
+	resp.SetHeaderEdits(testHeaderEdits)
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	resp.WriteTo(w)
+	reader := bufio.NewReader(strings.NewReader(raw))
+	if err := resp.ReadFrom(false, reader); err != nil {
+		t.Fatalf("fail to read response %q: %s", raw, err)
+	}
+	w.Flush()
+	if exp := "HTTP/1.1 200 OK\r\nX-A: 1, 3\r\nContent-Length: 5\r\nx-c: 4\r\n\r\nhello"; b.String() != exp {
+		t.Fatalf("unexpected response written %q, expecting %q", b.String(), exp)
+	}
+	if h.respBody.String() != "hello" {
+		t.Fatalf("unexpected body sniffed %q", h.respBody.String())
+	}
+	if left, _ := reader.Peek(len(next)); string(left) != next {
+		t.Fatalf("unexpected bytes %q left, expecting %q", left, next)
+	}
+}
@@ -2,6 +2,7 @@ package http
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"io"
 	"net"
@@ -29,16 +30,36 @@ type Request struct {
 
 	//headers info, includes conn close and content length
 	header http.Header
+	//raw header fields parsed from reader with proxy headers removed
+	rawHeader bytebufferpool.ByteBuffer
 
 	//body body parser
 	body http.Body
 
 	//hijacker, used for recording the http traffic
-	hijacker           hijack.Hijacker
-	hijackerBodyWriter io.Writer
+	hijacker hijack.Hijacker
+	//sniffer writes the body to hijacker
+	sniffer bodySniffer
+	//decodeSniffedBody decodes the body for hijacker
+	decodeSniffedBody bool
 
 	//proxy super proxy used for target connection
 	proxy *superproxy.SuperProxy
+	//proxySwitcher switches the super proxy for retrying, see `SetProxySwitcher`
+	proxySwitcher func()
+	//unreplayable the request is not replayed once written, see `SetUnreplayable`
+	unreplayable bool
+
+	//headerEdits edits applied to the header when it's written
+	headerEdits []HeaderEdit
+
+	//modification made by hijacker, see `Modifier`
+	modification requestModification
+
+	//limits limits of reading, see `SetLimits`
+	limits *http.Limits
+	//exceededLimit the limit exceeded in reading
+	exceededLimit *http.LimitError
 
 	//TLS request settings
 	isTLS         bool
@@ -50,6 +71,13 @@ type Request struct {
 
 	//byte size written to writer
 	writeSize int
+
+	//bodyWritten if `WriteBodyTo` is called, see `ConnectionClose`
+	bodyWritten bool
+	//connectionClose if the connection is closed after the response, see `SetConnectionClose`
+	connectionClose bool
+	//bodyReadHook called once the body is read, see `SetBodyReadHook`
+	bodyReadHook func()
 }
 
 //Reset reset request
@@ -57,17 +85,32 @@ func (r *Request) Reset() {
 	r.reader = nil
 	r.reqLine.Reset()
 	r.header.Reset()
+	r.body.Reset()
+	r.rawHeader.Reset()
 	r.hostInfo.Reset()
 	r.hijacker = nil
+	r.sniffer.reset(nil, false, 0, nil)
+	r.decodeSniffedBody = false
 	r.proxy = nil
+	r.proxySwitcher = nil
+	r.unreplayable = false
+	r.headerEdits = nil
+	r.modification.reset()
+	r.limits = nil
+	r.exceededLimit = nil
 	r.isTLS = false
 	r.tlsServerName = ""
 	r.readSize = 0
 	r.writeSize = 0
+	r.bodyWritten = false
+	r.connectionClose = false
+	r.bodyReadHook = nil
 }
 
 // ReadFrom init request with reader
-// then parse the start line of the http request
+// then parse the start line and the header fields of the http request,
+// header fields are cached and written to the target in `WriteHeaderTo`,
+// the *http.RejectError of the strict parsing is returned as is
 func (r *Request) ReadFrom(reader *bufio.Reader) error {
 	if r.reader != nil {
 		return errors.New("request already initialized")
@@ -76,14 +119,48 @@ func (r *Request) ReadFrom(reader *bufio.Reader) error {
 	if reader == nil {
 		return errors.New("nil reader provided")
 	}
-	if err := r.reqLine.Parse(reader); err != nil {
+	if err := r.checkLimit(r.reqLine.ParseWithLimits(reader, r.limits)); err != nil {
 		return util.ErrWrapper(err, "fail to read start line of request")
 	}
+	r.header.SetLimits(r.limits)
+	r.body.SetLimits(r.limits)
+	rn, err := r.header.ParseHeaderFields(reader, &r.rawHeader)
+	r.readSize += rn
+	if err = r.checkLimit(err); err != nil {
+		if _, ok := err.(*http.RejectError); ok {
+			return err
+		}
+		return util.ErrWrapper(err, "fail to parse http headers")
+	}
 	r.reader = reader
 	r.hostInfo.ParseHostWithPort(r.reqLine.HostWithPort())
 	return nil
 }
 
+//Header parsed header info of the request
+func (r *Request) Header() *http.Header {
+	return &r.header
+}
+
+//Reader the reader which the request is read from,
+//the traffic after the request is read from it as well, e.g. an upgraded one
+func (r *Request) Reader() *bufio.Reader {
+	return r.reader
+}
+
+//IsUpgrade if the request asks for upgrading the connection, e.g. a WebSocket handshake
+func (r *Request) IsUpgrade() bool {
+	return r.header.IsConnectionUpgrade() && len(r.header.Upgrade()) > 0
+}
+
+//HasBody if the request has a body regardless of its method, i.e. the body is
+//framed by a positive Content-Length or Transfer-Encoding, or set by hijacker,
+//the body is read from the reader in `WriteBodyTo`
+func (r *Request) HasBody() bool {
+	return r.header.BodyType() != http.BodyTypeFixedSize || r.header.ContentLength() > 0 ||
+		r.isBodyModified()
+}
+
 //SetTLS set request as TLS
 func (r *Request) SetTLS(tlsServerName string) {
 	r.isTLS = true
@@ -100,6 +177,18 @@ func (r *Request) GetHijacker() hijack.Hijacker {
 	return r.hijacker
 }
 
+//SetDecodeSniffedBody if the body written to hijacker is decoded, i.e. the chunked
+//encoding and the content coding, the body sent is not affected
+func (r *Request) SetDecodeSniffedBody(decode bool) {
+	r.decodeSniffedBody = decode
+}
+
+//SetStrictParsing rejects the request header ambiguous under RFC 7230 in
+//`ReadFrom`, see http.Header.SetStrictParsing, must be set before `ReadFrom`
+func (r *Request) SetStrictParsing(strict bool) {
+	r.header.SetStrictParsing(strict)
+}
+
 //SetProxy set super proxy for this request
 func (r *Request) SetProxy(p *superproxy.SuperProxy) {
 	r.proxy = p
@@ -110,8 +199,35 @@ func (r *Request) GetProxy() *superproxy.SuperProxy {
 	return r.proxy
 }
 
+//SetProxySwitcher set the switcher which sets an alternate super proxy
+//for retrying the request, see client.RetryPolicy
+func (r *Request) SetProxySwitcher(switcher func()) {
+	r.proxySwitcher = switcher
+}
+
+//SwitchProxy switches to an alternate super proxy by the switcher set, if any
+func (r *Request) SwitchProxy() {
+	if r.proxySwitcher != nil {
+		r.proxySwitcher()
+	}
+}
+
+//SetUnreplayable marks the request not replayed once written for retrying,
+//e.g. its header depends on the super proxy, which may be switched
+func (r *Request) SetUnreplayable() {
+	r.unreplayable = true
+}
+
+//Replayable if the request can be replayed once written, see client.RetryPolicy
+func (r *Request) Replayable() bool {
+	return !r.unreplayable
+}
+
 //Method request method in UPPER case
 func (r *Request) Method() []byte {
+	if r.modification.method != nil {
+		return r.modification.method
+	}
 	return r.reqLine.Method()
 }
 
@@ -125,11 +241,30 @@ func (r *Request) SetHostWithPort(hostWithPort string) {
 	r.hostInfo.ParseHostWithPort(hostWithPort)
 }
 
+//AddHeaderValue appends value to the header field name of the request,
+//the field is added if not present
+func (r *Request) AddHeaderValue(name, value string) {
+	addRawHeaderValue(&r.rawHeader, name, value)
+}
+
+//DelHeader removes all the header fields named name from the request
+func (r *Request) DelHeader(name string) {
+	delRawHeader(&r.rawHeader, name)
+}
+
 //PathWithQueryFragment request path with query and fragment
 func (r *Request) PathWithQueryFragment() []byte {
+	if r.modification.path != nil {
+		return r.modification.path
+	}
 	return r.reqLine.PathWithQueryFragment()
 }
 
+//RequestURI the request-target in the request line as sent by client
+func (r *Request) RequestURI() []byte {
+	return r.reqLine.RequestURI()
+}
+
 //Protocol HTTP/1.0, HTTP/1.1 etc.
 func (r *Request) Protocol() []byte {
 	return r.reqLine.Protocol()
@@ -141,16 +276,37 @@ func (r *Request) WriteHeaderTo(writer *bufio.Writer) error {
 	if r.reader == nil {
 		return errors.New("Empty request, nothing to write")
 	}
-	//read & write the headers
-	rn, err := copyHeader(&r.header, r.reader, writer,
+	//fix up the framing headers of the body modified by hijacker
+	if r.isBodyModified() {
+		if err := r.modification.body.fixupFraming(&r.rawHeader,
+			bytes.Equal(r.Protocol(), protocolHTTP11), r.readOriginalBody); err != nil {
+			return util.ErrWrapper(err, "fail to modify request body")
+		}
+	}
+	bodyType := r.header.BodyType()
+	if r.isBodyModified() {
+		bodyType = r.modification.body.sentBodyType(bodyType)
+	}
+	//the edits are applied to a copy, the ones set for a retry are applied to the original
+	rawHeader := r.rawHeader.B
+	if len(r.headerEdits) > 0 {
+		editedHeader := bytebufferpool.Get()
+		defer bytebufferpool.Put(editedHeader)
+		editedHeader.Set(rawHeader)
+		for i := range r.headerEdits {
+			r.headerEdits[i].apply(editedHeader)
+		}
+		rawHeader = editedHeader.B
+	}
+	//write the headers parsed in `ReadFrom`
+	return parallelWrite(writer,
 		func(rawHeader []byte) {
 			r.writeSize += len(rawHeader)
-			r.hijackerBodyWriter = r.hijacker.OnRequest(r.header, rawHeader)
+			r.sniffer.reset(r.hijacker.OnRequest(r.header, rawHeader),
+				r.decodeSniffedBody, bodyType, rawHeader)
 		},
+		rawHeader,
 	)
-
-	r.AddReadSize(rn)
-	return err
 }
 
 //WriteBodyTo write raw http request body to http client
@@ -159,23 +315,54 @@ func (r *Request) WriteBodyTo(writer *bufio.Writer) error {
 	if r.reader == nil {
 		return errors.New("Empty request, nothing to write")
 	}
+	r.bodyWritten = true
+	err := r.writeBodyTo(writer)
+	if err == nil && r.bodyReadHook != nil {
+		r.bodyReadHook()
+	}
+	return err
+}
+
+//SetBodyReadHook set the hook called once the body is read from the reader
+//entirely in `WriteBodyTo`, after that the reader is no longer read by the request
+func (r *Request) SetBodyReadHook(hook func()) {
+	r.bodyReadHook = hook
+}
+
+//writeBodyTo writes the body, which may be modified by hijacker
+func (r *Request) writeBodyTo(writer *bufio.Writer) error {
+	if r.isBodyModified() {
+		return r.endBody(r.modification.body.writeTo(r.readOriginalBody,
+			func(isChunkHeader bool, data []byte) error {
+				return r.writeBody(writer, isChunkHeader, data)
+			},
+		))
+	}
 	//write the request body (if any)
-	return copyBody(&r.header, &r.body, r.reader, writer,
-		func(rawBody []byte) {
+	return r.endBody(r.checkLimit(copyBody(&r.header, &r.body, r.reader, writer,
+		func(isChunkHeader bool, rawBody []byte) {
 			r.readSize += len(rawBody)
 			r.writeSize += len(rawBody)
-			if err := util.WriteWithValidation(r.hijackerBodyWriter, rawBody); err != nil {
-				//TODO: log the sniffer error
-			}
+			r.sniffer.write(isChunkHeader, rawBody)
 		},
-	)
+	)))
 }
 
-// ConnectionClose if the request's "Connection" or "Proxy-Connection" header value is set as "close".
+// ConnectionClose if the request's "Connection" or "Proxy-Connection" header value is set as "close",
+// or the request asks for upgrading, as the connection is no longer http after that,
+// or the body of the request expecting `100 Continue` is not written, which is left unread,
+// or `SetConnectionClose` is called.
 // this determines how the client reusing the connetions.
-// this func. result is only valid after `WriteTo` method is called
+// this func. result is only valid after `ReadFrom` method is called
 func (r *Request) ConnectionClose() bool {
-	return r.header.IsConnectionClose() || r.header.IsProxyConnectionClose()
+	return r.header.IsConnectionClose() || r.header.IsProxyConnectionClose() || r.IsUpgrade() ||
+		(r.ExpectContinue() && r.HasBody() && !r.bodyWritten) || r.connectionClose
+}
+
+//SetConnectionClose closes the connection the request is read from after the response,
+//e.g. the response is delimited by closing the connection, see `Response.IsCloseDelimited`
+func (r *Request) SetConnectionClose() {
+	r.connectionClose = true
 }
 
 //IsTLS is tls requests
@@ -228,6 +415,32 @@ type Response struct {
 	//body http body parser
 	body http.Body
 
+	//rewriteLocation rewrites the `Location` header value if set
+	rewriteLocation func(location []byte) []byte
+	//headerEdits edits applied to the header
+	headerEdits []HeaderEdit
+
+	//modification made by hijacker, see `Modifier`
+	modification responseModification
+
+	//sniffer writes the body to hijacker
+	sniffer bodySniffer
+	//decodeSniffedBody decodes the body for hijacker
+	decodeSniffedBody bool
+
+	//limits limits of reading, see `SetLimits`
+	limits *http.Limits
+	//exceededLimit the limit exceeded in reading
+	exceededLimit *http.LimitError
+
+	//dropInterim drops the interim responses rather than writing them, see `SetDropInterim`
+	dropInterim bool
+	//interimCount number of the interim responses read
+	interimCount int
+
+	//closeDelimited if the body is read until the connection is closed, see `IsCloseDelimited`
+	closeDelimited bool
+
 	//totol byte size of header and body
 	size int
 }
@@ -242,6 +455,17 @@ func (r *Response) Reset() {
 	r.writer = nil
 	r.respLine.Reset()
 	r.header.Reset()
+	r.body.Reset()
+	r.rewriteLocation = nil
+	r.headerEdits = nil
+	r.modification.reset()
+	r.sniffer.reset(nil, false, 0, nil)
+	r.decodeSniffedBody = false
+	r.limits = nil
+	r.exceededLimit = nil
+	r.dropInterim = false
+	r.interimCount = 0
+	r.closeDelimited = false
 	r.size = 0
 }
 
@@ -269,29 +493,123 @@ func (r *Response) GetHijacker() hijack.Hijacker {
 	return r.hijacker
 }
 
-//ReadFrom read data from http response got
+//SetDecodeSniffedBody if the body written to hijacker is decoded, i.e. the chunked
+//encoding and the content coding, the body sent is not affected
+func (r *Response) SetDecodeSniffedBody(decode bool) {
+	r.decodeSniffedBody = decode
+}
+
+//SetLocationRewriter set the rewriter of the `Location` header,
+//e.g. a reverse proxy maps the backend's redirection back to itself
+func (r *Response) SetLocationRewriter(rewrite func(location []byte) []byte) {
+	r.rewriteLocation = rewrite
+}
+
+//IsSwitchingProtocols if the response is a `101 Switching Protocols` one,
+//only valid after `ReadFrom` method is called
+func (r *Response) IsSwitchingProtocols() bool {
+	return r.respLine.GetStatusCode() == 101
+}
+
+//ReadFrom read data from http response got,
+//the interim 1xx responses before the final one are written as well, see `SetDropInterim`
 func (r *Response) ReadFrom(discardBody bool, reader *bufio.Reader) error {
 	//write back the start line to writer(i.e. net/connection)
-	if err := r.respLine.Parse(reader); err != nil {
+	if err := r.checkLimit(r.respLine.ParseWithLimits(reader, r.limits)); err != nil {
 		return util.ErrWrapper(err, "fail to read start line of response")
 	}
+	//the interim responses are written before the final one
+	for isInterimStatus(r.respLine.GetStatusCode()) {
+		if err := r.readInterim(reader); err != nil {
+			return err
+		}
+		if err := r.checkLimit(r.respLine.ParseWithLimits(reader, r.limits)); err != nil {
+			return util.ErrWrapper(err, "fail to read start line of response")
+		}
+	}
+	r.header.SetLimits(r.limits)
+	r.body.SetLimits(r.limits)
+	if respHijacker, ok := r.hijacker.(hijack.ResponseHijacker); ok {
+		return r.readModifiedFrom(discardBody, reader, respHijacker)
+	}
+
+	//read the headers, then write them after the start line,
+	//so nothing is written if the headers are invalid
+	respLineBytes := r.respLine.GetResponseLine()
+	if _, err := copyHeader(&r.header, respLineBytes, reader, r.writer, r.rewriteHeader,
+		func(rawHeader []byte) {
+			r.size += len(rawHeader)
+			r.setCloseDelimited(discardBody)
+			r.sniffer.reset(r.hijacker.OnResponse(r.respLine, r.header, rawHeader),
+				r.decodeSniffedBody, r.bodyType(), rawHeader)
+		},
+	); err != nil {
+		return r.checkLimit(err)
+	}
+	r.size += len(respLineBytes)
+
+	if discardBody {
+		return nil
+	}
+
+	//write the request body (if any)
+	return r.endBody(r.checkLimit(r.body.Parse(reader, r.bodyType(), r.header.ContentLength(),
+		bodyWriter(r.writer, r.writeBody))))
+}
+
+//writeBody writes the body data to hijacker
+func (r *Response) writeBody(isChunkHeader bool, rawBody []byte) {
+	r.size += len(rawBody)
+	r.sniffer.write(isChunkHeader, rawBody)
+}
+
+//readModifiedFrom reads the response whose start line is parsed, then writes it
+//after the status line, headers and body are modified by respHijacker
+func (r *Response) readModifiedFrom(discardBody bool, reader *bufio.Reader,
+	respHijacker hijack.ResponseHijacker) error {
+	rawHeader := bytebufferpool.Get()
+	defer bytebufferpool.Put(rawHeader)
+	if _, err := r.header.ParseHeaderFields(reader, rawHeader); err != nil {
+		return util.ErrWrapper(r.checkLimit(err), "fail to parse http headers")
+	}
+	r.rewriteHeader(rawHeader)
+	r.setCloseDelimited(discardBody)
+
+	//the body of the response without body can't be modified
+	hasBody := !discardBody && r.hasBody()
+	r.modification.rawHeader = rawHeader
+	respHijacker.ModifyResponse(r.Modifier())
+	r.modification.rawHeader = nil
+	bodyModified := hasBody && r.modification.body.isModified()
+	readOriginalBody := func(w func(data []byte) error) error {
+		bodyType := r.bodyType()
+		return r.checkLimit(r.body.Parse(reader, bodyType, r.header.ContentLength(),
+			http.DecodedBodyWrapper(bodyType, w)))
+	}
+	if bodyModified {
+		if err := r.modification.body.fixupFraming(rawHeader,
+			bytes.Equal(r.respLine.GetProtocol(), protocolHTTP11), readOriginalBody); err != nil {
+			return util.ErrWrapper(err, "fail to modify response body")
+		}
+	}
 
-	//rebuild  the start line
+	//write the modified start line and headers
 	respLineBytes := r.respLine.GetResponseLine()
-	//write start line
 	if err := util.WriteWithValidation(r.writer, respLineBytes); err != nil {
 		return util.ErrWrapper(err, "fail to write start line of response")
 	}
 	r.size += len(respLineBytes)
-
-	//read & write the headers
-	var hijackerBodyWriter io.Writer
-	if _, err := copyHeader(&r.header, reader, r.writer,
+	bodyType := r.bodyType()
+	if bodyModified {
+		bodyType = r.modification.body.sentBodyType(bodyType)
+	}
+	if err := parallelWrite(r.writer,
 		func(rawHeader []byte) {
 			r.size += len(rawHeader)
-			hijackerBodyWriter = r.hijacker.OnResponse(
-				r.respLine, r.header, rawHeader)
+			r.sniffer.reset(r.hijacker.OnResponse(r.respLine, r.header, rawHeader),
+				r.decodeSniffedBody, bodyType, rawHeader)
 		},
+		rawHeader.B,
 	); err != nil {
 		return err
 	}
@@ -299,46 +617,120 @@ func (r *Response) ReadFrom(discardBody bool, reader *bufio.Reader) error {
 	if discardBody {
 		return nil
 	}
-
-	//write the request body (if any)
-	return copyBody(&r.header, &r.body, reader, r.writer,
-		func(rawBody []byte) {
-			r.size += len(rawBody)
-			if err := util.WriteWithValidation(hijackerBodyWriter, rawBody); err != nil {
-				//TODO: log the sniffer error
-			}
+	if !bodyModified {
+		return r.endBody(r.checkLimit(r.body.Parse(reader, r.bodyType(), r.header.ContentLength(),
+			bodyWriter(r.writer, r.writeBody))))
+	}
+	return r.endBody(r.modification.body.writeTo(readOriginalBody,
+		func(isChunkHeader bool, data []byte) error {
+			return parallelWrite(r.writer, func(rawBody []byte) {
+				r.writeBody(isChunkHeader, rawBody)
+			}, data)
 		},
-	)
+	))
+}
+
+//hasBody if the response may have a body, i.e. it's not a 1xx, 204 or 304 one
+func (r *Response) hasBody() bool {
+	statusCode := r.respLine.GetStatusCode()
+	return statusCode >= 200 && statusCode != 204 && statusCode != 304
+}
+
+//setCloseDelimited tests if the body is read until the connection is closed once
+//the header is parsed, i.e. the response with body has no framing headers,
+//which is done before the hijacker modifying the status code
+func (r *Response) setCloseDelimited(discardBody bool) {
+	bodyType := r.header.BodyType()
+	r.closeDelimited = !discardBody && (bodyType == http.BodyTypeIdentity ||
+		(bodyType == http.BodyTypeFixedSize && r.hasBody() && r.header.Peek("Content-Length") == nil))
+}
+
+//bodyType the type of the body, the close-delimited one is an identity one
+func (r *Response) bodyType() http.BodyType {
+	if r.closeDelimited {
+		return http.BodyTypeIdentity
+	}
+	return r.header.BodyType()
+}
+
+//rewriteHeader rewrites the parsed raw header before writing
+func (r *Response) rewriteHeader(rawHeader *bytebufferpool.ByteBuffer) {
+	//the hop-by-hop `Connection` header is removed in parsing,
+	//which is required by client on switching protocols
+	if r.IsSwitchingProtocols() && r.header.IsConnectionUpgrade() {
+		addRawHeaderValue(rawHeader, "Connection", r.header.UpgradeConnection())
+	}
+	for i := range r.headerEdits {
+		r.headerEdits[i].apply(rawHeader)
+	}
+	if r.rewriteLocation == nil {
+		return
+	}
+	if location, ok := rawHeaderValue(rawHeader.B, "Location"); ok {
+		if rewritten := r.rewriteLocation(location); rewritten != nil {
+			setRawHeaderValue(rawHeader, "Location", string(rewritten))
+		}
+	}
 }
 
-//ConnectionClose if the request's "Connection" header value is set as "Close"
+//ConnectionClose if the response's "Connection" header value is set as "Close",
+//or the body is delimited by closing the connection, see `IsCloseDelimited`
 //this determines how the client reusing the connetions
 func (r *Response) ConnectionClose() bool {
-	return false
+	return r.header.IsConnectionClose() || r.closeDelimited
+}
+
+//IsCloseDelimited if the body of the response is read until the upstream closes
+//the connection, i.e. it has neither `Content-Length` nor chunked `Transfer-Encoding`,
+//the response written is delimited the same, so the client's connection should be
+//closed after it, only valid after `ReadFrom` method is called
+func (r *Response) IsCloseDelimited() bool {
+	return r.closeDelimited
 }
 
 //additionalDst used by copyHeader and copyBody for additional write
 type additionalDst func([]byte)
 
-func copyHeader(header *http.Header,
-	src *bufio.Reader, dst1 io.Writer, dst2 additionalDst) (int, error) {
+//copyHeader parses the header from src, then writes it to dst1 & dst2,
+//startLine is written to dst1 before the header once it's parsed,
+//the parsed raw header is rewritten by rewrite before writing if provided,
+//the *http.LimitError of parsing is returned as is
+func copyHeader(header *http.Header, startLine []byte, src *bufio.Reader, dst1 io.Writer,
+	rewrite func(*bytebufferpool.ByteBuffer), dst2 additionalDst) (int, error) {
 	//read and write header
 	buffer := bytebufferpool.Get()
 	defer bytebufferpool.Put(buffer)
 	var rn int
 	var err error
 	if rn, err = header.ParseHeaderFields(src, buffer); err != nil {
+		if _, ok := err.(*http.LimitError); ok {
+			return rn, err
+		}
 		return rn, util.ErrWrapper(err, "fail to parse http headers")
 	}
+	if rewrite != nil {
+		rewrite(buffer)
+	}
+	if err = util.WriteWithValidation(dst1, startLine); err != nil {
+		return rn, util.ErrWrapper(err, "fail to write start line")
+	}
 	return rn, parallelWrite(dst1, dst2, buffer.B)
 }
 
-func copyBody(header *http.Header, body *http.Body,
-	src *bufio.Reader, dst1 io.Writer, dst2 additionalDst) error {
-	w := func(isChunkHeader bool, data []byte) error {
-		return parallelWrite(dst1, dst2, data)
+//copyBody parses the body from src, then writes it to dst1 & dst2,
+//dst2 is told if the data is a chunk header of the chunked body
+func copyBody(header *http.Header, body *http.Body, src *bufio.Reader,
+	dst1 io.Writer, dst2 func(isChunkHeader bool, data []byte)) error {
+	return body.Parse(src, header.BodyType(), header.ContentLength(), bodyWriter(dst1, dst2))
+}
+
+//bodyWriter makes a BodyWrapper writing the body parsed to dst1 & dst2
+func bodyWriter(dst1 io.Writer, dst2 func(isChunkHeader bool, data []byte)) http.BodyWrapper {
+	return func(isChunkHeader bool, data []byte) error {
+		return parallelWrite(dst1, func(data []byte) {
+			dst2(isChunkHeader, data)
+		}, data)
 	}
-	return body.Parse(src, header.BodyType(), header.ContentLength(), w)
 }
 
 //parallelWrite write data to dst1 dst2 concurrently
@@ -428,5 +820,12 @@ func (h *HostInfo) SetIP(ip net.IP) {
 		return
 	}
 	h.ip = ip
-	h.targetWithPort = ip.String() + ":" + h.port
+	h.targetWithPort = net.JoinHostPort(ip.String(), h.port)
+}
+
+//SetTarget pins the target to addr, which is dialed rather than the host,
+//the host is kept for naming, e.g. the Host header and the TLS server name
+func (h *HostInfo) SetTarget(addr *net.TCPAddr) {
+	h.ip = addr.IP
+	h.targetWithPort = addr.String()
 }
@@ -0,0 +1,43 @@
+package http
+
+import "github.com/haxii/fastproxy/http"
+
+//SetLimits set the limits of reading the request, nil means the default ones,
+//must be set before `ReadFrom`
+func (r *Request) SetLimits(limits *http.Limits) {
+	r.limits = limits
+}
+
+//ExceededLimit the limit exceeded in reading the request, including the body
+//read in writing, nil if no limit is exceeded
+func (r *Request) ExceededLimit() *http.LimitError {
+	return r.exceededLimit
+}
+
+//checkLimit records the limit exceeded if err is a *http.LimitError
+func (r *Request) checkLimit(err error) error {
+	if limitErr, ok := err.(*http.LimitError); ok {
+		r.exceededLimit = limitErr
+	}
+	return err
+}
+
+//SetLimits set the limits of reading the response, nil means the default ones,
+//must be set before `ReadFrom`
+func (r *Response) SetLimits(limits *http.Limits) {
+	r.limits = limits
+}
+
+//ExceededLimit the limit exceeded in reading the response,
+//nil if no limit is exceeded
+func (r *Response) ExceededLimit() *http.LimitError {
+	return r.exceededLimit
+}
+
+//checkLimit records the limit exceeded if err is a *http.LimitError
+func (r *Response) checkLimit(err error) error {
+	if limitErr, ok := err.(*http.LimitError); ok {
+		r.exceededLimit = limitErr
+	}
+	return err
+}
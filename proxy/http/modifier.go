@@ -0,0 +1,441 @@
+package http
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/haxii/fastproxy/bytebufferpool"
+	"github.com/haxii/fastproxy/hijack"
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/util"
+)
+
+/*
+ * request & response modification made by hijacker
+ */
+
+var (
+	methodGet      = []byte("GET")
+	methodHead     = []byte("HEAD")
+	protocolHTTP11 = []byte("HTTP/1.1")
+
+	chunkCRLF = []byte("\r\n")
+	lastChunk = []byte("0\r\n\r\n")
+)
+
+//requestModification modification of a request made by hijacker
+type requestModification struct {
+	//method & path replace the ones in request line if not nil
+	method []byte
+	path   []byte
+	body   bodyModification
+}
+
+func (m *requestModification) reset() {
+	m.method = nil
+	m.path = nil
+	m.body.reset()
+}
+
+//Modifier modifier of the request for hijacker, see hijack.RequestModifier
+func (r *Request) Modifier() hijack.RequestModifier {
+	return (*requestModifier)(r)
+}
+
+//requestModifier implements hijack.RequestModifier
+type requestModifier Request
+
+func (m *requestModifier) Method() []byte {
+	return (*Request)(m).Method()
+}
+
+func (m *requestModifier) SetMethod(method string) {
+	m.modification.method = bytes.ToUpper([]byte(method))
+}
+
+func (m *requestModifier) PathWithQueryFragment() []byte {
+	return (*Request)(m).PathWithQueryFragment()
+}
+
+func (m *requestModifier) SetPathWithQueryFragment(path string) {
+	m.modification.path = []byte(path)
+}
+
+func (m *requestModifier) HostWithPort() string {
+	return m.hostInfo.HostWithPort()
+}
+
+func (m *requestModifier) SetHostWithPort(hostWithPort string) {
+	host, port, err := net.SplitHostPort(hostWithPort)
+	if err != nil {
+		return
+	}
+	m.hostInfo.Reset()
+	m.hostInfo.ParseHostWithPort(hostWithPort)
+
+	//the default port is omitted in `Host` header, brackets of IPv6 are kept
+	hostHeader := hostWithPort
+	if (m.isTLS && port == "443") || (!m.isTLS && port == "80") {
+		hostHeader = hostWithPort[:len(hostWithPort)-len(port)-1]
+	}
+	setRawHeaderValue(&m.rawHeader, "Host", hostHeader)
+	if m.isTLS && net.ParseIP(host) == nil {
+		m.tlsServerName = host
+	}
+}
+
+func (m *requestModifier) Header() *http.Header {
+	return &m.header
+}
+
+func (m *requestModifier) HeaderValue(name string) ([]byte, bool) {
+	return rawHeaderValue(m.rawHeader.B, name)
+}
+
+func (m *requestModifier) AddHeaderValue(name, value string) {
+	if !isFramingHeader(name) {
+		addRawHeaderValue(&m.rawHeader, name, value)
+	}
+}
+
+func (m *requestModifier) SetHeaderValue(name, value string) {
+	if !isFramingHeader(name) {
+		setRawHeaderValue(&m.rawHeader, name, value)
+	}
+}
+
+func (m *requestModifier) DelHeader(name string) {
+	if !isFramingHeader(name) {
+		delRawHeader(&m.rawHeader, name)
+	}
+}
+
+func (m *requestModifier) SetBody(body []byte) {
+	m.modification.body.setBody(body)
+}
+
+func (m *requestModifier) TransformBody(transform func(body io.Reader) io.Reader) {
+	m.modification.body.setTransform(transform, nil)
+}
+
+func (m *requestModifier) TransformBodyWriter(transform func(w io.Writer) io.WriteCloser) {
+	m.modification.body.setTransform(nil, transform)
+}
+
+//isBodyModified if the body is replaced or transformed by hijacker,
+//the body of GET & HEAD requests is never sent by client
+func (r *Request) isBodyModified() bool {
+	if !r.modification.body.isModified() {
+		return false
+	}
+	method := r.Method()
+	return !bytes.Equal(method, methodGet) && !bytes.Equal(method, methodHead)
+}
+
+//readOriginalBody reads the original body from reader,
+//only the body data is passed to w, i.e. the chunked encoding is decoded
+func (r *Request) readOriginalBody(w func(data []byte) error) error {
+	bodyType := r.header.BodyType()
+	decoded := http.DecodedBodyWrapper(bodyType, w)
+	return r.checkLimit(r.body.Parse(r.reader, bodyType, r.header.ContentLength(),
+		func(isChunkHeader bool, data []byte) error {
+			r.readSize += len(data)
+			return decoded(isChunkHeader, data)
+		},
+	))
+}
+
+//writeBody writes the modified body data to writer and the hijacker's sniffer
+func (r *Request) writeBody(writer io.Writer, isChunkHeader bool, data []byte) error {
+	return parallelWrite(writer,
+		func(rawBody []byte) {
+			r.writeSize += len(rawBody)
+			r.sniffer.write(isChunkHeader, rawBody)
+		},
+		data,
+	)
+}
+
+//responseModification modification of a response made by hijacker
+type responseModification struct {
+	//rawHeader raw header being modified, only valid in the hijacker's call
+	rawHeader *bytebufferpool.ByteBuffer
+	body      bodyModification
+}
+
+func (m *responseModification) reset() {
+	m.rawHeader = nil
+	m.body.reset()
+}
+
+//Modifier modifier of the response for hijacker, see hijack.ResponseModifier,
+//which is only valid in `hijack.ResponseHijacker.ModifyResponse`
+func (r *Response) Modifier() hijack.ResponseModifier {
+	return (*responseModifier)(r)
+}
+
+//responseModifier implements hijack.ResponseModifier
+type responseModifier Response
+
+func (m *responseModifier) StatusCode() int {
+	return m.respLine.GetStatusCode()
+}
+
+func (m *responseModifier) SetStatus(statusCode int, statusMessage string) {
+	m.respLine.SetStatus(statusCode, statusMessage)
+}
+
+func (m *responseModifier) Header() *http.Header {
+	return &m.header
+}
+
+func (m *responseModifier) HeaderValue(name string) ([]byte, bool) {
+	return rawHeaderValue(m.modification.rawHeader.B, name)
+}
+
+func (m *responseModifier) AddHeaderValue(name, value string) {
+	if !isFramingHeader(name) {
+		addRawHeaderValue(m.modification.rawHeader, name, value)
+	}
+}
+
+func (m *responseModifier) SetHeaderValue(name, value string) {
+	if !isFramingHeader(name) {
+		setRawHeaderValue(m.modification.rawHeader, name, value)
+	}
+}
+
+func (m *responseModifier) DelHeader(name string) {
+	if !isFramingHeader(name) {
+		delRawHeader(m.modification.rawHeader, name)
+	}
+}
+
+func (m *responseModifier) SetBody(body []byte) {
+	m.modification.body.setBody(body)
+}
+
+func (m *responseModifier) TransformBody(transform func(body io.Reader) io.Reader) {
+	m.modification.body.setTransform(transform, nil)
+}
+
+func (m *responseModifier) TransformBodyWriter(transform func(w io.Writer) io.WriteCloser) {
+	m.modification.body.setTransform(nil, transform)
+}
+
+//isFramingHeader if the header field determines how the body is framed,
+//which is managed by proxy
+func isFramingHeader(name string) bool {
+	return bytes.EqualFold([]byte(name), contentLengthHeader) ||
+		bytes.EqualFold([]byte(name), transferEncodingHeader)
+}
+
+var (
+	contentLengthHeader    = []byte("Content-Length")
+	transferEncodingHeader = []byte("Transfer-Encoding")
+)
+
+//bodyModification modification of a request or response body made by hijacker
+type bodyModification struct {
+	//body replaces the original body if replaced
+	body     []byte
+	replaced bool
+	//transform & transformWriter transform the original body if set,
+	//the original body is read from the reader given to transform,
+	//or written to the writer returned by transformWriter
+	transform       func(body io.Reader) io.Reader
+	transformWriter func(w io.Writer) io.WriteCloser
+
+	//originalRead if the original body is already read
+	originalRead bool
+}
+
+//bodySource reads the original body, only the body data is passed to w
+type bodySource func(w func(data []byte) error) error
+
+//bodySink writes the modified body data
+type bodySink func(data []byte) error
+
+func (m *bodyModification) reset() {
+	m.body = nil
+	m.replaced = false
+	m.transform = nil
+	m.transformWriter = nil
+	m.originalRead = false
+}
+
+func (m *bodyModification) setBody(body []byte) {
+	m.reset()
+	m.body = body
+	m.replaced = true
+}
+
+func (m *bodyModification) setTransform(transform func(body io.Reader) io.Reader,
+	transformWriter func(w io.Writer) io.WriteCloser) {
+	m.reset()
+	m.transform = transform
+	m.transformWriter = transformWriter
+}
+
+//isModified if the body is replaced or transformed
+func (m *bodyModification) isModified() bool {
+	return m.replaced || m.isTransformed()
+}
+
+//isTransformed if the body is transformed, whose size is unknown until it ends
+func (m *bodyModification) isTransformed() bool {
+	return m.transform != nil || m.transformWriter != nil
+}
+
+//readOriginal reads the original body from src once, w can be nil to discard it
+func (m *bodyModification) readOriginal(src bodySource, w func(data []byte) error) error {
+	if m.originalRead {
+		return nil
+	}
+	m.originalRead = true
+	if w == nil {
+		w = func([]byte) error { return nil }
+	}
+	if err := src(w); err != nil {
+		return util.ErrWrapper(err, "fail to read original body")
+	}
+	return nil
+}
+
+//fixupFraming rewrites the framing headers in rawHeader for the modified body,
+//i.e. the `Content-Length` of the replaced body, or the chunked `Transfer-Encoding`
+//of the transformed one, the transformed body is buffered for its size if
+//chunked encoding is unavailable, e.g. in HTTP/1.0
+func (m *bodyModification) fixupFraming(rawHeader *bytebufferpool.ByteBuffer,
+	chunkable bool, src bodySource) error {
+	if m.isTransformed() && !chunkable {
+		var body bytes.Buffer
+		if err := m.writeTransformed(src, func(data []byte) error {
+			_, err := body.Write(data)
+			return err
+		}); err != nil {
+			return err
+		}
+		m.setBody(body.Bytes())
+		m.originalRead = true
+	}
+
+	delRawHeader(rawHeader, "Content-Length")
+	delRawHeader(rawHeader, "Transfer-Encoding")
+	//the trailer fields of the original body are not sent
+	delRawHeader(rawHeader, "Trailer")
+	if m.isTransformed() {
+		addRawHeaderValue(rawHeader, "Transfer-Encoding", "chunked")
+	} else {
+		setRawHeaderValue(rawHeader, "Content-Length", strconv.Itoa(len(m.body)))
+	}
+	return nil
+}
+
+//sentBodyType how the body sent is framed, original is the original body's
+func (m *bodyModification) sentBodyType(original http.BodyType) http.BodyType {
+	if m.isTransformed() {
+		return http.BodyTypeChunked
+	}
+	if m.replaced {
+		return http.BodyTypeFixedSize
+	}
+	return original
+}
+
+//writeTo reads the original body from src, then writes the modified body to dst,
+//the transformed body is written in chunks
+func (m *bodyModification) writeTo(src bodySource, dst http.BodyWrapper) error {
+	if !m.isTransformed() {
+		if err := m.readOriginal(src, nil); err != nil {
+			return err
+		}
+		if len(m.body) == 0 {
+			return nil
+		}
+		return dst(false, m.body)
+	}
+	if err := m.writeTransformed(src, func(data []byte) error {
+		return writeChunk(dst, data)
+	}); err != nil {
+		return err
+	}
+	return dst(true, lastChunk)
+}
+
+//writeTransformed writes the transformed body data to dst
+func (m *bodyModification) writeTransformed(src bodySource, dst bodySink) error {
+	if m.transformWriter != nil {
+		transformed := m.transformWriter(writerFunc(dst))
+		if err := m.readOriginal(src, func(data []byte) error {
+			return util.WriteWithValidation(transformed, data)
+		}); err != nil {
+			transformed.Close()
+			return err
+		}
+		if err := transformed.Close(); err != nil {
+			return util.ErrWrapper(err, "fail to transform body")
+		}
+		return nil
+	}
+
+	//feed the original body to the transformer while reading it
+	bodyReader, bodyWriter := io.Pipe()
+	readErr := make(chan error, 1)
+	go func() {
+		var pipeErr error
+		err := m.readOriginal(src, func(data []byte) error {
+			//keep reading the body to the end even if the transformer stops early,
+			//so the following messages of the connection are not broken
+			if pipeErr == nil {
+				_, pipeErr = bodyWriter.Write(data)
+			}
+			return nil
+		})
+		bodyWriter.CloseWithError(err)
+		readErr <- err
+	}()
+
+	buffer := bytebufferpool.Get()
+	defer bytebufferpool.Put(buffer)
+	_, err := buffer.Copy(writerFunc(dst), m.transform(bodyReader))
+	bodyReader.Close()
+	if e := <-readErr; e != nil {
+		return e
+	}
+	if err != nil {
+		return util.ErrWrapper(err, "fail to transform body")
+	}
+	return nil
+}
+
+//writerFunc io.Writer writes data to the sink
+type writerFunc bodySink
+
+func (w writerFunc) Write(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if err := w(data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+//writeChunk writes data as a chunk to dst
+func writeChunk(dst http.BodyWrapper, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	chunkHeader := strconv.AppendInt(nil, int64(len(data)), 16)
+	chunkHeader = append(chunkHeader, chunkCRLF...)
+	if err := dst(true, chunkHeader); err != nil {
+		return err
+	}
+	if err := dst(false, data); err != nil {
+		return err
+	}
+	return dst(false, chunkCRLF)
+}
@@ -0,0 +1,368 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	gohttp "net/http"
+	"strings"
+	"testing"
+
+	"github.com/haxii/fastproxy/hijack"
+	"github.com/haxii/fastproxy/http"
+)
+
+//modifyingHijacker modifies the request with modifyRequest and the response
+//with modifyResponse, the bodies sniffed are recorded in reqBody & respBody
+type modifyingHijacker struct {
+	modifyRequest  func(req hijack.RequestModifier)
+	modifyResponse func(resp hijack.ResponseModifier)
+	reqBody        bytes.Buffer
+	respBody       bytes.Buffer
+}
+
+func (h *modifyingHijacker) OnRequest(header http.Header, rawHeader []byte) io.Writer {
+	return &h.reqBody
+}
+
+func (h *modifyingHijacker) OnResponse(statusLine http.ResponseLine,
+	header http.Header, rawHeader []byte) io.Writer {
+	return &h.respBody
+}
+
+func (h *modifyingHijacker) HijackResponse() io.Reader {
+	return nil
+}
+
+func (h *modifyingHijacker) HijackRequest(req hijack.RequestModifier) {
+	if h.modifyRequest != nil {
+		h.modifyRequest(req)
+	}
+}
+
+func (h *modifyingHijacker) ModifyResponse(resp hijack.ResponseModifier) {
+	if h.modifyResponse != nil {
+		h.modifyResponse(resp)
+	}
+}
+
+//modifyRequest reads the request from raw, then modifies it with h as the proxy does,
+//the reader is returned for checking the bytes left
+func modifyRequest(t *testing.T, raw string, isTLS bool, h *modifyingHijacker) (*Request, *bufio.Reader) {
+	req := &Request{}
+	reader := bufio.NewReader(strings.NewReader(raw))
+	if err := req.ReadFrom(reader); err != nil {
+		t.Fatalf("fail to read request %q: %s", raw, err)
+	}
+	if isTLS {
+		req.SetTLS("")
+	}
+	req.SetHijacker(h)
+	h.HijackRequest(req.Modifier())
+	return req, reader
+}
+
+//writeRequest writes req in origin-form as the client does
+func writeRequest(t *testing.T, req *Request) string {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	w.WriteString(string(req.Method()) + " " + string(req.PathWithQueryFragment()) +
+		" " + string(req.Protocol()) + "\r\n")
+	if err := req.WriteHeaderTo(w); err != nil {
+		t.Fatalf("fail to write request header: %s", err)
+	}
+	if err := req.WriteBodyTo(w); err != nil {
+		t.Fatalf("fail to write request body: %s", err)
+	}
+	w.Flush()
+	return b.String()
+}
+
+func TestRequestModifier(t *testing.T) {
+	const next = "GET /next HTTP/1.1\r\nHost: a.com\r\n\r\n"
+	tests := []struct {
+		name   string
+		raw    string
+		isTLS  bool
+		modify func(req hijack.RequestModifier)
+		//expWritten the request written, expBody the body sniffed,
+		//expHost the target changed if any
+		expWritten string
+		expBody    string
+		expHost    string
+	}{
+		{
+			name: "request line",
+			raw:  "post /a HTTP/1.1\r\nHost: a.com\r\nContent-Length: 5\r\n\r\nhello",
+			modify: func(req hijack.RequestModifier) {
+				req.SetMethod("put")
+				req.SetPathWithQueryFragment("/b?c=d")
+			},
+			expWritten: "PUT /b?c=d HTTP/1.1\r\nHost: a.com\r\nContent-Length: 5\r\n\r\nhello",
+			expBody:    "hello",
+		},
+		{
+			name: "host",
+			raw:  "GET / HTTP/1.1\r\nHost: a.com\r\n\r\n",
+			modify: func(req hijack.RequestModifier) {
+				req.SetHostWithPort("b.com:8080")
+			},
+			expWritten: "GET / HTTP/1.1\r\nHost: b.com:8080\r\n\r\n",
+			expHost:    "b.com:8080",
+		},
+		{
+			name:  "host of default port",
+			raw:   "GET / HTTP/1.1\r\nHost: a.com\r\n\r\n",
+			isTLS: true,
+			modify: func(req hijack.RequestModifier) {
+				req.SetHostWithPort("[::1]:443")
+			},
+			expWritten: "GET / HTTP/1.1\r\nHost: [::1]\r\n\r\n",
+			expHost:    "[::1]:443",
+		},
+		{
+			name: "header",
+			raw:  "GET / HTTP/1.1\r\nHost: a.com\r\nX-A: 1\r\nX-B: 2\r\nX-B: 3\r\n\r\n",
+			modify: func(req hijack.RequestModifier) {
+				req.AddHeaderValue("X-A", "4")
+				req.SetHeaderValue("X-C", "5")
+				req.DelHeader("x-b")
+				//the framing headers are left alone
+				req.SetHeaderValue("Content-Length", "10")
+				req.AddHeaderValue("Transfer-Encoding", "chunked")
+			},
+			expWritten: "GET / HTTP/1.1\r\nHost: a.com\r\nX-A: 1, 4\r\nX-C: 5\r\n\r\n",
+		},
+		{
+			name: "body replaced",
+			raw: "POST / HTTP/1.1\r\nHost: a.com\r\nTransfer-Encoding: chunked\r\nTrailer: X-T\r\n\r\n" +
+				"5\r\nhello\r\n0\r\nX-T: 1\r\n\r\n",
+			modify: func(req hijack.RequestModifier) {
+				req.SetBody([]byte("bye"))
+			},
+			expWritten: "POST / HTTP/1.1\r\nHost: a.com\r\nContent-Length: 3\r\n\r\nbye",
+			expBody:    "bye",
+		},
+		{
+			name: "body of GET not sent",
+			raw:  "GET / HTTP/1.1\r\nHost: a.com\r\n\r\n",
+			modify: func(req hijack.RequestModifier) {
+				req.SetBody([]byte("ignored"))
+			},
+			expWritten: "GET / HTTP/1.1\r\nHost: a.com\r\n\r\n",
+		},
+		{
+			name: "body transformed in chunks",
+			raw:  "POST / HTTP/1.1\r\nHost: a.com\r\nContent-Length: 5\r\n\r\nhello",
+			modify: func(req hijack.RequestModifier) {
+				req.TransformBody(func(body io.Reader) io.Reader {
+					b, _ := io.ReadAll(body)
+					return bytes.NewReader(bytes.ToUpper(b))
+				})
+			},
+			expWritten: "POST / HTTP/1.1\r\nHost: a.com\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"5\r\nHELLO\r\n0\r\n\r\n",
+			expBody: "5\r\nHELLO\r\n0\r\n\r\n",
+		},
+		{
+			name: "body transformed and buffered in HTTP/1.0",
+			raw: "POST / HTTP/1.0\r\nHost: a.com\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"2\r\nhe\r\n3\r\nllo\r\n0\r\n\r\n",
+			modify: func(req hijack.RequestModifier) {
+				req.TransformBodyWriter(func(w io.Writer) io.WriteCloser {
+					return upperWriter{w}
+				})
+			},
+			expWritten: "POST / HTTP/1.0\r\nHost: a.com\r\nContent-Length: 5\r\n\r\nHELLO",
+			expBody:    "HELLO",
+		},
+	}
+	for _, test := range tests {
+		h := &modifyingHijacker{modifyRequest: test.modify}
+		req, reader := modifyRequest(t, test.raw+next, test.isTLS, h)
+		if written := writeRequest(t, req); written != test.expWritten {
+			t.Fatalf("%s: unexpected request written %q, expecting %q", test.name, written, test.expWritten)
+		}
+		if h.reqBody.String() != test.expBody {
+			t.Fatalf("%s: unexpected body sniffed %q, expecting %q", test.name, h.reqBody.String(), test.expBody)
+		}
+		if hostWithPort := req.HostInfo().HostWithPort(); len(test.expHost) > 0 &&
+			hostWithPort != test.expHost {
+			t.Fatalf("%s: unexpected target %s, expecting %s", test.name, hostWithPort, test.expHost)
+		}
+		//the original body is read to the end, so the next request is kept
+		if left, _ := io.ReadAll(reader); string(left) != next {
+			t.Fatalf("%s: unexpected bytes %q left", test.name, left)
+		}
+		//the request written is a valid one
+		if _, err := gohttp.ReadRequest(bufio.NewReader(strings.NewReader(test.expWritten))); err != nil {
+			t.Fatalf("%s: invalid request written: %s", test.name, err)
+		}
+	}
+
+	//the TLS server name follows the host changed
+	h := &modifyingHijacker{modifyRequest: func(req hijack.RequestModifier) {
+		req.SetHostWithPort("b.com:443")
+	}}
+	req, _ := modifyRequest(t, "GET / HTTP/1.1\r\nHost: a.com\r\n\r\n", true, h)
+	if req.TLSServerName() != "b.com" {
+		t.Fatalf("unexpected TLS server name %q, expecting b.com", req.TLSServerName())
+	}
+}
+
+//modifyResponse reads the response from raw modified by h, returns the response
+//written and the bytes left in raw
+func modifyResponse(t *testing.T, raw string, discardBody bool, h *modifyingHijacker) (
+	resp *Response, written, left string) {
+	resp = &Response{}
+	resp.SetHijacker(h)
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	resp.WriteTo(w)
+	reader := bufio.NewReader(strings.NewReader(raw))
+	if err := resp.ReadFrom(discardBody, reader); err != nil {
+		t.Fatalf("fail to read response %q: %s", raw, err)
+	}
+	w.Flush()
+	rest, _ := io.ReadAll(reader)
+	return resp, b.String(), string(rest)
+}
+
+func TestResponseModifier(t *testing.T) {
+	const next = "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	upper := func(resp hijack.ResponseModifier) {
+		resp.TransformBody(func(body io.Reader) io.Reader {
+			b, _ := io.ReadAll(body)
+			return bytes.NewReader(bytes.ToUpper(b))
+		})
+	}
+	tests := []struct {
+		name        string
+		raw         string
+		discardBody bool
+		modify      func(resp hijack.ResponseModifier)
+		//expWritten the response written, expBody the body sniffed,
+		//expLeft the bytes left unread after the response
+		expWritten     string
+		expBody        string
+		expLeft        string
+		closeDelimited bool
+	}{
+		{
+			name: "status",
+			raw:  "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello" + next,
+			modify: func(resp hijack.ResponseModifier) {
+				resp.SetStatus(201, "")
+			},
+			expWritten: "HTTP/1.1 201 Created\r\nContent-Length: 5\r\n\r\nhello",
+			expBody:    "hello",
+			expLeft:    next,
+		},
+		{
+			name: "header",
+			raw:  "HTTP/1.1 200 OK\r\nX-A: 1\r\nX-B: 2\r\nContent-Length: 5\r\n\r\nhello" + next,
+			modify: func(resp hijack.ResponseModifier) {
+				resp.AddHeaderValue("X-A", "3")
+				resp.SetHeaderValue("X-C", "4")
+				resp.DelHeader("X-B")
+				//the framing headers are left alone
+				resp.DelHeader("Content-Length")
+				resp.SetHeaderValue("Transfer-Encoding", "chunked")
+			},
+			expWritten: "HTTP/1.1 200 OK\r\nX-A: 1, 3\r\nContent-Length: 5\r\nX-C: 4\r\n\r\nhello",
+			expBody:    "hello",
+			expLeft:    next,
+		},
+		{
+			name: "body replaced",
+			raw:  "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n" + next,
+			modify: func(resp hijack.ResponseModifier) {
+				resp.SetBody([]byte("bye"))
+			},
+			expWritten: "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\nbye",
+			expBody:    "bye",
+			expLeft:    next,
+		},
+		{
+			name:       "body transformed in chunks",
+			raw:        "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello" + next,
+			modify:     upper,
+			expWritten: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nHELLO\r\n0\r\n\r\n",
+			expBody:    "5\r\nHELLO\r\n0\r\n\r\n",
+			expLeft:    next,
+		},
+		{
+			name:           "close-delimited",
+			raw:            "HTTP/1.1 200 OK\r\nX-A: 1\r\n\r\nhello",
+			modify:         func(resp hijack.ResponseModifier) { resp.SetHeaderValue("X-A", "2") },
+			expWritten:     "HTTP/1.1 200 OK\r\nX-A: 2\r\n\r\nhello",
+			expBody:        "hello",
+			closeDelimited: true,
+		},
+		{
+			name:           "close-delimited body transformed in chunks",
+			raw:            "HTTP/1.1 200 OK\r\n\r\nhello",
+			modify:         upper,
+			expWritten:     "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nHELLO\r\n0\r\n\r\n",
+			expBody:        "5\r\nHELLO\r\n0\r\n\r\n",
+			closeDelimited: true,
+		},
+		{
+			name:           "close-delimited body transformed and buffered in HTTP/1.0",
+			raw:            "HTTP/1.0 200 OK\r\n\r\nhello",
+			modify:         upper,
+			expWritten:     "HTTP/1.0 200 OK\r\nContent-Length: 5\r\n\r\nHELLO",
+			expBody:        "HELLO",
+			closeDelimited: true,
+		},
+		{
+			name:        "HEAD",
+			raw:         "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n" + next,
+			discardBody: true,
+			modify: func(resp hijack.ResponseModifier) {
+				resp.SetBody([]byte("ignored"))
+				resp.SetHeaderValue("X-A", "1")
+			},
+			expWritten: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nX-A: 1\r\n\r\n",
+			expLeft:    next,
+		},
+		{
+			name: "304",
+			raw:  "HTTP/1.1 304 Not Modified\r\nETag: \"a\"\r\n\r\n" + next,
+			modify: func(resp hijack.ResponseModifier) {
+				upper(resp)
+			},
+			expWritten: "HTTP/1.1 304 Not Modified\r\nETag: \"a\"\r\n\r\n",
+			expLeft:    next,
+		},
+	}
+	for _, test := range tests {
+		h := &modifyingHijacker{modifyResponse: test.modify}
+		resp, written, left := modifyResponse(t, test.raw, test.discardBody, h)
+		if written != test.expWritten {
+			t.Fatalf("%s: unexpected response written %q, expecting %q", test.name, written, test.expWritten)
+		}
+		if h.respBody.String() != test.expBody {
+			t.Fatalf("%s: unexpected body sniffed %q, expecting %q", test.name, h.respBody.String(), test.expBody)
+		}
+		if left != test.expLeft {
+			t.Fatalf("%s: unexpected bytes %q left, expecting %q", test.name, left, test.expLeft)
+		}
+		if resp.IsCloseDelimited() != test.closeDelimited {
+			t.Fatalf("%s: unexpected close-delimited %v", test.name, resp.IsCloseDelimited())
+		}
+	}
+}
+
+//upperWriter writes the data in upper case to the writer
+type upperWriter struct {
+	io.Writer
+}
+
+func (w upperWriter) Write(data []byte) (int, error) {
+	return w.Writer.Write(bytes.ToUpper(data))
+}
+
+func (w upperWriter) Close() error {
+	return nil
+}
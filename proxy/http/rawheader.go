@@ -0,0 +1,102 @@
+package http
+
+import (
+	"bytes"
+
+	"github.com/haxii/fastproxy/bytebufferpool"
+)
+
+/*
+ * helpers editing the raw header fields, i.e. lines ending with (CR)LF
+ * which are terminated by an empty line
+ */
+
+//rawHeaderField finds the 1st header field named name in raw,
+//returns the start and the end (CRLF excluded) of the field line
+func rawHeaderField(raw []byte, name string) (start, end int, ok bool) {
+	for start < len(raw) {
+		lineEnd := bytes.IndexByte(raw[start:], '\n')
+		if lineEnd < 0 {
+			return 0, 0, false
+		}
+		lineEnd += start
+		line := raw[start:lineEnd]
+		if len(line) > len(name) && line[len(name)] == ':' &&
+			bytes.EqualFold(line[:len(name)], []byte(name)) {
+			end = lineEnd
+			if end > start && raw[end-1] == '\r' {
+				end--
+			}
+			return start, end, true
+		}
+		start = lineEnd + 1
+	}
+	return 0, 0, false
+}
+
+//rawHeaderValue value of the 1st header field named name in raw
+func rawHeaderValue(raw []byte, name string) ([]byte, bool) {
+	start, end, ok := rawHeaderField(raw, name)
+	if !ok {
+		return nil, false
+	}
+	return bytes.TrimSpace(raw[start+len(name)+1 : end]), true
+}
+
+//addRawHeaderValue appends value to the 1st header field named name with a comma,
+//as list based fields can be combined (RFC 7230 3.2.2),
+//a new field is added before the empty line if name is not found
+func addRawHeaderValue(buffer *bytebufferpool.ByteBuffer, name, value string) {
+	if _, end, ok := rawHeaderField(buffer.B, name); ok {
+		insertRawHeader(buffer, end, ", "+value)
+		return
+	}
+	insertRawHeader(buffer, rawHeaderEnd(buffer.B), name+": "+value+"\r\n")
+}
+
+//setRawHeaderValue replaces the value of the 1st header field named name,
+//a new field is added before the empty line if name is not found
+func setRawHeaderValue(buffer *bytebufferpool.ByteBuffer, name, value string) {
+	if start, end, ok := rawHeaderField(buffer.B, name); ok {
+		field := name + ": " + value
+		tail := append([]byte(field), buffer.B[end:]...)
+		buffer.B = append(buffer.B[:start], tail...)
+		return
+	}
+	insertRawHeader(buffer, rawHeaderEnd(buffer.B), name+": "+value+"\r\n")
+}
+
+//delRawHeader removes all the header fields named name
+func delRawHeader(buffer *bytebufferpool.ByteBuffer, name string) {
+	for {
+		start, end, ok := rawHeaderField(buffer.B, name)
+		if !ok {
+			return
+		}
+		//remove the line with its (CR)LF
+		end += bytes.IndexByte(buffer.B[end:], '\n') + 1
+		buffer.B = append(buffer.B[:start], buffer.B[end:]...)
+	}
+}
+
+//rawHeaderEnd position of the terminating empty line
+func rawHeaderEnd(raw []byte) int {
+	switch {
+	case bytes.HasSuffix(raw, []byte("\r\n\r\n")):
+		return len(raw) - 2
+	case bytes.HasSuffix(raw, []byte("\n\n")):
+		return len(raw) - 1
+	case bytes.Equal(raw, []byte("\r\n")), bytes.Equal(raw, []byte("\n")):
+		return 0
+	}
+	return len(raw)
+}
+
+func insertRawHeader(buffer *bytebufferpool.ByteBuffer, pos int, s string) {
+	tail := append([]byte(s), buffer.B[pos:]...)
+	buffer.B = append(buffer.B[:pos], tail...)
+	//a raw header without any field has no empty line written
+	if len(buffer.B) == len(s) {
+		buffer.B = append(buffer.B, "\r\n"...)
+	}
+}
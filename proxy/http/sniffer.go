@@ -0,0 +1,88 @@
+package http
+
+import (
+	"io"
+
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/util"
+)
+
+//bodySniffer writes the body sent to the hijacker's body writer, the body is
+//decoded by the transfer coding and the content coding if decoding is enabled,
+//the writing is synchronous, the content coding is decoded via an io.Pipe as well,
+//so a slow body writer throttles the body forwarded
+type bodySniffer struct {
+	w io.Writer
+	//err the 1st error of sniffing, the body is not sniffed any more after it
+	err error
+
+	//decode decodes the transfer coding, nil means the raw body is sniffed
+	decode http.BodyWrapper
+	//contentEncoding content coding of the body to decode
+	contentEncoding string
+	//decoder decodes the content coding, made on the 1st write
+	decoder io.WriteCloser
+	//decoderFailed if the content coding can't be decoded
+	decoderFailed bool
+}
+
+//reset prepares the sniffer for a new body written to w, bodyType is how
+//the body sent is framed, rawHeader is the header sent before the body
+func (s *bodySniffer) reset(w io.Writer, decode bool, bodyType http.BodyType, rawHeader []byte) {
+	s.close()
+	s.w = w
+	s.err = nil
+	s.decode = nil
+	s.contentEncoding = ""
+	s.decoderFailed = false
+	if !decode || w == nil {
+		return
+	}
+	if contentEncoding, ok := rawHeaderValue(rawHeader, "Content-Encoding"); ok {
+		s.contentEncoding = string(contentEncoding)
+	}
+	s.decode = http.DecodedBodyWrapper(bodyType, s.writeDecoded)
+}
+
+//write writes the body data sent, whose chunk headers are told by isChunkHeader
+func (s *bodySniffer) write(isChunkHeader bool, data []byte) {
+	if s.err != nil {
+		return
+	}
+	if s.decode != nil {
+		s.err = s.decode(isChunkHeader, data)
+	} else {
+		s.err = util.WriteWithValidation(s.w, data)
+	}
+	if s.err != nil {
+		//the rest of the body is forwarded without sniffing
+		s.close()
+	}
+}
+
+func (s *bodySniffer) writeDecoded(data []byte) error {
+	if len(s.contentEncoding) == 0 {
+		return util.WriteWithValidation(s.w, data)
+	}
+	if s.decoder == nil && !s.decoderFailed {
+		if s.decoder = http.NewContentDecoder(s.w, s.contentEncoding); s.decoder == nil {
+			//unsupported content coding is sniffed as is
+			s.decoderFailed = true
+		}
+	}
+	if s.decoder == nil {
+		return util.WriteWithValidation(s.w, data)
+	}
+	return util.WriteWithValidation(s.decoder, data)
+}
+
+//close ends the body, it waits for the decoded data written to the hijacker,
+//the error of decoding is recorded
+func (s *bodySniffer) close() {
+	if s.decoder != nil {
+		if err := s.decoder.Close(); err != nil && s.err == nil {
+			s.err = err
+		}
+		s.decoder = nil
+	}
+}
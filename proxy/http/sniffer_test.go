@@ -0,0 +1,56 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+
+	"github.com/haxii/fastproxy/http"
+)
+
+//failingWriter fails the writes after n bytes written
+type failingWriter struct {
+	b bytes.Buffer
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.b.Len()+len(p) > w.n {
+		return 0, errors.New("writer fails")
+	}
+	return w.b.Write(p)
+}
+
+func TestBodySnifferError(t *testing.T) {
+	//the body is not sniffed any more once the writing fails
+	w := &failingWriter{n: 5}
+	s := &bodySniffer{}
+	s.reset(w, false, http.BodyTypeIdentity, nil)
+	for _, data := range []string{"hello", " world", "!"} {
+		s.write(false, []byte(data))
+	}
+	if s.err == nil || w.b.String() != "hello" {
+		t.Fatalf("unexpected body sniffed %q with error %v", w.b.String(), s.err)
+	}
+	//the error is cleared for the next body
+	s.reset(w, false, http.BodyTypeIdentity, nil)
+	if s.err != nil {
+		t.Fatalf("error %s is kept for the next body", s.err)
+	}
+
+	//the same for the body decoded by the content coding
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(bytes.Repeat([]byte("hello"), 1000))
+	zw.Close()
+	w = &failingWriter{n: 5}
+	s.reset(w, true, http.BodyTypeIdentity, []byte("Content-Encoding: gzip\r\n"))
+	for _, b := range gz.Bytes() {
+		s.write(false, []byte{b})
+	}
+	s.close()
+	if s.err == nil || w.b.Len() > 5 {
+		t.Fatalf("unexpected body sniffed %q with error %v", w.b.String(), s.err)
+	}
+}
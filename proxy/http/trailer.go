@@ -0,0 +1,29 @@
+package http
+
+import "github.com/haxii/fastproxy/hijack"
+
+//endBody ends the request body written with err, it waits for the decoded
+//body written to hijacker, then tells hijacker the trailer fields if any
+func (r *Request) endBody(err error) error {
+	r.sniffer.close()
+	if err != nil || r.body.Trailer().Len() == 0 {
+		return err
+	}
+	if trailerHijacker, ok := r.hijacker.(hijack.TrailerHijacker); ok {
+		trailerHijacker.OnRequestTrailer(*r.body.Trailer())
+	}
+	return nil
+}
+
+//endBody ends the response body written with err, it waits for the decoded
+//body written to hijacker, then tells hijacker the trailer fields if any
+func (r *Response) endBody(err error) error {
+	r.sniffer.close()
+	if err != nil || r.body.Trailer().Len() == 0 {
+		return err
+	}
+	if trailerHijacker, ok := r.hijacker.(hijack.TrailerHijacker); ok {
+		trailerHijacker.OnResponseTrailer(*r.body.Trailer())
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultNonceMaxAge is the default max age of a digest nonce
+const DefaultNonceMaxAge = 5 * time.Minute
+
+// ProxyAuthenticator authenticates proxy clients with the
+// `Proxy-Authorization` header, both Basic and Digest (RFC 7616, MD5 & qop=auth)
+// schemes are supported, the client is challenged with
+// `407 Proxy Authentication Required` when the credentials are missing or invalid.
+//
+// The `uri` directive of a digest response must be the request-target of the
+// request, and the nonce-count must increase with each request using the same
+// nonce, so a captured digest response can't be replayed. The RFC 2069 response
+// without qop is refused, as it has no nonce-count.
+type ProxyAuthenticator struct {
+	// Realm of the protection space shown to client
+	Realm string
+
+	// Basic validates user & password of the Basic scheme,
+	// nil disables the Basic scheme
+	Basic func(user, password string) bool
+
+	// DigestHA1 returns the hex encoded MD5(user:realm:password) of user
+	// for the Digest scheme, false is returned if user is unknown,
+	// nil disables the Digest scheme
+	DigestHA1 func(user, realm string) (ha1 string, ok bool)
+
+	// NonceMaxAge max age of a digest nonce before it turns stale,
+	// DefaultNonceMaxAge is used if not set
+	NonceMaxAge time.Duration
+
+	nonceKey     []byte
+	nonceKeyOnce sync.Once
+
+	// nonceCounts the last nonce-count used with each nonce, see useNonceCount
+	nonceCounts     map[string]nonceCount
+	nonceCountsLock sync.Mutex
+	// nonceCountsSweepSize the size of nonceCounts to forget the expired nonces
+	nonceCountsSweepSize int
+}
+
+// nonceCount the last nonce-count used with a nonce
+type nonceCount struct {
+	nc     uint64
+	issued time.Time
+}
+
+// authenticate validates the `Proxy-Authorization` header value of the request
+// with method and requestURI, i.e. the request-target of its request line,
+// returns the authenticated user if ok, stale is true when
+// a valid digest response is sent with an expired nonce
+func (a *ProxyAuthenticator) authenticate(method, requestURI []byte,
+	authorization string) (user string, stale bool, ok bool) {
+	scheme, credentials := splitAuthScheme(authorization)
+	switch {
+	case strings.EqualFold(scheme, "Basic") && a.Basic != nil:
+		return a.authenticateBasic(credentials)
+	case strings.EqualFold(scheme, "Digest") && a.DigestHA1 != nil:
+		return a.authenticateDigest(method, string(requestURI), credentials)
+	}
+	return "", false, false
+}
+
+func (a *ProxyAuthenticator) authenticateBasic(credentials string) (string, bool, bool) {
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", false, false
+	}
+	userPass := string(decoded)
+	i := strings.IndexByte(userPass, ':')
+	if i < 0 {
+		return "", false, false
+	}
+	user, pass := userPass[:i], userPass[i+1:]
+	if !a.Basic(user, pass) {
+		return "", false, false
+	}
+	return user, false, true
+}
+
+func (a *ProxyAuthenticator) authenticateDigest(method []byte, requestURI,
+	credentials string) (string, bool, bool) {
+	params := parseDigestParams(credentials)
+	user := params["username"]
+	if len(user) == 0 || params["realm"] != a.Realm {
+		return "", false, false
+	}
+	//the response is bound to the request-target, so it's not replayed for other ones
+	if !digestURIMatches(params["uri"], requestURI) {
+		return "", false, false
+	}
+	if algorithm := params["algorithm"]; len(algorithm) > 0 && !strings.EqualFold(algorithm, "MD5") {
+		return "", false, false
+	}
+	ha1, ok := a.DigestHA1(user, a.Realm)
+	if !ok {
+		return "", false, false
+	}
+
+	//only qop=auth is accepted, the RFC 2069 response without qop has no
+	//nonce-count, which can't be checked against replaying
+	if params["qop"] != "auth" {
+		return "", false, false
+	}
+	nc, err := strconv.ParseUint(params["nc"], 16, 32)
+	if err != nil || nc == 0 {
+		return "", false, false
+	}
+	nonce := params["nonce"]
+	ha2 := md5Hex(string(method) + ":" + params["uri"])
+	expected := md5Hex(ha1 + ":" + nonce + ":" + params["nc"] + ":" +
+		params["cnonce"] + ":auth:" + ha2)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(params["response"])) != 1 {
+		return "", false, false
+	}
+
+	//check the nonce at last, so a stale nonce is reported
+	//only if the credentials are correct
+	issued, valid, expired := a.checkNonce(nonce)
+	if !valid {
+		return "", false, false
+	}
+	if expired {
+		return "", true, false
+	}
+	if !a.useNonceCount(nonce, nc, issued) {
+		return "", false, false
+	}
+	return user, false, true
+}
+
+// digestURIMatches if the `uri` directive is the request-target, the origin-form
+// of an absolute-form target is accepted as well, as it's sent by some clients
+func digestURIMatches(digestURI, requestURI string) bool {
+	if len(digestURI) == 0 {
+		return false
+	}
+	if digestURI == requestURI {
+		return true
+	}
+	schemeEnd := strings.Index(requestURI, "://")
+	if schemeEnd <= 0 {
+		return false
+	}
+	authority := requestURI[schemeEnd+3:]
+	pathStart := strings.IndexByte(authority, '/')
+	if pathStart < 0 {
+		return digestURI == "/"
+	}
+	return digestURI == authority[pathStart:]
+}
+
+// useNonceCount records nc as the last nonce-count used with nonce issued at
+// issued, false is returned if nc is not greater than the last one,
+// i.e. the request is replayed
+func (a *ProxyAuthenticator) useNonceCount(nonce string, nc uint64, issued time.Time) bool {
+	a.nonceCountsLock.Lock()
+	defer a.nonceCountsLock.Unlock()
+	last, ok := a.nonceCounts[nonce]
+	if ok && nc <= last.nc {
+		return false
+	}
+	if !ok {
+		if a.nonceCounts == nil {
+			a.nonceCounts = make(map[string]nonceCount)
+		}
+		//forget the expired nonces, which are rejected as stale before used
+		if len(a.nonceCounts) >= a.nonceCountsSweepSize {
+			maxAge := a.nonceMaxAge()
+			for n, c := range a.nonceCounts {
+				if time.Since(c.issued) > maxAge {
+					delete(a.nonceCounts, n)
+				}
+			}
+			a.nonceCountsSweepSize = 2*len(a.nonceCounts) + minNonceCountsSweepSize
+		}
+	}
+	a.nonceCounts[nonce] = nonceCount{nc: nc, issued: issued}
+	return true
+}
+
+// minNonceCountsSweepSize min growth of the nonce counts before the expired ones are forgotten
+const minNonceCountsSweepSize = 1024
+
+// validatePassword validates the plain user & password,
+// e.g. the RFC 1929 username/password of a SOCKS5 client
+func (a *ProxyAuthenticator) validatePassword(user, password string) bool {
+	if a.Basic != nil {
+		return a.Basic(user, password)
+	}
+	if a.DigestHA1 != nil {
+		ha1, ok := a.DigestHA1(user, a.Realm)
+		return ok && subtle.ConstantTimeCompare([]byte(ha1),
+			[]byte(md5Hex(user+":"+a.Realm+":"+password))) == 1
+	}
+	return false
+}
+
+// challenges `Proxy-Authenticate` header lines with CRLF for each enabled scheme
+func (a *ProxyAuthenticator) challenges(stale bool) string {
+	var b strings.Builder
+	if a.DigestHA1 != nil {
+		b.WriteString(`Proxy-Authenticate: Digest realm="`)
+		b.WriteString(a.Realm)
+		b.WriteString(`", qop="auth", algorithm=MD5, nonce="`)
+		b.WriteString(a.makeNonce())
+		b.WriteString(`"`)
+		if stale {
+			b.WriteString(", stale=true")
+		}
+		b.WriteString("\r\n")
+	}
+	if a.Basic != nil {
+		b.WriteString(`Proxy-Authenticate: Basic realm="`)
+		b.WriteString(a.Realm)
+		b.WriteString("\"\r\n")
+	}
+	return b.String()
+}
+
+// nonce is a stateless one made by timestamp and its HMAC
+const (
+	nonceTimeSize = 8
+	nonceMACSize  = 16
+)
+
+func (a *ProxyAuthenticator) initNonceKey() {
+	a.nonceKeyOnce.Do(func() {
+		a.nonceKey = make([]byte, 32)
+		if _, err := rand.Read(a.nonceKey); err != nil {
+			panic("BUG: fail to generate digest nonce key: " + err.Error())
+		}
+	})
+}
+
+func (a *ProxyAuthenticator) makeNonce() string {
+	a.initNonceKey()
+	b := make([]byte, nonceTimeSize, nonceTimeSize+nonceMACSize)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+	b = append(b, a.nonceMAC(b)...)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (a *ProxyAuthenticator) checkNonce(nonce string) (issued time.Time, valid, expired bool) {
+	a.initNonceKey()
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != nonceTimeSize+nonceMACSize {
+		return issued, false, false
+	}
+	if !hmac.Equal(b[nonceTimeSize:], a.nonceMAC(b[:nonceTimeSize])) {
+		return issued, false, false
+	}
+	issued = time.Unix(0, int64(binary.BigEndian.Uint64(b[:nonceTimeSize])))
+	return issued, true, time.Since(issued) > a.nonceMaxAge()
+}
+
+func (a *ProxyAuthenticator) nonceMaxAge() time.Duration {
+	if a.NonceMaxAge <= 0 {
+		return DefaultNonceMaxAge
+	}
+	return a.NonceMaxAge
+}
+
+func (a *ProxyAuthenticator) nonceMAC(t []byte) []byte {
+	mac := hmac.New(sha256.New, a.nonceKey)
+	mac.Write(t)
+	return mac.Sum(nil)[:nonceMACSize]
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// splitAuthScheme splits `scheme credentials`
+func splitAuthScheme(authorization string) (scheme, credentials string) {
+	authorization = strings.TrimSpace(authorization)
+	i := strings.IndexByte(authorization, ' ')
+	if i < 0 {
+		return authorization, ""
+	}
+	return authorization[:i], strings.TrimSpace(authorization[i+1:])
+}
+
+// parseDigestParams parses comma separated `key=value` or `key="value"` pairs
+func parseDigestParams(s string) map[string]string {
+	params := make(map[string]string, 10)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " \t,")
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		var val string
+		if len(s) > 0 && s[0] == '"' {
+			//quoted-string with backslash escaping
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			val = b.String()
+			if i < len(s) {
+				i++
+			}
+			s = s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			val = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[key] = val
+	}
+	return params
+}
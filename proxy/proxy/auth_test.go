@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestProxyAuthenticatorBasic(t *testing.T) {
+	a := &ProxyAuthenticator{
+		Realm: "fastproxy",
+		Basic: func(user, password string) bool {
+			return user == "user" && password == "pass"
+		},
+	}
+	basic := func(s string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	testAuthenticate(t, a, basic("user:pass"), "user", true)
+	testAuthenticate(t, a, basic("user:wrong"), "", false)
+	testAuthenticate(t, a, basic("userpass"), "", false)
+	testAuthenticate(t, a, "Basic !!!", "", false)
+	testAuthenticate(t, a, "", "", false)
+	//digest scheme is not enabled
+	testAuthenticate(t, a, `Digest username="user"`, "", false)
+}
+
+func TestProxyAuthenticatorDigest(t *testing.T) {
+	a := &ProxyAuthenticator{
+		Realm: "fastproxy",
+		DigestHA1: func(user, realm string) (string, bool) {
+			return md5Hex(user + ":" + realm + ":pass"), user == "user"
+		},
+	}
+	nonce := a.makeNonce()
+	ha1 := md5Hex("user:fastproxy:pass")
+	ha2 := md5Hex("CONNECT:www.example.com:443")
+	response := md5Hex(ha1 + ":" + nonce + ":00000001:abc:auth:" + ha2)
+	digest := func(user, nonce, response string) string {
+		return `Digest username="` + user + `", realm="fastproxy", nonce="` + nonce +
+			`", uri="www.example.com:443", qop=auth, nc=00000001, cnonce="abc", response="` +
+			response + `"`
+	}
+	testAuthenticate(t, a, digest("user", nonce, response), "user", true)
+	testAuthenticate(t, a, digest("user", nonce, md5Hex("wrong")), "", false)
+	testAuthenticate(t, a, digest("other", nonce, response), "", false)
+	testAuthenticate(t, a, digest("user", "forged"+nonce, response), "", false)
+
+	//stale nonce with correct credentials
+	a.NonceMaxAge = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, stale, ok := a.authenticate([]byte("CONNECT"), []byte("www.example.com:443"),
+		digest("user", nonce, response)); ok || !stale {
+		t.Fatalf("unexpected auth result %t, stale %t, expecting a stale nonce", ok, stale)
+	}
+}
+
+func TestProxyAuthenticatorDigestReplay(t *testing.T) {
+	a := &ProxyAuthenticator{
+		Realm: "fastproxy",
+		DigestHA1: func(user, realm string) (string, bool) {
+			return md5Hex(user + ":" + realm + ":pass"), user == "user"
+		},
+	}
+	nonce := a.makeNonce()
+	digest := func(method, uri, nc string) string {
+		ha2 := md5Hex(method + ":" + uri)
+		response := md5Hex(md5Hex("user:fastproxy:pass") + ":" + nonce + ":" + nc + ":abc:auth:" + ha2)
+		return `Digest username="user", realm="fastproxy", nonce="` + nonce + `", uri="` + uri +
+			`", qop=auth, nc=` + nc + `, cnonce="abc", response="` + response + `"`
+	}
+	testAuth := func(method, requestURI, authorization string, expOK bool) {
+		t.Helper()
+		if _, _, ok := a.authenticate([]byte(method), []byte(requestURI), authorization); ok != expOK {
+			t.Fatalf("unexpected auth result %t for %s %s with %q, expecting %t",
+				ok, method, requestURI, authorization, expOK)
+		}
+	}
+
+	//the uri directive is bound to the request-target
+	testAuth("GET", "http://www.example.com/a?b", digest("GET", "http://www.example.com/a?b", "00000001"), true)
+	testAuth("GET", "http://www.example.com/a?b", digest("GET", "/a?b", "00000002"), true)
+	testAuth("GET", "http://www.example.com", digest("GET", "/", "00000003"), true)
+	testAuth("GET", "http://www.example.com/other", digest("GET", "/a?b", "00000004"), false)
+	testAuth("GET", "http://www.evil.com/a?b", digest("GET", "http://www.example.com/a?b", "00000005"), false)
+	testAuth("CONNECT", "www.evil.com:443", digest("CONNECT", "www.example.com:443", "00000006"), false)
+	testAuth("CONNECT", "www.example.com:443", digest("CONNECT", "", "00000007"), false)
+
+	//the nonce-count must increase
+	testAuth("CONNECT", "www.example.com:443", digest("CONNECT", "www.example.com:443", "00000010"), true)
+	testAuth("CONNECT", "www.example.com:443", digest("CONNECT", "www.example.com:443", "00000010"), false)
+	testAuth("CONNECT", "www.example.com:443", digest("CONNECT", "www.example.com:443", "0000000f"), false)
+	testAuth("CONNECT", "www.example.com:443", digest("CONNECT", "www.example.com:443", "00000011"), true)
+	testAuth("CONNECT", "www.example.com:443", digest("CONNECT", "www.example.com:443", "00000000"), false)
+	testAuth("CONNECT", "www.example.com:443", digest("CONNECT", "www.example.com:443", "zz"), false)
+
+	//the RFC 2069 response without qop is refused, as it has no nonce-count
+	ha2 := md5Hex("CONNECT:www.example.com:443")
+	testAuth("CONNECT", "www.example.com:443", `Digest username="user", realm="fastproxy", nonce="`+nonce+
+		`", uri="www.example.com:443", response="`+md5Hex(md5Hex("user:fastproxy:pass")+":"+nonce+":"+ha2)+`"`, false)
+}
+
+func TestParseDigestParams(t *testing.T) {
+	params := parseDigestParams(`username="a\"b", realm="r, s",nc=00000001 , qop=auth`)
+	expected := map[string]string{
+		"username": `a"b`,
+		"realm":    "r, s",
+		"nc":       "00000001",
+		"qop":      "auth",
+	}
+	if len(params) != len(expected) {
+		t.Fatalf("unexpected params %v, expecting %v", params, expected)
+	}
+	for k, v := range expected {
+		if params[k] != v {
+			t.Fatalf("unexpected param %s=%q, expecting %q", k, params[k], v)
+		}
+	}
+}
+
+func testAuthenticate(t *testing.T, a *ProxyAuthenticator, authorization string,
+	expUser string, expOK bool) {
+	method := []byte("CONNECT")
+	user, _, ok := a.authenticate(method, []byte("www.example.com:443"), authorization)
+	if ok != expOK {
+		t.Fatalf("unexpected auth result %t for %q, expecting %t", ok, authorization, expOK)
+	}
+	if user != expUser {
+		t.Fatalf("unexpected user %q, expecting %q", user, expUser)
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/haxii/fastproxy/proxy/http"
+)
+
+//aLongTimeAgo a deadline in the past, which interrupts the blocked reads at once
+var aLongTimeAgo = time.Unix(1, 0)
+
+//watchClient returns the context of req read from c, which is canceled once
+//the client closes the connection, stop stops watching then cancels the context.
+//The client is watched after the body is read if any, whatever the method is,
+//as it's read by peeking the reader of req, and not watched at all if the
+//connection is taken over by upgrading
+func watchClient(c net.Conn, req *http.Request) (ctx context.Context, stop func()) {
+	ctx, w := newClientWatcher(c, req.Reader())
+	if req.IsUpgrade() {
+		return ctx, w.stop
+	}
+	if req.HasBody() {
+		req.SetBodyReadHook(w.start)
+	} else {
+		w.start()
+	}
+	return ctx, w.stop
+}
+
+//clientWatcher cancels the context once the client closes the connection,
+//which is detected by peeking the reader of the connection in background,
+//so the bytes peeked, e.g. the next request, are kept in the reader
+type clientWatcher struct {
+	c      net.Conn
+	reader *bufio.Reader
+	cancel context.CancelFunc
+	//done closed once the peeking ends, nil if not started
+	done    chan struct{}
+	stopped int32
+	//readDeadline the read deadline of the connection before watching
+	readDeadline time.Time
+}
+
+func newClientWatcher(c net.Conn, reader *bufio.Reader) (context.Context, *clientWatcher) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return ctx, &clientWatcher{c: c, reader: reader, cancel: cancel}
+}
+
+//start starts watching, no bytes should be read from reader until it's stopped
+func (w *clientWatcher) start() {
+	if w.done != nil {
+		return
+	}
+	w.done = make(chan struct{})
+	//only the client closing cancels the context, rather than the read timeout
+	w.readDeadline = readDeadlineOf(w.c)
+	w.c.SetReadDeadline(time.Time{})
+	go func() {
+		defer close(w.done)
+		if _, err := w.reader.Peek(1); err != nil && atomic.LoadInt32(&w.stopped) == 0 {
+			w.cancel()
+		}
+	}()
+}
+
+//stop stops watching then cancels the context, the read deadline of the
+//connection before watching is restored if it's watched
+func (w *clientWatcher) stop() {
+	atomic.StoreInt32(&w.stopped, 1)
+	if w.done != nil {
+		w.c.SetReadDeadline(aLongTimeAgo)
+		<-w.done
+		w.c.SetReadDeadline(w.readDeadline)
+	}
+	w.cancel()
+}
+
+//readDeadlineOf the read deadline of c last set, which is recorded by the
+//gracefulConn accepted, the zero time is returned if it's not recorded
+func readDeadlineOf(c net.Conn) time.Time {
+	for {
+		switch conn := c.(type) {
+		case *tls.Conn:
+			c = conn.NetConn()
+		case *bufferedConn:
+			c = conn.Conn
+		case *gracefulConn:
+			conn.lock.Lock()
+			defer conn.lock.Unlock()
+			return conn.readDeadline
+		default:
+			return time.Time{}
+		}
+	}
+}
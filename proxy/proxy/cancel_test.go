@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	gohttp "net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWatchClientCancel(t *testing.T) {
+	started := make(chan struct{}, 1)
+	canceled := make(chan struct{}, 1)
+	upstream := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		io.ReadAll(r.Body)
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer upstream.Close()
+	addr := startTestProxy(t, &Proxy{})
+	host := upstream.Listener.Addr().String()
+
+	for _, req := range []string{
+		"GET " + upstream.URL + "/ HTTP/1.1\r\nHost: " + host + "\r\n\r\n",
+		"GET " + upstream.URL + "/ HTTP/1.1\r\nHost: " + host + "\r\nContent-Length: 5\r\n\r\nhello",
+		"POST " + upstream.URL + "/ HTTP/1.1\r\nHost: " + host + "\r\nContent-Length: 5\r\n\r\nhello",
+	} {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("fail to dial proxy: %s", err)
+		}
+		io.WriteString(c, req)
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("request %q is not sent to upstream", req)
+		}
+		//the upstream request is canceled once the client is gone
+		c.Close()
+		select {
+		case <-canceled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("request %q is not canceled", req)
+		}
+	}
+}
+
+func TestWatchClientRequestBody(t *testing.T) {
+	upstream := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.Method+" "+string(body))
+	}))
+	defer upstream.Close()
+	addr := startTestProxy(t, &Proxy{})
+	host := upstream.Listener.Addr().String()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("fail to dial proxy: %s", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	//the body of the GET & HEAD requests is read before watching the client,
+	//then the next requests are read from the same connection
+	for _, test := range []struct {
+		req     string
+		expBody string
+	}{
+		{"GET " + upstream.URL + "/ HTTP/1.1\r\nHost: " + host + "\r\nContent-Length: 5\r\n\r\nhello", "GET hello"},
+		{"GET " + upstream.URL + "/ HTTP/1.1\r\nHost: " + host + "\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n", "GET hello world"},
+		{"GET " + upstream.URL + "/ HTTP/1.1\r\nHost: " + host + "\r\n\r\n", "GET "},
+		{"POST " + upstream.URL + "/ HTTP/1.1\r\nHost: " + host + "\r\nContent-Length: 4\r\n\r\npost", "POST post"},
+	} {
+		io.WriteString(c, test.req)
+		resp, err := gohttp.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("fail to read response of %q: %s", test.req, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != test.expBody {
+			t.Fatalf("unexpected response %q of %q, expecting %q", body, test.req, test.expBody)
+		}
+	}
+}
+
+func TestClientWatcher(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("fail to listen: %s", err)
+	}
+	gln := NewGracefulListener(ln, time.Second)
+	defer gln.Close()
+	accept := func() (client, server net.Conn) {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("fail to dial: %s", err)
+		}
+		server, err = gln.Accept()
+		if err != nil {
+			t.Fatalf("fail to accept: %s", err)
+		}
+		return client, server
+	}
+
+	//the read deadline before watching is restored once stopped
+	client, server := accept()
+	defer client.Close()
+	defer server.Close()
+	deadline := time.Now().Add(200 * time.Millisecond)
+	server.SetReadDeadline(deadline)
+	ctx, w := newClientWatcher(server, bufio.NewReader(server))
+	w.start()
+	if !readDeadlineOf(server).IsZero() {
+		t.Fatalf("read deadline is not cleared in watching")
+	}
+	time.Sleep(300 * time.Millisecond)
+	if ctx.Err() != nil {
+		t.Fatalf("context is canceled without the client closing")
+	}
+	w.stop()
+	if d := readDeadlineOf(server); !d.Equal(deadline) {
+		t.Fatalf("read deadline %s is restored, expecting %s", d, deadline)
+	}
+	if _, err := server.Read(make([]byte, 1)); err == nil || !err.(net.Error).Timeout() {
+		t.Fatalf("unexpected error %v, expecting read timeout", err)
+	}
+
+	//the context is canceled once the client closes the connection,
+	//the deadline is recorded through the wrappers of the connection
+	client, server = accept()
+	defer server.Close()
+	server.SetReadDeadline(deadline)
+	ctx, w = newClientWatcher(server, bufio.NewReader(server))
+	if d := readDeadlineOf(&bufferedConn{Conn: server}); !d.Equal(deadline) {
+		t.Fatalf("read deadline %s is recorded, expecting %s", d, deadline)
+	}
+	w.start()
+	client.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("context is not canceled once the client closes the connection")
+	}
+	w.stop()
+}
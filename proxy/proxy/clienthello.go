@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+)
+
+//ClientHello info parsed from the TLS ClientHello message sent by client
+type ClientHello struct {
+	//ServerName SNI, empty if not provided
+	ServerName string
+	//ALPNProtocols protocols offered in ALPN, e.g. h2, http/1.1
+	ALPNProtocols []string
+	//CipherSuites cipher suites offered by client
+	CipherSuites []uint16
+}
+
+const (
+	tlsRecordHeaderLen          = 5
+	tlsHandshakeTypeClientHello = 1
+
+	tlsExtensionServerName = 0
+	tlsExtensionALPN       = 16
+)
+
+var errNotClientHello = errors.New("not a TLS ClientHello")
+
+//peekClientHello parses the ClientHello in the 1st TLS record without consuming it,
+//a ClientHello larger than the buffer of reader is not supported
+func peekClientHello(reader *bufio.Reader) (*ClientHello, error) {
+	header, err := reader.Peek(tlsRecordHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != tlsRecordTypeHandshake {
+		return nil, errNotClientHello
+	}
+	recordLen := int(header[3])<<8 | int(header[4])
+	record, err := reader.Peek(tlsRecordHeaderLen + recordLen)
+	if err != nil {
+		return nil, err
+	}
+	return parseClientHello(record[tlsRecordHeaderLen:])
+}
+
+//parseClientHello parses the ClientHello handshake message
+func parseClientHello(b []byte) (*ClientHello, error) {
+	s := tlsBytes(b)
+	var msgType uint8
+	var msg tlsBytes
+	if !s.readUint8(&msgType) || msgType != tlsHandshakeTypeClientHello ||
+		!s.readUint24LengthPrefixed(&msg) {
+		return nil, errNotClientHello
+	}
+
+	var sessionID, cipherSuites, compressionMethods tlsBytes
+	if !msg.skip(2+32) || //version & random
+		!msg.readUint8LengthPrefixed(&sessionID) ||
+		!msg.readUint16LengthPrefixed(&cipherSuites) ||
+		!msg.readUint8LengthPrefixed(&compressionMethods) {
+		return nil, errNotClientHello
+	}
+
+	hello := &ClientHello{}
+	for len(cipherSuites) >= 2 {
+		var suite uint16
+		cipherSuites.readUint16(&suite)
+		hello.CipherSuites = append(hello.CipherSuites, suite)
+	}
+
+	//extensions are optional
+	if len(msg) == 0 {
+		return hello, nil
+	}
+	var extensions tlsBytes
+	if !msg.readUint16LengthPrefixed(&extensions) {
+		return nil, errNotClientHello
+	}
+	for len(extensions) > 0 {
+		var extType uint16
+		var extData tlsBytes
+		if !extensions.readUint16(&extType) ||
+			!extensions.readUint16LengthPrefixed(&extData) {
+			return nil, errNotClientHello
+		}
+		switch extType {
+		case tlsExtensionServerName:
+			var names tlsBytes
+			if !extData.readUint16LengthPrefixed(&names) {
+				return nil, errNotClientHello
+			}
+			for len(names) > 0 {
+				var nameType uint8
+				var name tlsBytes
+				if !names.readUint8(&nameType) ||
+					!names.readUint16LengthPrefixed(&name) {
+					return nil, errNotClientHello
+				}
+				//host_name
+				if nameType == 0 {
+					hello.ServerName = string(name)
+				}
+			}
+		case tlsExtensionALPN:
+			var protocols tlsBytes
+			if !extData.readUint16LengthPrefixed(&protocols) {
+				return nil, errNotClientHello
+			}
+			for len(protocols) > 0 {
+				var protocol tlsBytes
+				if !protocols.readUint8LengthPrefixed(&protocol) {
+					return nil, errNotClientHello
+				}
+				hello.ALPNProtocols = append(hello.ALPNProtocols, string(protocol))
+			}
+		}
+	}
+	return hello, nil
+}
+
+//tlsBytes a simple reader of tls vectors
+type tlsBytes []byte
+
+func (s *tlsBytes) read(n int) ([]byte, bool) {
+	if len(*s) < n {
+		return nil, false
+	}
+	v := (*s)[:n]
+	*s = (*s)[n:]
+	return v, true
+}
+
+func (s *tlsBytes) skip(n int) bool {
+	_, ok := s.read(n)
+	return ok
+}
+
+func (s *tlsBytes) readUint8(out *uint8) bool {
+	v, ok := s.read(1)
+	if !ok {
+		return false
+	}
+	*out = v[0]
+	return true
+}
+
+func (s *tlsBytes) readUint16(out *uint16) bool {
+	v, ok := s.read(2)
+	if !ok {
+		return false
+	}
+	*out = uint16(v[0])<<8 | uint16(v[1])
+	return true
+}
+
+func (s *tlsBytes) readLengthPrefixed(lenLen int, out *tlsBytes) bool {
+	lenBytes, ok := s.read(lenLen)
+	if !ok {
+		return false
+	}
+	n := 0
+	for _, b := range lenBytes {
+		n = n<<8 | int(b)
+	}
+	v, ok := s.read(n)
+	if !ok {
+		return false
+	}
+	*out = v
+	return true
+}
+
+func (s *tlsBytes) readUint8LengthPrefixed(out *tlsBytes) bool {
+	return s.readLengthPrefixed(1, out)
+}
+
+func (s *tlsBytes) readUint16LengthPrefixed(out *tlsBytes) bool {
+	return s.readLengthPrefixed(2, out)
+}
+
+func (s *tlsBytes) readUint24LengthPrefixed(out *tlsBytes) bool {
+	return s.readLengthPrefixed(3, out)
+}
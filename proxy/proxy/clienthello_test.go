@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	gohttp "net/http"
+	"testing"
+	"time"
+)
+
+//makeClientHello returns the 1st TLS record sent by a client with config
+func makeClientHello(t testing.TB, config *tls.Config) []byte {
+	server, client := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, config).Handshake()
+		client.Close()
+	}()
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, tlsRecordHeaderLen)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatalf("fail to read ClientHello record header: %s", err)
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatalf("fail to read ClientHello record: %s", err)
+	}
+	return append(header, body...)
+}
+
+func TestPeekClientHello(t *testing.T) {
+	record := makeClientHello(t, &tls.Config{
+		ServerName:   "www.example.com",
+		NextProtos:   []string{"h2", "http/1.1"},
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		MaxVersion:   tls.VersionTLS12,
+	})
+	reader := bufio.NewReader(bytes.NewReader(record))
+	hello, err := peekClientHello(reader)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if hello.ServerName != "www.example.com" {
+		t.Fatalf("unexpected server name %q", hello.ServerName)
+	}
+	if len(hello.ALPNProtocols) != 2 || hello.ALPNProtocols[0] != "h2" ||
+		hello.ALPNProtocols[1] != "http/1.1" {
+		t.Fatalf("unexpected ALPN protocols %v", hello.ALPNProtocols)
+	}
+	found := false
+	for _, suite := range hello.CipherSuites {
+		found = found || suite == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	}
+	if !found {
+		t.Fatalf("cipher suite not found in %v", hello.CipherSuites)
+	}
+	//the record is peeked rather than consumed
+	if reader.Buffered() != len(record) {
+		t.Fatalf("unexpected buffered size %d, expecting %d", reader.Buffered(), len(record))
+	}
+
+	//IP address is not sent as SNI
+	record = makeClientHello(t, &tls.Config{ServerName: "127.0.0.1"})
+	hello, err = peekClientHello(bufio.NewReader(bytes.NewReader(record)))
+	if err != nil || len(hello.ServerName) != 0 {
+		t.Fatalf("unexpected result %v, %v, expecting no server name", hello, err)
+	}
+}
+
+func TestPeekClientHelloMalformed(t *testing.T) {
+	record := makeClientHello(t, &tls.Config{ServerName: "www.example.com"})
+
+	//every truncated record is rejected
+	for n := 0; n < len(record); n++ {
+		if _, err := peekClientHello(bufio.NewReader(bytes.NewReader(record[:n]))); err == nil {
+			t.Fatalf("truncated record of %d bytes is parsed", n)
+		}
+	}
+	//every truncated message in a record of consistent length is rejected
+	body := record[tlsRecordHeaderLen:]
+	for n := 0; n < len(body); n++ {
+		if _, err := parseClientHello(body[:n]); err == nil {
+			t.Fatalf("truncated message of %d bytes is parsed", n)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		record []byte
+	}{
+		{"not handshake", []byte{0x17, 3, 1, 0, 1, 1}},
+		{"not ClientHello", []byte{0x16, 3, 1, 0, 4, 2, 0, 0, 0}},
+		{"empty message", []byte{0x16, 3, 1, 0, 4, 1, 0, 0, 0}},
+		{"message longer than record", []byte{0x16, 3, 1, 0, 4, 1, 0, 0, 0xff}},
+		{"record larger than buffer", []byte{0x16, 3, 1, 0xff, 0xff, 1}},
+	}
+	for _, test := range tests {
+		reader := bufio.NewReaderSize(bytes.NewReader(test.record), 16)
+		if hello, err := peekClientHello(reader); err == nil {
+			t.Fatalf("%s: unexpected ClientHello %v parsed", test.name, hello)
+		}
+	}
+}
+
+func TestPeekClientHelloServerSpeaksFirst(t *testing.T) {
+	//the upstream greets first, then echoes a line, like SMTP
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("fail to listen: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(5 * time.Second))
+				io.WriteString(c, "220 ready\r\n")
+				line, _ := bufio.NewReader(c).ReadString('\n')
+				io.WriteString(c, line)
+			}()
+		}
+	}()
+	addr := startTestProxy(t, &Proxy{Handler: Handler{PeekClientHello: true}})
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("fail to dial proxy: %s", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	target := ln.Addr().String()
+	io.WriteString(c, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	r := bufio.NewReader(c)
+	resp, err := gohttp.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != gohttp.StatusOK {
+		t.Fatalf("fail to make tunnel: %v, %v", resp, err)
+	}
+	//the tunnel is made once the client sends nothing for a while
+	if greeting, err := r.ReadString('\n'); err != nil || greeting != "220 ready\r\n" {
+		t.Fatalf("unexpected greeting %q: %v", greeting, err)
+	}
+	io.WriteString(c, "HELO example.com\r\n")
+	if line, err := r.ReadString('\n'); err != nil || line != "HELO example.com\r\n" {
+		t.Fatalf("unexpected echo %q: %v", line, err)
+	}
+}
+
+func FuzzParseClientHello(f *testing.F) {
+	record := makeClientHello(f, &tls.Config{ServerName: "www.example.com", NextProtos: []string{"h2"}})
+	f.Add(record[tlsRecordHeaderLen:])
+	f.Add([]byte{1, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		hello, err := parseClientHello(b)
+		if err == nil && hello == nil {
+			t.Fatalf("nil ClientHello parsed without error")
+		}
+	})
+}
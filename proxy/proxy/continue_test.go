@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	gohttp "net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/client"
+	"github.com/haxii/fastproxy/http"
+)
+
+//startRawUpstream serves the connections of a local listener with serve,
+//after the request header is read from r, returns the address of the listener
+func startRawUpstream(t *testing.T, serve func(c net.Conn, r *bufio.Reader)) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("fail to listen: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(5 * time.Second))
+				r := bufio.NewReader(c)
+				if _, err := gohttp.ReadRequest(r); err == nil {
+					serve(c, r)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestProxyExpectContinue(t *testing.T) {
+	tests := []struct {
+		name            string
+		continueTimeout time.Duration
+		//upstream replies the request header, then the body read by upstream is sent
+		upstream    func(c net.Conn, r *bufio.Reader, body chan<- string)
+		expStatuses []int
+		expBody     string
+	}{
+		{"continue", 5 * time.Second, func(c net.Conn, r *bufio.Reader, body chan<- string) {
+			io.WriteString(c, "HTTP/1.1 100 Continue\r\n\r\n")
+			b := make([]byte, 5)
+			io.ReadFull(r, b)
+			body <- string(b)
+			io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n"+string(b))
+		}, []int{100, 200}, "hello"},
+		//the body is sent anyway once timed out waiting
+		{"timeout", 100 * time.Millisecond, func(c net.Conn, r *bufio.Reader, body chan<- string) {
+			b := make([]byte, 5)
+			io.ReadFull(r, b)
+			body <- string(b)
+			io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n"+string(b))
+		}, []int{200}, "hello"},
+		//the body is not sent once the final response is read
+		{"final", 5 * time.Second, func(c net.Conn, r *bufio.Reader, body chan<- string) {
+			io.WriteString(c, "HTTP/1.1 417 Expectation Failed\r\nContent-Length: 6\r\n\r\nfailed")
+			c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			b, _ := io.ReadAll(r)
+			body <- string(b)
+		}, []int{417}, ""},
+		//the interim responses before `100 Continue` are forwarded as well
+		{"early hints", 5 * time.Second, func(c net.Conn, r *bufio.Reader, body chan<- string) {
+			io.WriteString(c, "HTTP/1.1 103 Early Hints\r\nLink: </a.css>\r\n\r\n"+
+				"HTTP/1.1 100 Continue\r\n\r\n")
+			b := make([]byte, 5)
+			io.ReadFull(r, b)
+			body <- string(b)
+			io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+		}, []int{103, 100, 200}, "hello"},
+	}
+	for _, test := range tests {
+		body := make(chan string, 1)
+		upstreamAddr := startRawUpstream(t, func(c net.Conn, r *bufio.Reader) {
+			test.upstream(c, r, body)
+		})
+		addr := startTestProxy(t, &Proxy{Client: client.Client{ContinueTimeout: test.continueTimeout}})
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("fail to dial proxy: %s", err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		start := time.Now()
+		io.WriteString(c, "POST http://"+upstreamAddr+"/ HTTP/1.1\r\nHost: "+upstreamAddr+"\r\n"+
+			"Expect: 100-continue\r\nContent-Length: 5\r\n\r\nhello")
+
+		r := bufio.NewReader(c)
+		for _, expStatus := range test.expStatuses {
+			resp, err := gohttp.ReadResponse(r, nil)
+			if err != nil || resp.StatusCode != expStatus {
+				t.Fatalf("%s: unexpected response %v, expecting %d: %v", test.name, resp, expStatus, err)
+			}
+			io.Copy(io.Discard, resp.Body)
+		}
+		if b := <-body; b != test.expBody {
+			t.Fatalf("%s: unexpected body %q sent to upstream, expecting %q", test.name, b, test.expBody)
+		}
+		if elapsed := time.Since(start); test.name != "final" && elapsed > time.Second {
+			t.Fatalf("%s: response is delayed for %s", test.name, elapsed)
+		}
+	}
+}
+
+func TestProxyInterimLimit(t *testing.T) {
+	upstreamAddr := startRawUpstream(t, func(c net.Conn, r *bufio.Reader) {
+		io.WriteString(c, strings.Repeat("HTTP/1.1 103 Early Hints\r\n\r\n", 1000)+
+			"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	})
+	p := &Proxy{Client: client.Client{ResponseLimits: http.Limits{MaxInterimCount: 3}}}
+	addr := startTestProxy(t, p)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("fail to dial proxy: %s", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "GET http://"+upstreamAddr+"/ HTTP/1.1\r\nHost: "+upstreamAddr+"\r\n\r\n")
+
+	//the interim responses within the limit are forwarded, then the connection is closed
+	r := bufio.NewReader(c)
+	interims := 0
+	for {
+		resp, err := gohttp.ReadResponse(r, nil)
+		if err != nil {
+			break
+		}
+		if resp.StatusCode != gohttp.StatusEarlyHints {
+			t.Fatalf("unexpected final response %d", resp.StatusCode)
+		}
+		interims++
+	}
+	if interims != 3 {
+		t.Fatalf("%d interim responses are forwarded, expecting 3", interims)
+	}
+	if n := p.Client.ExceededResponseLimits.Get(http.LimitInterimCount); n != 1 {
+		t.Fatalf("interim count limit is exceeded %d times, expecting 1", n)
+	}
+}
@@ -1,10 +1,15 @@
 package proxy
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
-	"errors"
+	"crypto/x509"
+	"io"
 	"net"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/haxii/fastproxy/bufiopool"
 	"github.com/haxii/fastproxy/cert"
@@ -15,6 +20,7 @@ import (
 	"github.com/haxii/fastproxy/transport"
 	"github.com/haxii/fastproxy/usage"
 	"github.com/haxii/fastproxy/util"
+	"golang.org/x/net/http2"
 )
 
 //Handler proxy handler
@@ -22,11 +28,33 @@ type Handler struct {
 	//ShouldAllowConnection should allow the connection to proxy, return false to drop the conn
 	ShouldAllowConnection func(connAddr net.Addr) bool
 
-	//HTTPSDecryptEnable test if host's https connection should be decrypted
-	ShouldDecryptHost func(host string) bool
+	//HTTPSDecryptEnable test if host's https connection should be decrypted,
+	//hello is the client's TLS ClientHello if PeekClientHello is enabled, nil otherwise
+	ShouldDecryptHost func(hostWithPort string, hello *ClientHello) bool
 
-	//URLProxy url specified proxy, nil path means this is a un-decrypted https traffic
-	URLProxy func(hostWithPort string, path []byte) *superproxy.SuperProxy
+	//URLProxy url specified proxy, nil path means this is a un-decrypted https traffic,
+	//user is the authenticated proxy user, empty if proxy auth is disabled,
+	//hello is the client's TLS ClientHello of https traffic if available, nil otherwise
+	URLProxy func(user, hostWithPort string, path []byte, hello *ClientHello) *superproxy.SuperProxy
+
+	//PeekClientHello reads the client's TLS ClientHello of a tunnel before
+	//deciding whether to decrypt it, the tunnel is made with client before
+	//dialing the target, as the ClientHello is sent only after that, the client
+	//sending nothing for a second, e.g. of SMTP, is served without ClientHello
+	PeekClientHello bool
+
+	//Authenticator authenticates proxy clients for both http and https(CONNECT)
+	//requests, nil means no authentication is required
+	Authenticator *ProxyAuthenticator
+
+	//ReverseProxyRules maps origin-form requests to backends,
+	//so the proxy works as a reverse proxy for these requests,
+	//non-proxy requests are refused if no rule is matched
+	ReverseProxyRules []ReverseProxyRule
+
+	//HeaderRules edits the headers of the requests sent to upstream
+	//and their responses, all the rules matched are applied in order
+	HeaderRules []HeaderRule
 
 	//LookupIP returns ip string,
 	//should not block for long time
@@ -36,39 +64,139 @@ type Handler struct {
 	HijackerPool hijack.HijackerPool
 	//hijacker client for make hijacked response if available
 	hijackClient hijack.Client
+	//DecodeSniffedBody decodes the request & response body written to hijacker,
+	//i.e. the chunked encoding and the content coding such as gzip, deflate and br,
+	//the body sent to upstream & client is untouched
+	DecodeSniffedBody bool
+	//MaxWebSocketMessageSize max size of a WebSocket frame or a fragmented message
+	//reassembled for hijack.WebSocketHijacker, the connection sending a bigger one
+	//is closed, DefaultMaxWebSocketMessageSize is used if not set
+	MaxWebSocketMessageSize int64
 	//MitmCACert HTTPSDecryptCACert ca.cer used for https decryption
 	MitmCACert *tls.Certificate
+	//MitmCertCache caches the fake certificates signed by MitmCACert,
+	//a default in-memory cache is used if not set
+	MitmCertCache *cert.Cache
+	//MitmBypass tracks the clients' handshake failures in https decryption,
+	//the hosts which keep failing are tunneled without decryption for a while,
+	//nil means the failures are not tracked
+	MitmBypass *MitmBypass
+	//MimicUpstreamCert handshakes with the upstream before answering the client
+	//in https decryption, then forges the certificate by copying the upstream's
+	//subject, SANs, validity window and key usage, the upstream's verification
+	//result is told to the hijacker implementing hijack.UpstreamTLSHijacker.
+	//The handshake result of each upstream is cached for a while, so the
+	//upstream is not handshaken with again for every client connection
+	MimicUpstreamCert bool
+	//MitmHTTP2 offers h2 by ALPN in https decryption, streams of the h2 connection
+	//are proxied as HTTP/1.1 requests, so the hijackers see every exchange as well
+	MitmHTTP2 bool
+
+	//StrictParsing rejects the requests ambiguous under RFC 7230 with 400, e.g.
+	//with both `Content-Length` & `Transfer-Encoding`, which are used in request
+	//smuggling, see http.RejectReason for the reasons rejected
+	StrictParsing bool
+
+	//RejectedRequests counts the requests rejected by StrictParsing,
+	//made by proxy if StrictParsing is set
+	RejectedRequests *RejectedRequests
+
+	//requestLimits limits of the requests read, set by proxy
+	requestLimits requestLimits
+	//keepalive limits of the keep-alive connections decrypted, set by proxy
+	keepalive keepalive
+	//upstreamTLSCache caches the upstream handshakes of MimicUpstreamCert
+	upstreamTLSCache upstreamTLSCache
 
 	//http requests and response pool
 	reqPool  http.RequestPool
 	respPool http.ResponsePool
 }
 
-func (h *Handler) handleHTTPConns(c net.Conn, req *http.Request,
-	bufioPool *bufiopool.Pool, client *client.Client, usage *usage.ProxyUsage) error {
-	return h.do(c, req, bufioPool, client, usage)
+//usages usage recorders which the traffic is accounted to,
+//i.e. the proxy usage and the authenticated user's usage
+type usages []*usage.ProxyUsage
+
+//AddIncomingSize adds incoming size to every usage
+func (u usages) AddIncomingSize(n uint64) {
+	for _, pu := range u {
+		pu.AddIncomingSize(n)
+	}
+}
+
+//AddOutgoingSize adds outgoing size to every usage
+func (u usages) AddOutgoingSize(n uint64) {
+	for _, pu := range u {
+		pu.AddOutgoingSize(n)
+	}
 }
 
-func (h *Handler) do(c net.Conn, req *http.Request,
-	bufioPool *bufiopool.Pool, client *client.Client, usage *usage.ProxyUsage) error {
+func (h *Handler) handleHTTPConns(c net.Conn, req *http.Request, user string,
+	bufioPool *bufiopool.Pool, client *client.Client, usage usages) error {
+	return h.do(c, req, user, bufioPool, client, usage, nil)
+}
+
+//doOptions options of proxying a request
+type doOptions struct {
+	//clientHello ClientHello of the decrypted https traffic
+	clientHello *ClientHello
+	//rewriteLocation rewrites the `Location` header of response
+	rewriteLocation func(location []byte) []byte
+	//upstreamTLS the upstream's handshake result of the decrypted https traffic
+	upstreamTLS *upstreamTLS
+	//ctx context of the request canceled once the client is gone,
+	//e.g. the one of a h2 stream, the connection is watched by `do` if not set
+	ctx context.Context
+	//dst the pinned destination dialed rather than the request's host,
+	//e.g. the original destination of the transparent traffic
+	dst *net.TCPAddr
+}
+
+//do proxies req then writes the response to c, opts is optional
+func (h *Handler) do(c net.Conn, req *http.Request, user string,
+	bufioPool *bufiopool.Pool, client *client.Client, usage usages,
+	opts *doOptions) error {
+	if opts == nil {
+		opts = &doOptions{}
+	}
 	//convert connetion into a http response
 	writer := bufioPool.AcquireWriter(c)
 	defer bufioPool.ReleaseWriter(writer)
 	defer writer.Flush()
 	resp := h.respPool.Acquire()
 	defer h.respPool.Release(resp)
+	//the client can't tell the end of the response but the connection closed
+	defer func() {
+		if resp.IsCloseDelimited() {
+			req.SetConnectionClose()
+		}
+	}()
 	if err := resp.WriteTo(writer); err != nil {
 		return err
 	}
+	resp.SetLocationRewriter(opts.rewriteLocation)
+	//HTTP/1.0 clients don't understand the interim responses
+	resp.SetDropInterim(string(req.Protocol()) == "HTTP/1.0")
 
 	//set requests hijacker
-	hijacker := h.HijackerPool.Get(c.RemoteAddr(),
+	hijacker := h.HijackerPool.Get(c.RemoteAddr(), user,
 		req.HostInfo().HostWithPort(), req.Method(), req.PathWithQueryFragment())
 	defer h.HijackerPool.Put(hijacker)
 
 	//set request & response hijacker
 	req.SetHijacker(hijacker)
 	resp.SetHijacker(hijacker)
+	req.SetDecodeSniffedBody(h.DecodeSniffedBody)
+	resp.SetDecodeSniffedBody(h.DecodeSniffedBody)
+	if opts.upstreamTLS != nil {
+		if tlsHijacker, ok := hijacker.(hijack.UpstreamTLSHijacker); ok {
+			tlsHijacker.OnUpstreamTLS(opts.upstreamTLS.serverName,
+				opts.upstreamTLS.certs, opts.upstreamTLS.err)
+		}
+	}
+	if reqHijacker, ok := hijacker.(hijack.RequestHijacker); ok {
+		reqHijacker.HijackRequest(req.Modifier())
+	}
 	if hijackedRespReader := hijacker.HijackResponse(); hijackedRespReader != nil {
 		err := h.hijackClient.Do(req, resp, hijackedRespReader)
 		if usage != nil {
@@ -78,29 +206,44 @@ func (h *Handler) do(c net.Conn, req *http.Request,
 		return err
 	}
 
-	//set requests proxy
-	superProxy := h.URLProxy(req.HostInfo().HostWithPort(), req.PathWithQueryFragment())
-	req.SetProxy(superProxy)
-	if superProxy != nil {
-		domain := req.HostInfo().Domain()
-		if len(domain) > 0 {
-			ip := h.lookupIp(domain)
-			req.HostInfo().SetIP(ip)
-		}
+	if opts.dst != nil {
+		req.HostInfo().SetTarget(opts.dst)
+	}
 
-		superProxy.AcquireToken()
-		defer func() {
-			superProxy.PushBackToken()
-		}()
+	//set requests proxy, which may be switched for retrying, see client.RetryPolicy
+	//the header rules matching the super proxy are applied again once it's switched
+	selectProxy := func() {
+		h.setProxy(req, h.URLProxy(user, req.HostInfo().HostWithPort(),
+			req.PathWithQueryFragment(), opts.clientHello))
+		h.applyHeaderRules(req, resp)
+	}
+	selectProxy()
+	req.SetProxySwitcher(selectProxy)
+	defer h.setProxy(req, nil)
+
+	//the upstream work is canceled once the client is gone
+	ctx := opts.ctx
+	if ctx == nil {
+		var stopWatching func()
+		ctx, stopWatching = watchClient(c, req)
+		defer stopWatching()
 	}
 
 	//handle http proxy request
-	err := client.Do(req, resp)
+	var err error
+	if req.IsUpgrade() {
+		err = h.doUpgrade(ctx, c, writer, req, resp, client, req.GetProxy(), usage)
+	} else {
+		err = client.DoContext(ctx, req, resp)
+	}
+	if err != nil && resp.GetSize() == 0 {
+		h.respondExceededLimit(writer, req, resp)
+	}
 	if usage != nil {
 		usage.AddIncomingSize(uint64(req.GetReadSize()))
 		usage.AddOutgoingSize(uint64(resp.GetSize()))
 	}
-	if superProxy != nil && superProxy.Usage != nil {
+	if superProxy := req.GetProxy(); superProxy != nil && superProxy.Usage != nil {
 		superProxy.Usage.AddIncomingSize(uint64(resp.GetSize()))
 		superProxy.Usage.AddOutgoingSize(uint64(req.GetWriteSize()))
 	}
@@ -108,12 +251,98 @@ func (h *Handler) do(c net.Conn, req *http.Request,
 	return err
 }
 
-func (h *Handler) handleHTTPSConns(c net.Conn, hostWithPort string,
-	bufioPool *bufiopool.Pool, client *client.Client, usage *usage.ProxyUsage) error {
-	if h.ShouldDecryptHost(hostWithPort) {
-		return h.decryptConnect(c, hostWithPort, bufioPool, client, usage)
+//setProxy sets the super proxy of req, whose concurrency token is acquired,
+//the token of the previous one is pushed back
+func (h *Handler) setProxy(req *http.Request, superProxy *superproxy.SuperProxy) {
+	prev := req.GetProxy()
+	if superProxy == prev {
+		return
+	}
+	if prev != nil {
+		prev.PushBackToken()
+	}
+	req.SetProxy(superProxy)
+	if superProxy == nil {
+		return
+	}
+	//the pinned target is never looked up
+	domain := req.HostInfo().Domain()
+	if len(domain) > 0 && req.HostInfo().IP() == nil {
+		ip := h.lookupIp(domain)
+		req.HostInfo().SetIP(ip)
+	}
+	superProxy.AcquireToken()
+}
+
+func (h *Handler) handleHTTPSConns(c net.Conn, hostWithPort, user string,
+	bufioPool *bufiopool.Pool, client *client.Client, usage usages) error {
+	return h.handleTunnelConns(c, hostWithPort, user, httpTunnelReplier{},
+		bufioPool, client, usage)
+}
+
+//handleTunnelConns handles the tunnel requested by a HTTP CONNECT or a SOCKS5 CONNECT,
+//replier replies the client in the corresponding protocol
+func (h *Handler) handleTunnelConns(c net.Conn, hostWithPort, user string, replier tunnelReplier,
+	bufioPool *bufiopool.Pool, client *client.Client, usage usages) error {
+	if !h.PeekClientHello {
+		return h.serveTunnel(c, hostWithPort, nil, user, nil, replier, bufioPool, client, usage)
 	}
-	return h.tunnelConnect(c, bufioPool, hostWithPort, usage)
+
+	//make the tunnel with client first, the client sends nothing before that
+	n, err := replier.replyOK(c)
+	if err != nil {
+		return util.ErrWrapper(err, "proxy fails to handshake with client")
+	}
+	if usage != nil {
+		usage.AddOutgoingSize(n)
+	}
+
+	//peek the ClientHello, the buffered bytes are replayed in the tunnel by the reader
+	reader := bufioPool.AcquireReader(c)
+	defer bufioPool.ReleaseReader(reader)
+	hello, err := peekTunnelHello(c, reader)
+	if err != nil {
+		return util.ErrWrapper(err, "fail to read tunnel traffic from client")
+	}
+	return h.serveTunnel(&bufferedConn{Conn: c, r: reader}, hostWithPort, nil, user, hello,
+		nopTunnelReplier{}, bufioPool, client, usage)
+}
+
+//tunnelPeekTimeout max duration waiting for the ClientHello in a tunnel, the clients
+//of the server-speaks-first protocols, e.g. SMTP & SSH, send nothing before the server
+const tunnelPeekTimeout = time.Second
+
+//peekTunnelHello peeks the ClientHello sent first in the tunnel read by reader of c,
+//nil is returned if the traffic is not TLS, the ClientHello is malformed, or nothing
+//is sent within tunnelPeekTimeout, the read deadline of c is restored after peeking
+func peekTunnelHello(c net.Conn, reader *bufio.Reader) (*ClientHello, error) {
+	defer c.SetReadDeadline(readDeadlineOf(c))
+	c.SetReadDeadline(time.Now().Add(tunnelPeekTimeout))
+	b, err := reader.Peek(1)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if b[0] != tlsRecordTypeHandshake {
+		return nil, nil
+	}
+	//a malformed ClientHello is left to the target server
+	hello, _ := peekClientHello(reader)
+	return hello, nil
+}
+
+//serveTunnel decrypts or forwards the tunnel traffic, hello is the peeked ClientHello if any,
+//dst is the pinned destination dialed rather than hostWithPort if not nil
+func (h *Handler) serveTunnel(c net.Conn, hostWithPort string, dst *net.TCPAddr, user string,
+	hello *ClientHello, replier tunnelReplier, bufioPool *bufiopool.Pool,
+	client *client.Client, usage usages) error {
+	if h.ShouldDecryptHost(hostWithPort, hello) && !h.MitmBypass.ShouldBypass(hostWithPort) {
+		return h.decryptConnect(c, hostWithPort, dst, user, hello, replier, bufioPool, client, usage)
+	}
+	return h.tunnelConnect(c, bufioPool, hostWithPort, dst, user, hello, replier,
+		client.RetryPolicy, usage)
 }
 
 const (
@@ -129,62 +358,92 @@ var (
 	httpTunnelMadeErrorSize = uint64(len(httpTunnelMadeErrorBytes))
 )
 
-func (h *Handler) sendHTTPSProxyStatusOK(c net.Conn) (err error) {
-	return util.WriteWithValidation(c, httpTunnelMadeOkBytes)
+//tunnelReplier replies client whether the requested tunnel is made,
+//i.e. the response of HTTP CONNECT or the reply of SOCKS5 CONNECT
+type tunnelReplier interface {
+	//replyOK tells client the tunnel is made, returns the byte size sent
+	replyOK(c net.Conn) (uint64, error)
+	//replyError tells client the tunnel fails, returns the byte size sent
+	replyError(c net.Conn) (uint64, error)
 }
 
-func (h *Handler) sendHTTPSProxyStatusBadGateway(c net.Conn) (err error) {
-	return util.WriteWithValidation(c, httpTunnelMadeErrorBytes)
+//httpTunnelReplier replies HTTP CONNECT requests
+type httpTunnelReplier struct{}
+
+func (httpTunnelReplier) replyOK(c net.Conn) (uint64, error) {
+	return httpTunnelMadeOkSize, util.WriteWithValidation(c, httpTunnelMadeOkBytes)
+}
+
+func (httpTunnelReplier) replyError(c net.Conn) (uint64, error) {
+	return httpTunnelMadeErrorSize, util.WriteWithValidation(c, httpTunnelMadeErrorBytes)
+}
+
+//nopTunnelReplier replies nothing, e.g. the tunnel is already made with client,
+//or the transparent client doesn't know the proxy at all
+type nopTunnelReplier struct{}
+
+func (nopTunnelReplier) replyOK(c net.Conn) (uint64, error) {
+	return 0, nil
+}
+
+func (nopTunnelReplier) replyError(c net.Conn) (uint64, error) {
+	return 0, nil
 }
 
 //proxy https traffic directly
 func (h *Handler) tunnelConnect(conn net.Conn,
-	bufioPool *bufiopool.Pool, hostWithPort string, usage *usage.ProxyUsage) error {
-	superProxy := h.URLProxy(hostWithPort, nil)
-
-	targetWithPort := hostWithPort
-	if superProxy != nil {
-		host, port, _ := net.SplitHostPort(hostWithPort)
-		if len(host) > 0 && net.ParseIP(host) == nil {
-			ip := h.lookupIp(host)
-			if ip != nil {
-				targetWithPort = ip.String() + ":" + port
-			}
+	bufioPool *bufiopool.Pool, hostWithPort string, dst *net.TCPAddr, user string, hello *ClientHello,
+	replier tunnelReplier, retryPolicy *client.RetryPolicy, usage usages) error {
+	//limit concurrency, the token is moved to the alternate super proxy switched to
+	var superProxy *superproxy.SuperProxy
+	selectProxy := func() {
+		next := h.URLProxy(user, hostWithPort, nil, hello)
+		if next == superProxy {
+			return
 		}
-		//limit concurrency
-		superProxy.AcquireToken()
-		defer func() {
+		if superProxy != nil {
 			superProxy.PushBackToken()
-		}()
+		}
+		if superProxy = next; superProxy != nil {
+			superProxy.AcquireToken()
+		}
 	}
+	selectProxy()
+	defer func() {
+		if superProxy != nil {
+			superProxy.PushBackToken()
+		}
+	}()
 
-	var (
-		tunnelConn net.Conn
-		err        error
-	)
-	if superProxy != nil {
-		//acquire server conn to target host
-		tunnelConn, err = superProxy.MakeTunnel(bufioPool, targetWithPort)
-	} else {
-		//acquire server conn to target host
-		tunnelConn, err = transport.Dial(hostWithPort)
+	//acquire server conn to target host, retried by the policy,
+	//which is canceled once the client is gone
+	ctx, stopWatching := context.Background(), func() {}
+	if bc, ok := conn.(*bufferedConn); ok {
+		var w *clientWatcher
+		ctx, w = newClientWatcher(bc, bc.r)
+		w.start()
+		stopWatching = w.stop
 	}
-
+	tunnelConn, err := retryPolicy.DialContext(ctx, func(ctx context.Context) (net.Conn, error) {
+		return h.dialTunnel(ctx, bufioPool, superProxy, hostWithPort, dst)
+	}, selectProxy)
+	stopWatching()
 	if err != nil {
-		h.sendHTTPSProxyStatusBadGateway(conn)
+		n, _ := replier.replyError(conn)
 		if usage != nil {
-			usage.AddOutgoingSize(httpTunnelMadeErrorSize)
+			usage.AddOutgoingSize(n)
 		}
 		return util.ErrWrapper(err, "error occurred when dialing to host "+hostWithPort)
 	}
 	defer tunnelConn.Close()
 
 	//handshake with client
-	if err := h.sendHTTPSProxyStatusOK(conn); err != nil {
+	n, err := replier.replyOK(conn)
+	if err != nil {
 		return util.ErrWrapper(err, "error occurred when handshaking with client")
 	}
 	if usage != nil {
-		usage.AddOutgoingSize(httpTunnelMadeOkSize)
+		usage.AddOutgoingSize(n)
 	}
 
 	var wg sync.WaitGroup
@@ -227,65 +486,161 @@ func (h *Handler) tunnelConnect(conn net.Conn,
 	return nil
 }
 
+//dialTunnel dials the target host directly or via the super proxy,
+//the pinned destination dst is dialed if not nil,
+//the dialing is canceled once ctx is done
+func (h *Handler) dialTunnel(ctx context.Context, bufioPool *bufiopool.Pool,
+	superProxy *superproxy.SuperProxy, hostWithPort string, dst *net.TCPAddr) (net.Conn, error) {
+	targetWithPort := dialAddr(hostWithPort, dst)
+	if superProxy == nil {
+		return transport.DialContext(ctx, targetWithPort)
+	}
+	host, port, _ := net.SplitHostPort(hostWithPort)
+	if dst == nil && len(host) > 0 && net.ParseIP(host) == nil {
+		ip := h.lookupIp(host)
+		if ip != nil {
+			targetWithPort = net.JoinHostPort(ip.String(), port)
+		}
+	}
+	return superProxy.MakeTunnelContext(ctx, bufioPool, targetWithPort)
+}
+
+//dialAddr returns the address dialed for hostWithPort, i.e. dst if pinned
+func dialAddr(hostWithPort string, dst *net.TCPAddr) string {
+	if dst != nil {
+		return dst.String()
+	}
+	return hostWithPort
+}
+
 //proxy the https connetions by MITM
-func (h *Handler) decryptConnect(c net.Conn, hostWithPort string,
-	bufioPool *bufiopool.Pool, client *client.Client, usage *usage.ProxyUsage) error {
+func (h *Handler) decryptConnect(c net.Conn, hostWithPort string, dst *net.TCPAddr,
+	user string, hello *ClientHello,
+	replier tunnelReplier, bufioPool *bufiopool.Pool, client *client.Client, usage usages) error {
 	//fakeTargetServer means a fake target server for remote client
 	//make a connection with client by creating a fake target server
 	//
 	//make a fake target server's certificate
-	fakeTargetServerCert, err := h.signFakeCert(h.MitmCACert, hostWithPort)
+	fakeTargetServerCert, err := h.signFakeCert(hostWithPort)
 	if err != nil {
-		h.sendHTTPSProxyStatusBadGateway(c)
+		n, _ := replier.replyError(c)
 		if usage != nil {
-			usage.AddOutgoingSize(httpTunnelMadeErrorSize)
+			usage.AddOutgoingSize(n)
 		}
 		return util.ErrWrapper(err, "fail to sign fake certificate for client")
 	}
-	//make the target server's config with this fake certificate
+	//make the target server's config with this fake certificate,
+	//the clients sending no SNI, e.g. the ones of an IP literal,
+	//are served with the certificate of the tunnel's host
 	targetServerName := ""
+	var upstream *upstreamTLS
 	fakeTargetServerTLSConfig := &tls.Config{
-		Certificates: []tls.Certificate{*fakeTargetServerCert},
-		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			targetServerName = hello.ServerName
-			return cert.GenCert(h.MitmCACert, []string{hello.ServerName})
+		GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			serverName := info.ServerName
+			if len(serverName) == 0 {
+				serverName = hostWithoutPort(hostWithPort)
+			}
+			targetServerName = serverName
+			if hello == nil {
+				hello = &ClientHello{
+					ServerName:    info.ServerName,
+					ALPNProtocols: info.SupportedProtos,
+					CipherSuites:  info.CipherSuites,
+				}
+			}
+			if h.MimicUpstreamCert {
+				upstream = h.upstreamTLSCache.get(dialAddr(hostWithPort, dst), serverName, func() *upstreamTLS {
+					return h.handshakeUpstream(bufioPool, hostWithPort, dst, user, serverName, hello)
+				})
+				if len(upstream.certs) > 0 {
+					if c, err := h.MitmCertCache.GetForUpstream(upstream.certs[0]); err == nil {
+						return c, nil
+					}
+				}
+			}
+			//the fake certificate is already signed for the tunnel's host
+			if strings.EqualFold(serverName, fakeTargetServerCert.Leaf.Subject.CommonName) {
+				return fakeTargetServerCert, nil
+			}
+			return h.MitmCertCache.Get(serverName)
 		},
 	}
-	//perform the proxy hand shake and fake tls handshake
-	handShake := func() (*tls.Conn, error) {
-		//make the proxy handshake
-		if err := h.sendHTTPSProxyStatusOK(c); err != nil {
-			return nil, util.ErrWrapper(err, "proxy fails to handshake with client")
-		}
-		if usage != nil {
-			usage.AddOutgoingSize(httpTunnelMadeOkSize)
-		}
-		//make the tls handshake in https
-		conn := tls.Server(c, fakeTargetServerTLSConfig)
-		if err := conn.Handshake(); err != nil {
-			conn.Close()
-			return nil, util.ErrWrapper(err, "fake tls server fails to handshake with client")
-		}
-		return conn, nil
-	}
-	fakeServerConn, err := handShake()
-	if len(targetServerName) == 0 {
-		err = errors.New("client didn't provide a target server name")
+	if h.MitmHTTP2 {
+		fakeTargetServerTLSConfig.NextProtos = mitmNextProtos
 	}
+
+	//make the proxy handshake
+	n, err := replier.replyOK(c)
 	if err != nil {
-		return err
+		return util.ErrWrapper(err, "proxy fails to handshake with client")
+	}
+	if usage != nil {
+		usage.AddOutgoingSize(n)
+	}
+
+	//tunnel traffic may not be a tls one, e.g. a SOCKS5 tunnel to port 80,
+	//so test the 1st byte, tls traffic always starts with a handshake record
+	tunnelReader := bufioPool.AcquireReader(c)
+	defer bufioPool.ReleaseReader(tunnelReader)
+	if b, err := tunnelReader.Peek(1); err != nil {
+		return util.ErrWrapper(err, "fail to read tunnel traffic from client")
+	} else if b[0] != tlsRecordTypeHandshake {
+		return h.serveTunnelHTTP(c, tunnelReader, hostWithPort, user,
+			&doOptions{dst: dst}, bufioPool, client, usage)
+	}
+
+	//make the tls handshake in https
+	fakeServerConn := tls.Server(&bufferedConn{Conn: c, r: tunnelReader},
+		fakeTargetServerTLSConfig)
+	if err := fakeServerConn.Handshake(); err != nil {
+		fakeServerConn.Close()
+		failure := h.MitmBypass.RecordFailure(hostWithPort, c.RemoteAddr(), err)
+		return util.ErrWrapper(err, "fake tls server fails to handshake with client (%s)", failure)
 	}
+	h.MitmBypass.RecordSuccess(hostWithPort)
 	defer fakeServerConn.Close()
 
+	opts := &doOptions{clientHello: hello, upstreamTLS: upstream, dst: dst}
+	if fakeServerConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		h.serveMitmHTTP2(fakeServerConn, hostWithPort, targetServerName, user, opts,
+			bufioPool, client, usage)
+		return nil
+	}
+
 	//make a connection with target server by creating a fake remote client
 	//
-	//convert fakeServerConn into a http request
+	//convert fakeServerConn into http requests, until client closes it
 	reader := bufioPool.AcquireReader(fakeServerConn)
 	defer bufioPool.ReleaseReader(reader)
+	connTime := time.Now()
+	for i := 0; ; i++ {
+		//the deadline restored after watching the client in `do` may have passed,
+		//so it's set for every request
+		if !h.keepalive.setReadDeadline(fakeServerConn, connTime) {
+			return util.ErrWrapper(nil, "exceeded MaxKeepaliveDuration, close connection after %s",
+				h.keepalive.maxDuration)
+		}
+		//client closes the keep-alive connection between requests
+		if _, err := reader.Peek(1); err == io.EOF && i > 0 {
+			return nil
+		}
+		closeConn, err := h.serveMitmRequest(fakeServerConn, reader, hostWithPort,
+			targetServerName, user, opts, bufioPool, client, usage)
+		if err != nil || closeConn {
+			return err
+		}
+	}
+}
+
+//serveMitmRequest reads a request from the decrypted connection and proxies it,
+//returns if the connection should be closed after this request
+func (h *Handler) serveMitmRequest(c net.Conn, reader *bufio.Reader,
+	hostWithPort, targetServerName, user string, opts *doOptions,
+	bufioPool *bufiopool.Pool, client *client.Client, usage usages) (bool, error) {
 	req := h.reqPool.Acquire()
 	defer h.reqPool.Release(req)
-	if err := req.ReadFrom(reader); err != nil {
-		return util.ErrWrapper(err, "fail to read fake tls server request header")
+	if err := h.readRequest(c, req, reader); err != nil {
+		return true, util.ErrWrapper(err, "fail to read fake tls server request header")
 	}
 
 	if usage != nil {
@@ -296,19 +651,133 @@ func (h *Handler) decryptConnect(c net.Conn, hostWithPort string,
 	//mandatory for tls request cause non hosts provided in request header
 	req.SetHostWithPort(hostWithPort)
 
-	return h.do(fakeServerConn, req, bufioPool, client, usage)
+	if err := h.do(c, req, user, bufioPool, client, usage, opts); err != nil {
+		return true, err
+	}
+	return req.ConnectionClose(), nil
 }
 
-func (h *Handler) signFakeCert(mitmCACert *tls.Certificate, host string) (*tls.Certificate, error) {
+//keepalive limits the keep-alive connections decrypted,
+//see Proxy.ReadTimeout and Proxy.MaxKeepaliveDuration
+type keepalive struct {
+	readTimeout time.Duration
+	maxDuration time.Duration
+}
+
+//setReadDeadline sets the read deadline of the next request read from c
+//connected at connTime, returns false if the max duration is exceeded
+func (k keepalive) setReadDeadline(c net.Conn, connTime time.Time) bool {
+	now := time.Now()
+	var deadline time.Time
+	if k.readTimeout > 0 {
+		deadline = now.Add(k.readTimeout)
+	}
+	if k.maxDuration > 0 {
+		connDeadline := connTime.Add(k.maxDuration)
+		if !now.Before(connDeadline) {
+			return false
+		}
+		if deadline.IsZero() || connDeadline.Before(deadline) {
+			deadline = connDeadline
+		}
+	}
+	c.SetReadDeadline(deadline)
+	return true
+}
+
+//upstreamHandshakeTimeout timeout of dialing and handshaking with the upstream
+//in MimicUpstreamCert mode
+const upstreamHandshakeTimeout = 10 * time.Second
+
+//upstreamTLS the result of handshaking with the upstream
+type upstreamTLS struct {
+	serverName string
+	certs      []*x509.Certificate
+	//err the handshake or verification error
+	err error
+}
+
+//handshakeUpstream handshakes with the upstream of hostWithPort in TLS,
+//the certificates are verified after handshake rather than skipped,
+//so the verification error is recorded instead of failing the handshake
+func (h *Handler) handshakeUpstream(bufioPool *bufiopool.Pool, hostWithPort string,
+	dst *net.TCPAddr, user, serverName string, hello *ClientHello) *upstreamTLS {
+	result := &upstreamTLS{serverName: serverName}
+	superProxy := h.URLProxy(user, hostWithPort, nil, hello)
+	if superProxy != nil {
+		superProxy.AcquireToken()
+		defer superProxy.PushBackToken()
+	}
+	//the client is waiting for the handshake, so the dialing is limited as well
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamHandshakeTimeout)
+	defer cancel()
+	conn, err := h.dialTunnel(ctx, bufioPool, superProxy, hostWithPort, dst)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer conn.Close()
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		result.err = err
+		return result
+	}
+	result.certs = tlsConn.ConnectionState().PeerCertificates
+
+	intermediates := x509.NewCertPool()
+	for _, c := range result.certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, result.err = result.certs[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Intermediates: intermediates,
+	})
+	return result
+}
+
+//tlsRecordTypeHandshake the content type of a tls handshake record
+const tlsRecordTypeHandshake = 0x16
+
+//serveTunnelHTTP serves the plain http request sent in a tunnel,
+//the request is in origin-form, so the tunnel's target is used as host
+func (h *Handler) serveTunnelHTTP(c net.Conn, reader *bufio.Reader,
+	hostWithPort, user string, opts *doOptions,
+	bufioPool *bufiopool.Pool, client *client.Client, usage usages) error {
+	req := h.reqPool.Acquire()
+	defer h.reqPool.Release(req)
+	if err := h.readRequest(c, req, reader); err != nil {
+		return util.ErrWrapper(err, "fail to read tunnel request header")
+	}
+
+	if usage != nil {
+		usage.AddIncomingSize(uint64(req.GetReqLineSize()))
+	}
+
+	req.SetHostWithPort(hostWithPort)
+	return h.do(c, req, user, bufioPool, client, usage, opts)
+}
+
+//bufferedConn net connection reads from a buffered reader of itself,
+//so the bytes already buffered are not lost
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (h *Handler) signFakeCert(host string) (*tls.Certificate, error) {
 	domain, _, err := net.SplitHostPort(host)
 	if err != nil {
 		return nil, err
 	}
-	cert, err2 := cert.GenCert(mitmCACert, []string{domain})
-	if err2 != nil {
-		return nil, err2
-	}
-	return cert, nil
+	return h.MitmCertCache.Get(domain)
 }
 
 //resolve domain to ip
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+
+	basehttp "github.com/haxii/fastproxy/http"
+	"github.com/haxii/fastproxy/proxy/http"
+	"github.com/haxii/fastproxy/superproxy"
+	"github.com/haxii/fastproxy/util"
+)
+
+//HeaderRuleDirection which messages a header rule edits
+type HeaderRuleDirection int
+
+const (
+	//HeaderRuleRequest edits the requests sent to upstream
+	HeaderRuleRequest HeaderRuleDirection = iota
+	//HeaderRuleResponse edits the responses sent to client
+	HeaderRuleResponse
+	//HeaderRuleBoth edits both the requests and the responses
+	HeaderRuleBoth
+)
+
+//HeaderRule edits the headers of the requests matched and their responses,
+//e.g. strips `X-Forwarded-For` for some hosts, or injects an API key header,
+//the headers are edited while they're streamed, bodies are not buffered
+type HeaderRule struct {
+	//Host glob matches the target host of the request, e.g. `*.example.com`,
+	//the port is matched as well if Host has one, e.g. `api.internal:443`,
+	//empty matches all the hosts, see path.Match for the glob syntax
+	Host string
+
+	//PathPrefix matches the path of the request, empty matches all the paths
+	PathPrefix string
+
+	//Methods matches the method of the request, empty matches all the methods
+	Methods []string
+
+	//SuperProxies matches the requests sent via one of the super proxies,
+	//empty matches all the requests
+	SuperProxies []*superproxy.SuperProxy
+
+	//Direction which messages the rule edits, requests by default
+	Direction HeaderRuleDirection
+
+	//Edits edits applied to the header in order
+	Edits []http.HeaderEdit
+}
+
+func (rule *HeaderRule) validate() error {
+	if _, err := path.Match(rule.Host, ""); err != nil {
+		return util.ErrWrapper(err, "invalid header rule host "+rule.Host)
+	}
+	//the edits are written in the header as is, so CR & LF can't inject other fields
+	for _, e := range rule.Edits {
+		if !basehttp.IsToken(e.Name) {
+			return errors.New("invalid header rule edit name " + strconv.Quote(e.Name))
+		}
+		if !basehttp.IsFieldValue(e.Value) {
+			return errors.New("invalid header rule edit value " + strconv.Quote(e.Value) + " of " + e.Name)
+		}
+	}
+	return nil
+}
+
+//match test if the request is matched by the rule, regardless of the super proxy
+func (rule *HeaderRule) match(hostWithPort string, path, method []byte) bool {
+	if len(rule.Host) > 0 {
+		host := hostWithPort
+		if strings.IndexByte(rule.Host, ':') < 0 {
+			host = hostWithoutPort(hostWithPort)
+		}
+		if !matchHostGlob(rule.Host, host) {
+			return false
+		}
+	}
+	if !bytes.HasPrefix(path, []byte(rule.PathPrefix)) {
+		return false
+	}
+	if len(rule.Methods) > 0 {
+		matched := false
+		for _, m := range rule.Methods {
+			if strings.EqualFold(m, string(method)) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+//matchProxy test if the request sent via superProxy is matched by the rule
+func (rule *HeaderRule) matchProxy(superProxy *superproxy.SuperProxy) bool {
+	if len(rule.SuperProxies) == 0 {
+		return true
+	}
+	for _, p := range rule.SuperProxies {
+		if p == superProxy {
+			return true
+		}
+	}
+	return false
+}
+
+//matchHostGlob path.Match case-insensitively, as host names are
+func matchHostGlob(pattern, host string) bool {
+	matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(host))
+	return matched
+}
+
+//applyHeaderRules sets the edits of the rules matched to the request and resp,
+//which are applied when the headers are written or read, it's applied again
+//once the super proxy is switched, the request matched by a rule of super
+//proxies is not replayed, as its header written may be edited for another one
+func (h *Handler) applyHeaderRules(req *http.Request, resp *http.Response) {
+	if len(h.HeaderRules) == 0 {
+		return
+	}
+	hostWithPort := req.HostInfo().HostWithPort()
+	path := req.PathWithQueryFragment()
+	method := req.Method()
+	superProxy := req.GetProxy()
+	var reqEdits, respEdits []http.HeaderEdit
+	for i := range h.HeaderRules {
+		rule := &h.HeaderRules[i]
+		if !rule.match(hostWithPort, path, method) {
+			continue
+		}
+		if len(rule.SuperProxies) > 0 {
+			req.SetUnreplayable()
+		}
+		if !rule.matchProxy(superProxy) {
+			continue
+		}
+		if rule.Direction != HeaderRuleResponse {
+			reqEdits = append(reqEdits, rule.Edits...)
+		}
+		if rule.Direction != HeaderRuleRequest {
+			respEdits = append(respEdits, rule.Edits...)
+		}
+	}
+	req.SetHeaderEdits(reqEdits)
+	resp.SetHeaderEdits(respEdits)
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	proxyhttp "github.com/haxii/fastproxy/proxy/http"
+	"github.com/haxii/fastproxy/superproxy"
+)
+
+func TestHeaderRuleMatch(t *testing.T) {
+	pool := &superproxy.SuperProxy{}
+	for i, c := range []struct {
+		rule         HeaderRule
+		hostWithPort string
+		path, method string
+		superProxy   *superproxy.SuperProxy
+		matched      bool
+	}{
+		{HeaderRule{}, "a.com:80", "/", "GET", nil, true},
+		{HeaderRule{Host: "*.example.com"}, "API.Example.com:443", "/", "GET", nil, true},
+		{HeaderRule{Host: "*.example.com"}, "example.com:443", "/", "GET", nil, false},
+		{HeaderRule{Host: "api.internal:443"}, "api.internal:443", "/", "GET", nil, true},
+		{HeaderRule{Host: "api.internal:443"}, "api.internal:80", "/", "GET", nil, false},
+		{HeaderRule{PathPrefix: "/v1/"}, "a.com:80", "/v1/users", "GET", nil, true},
+		{HeaderRule{PathPrefix: "/v1/"}, "a.com:80", "/v2/users", "GET", nil, false},
+		{HeaderRule{Methods: []string{"post", "PUT"}}, "a.com:80", "/", "POST", nil, true},
+		{HeaderRule{Methods: []string{"post", "PUT"}}, "a.com:80", "/", "GET", nil, false},
+		{HeaderRule{SuperProxies: []*superproxy.SuperProxy{pool}}, "a.com:80", "/", "GET", pool, true},
+		{HeaderRule{SuperProxies: []*superproxy.SuperProxy{pool}}, "a.com:80", "/", "GET", nil, false},
+	} {
+		if matched := c.rule.match(c.hostWithPort, []byte(c.path), []byte(c.method)) &&
+			c.rule.matchProxy(c.superProxy); matched != c.matched {
+			t.Fatalf("case %d: unexpected match %v, expecting %v", i, matched, c.matched)
+		}
+	}
+
+	if err := (&HeaderRule{Host: "[a-"}).validate(); err == nil {
+		t.Fatalf("invalid host glob is not refused")
+	}
+	for _, e := range []proxyhttp.HeaderEdit{
+		{Name: ""},
+		{Name: "X A"},
+		{Name: "X-A:"},
+		{Name: "X-A", Value: "1\r\nX-Injected: 1"},
+		{Name: "X-A", Value: "1\n"},
+		{Name: "X-A", Value: "\x00"},
+	} {
+		if err := (&HeaderRule{Edits: []proxyhttp.HeaderEdit{e}}).validate(); err == nil {
+			t.Fatalf("invalid header edit %q: %q is not refused", e.Name, e.Value)
+		}
+	}
+	if err := (&HeaderRule{Edits: []proxyhttp.HeaderEdit{
+		{Action: proxyhttp.HeaderEditSet, Name: "X-Api-Key", Value: "a\tb c"},
+		{Action: proxyhttp.HeaderEditRemove, Name: "X-Forwarded-For"},
+	}}).validate(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+}
+
+func TestHeaderRuleSwitchProxy(t *testing.T) {
+	a, b := &superproxy.SuperProxy{}, &superproxy.SuperProxy{}
+	h := &Handler{HeaderRules: []HeaderRule{
+		{SuperProxies: []*superproxy.SuperProxy{a}, Edits: []proxyhttp.HeaderEdit{
+			{Action: proxyhttp.HeaderEditSet, Name: "X-Proxy", Value: "a"}}},
+		{SuperProxies: []*superproxy.SuperProxy{b}, Edits: []proxyhttp.HeaderEdit{
+			{Action: proxyhttp.HeaderEditSet, Name: "X-Proxy", Value: "b"}}},
+	}}
+	req := &proxyhttp.Request{}
+	raw := "GET / HTTP/1.1\r\nHost: a.com\r\nX-Proxy: none\r\n\r\n"
+	if err := req.ReadFrom(bufio.NewReader(strings.NewReader(raw))); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	req.SetHijacker(testHijacker{})
+	resp := &proxyhttp.Response{}
+	//the edits are set again for the super proxy switched to
+	for _, test := range []struct {
+		superProxy *superproxy.SuperProxy
+		expHeader  string
+	}{
+		{a, "X-Proxy: a\r\n"},
+		{b, "X-Proxy: b\r\n"},
+		{nil, "X-Proxy: none\r\n"},
+	} {
+		req.SetProxy(test.superProxy)
+		h.applyHeaderRules(req, resp)
+		var buf bytes.Buffer
+		bw := bufio.NewWriter(&buf)
+		if err := req.WriteHeaderTo(bw); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		bw.Flush()
+		if !strings.Contains(buf.String(), test.expHeader) || strings.Count(buf.String(), "X-Proxy") != 1 {
+			t.Fatalf("unexpected header %q, expecting %q", buf.String(), test.expHeader)
+		}
+	}
+	//the header written for a super proxy is not replayed for another
+	if req.Replayable() {
+		t.Fatalf("request edited by super proxy is replayable")
+	}
+}
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haxii/fastproxy/bufiopool"
+	"github.com/haxii/fastproxy/client"
+	"golang.org/x/net/http2"
+)
+
+//mitmNextProtos ALPN protocols offered by the fake tls server if MitmHTTP2 is enabled
+var mitmNextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+
+//serveMitmHTTP2 serves the decrypted h2 connection until it's closed,
+//every stream is converted into a HTTP/1.1 request and proxied by `do`
+//like the ones in HTTP/1.1 connections, then the response is sent back in h2
+func (h *Handler) serveMitmHTTP2(c *tls.Conn, hostWithPort, targetServerName, user string,
+	opts *doOptions, bufioPool *bufiopool.Pool, client *client.Client, usage usages) {
+	//the idle connection is closed within ReadTimeout, and the connection
+	//is closed once MaxKeepaliveDuration is exceeded
+	server := &http2.Server{IdleTimeout: h.keepalive.readTimeout}
+	if h.keepalive.maxDuration > 0 {
+		c.SetReadDeadline(time.Now().Add(h.keepalive.maxDuration))
+	}
+	conn := &http2Conn{Conn: c}
+	defer conn.close()
+	server.ServeConn(conn, &http2.ServeConnOpts{
+		Handler: nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+			h.serveHTTP2Stream(w, r, c, hostWithPort, targetServerName, user, opts,
+				bufioPool, client, usage)
+		}),
+	})
+}
+
+//http2Conn the decrypted connection served in h2, the h2 server returns without
+//waiting for its reading goroutine, e.g. the idle connection is closed by server,
+//so the reading is waited for in close, as the reader of c is released after serving
+type http2Conn struct {
+	*tls.Conn
+	lock   sync.RWMutex
+	closed bool
+}
+
+func (c *http2Conn) Read(b []byte) (int, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Read(b)
+}
+
+//close closes the connection then waits for the reading to end
+func (c *http2Conn) close() {
+	c.Conn.Close()
+	c.lock.Lock()
+	c.closed = true
+	c.lock.Unlock()
+}
+
+//serveHTTP2Stream proxies the request of a h2 stream
+func (h *Handler) serveHTTP2Stream(w nethttp.ResponseWriter, r *nethttp.Request,
+	c net.Conn, hostWithPort, targetServerName, user string, opts *doOptions,
+	bufioPool *bufiopool.Pool, client *client.Client, usage usages) {
+	if r.Method == nethttp.MethodConnect {
+		w.WriteHeader(nethttp.StatusMethodNotAllowed)
+		return
+	}
+
+	//convert the stream into a HTTP/1.1 request
+	reqStream, closeReqStream := http1RequestStream(r)
+	defer closeReqStream()
+	reader := bufioPool.AcquireReader(reqStream)
+	defer bufioPool.ReleaseReader(reader)
+	req := h.reqPool.Acquire()
+	defer h.reqPool.Release(req)
+	if err := h.readRequest(nil, req, reader); err != nil {
+		statusCode := nethttp.StatusBadRequest
+		if limitErr := req.ExceededLimit(); limitErr != nil {
+			statusCode = requestLimitStatusCode(limitErr.Limit)
+		}
+		w.WriteHeader(statusCode)
+		return
+	}
+
+	if usage != nil {
+		usage.AddIncomingSize(uint64(req.GetReqLineSize()))
+	}
+
+	req.SetTLS(targetServerName)
+	req.SetHostWithPort(hostWithPort)
+
+	//the upstream work is canceled once the stream is reset or the connection is closed
+	var streamOpts doOptions
+	if opts != nil {
+		streamOpts = *opts
+	}
+	streamOpts.ctx = r.Context()
+
+	//the HTTP/1.1 response written by `do` is parsed then sent back in h2
+	respStream, respStreamWriter := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		err := h.do(&http2StreamConn{Conn: c, w: respStreamWriter}, req, user,
+			bufioPool, client, usage, &streamOpts)
+		respStreamWriter.CloseWithError(err)
+		close(done)
+	}()
+	defer func() {
+		//stop writing the response if client is gone
+		respStream.Close()
+		<-done
+	}()
+	respReader := bufioPool.AcquireReader(respStream)
+	defer bufioPool.ReleaseReader(respReader)
+	resp, err := nethttp.ReadResponse(respReader, r)
+	//informational responses are not sent in h2
+	for err == nil && resp.StatusCode < nethttp.StatusOK {
+		resp, err = nethttp.ReadResponse(respReader, r)
+	}
+	if err != nil {
+		w.WriteHeader(nethttp.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	header := w.Header()
+	for name, values := range resp.Header {
+		if !isHopByHopHeader(name) {
+			header[name] = values
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(flushWriter{w}, resp.Body); err != nil {
+		//the response is broken, reset the stream
+		panic(nethttp.ErrAbortHandler)
+	}
+	//the trailer fields are read after the body
+	for name, values := range resp.Trailer {
+		header[nethttp.TrailerPrefix+name] = values
+	}
+}
+
+//http1RequestStream converts the h2 request into a HTTP/1.1 request stream,
+//a body of unknown length or with trailer fields is sent in chunked encoding,
+//close releases the stream in case it's not fully read
+func http1RequestStream(r *nethttp.Request) (stream io.Reader, close func()) {
+	var header bytes.Buffer
+	header.WriteString(r.Method + " " + r.RequestURI + " HTTP/1.1\r\n")
+	header.WriteString("Host: " + r.Host + "\r\n")
+	r.Header.WriteSubset(&header, http1ExcludedHeaders)
+	switch {
+	case r.ContentLength > 0 && len(r.Trailer) == 0:
+		header.WriteString("Content-Length: " + strconv.FormatInt(r.ContentLength, 10) + "\r\n\r\n")
+		return io.MultiReader(&header, r.Body), func() {}
+	case r.ContentLength == 0 || r.Body == nil || r.Body == nethttp.NoBody:
+		header.WriteString("\r\n")
+		return &header, func() {}
+	}
+
+	if len(r.Trailer) > 0 {
+		names := make([]string, 0, len(r.Trailer))
+		for name := range r.Trailer {
+			names = append(names, name)
+		}
+		header.WriteString("Trailer: " + strings.Join(names, ", ") + "\r\n")
+	}
+	header.WriteString("Transfer-Encoding: chunked\r\n\r\n")
+	body, bodyWriter := io.Pipe()
+	go func() {
+		chunkedWriter := httputil.NewChunkedWriter(bodyWriter)
+		_, err := io.Copy(chunkedWriter, r.Body)
+		if err == nil {
+			err = chunkedWriter.Close()
+		}
+		if err == nil {
+			//the trailer fields are received after the body
+			err = r.Trailer.Write(bodyWriter)
+		}
+		if err == nil {
+			_, err = io.WriteString(bodyWriter, "\r\n")
+		}
+		bodyWriter.CloseWithError(err)
+	}()
+	return io.MultiReader(&header, body), func() { body.Close() }
+}
+
+//http1ExcludedHeaders headers of a h2 request rewritten in HTTP/1.1
+var http1ExcludedHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+}
+
+//isHopByHopHeader test if the response header is for HTTP/1.1 connection only
+func isHopByHopHeader(name string) bool {
+	switch name {
+	case "Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade":
+		return true
+	}
+	return false
+}
+
+//http2StreamConn connection of a h2 stream, the HTTP/1.1 response written
+//to it is sent to w instead of the underlying connection
+type http2StreamConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c *http2StreamConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+//flushWriter flushes every write to client, so the streaming responses are not delayed
+type flushWriter struct {
+	w nethttp.ResponseWriter
+}
+
+func (f flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if flusher, ok := f.w.(nethttp.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
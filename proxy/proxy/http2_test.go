@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	gohttp "net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestMitmHTTP2(t *testing.T) {
+	pool := &hijackedResponsePool{response: func(method, path string) string {
+		if path == "/trailer" {
+			return "HTTP/1.1 200 OK\r\nTrailer: X-Checksum\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"5\r\nhello\r\n0\r\nX-Checksum: 1234\r\n\r\n"
+		}
+		return pathResponse(method, path)
+	}}
+	addr := startTestProxy(t, &Proxy{ReadTimeout: time.Second, Handler: Handler{
+		HijackerPool:      pool,
+		MitmCACert:        testCA(t),
+		MitmHTTP2:         true,
+		DecodeSniffedBody: true,
+		ShouldDecryptHost: func(string, *ClientHello) bool { return true },
+	}})
+	conn, err := dialMitm(t, addr, "example.com:443", &tls.Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+		NextProtos:         []string{http2.NextProtoTLS},
+	})
+	if err != nil {
+		t.Fatalf("fail to handshake with proxy: %s", err)
+	}
+	defer conn.Close()
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != http2.NextProtoTLS {
+		t.Fatalf("unexpected protocol %q negotiated", proto)
+	}
+	cc, err := (&http2.Transport{}).NewClientConn(conn)
+	if err != nil {
+		t.Fatalf("fail to make h2 connection: %s", err)
+	}
+
+	tests := []struct {
+		method     string
+		path       string
+		body       io.Reader
+		expBody    string
+		expTrailer string
+	}{
+		{"GET", "/a?b=c", nil, "/a?b=c", ""},
+		//the body of unknown length is sent in chunks
+		{"POST", "/post", io.MultiReader(strings.NewReader("hello "), strings.NewReader("world")),
+			"/post", ""},
+		{"PUT", "/put", strings.NewReader("sized"), "/put", ""},
+		//the response delimited by closing ends the stream only
+		{"GET", "/close", nil, "/close", ""},
+		{"GET", "/trailer", nil, "hello", "1234"},
+	}
+	for i, test := range tests {
+		req, _ := gohttp.NewRequest(test.method, "https://example.com"+test.path, test.body)
+		if test.method == "POST" {
+			req.ContentLength = -1
+		}
+		resp, err := cc.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("fail to %s %s: %s", test.method, test.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 || string(body) != test.expBody {
+			t.Fatalf("unexpected response %s %q of %s %s", resp.Proto, body, test.method, test.path)
+		}
+		if trailer := resp.Trailer.Get("X-Checksum"); trailer != test.expTrailer {
+			t.Fatalf("unexpected trailer %q of %s", trailer, test.path)
+		}
+		pool.lock.Lock()
+		reqBody := pool.bodies[i]
+		pool.lock.Unlock()
+		if expReqBody := map[string]string{"POST": "hello world", "PUT": "sized"}[test.method]; reqBody != expReqBody {
+			t.Fatalf("unexpected request body %q of %s %s", reqBody, test.method, test.path)
+		}
+	}
+
+	//the CONNECT method is not allowed in the decrypted connection
+	req, _ := gohttp.NewRequest("CONNECT", "https://example.com", nil)
+	req.Host = "other.com:443"
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("fail to CONNECT: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != gohttp.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %d of CONNECT", resp.StatusCode)
+	}
+
+	//the idle connection is closed within ReadTimeout
+	start := time.Now()
+	for cc.State().Closed == false && time.Since(start) < 5*time.Second {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !cc.State().Closed {
+		t.Fatalf("idle h2 connection is not closed")
+	}
+}
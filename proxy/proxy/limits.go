@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"io"
+
+	"github.com/haxii/fastproxy/http"
+
+	proxyhttp "github.com/haxii/fastproxy/proxy/http"
+)
+
+//requestLimits limits of the requests read from clients, see Proxy.Limits
+type requestLimits struct {
+	limits   *http.Limits
+	exceeded *http.LimitCounter
+}
+
+//respondExceededLimit counts the limit exceeded in proxying req then responds it
+//to w, it's called before anything of resp written, so the error can be responded
+func (h *Handler) respondExceededLimit(w io.Writer, req *proxyhttp.Request, resp *proxyhttp.Response) {
+	if limitErr := req.ExceededLimit(); limitErr != nil {
+		h.requestLimits.exceeded.Add(limitErr.Limit)
+		writeFastError(w, requestLimitStatusCode(limitErr.Limit), limitErr.Error()+".\n")
+	} else if limitErr := resp.ExceededLimit(); limitErr != nil {
+		//the upstream one is counted by client
+		writeFastError(w, http.StatusBadGateway, "upstream "+limitErr.Error()+".\n")
+	}
+}
+
+//requestLimitStatusCode status code responded to the request exceeding limit
+func requestLimitStatusCode(limit http.Limit) int {
+	switch limit {
+	case http.LimitStartLineSize:
+		return http.StatusRequestURITooLong
+	case http.LimitHeaderSize, http.LimitHeaderCount:
+		return http.StatusRequestHeaderFieldsTooLarge
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,387 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	gohttp "net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/cert"
+	"github.com/haxii/fastproxy/hijack"
+	"github.com/haxii/fastproxy/http"
+)
+
+//testCA makes a new CA for MITM
+func testCA(t *testing.T) *tls.Certificate {
+	certPEM, keyPEM, err := cert.GenCA("fastproxy test CA")
+	if err != nil {
+		t.Fatalf("fail to generate CA: %s", err)
+	}
+	ca, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("fail to load CA: %s", err)
+	}
+	if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+		t.Fatalf("fail to parse CA: %s", err)
+	}
+	return &ca
+}
+
+//dialMitm makes a tunnel to target via the proxy, then handshakes in TLS with
+//server name, which is answered by the proxy decrypting the tunnel
+func dialMitm(t *testing.T, proxyAddr, target string, config *tls.Config) (*tls.Conn, error) {
+	c, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("fail to dial proxy: %s", err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	resp, err := gohttp.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil || resp.StatusCode != gohttp.StatusOK {
+		t.Fatalf("fail to make tunnel: %v, %v", resp, err)
+	}
+	tlsConn := tls.Client(c, config)
+	if err := tlsConn.Handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+//upstreamTLSHijacker records the upstream's handshake result told
+type upstreamTLSHijacker struct {
+	testHijacker
+	told *int32
+}
+
+func (h upstreamTLSHijacker) OnUpstreamTLS(serverName string, certs []*x509.Certificate, err error) {
+	if len(certs) > 0 && err != nil {
+		atomic.AddInt32(h.told, 1)
+	}
+}
+
+type upstreamTLSHijackerPool struct {
+	told int32
+}
+
+func (p *upstreamTLSHijackerPool) Get(clientAddr net.Addr, user string, host string,
+	method, path []byte) hijack.Hijacker {
+	return upstreamTLSHijacker{told: &p.told}
+}
+
+func (p *upstreamTLSHijackerPool) Put(hijack.Hijacker) {}
+
+func TestMimicUpstreamCert(t *testing.T) {
+	var upstreamConns int32
+	upstream := httptest.NewUnstartedServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		io.WriteString(w, "hello")
+	}))
+	upstream.Config.ConnState = func(c net.Conn, state gohttp.ConnState) {
+		if state == gohttp.StateNew {
+			atomic.AddInt32(&upstreamConns, 1)
+		}
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+	upstreamAddr := upstream.Listener.Addr().String()
+
+	ca := testCA(t)
+	pool := &upstreamTLSHijackerPool{}
+	addr := startTestProxy(t, &Proxy{Handler: Handler{
+		HijackerPool:      pool,
+		MitmCACert:        ca,
+		MimicUpstreamCert: true,
+		ShouldDecryptHost: func(string, *ClientHello) bool { return true },
+	}})
+
+	//the upstream is handshaken with only once for the clients
+	for i := 0; i < 3; i++ {
+		conn, err := dialMitm(t, addr, upstreamAddr, &tls.Config{
+			ServerName:         "example.com",
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatalf("fail to handshake with proxy: %s", err)
+		}
+		leaf := conn.ConnectionState().PeerCertificates[0]
+		upstreamLeaf := upstream.Certificate()
+		if leaf.Subject.String() != upstreamLeaf.Subject.String() ||
+			!leaf.NotAfter.Equal(upstreamLeaf.NotAfter) ||
+			len(leaf.DNSNames) != len(upstreamLeaf.DNSNames) {
+			t.Fatalf("upstream certificate %v is not mimicked by %v", upstreamLeaf.Subject, leaf.Subject)
+		}
+		if err := leaf.CheckSignatureFrom(ca.Leaf); err != nil {
+			t.Fatalf("mimicked certificate is not signed by CA: %s", err)
+		}
+		//the self-signed upstream fails to be verified
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}
+	//one connection for mimicking, then one for each request failing to verify
+	if n := atomic.LoadInt32(&upstreamConns); n != 1+3 {
+		t.Fatalf("upstream is connected %d times, expecting once for mimicking", n)
+	}
+	if told := atomic.LoadInt32(&pool.told); told != 3 {
+		t.Fatalf("upstream verification error is told %d times, expecting 3", told)
+	}
+
+	//the client sending no SNI is served with the certificate of the tunnel's IP
+	conn, err := dialMitm(t, addr, upstreamAddr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("fail to handshake with proxy without SNI: %s", err)
+	}
+	defer conn.Close()
+	if err := conn.ConnectionState().PeerCertificates[0].VerifyHostname("127.0.0.1"); err != nil {
+		t.Fatalf("certificate mimicked without SNI is not for the tunnel's IP: %s", err)
+	}
+}
+
+func TestMitmNoServerName(t *testing.T) {
+	ca := testCA(t)
+	addr := startTestProxy(t, &Proxy{Handler: Handler{
+		HijackerPool:      &hijackedResponsePool{response: pathResponse},
+		MitmCACert:        ca,
+		ShouldDecryptHost: func(string, *ClientHello) bool { return true },
+	}})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	//the clients sending no SNI get the certificate forged for the CONNECT host,
+	//whether it's an IP or a name
+	for _, test := range []struct {
+		target string
+		host   string
+	}{
+		{"127.0.0.1:443", "127.0.0.1"},
+		{"[::1]:443", "::1"},
+		{"example.com:443", "example.com"},
+	} {
+		//the certificate is verified against the host below rather than in handshake
+		conn, err := dialMitm(t, addr, test.target, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("fail to handshake with proxy for %s: %s", test.target, err)
+		}
+		certs := conn.ConnectionState().PeerCertificates
+		if _, err := certs[0].Verify(x509.VerifyOptions{DNSName: test.host, Roots: roots}); err != nil {
+			t.Fatalf("certificate for %s is not forged for %s: %s", test.target, test.host, err)
+		}
+		io.WriteString(conn, "GET /a HTTP/1.1\r\nHost: "+test.host+"\r\n\r\n")
+		resp, err := gohttp.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("fail to read response for %s: %s", test.target, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "/a" {
+			t.Fatalf("unexpected response %q for %s", body, test.target)
+		}
+		conn.Close()
+	}
+}
+
+func TestUpstreamTLSCache(t *testing.T) {
+	c := &upstreamTLSCache{}
+	leaf := &x509.Certificate{NotAfter: time.Now().Add(time.Hour)}
+	var handshakes int32
+	handshake := func() *upstreamTLS {
+		atomic.AddInt32(&handshakes, 1)
+		time.Sleep(10 * time.Millisecond)
+		return &upstreamTLS{certs: []*x509.Certificate{leaf}}
+	}
+
+	//concurrent clients share the same handshake
+	var wg sync.WaitGroup
+	results := make([]*upstreamTLS, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = c.get("a.com:443", "a.com", handshake)
+		}(i)
+	}
+	wg.Wait()
+	for _, result := range results {
+		if result != results[0] {
+			t.Fatalf("upstream is handshaken with more than once")
+		}
+	}
+	if c.get("a.com:443", "a.com", handshake) != results[0] || handshakes != 1 {
+		t.Fatalf("handshake result is not cached")
+	}
+	//keyed by the server name as well
+	if c.get("a.com:443", "b.com", handshake) == results[0] || handshakes != 2 {
+		t.Fatalf("handshake result of another server name is used")
+	}
+
+	//failures are not cached
+	failure := func() *upstreamTLS {
+		atomic.AddInt32(&handshakes, 1)
+		return &upstreamTLS{err: errors.New("connection refused")}
+	}
+	c.get("c.com:443", "c.com", failure)
+	c.get("c.com:443", "c.com", failure)
+	if handshakes != 4 {
+		t.Fatalf("failed handshake is cached")
+	}
+
+	//expired with the upstream certificate
+	expired := &x509.Certificate{NotAfter: time.Now()}
+	c.get("d.com:443", "d.com", func() *upstreamTLS {
+		return &upstreamTLS{certs: []*x509.Certificate{expired}}
+	})
+	c.get("d.com:443", "d.com", handshake)
+	if handshakes != 5 {
+		t.Fatalf("handshake result of expired certificate is used")
+	}
+}
+
+//hijackedResponsePool hijacks every response with the one made by response,
+//the request bodies sniffed are recorded
+type hijackedResponsePool struct {
+	response func(method, path string) string
+	lock     sync.Mutex
+	bodies   []string
+}
+
+func (p *hijackedResponsePool) Get(clientAddr net.Addr, user string, host string,
+	method, path []byte) hijack.Hijacker {
+	return &hijackedResponseHijacker{response: p.response(string(method), string(path))}
+}
+
+func (p *hijackedResponsePool) Put(h hijack.Hijacker) {
+	p.lock.Lock()
+	p.bodies = append(p.bodies, h.(*hijackedResponseHijacker).body.String())
+	p.lock.Unlock()
+}
+
+type hijackedResponseHijacker struct {
+	testHijacker
+	response string
+	body     bytes.Buffer
+}
+
+func (h *hijackedResponseHijacker) OnRequest(header http.Header, rawHeader []byte) io.Writer {
+	return &h.body
+}
+
+func (h *hijackedResponseHijacker) HijackResponse() io.Reader {
+	return strings.NewReader(h.response)
+}
+
+//pathResponse responds the path in body, the one of path `/close` is delimited
+//by closing the connection
+func pathResponse(method, path string) string {
+	if path == "/close" {
+		return "HTTP/1.1 200 OK\r\n\r\n" + path
+	}
+	return "HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len(path)) + "\r\n\r\n" + path
+}
+
+func TestMitmKeepAlive(t *testing.T) {
+	addr := startTestProxy(t, &Proxy{ReadTimeout: 200 * time.Millisecond, Handler: Handler{
+		HijackerPool:      &hijackedResponsePool{response: pathResponse},
+		MitmCACert:        testCA(t),
+		ShouldDecryptHost: func(string, *ClientHello) bool { return true },
+	}})
+	config := &tls.Config{ServerName: "example.com", InsecureSkipVerify: true}
+	conn, err := dialMitm(t, addr, "example.com:443", config)
+	if err != nil {
+		t.Fatalf("fail to handshake with proxy: %s", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for _, path := range []string{"/a", "/b"} {
+		io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		resp, err := gohttp.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("fail to read response of %s: %s", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != path {
+			t.Fatalf("unexpected response %q of %s", body, path)
+		}
+	}
+	//the idle connection is closed within ReadTimeout
+	start := time.Now()
+	if n, err := reader.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("idle connection is not closed: %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("idle connection is closed after %s", elapsed)
+	}
+
+	//the connection ends the response delimited by closing it
+	conn, err = dialMitm(t, addr, "example.com:443", config)
+	if err != nil {
+		t.Fatalf("fail to handshake with proxy: %s", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /close HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, err := gohttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("fail to read response: %s", err)
+	}
+	if body, err := io.ReadAll(resp.Body); err != nil || string(body) != "/close" {
+		t.Fatalf("unexpected response %q delimited by closing: %v", body, err)
+	}
+}
+
+//deadlineConn records the read deadline set
+type deadlineConn struct {
+	net.Conn
+	deadline time.Time
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func TestKeepaliveSetReadDeadline(t *testing.T) {
+	tests := []struct {
+		readTimeout time.Duration
+		maxDuration time.Duration
+		connAge     time.Duration
+		expOK       bool
+		//expDeadline from now, zero means no deadline
+		expDeadline time.Duration
+	}{
+		{0, 0, time.Hour, true, 0},
+		{time.Minute, 0, time.Hour, true, time.Minute},
+		{0, time.Hour, 30 * time.Minute, true, 30 * time.Minute},
+		{time.Minute, time.Hour, 30 * time.Minute, true, time.Minute},
+		{time.Minute, time.Hour, 59*time.Minute + 30*time.Second, true, 30 * time.Second},
+		{time.Minute, time.Hour, time.Hour, false, 0},
+	}
+	for _, test := range tests {
+		k := keepalive{readTimeout: test.readTimeout, maxDuration: test.maxDuration}
+		c := &deadlineConn{}
+		now := time.Now()
+		if ok := k.setReadDeadline(c, now.Add(-test.connAge)); ok != test.expOK {
+			t.Fatalf("unexpected result %t of %+v", ok, test)
+		}
+		if !test.expOK {
+			continue
+		}
+		if test.expDeadline == 0 {
+			if !c.deadline.IsZero() {
+				t.Fatalf("unexpected deadline %s of %+v", c.deadline, test)
+			}
+			continue
+		}
+		if d := c.deadline.Sub(now) - test.expDeadline; d < 0 || d > time.Second {
+			t.Fatalf("unexpected deadline %s after %+v", c.deadline.Sub(now), test)
+		}
+	}
+}
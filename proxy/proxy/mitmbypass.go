@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//MitmFailure classification of a client's failure in handshaking with the fake tls server
+type MitmFailure int
+
+const (
+	//MitmFailureOther failures not caused by the fake certificate, e.g. timeout
+	MitmFailureOther MitmFailure = iota
+	//MitmFailureBadCertificate client rejects the certificate with alert
+	//bad_certificate, unsupported_certificate or certificate_unknown,
+	//e.g. a client pinning the certificate
+	MitmFailureBadCertificate
+	//MitmFailureUnknownCA client rejects the certificate with alert unknown_ca,
+	//i.e. the MITM CA is not trusted by client
+	MitmFailureUnknownCA
+	//MitmFailureEOF client closes the connection without any alert,
+	//which some pinned clients do
+	MitmFailureEOF
+)
+
+func (f MitmFailure) String() string {
+	switch f {
+	case MitmFailureBadCertificate:
+		return "bad_certificate"
+	case MitmFailureUnknownCA:
+		return "unknown_ca"
+	case MitmFailureEOF:
+		return "eof"
+	}
+	return "other"
+}
+
+//classifyMitmFailure classifies the handshake error of the fake tls server
+func classifyMitmFailure(err error) MitmFailure {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		switch opErr.Err.Error() {
+		case "tls: bad certificate", "tls: unsupported certificate",
+			"tls: unknown certificate":
+			return MitmFailureBadCertificate
+		case "tls: unknown certificate authority":
+			return MitmFailureUnknownCA
+		}
+		return MitmFailureOther
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		strings.Contains(err.Error(), "reset by peer") {
+		return MitmFailureEOF
+	}
+	return MitmFailureOther
+}
+
+const (
+	//DefaultMitmBypassTTL default time a host is not decrypted
+	DefaultMitmBypassTTL = 30 * time.Minute
+	//DefaultMitmFailureWindow default time the failures of a host are counted in
+	DefaultMitmFailureWindow = 10 * time.Minute
+	//DefaultMitmMaxCertRejections default number of distinct clients
+	//rejecting the certificate before bypassing
+	DefaultMitmMaxCertRejections = 3
+	//DefaultMitmMaxEOFs default number of distinct clients closing the
+	//connection in handshake before bypassing
+	DefaultMitmMaxEOFs = 3
+)
+
+// MitmBypass tracks the clients' handshake failures with the fake tls server
+// per host, the hosts which keep failing are not decrypted for a while,
+// i.e. their traffic falls back to a plain tunnel regardless of ShouldDecryptHost.
+//
+// It is safe calling MitmBypass methods from concurrently running goroutines.
+type MitmBypass struct {
+	//TTL time a host is not decrypted, DefaultMitmBypassTTL is used if not set
+	TTL time.Duration
+
+	//Window time the failures of a host are counted in since the first one,
+	//failures older than it are forgotten, DefaultMitmFailureWindow is used if not set
+	Window time.Duration
+
+	//MaxCertRejections number of distinct clients (by IP) rejecting the
+	//certificate (bad_certificate & unknown_ca) within Window before bypassing,
+	//so a single client not trusting the CA won't stop decrypting the host
+	//for the others, DefaultMitmMaxCertRejections is used if not set
+	MaxCertRejections int
+
+	//MaxEOFs number of distinct clients (by IP) closing the connection in
+	//handshake within Window before bypassing, so a single client giving up
+	//won't stop decrypting the host, DefaultMitmMaxEOFs is used if not set
+	MaxEOFs int
+
+	lock  sync.Mutex
+	hosts map[string]*mitmBypassHost
+}
+
+type mitmBypassHost struct {
+	//rejectingClients IPs of the clients rejecting the certificate
+	rejectingClients map[string]struct{}
+	//eofClients IPs of the clients closing the connection in handshake
+	eofClients   map[string]struct{}
+	firstFailure time.Time
+	//bypassUntil zero if the host is not bypassed
+	bypassUntil time.Time
+}
+
+// ShouldBypass test if the host's traffic should not be decrypted
+func (b *MitmBypass) ShouldBypass(hostWithPort string) bool {
+	if b == nil {
+		return false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	host, ok := b.hosts[hostWithPort]
+	if !ok || host.bypassUntil.IsZero() {
+		return false
+	}
+	if time.Now().After(host.bypassUntil) {
+		delete(b.hosts, hostWithPort)
+		return false
+	}
+	return true
+}
+
+// RecordFailure records a handshake failure of host with client, returns the classification
+func (b *MitmBypass) RecordFailure(hostWithPort string, clientAddr net.Addr, err error) MitmFailure {
+	failure := classifyMitmFailure(err)
+	if b == nil || failure == MitmFailureOther {
+		return failure
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.hosts == nil {
+		b.hosts = make(map[string]*mitmBypassHost)
+	}
+	now := time.Now()
+	if len(b.hosts) >= mitmBypassPurgeSize {
+		b.purge(now)
+	}
+	host, ok := b.hosts[hostWithPort]
+	if ok && !host.bypassUntil.IsZero() && now.Before(host.bypassUntil) {
+		//already bypassed, e.g. the client made the handshake before bypassing
+		return failure
+	}
+	if !ok || !host.bypassUntil.IsZero() || now.Sub(host.firstFailure) > b.window() {
+		host = &mitmBypassHost{firstFailure: now}
+		b.hosts[hostWithPort] = host
+	}
+	if failure == MitmFailureEOF {
+		if host.eofClients == nil {
+			host.eofClients = make(map[string]struct{})
+		}
+		host.eofClients[mitmClientIP(clientAddr)] = struct{}{}
+	} else {
+		if host.rejectingClients == nil {
+			host.rejectingClients = make(map[string]struct{})
+		}
+		host.rejectingClients[mitmClientIP(clientAddr)] = struct{}{}
+	}
+	if len(host.rejectingClients) >= b.maxCertRejections() || len(host.eofClients) >= b.maxEOFs() {
+		host.bypassUntil = now.Add(b.ttl())
+		host.rejectingClients = nil
+		host.eofClients = nil
+	}
+	return failure
+}
+
+//mitmClientIP returns the IP of client, the clients behind a NAT are treated as one
+func mitmClientIP(clientAddr net.Addr) string {
+	if clientAddr == nil {
+		return ""
+	}
+	if addr, ok := clientAddr.(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	if ip, _, err := net.SplitHostPort(clientAddr.String()); err == nil {
+		return ip
+	}
+	return clientAddr.String()
+}
+
+// RecordSuccess records a successful handshake of host, the failures are forgotten
+func (b *MitmBypass) RecordSuccess(hostWithPort string) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	delete(b.hosts, hostWithPort)
+	b.lock.Unlock()
+}
+
+// Hosts returns the hosts not decrypted with the time they expire
+func (b *MitmBypass) Hosts() map[string]time.Time {
+	hosts := make(map[string]time.Time)
+	if b == nil {
+		return hosts
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	for hostWithPort, host := range b.hosts {
+		if !host.bypassUntil.IsZero() && now.Before(host.bypassUntil) {
+			hosts[hostWithPort] = host.bypassUntil
+		}
+	}
+	return hosts
+}
+
+// Clear clears the failures of hosts, all the hosts are cleared if none provided
+func (b *MitmBypass) Clear(hostsWithPort ...string) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(hostsWithPort) == 0 {
+		b.hosts = nil
+		return
+	}
+	for _, hostWithPort := range hostsWithPort {
+		delete(b.hosts, hostWithPort)
+	}
+}
+
+//mitmBypassPurgeSize hosts expired are purged when the number of hosts tracked reaches it
+const mitmBypassPurgeSize = 1024
+
+//purge removes the hosts whose failures are forgotten and bypassing is expired
+func (b *MitmBypass) purge(now time.Time) {
+	for hostWithPort, host := range b.hosts {
+		if now.Sub(host.firstFailure) > b.window() && now.After(host.bypassUntil) {
+			delete(b.hosts, hostWithPort)
+		}
+	}
+}
+
+func (b *MitmBypass) ttl() time.Duration {
+	if b.TTL <= 0 {
+		return DefaultMitmBypassTTL
+	}
+	return b.TTL
+}
+
+func (b *MitmBypass) window() time.Duration {
+	if b.Window <= 0 {
+		return DefaultMitmFailureWindow
+	}
+	return b.Window
+}
+
+func (b *MitmBypass) maxCertRejections() int {
+	if b.MaxCertRejections <= 0 {
+		return DefaultMitmMaxCertRejections
+	}
+	return b.MaxCertRejections
+}
+
+func (b *MitmBypass) maxEOFs() int {
+	if b.MaxEOFs <= 0 {
+		return DefaultMitmMaxEOFs
+	}
+	return b.MaxEOFs
+}
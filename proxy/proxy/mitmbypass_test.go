@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMitmBypass(t *testing.T) {
+	b := &MitmBypass{TTL: time.Minute, MaxCertRejections: 2, MaxEOFs: 2}
+	unknownCA := &net.OpError{Op: "remote error", Err: errors.New("tls: unknown certificate authority")}
+	client1 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	client2 := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1234}
+	if f := b.RecordFailure("a.com:443", client1, unknownCA); f != MitmFailureUnknownCA {
+		t.Fatalf("unexpected failure %s, expecting unknown_ca", f)
+	}
+	if b.ShouldBypass("a.com:443") {
+		t.Fatalf("host is bypassed after a single rejection")
+	}
+	//the same client rejecting again is counted once
+	b.RecordFailure("a.com:443", &net.TCPAddr{IP: client1.IP, Port: 4321}, unknownCA)
+	if b.ShouldBypass("a.com:443") {
+		t.Fatalf("host is bypassed after rejections of a single client")
+	}
+	b.RecordFailure("a.com:443", client2, unknownCA)
+	if !b.ShouldBypass("a.com:443") {
+		t.Fatalf("host rejected by distinct clients is not bypassed")
+	}
+
+	//EOFs are tolerated until MaxEOFs reached by distinct clients,
+	//the same client closing again is counted once
+	if f := b.RecordFailure("b.com:443", client1, io.EOF); f != MitmFailureEOF {
+		t.Fatalf("unexpected failure %s, expecting eof", f)
+	}
+	b.RecordFailure("b.com:443", &net.TCPAddr{IP: client1.IP, Port: 4321}, io.ErrUnexpectedEOF)
+	if b.ShouldBypass("b.com:443") {
+		t.Fatalf("host is bypassed after EOFs of a single client")
+	}
+	b.RecordFailure("b.com:443", client2, io.ErrUnexpectedEOF)
+	if !b.ShouldBypass("b.com:443") {
+		t.Fatalf("host is not bypassed after MaxEOFs reached")
+	}
+
+	//other failures are not counted
+	if f := b.RecordFailure("c.com:443", client1, errors.New("i/o timeout")); f != MitmFailureOther {
+		t.Fatalf("unexpected failure %s, expecting other", f)
+	}
+	if len(b.Hosts()) != 2 {
+		t.Fatalf("unexpected bypassed hosts %v", b.Hosts())
+	}
+
+	b.Clear("a.com:443")
+	if b.ShouldBypass("a.com:443") || !b.ShouldBypass("b.com:443") {
+		t.Fatalf("unexpected bypassed hosts %v after clearing", b.Hosts())
+	}
+	b.Clear()
+	if len(b.Hosts()) != 0 {
+		t.Fatalf("unexpected bypassed hosts %v after clearing all", b.Hosts())
+	}
+
+	//nil MitmBypass never bypasses
+	var nilBypass *MitmBypass
+	nilBypass.RecordFailure("a.com:443", client1, unknownCA)
+	if nilBypass.ShouldBypass("a.com:443") {
+		t.Fatalf("nil MitmBypass bypasses host")
+	}
+}
+
+func TestMitmBypassDefault(t *testing.T) {
+	b := &MitmBypass{Window: 50 * time.Millisecond}
+	badCert := &net.OpError{Op: "remote error", Err: errors.New("tls: bad certificate")}
+	//a single client never trips the bypass
+	for i := 0; i < 10; i++ {
+		b.RecordFailure("a.com:443", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000 + i}, badCert)
+	}
+	if b.ShouldBypass("a.com:443") {
+		t.Fatalf("host is bypassed after rejections of a single client")
+	}
+
+	//the rejections out of window are forgotten
+	for i := 2; i <= DefaultMitmMaxCertRejections; i++ {
+		time.Sleep(30 * time.Millisecond)
+		b.RecordFailure("a.com:443", &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 1000}, badCert)
+	}
+	if b.ShouldBypass("a.com:443") {
+		t.Fatalf("host is bypassed by rejections out of window")
+	}
+
+	for i := 1; i <= DefaultMitmMaxCertRejections; i++ {
+		if b.ShouldBypass("b.com:443") {
+			t.Fatalf("host is bypassed after %d rejections", i-1)
+		}
+		b.RecordFailure("b.com:443", &net.TCPAddr{IP: net.IPv4(10, 0, 1, byte(i)), Port: 1000}, badCert)
+	}
+	if !b.ShouldBypass("b.com:443") {
+		t.Fatalf("host is not bypassed after %d distinct clients rejecting", DefaultMitmMaxCertRejections)
+	}
+}
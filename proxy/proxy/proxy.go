@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"time"
 
 	"github.com/haxii/fastproxy/bufiopool"
+	"github.com/haxii/fastproxy/cert"
 	"github.com/haxii/fastproxy/client"
 	"github.com/haxii/fastproxy/http"
 	"github.com/haxii/fastproxy/server"
@@ -55,13 +57,37 @@ type Proxy struct {
 	// Maximum duration for reading the full request (including body).
 	//
 	// This also limits the maximum duration for idle keep-alive
-	// connections.
+	// connections, including the decrypted https ones.
 	//
 	// By default request read timeout is unlimited.
 	ReadTimeout time.Duration
 
+	// ServeSOCKS5 serves SOCKS5 clients as well as HTTP proxy clients
+	// on the same listener, SOCKS5 clients are detected by the 1st byte.
+	//
+	// The 1st byte and the SOCKS5 handshake are read within ReadTimeout,
+	// or DefaultSOCKS5HandshakeTimeout if it's not set.
+	//
+	// SOCKS5 CONNECT requests are handled the same as HTTP CONNECT ones,
+	// i.e. decrypted or tunneled based on the Handler.
+	ServeSOCKS5 bool
+
 	//usage
 	Usage *usage.ProxyUsage
+
+	//UserUsage returns the usage of an authenticated proxy user,
+	//nil means the user's traffic is not accounted separately
+	UserUsage func(user string) *usage.ProxyUsage
+
+	// Limits limits of the requests read from clients, the default ones
+	// are used if not set, see http.Limits.
+	//
+	// The request exceeding the limits is responded with
+	// 414 (request line), 431 (header) or 400 (chunk extension).
+	Limits http.Limits
+
+	//ExceededLimits counts the requests exceeding Limits, made by proxy if not set
+	ExceededLimits *http.LimitCounter
 }
 
 func (p *Proxy) init() error {
@@ -80,18 +106,46 @@ func (p *Proxy) init() error {
 		}
 	}
 	if p.Handler.ShouldDecryptHost == nil {
-		p.Handler.ShouldDecryptHost = func(string) bool {
+		p.Handler.ShouldDecryptHost = func(string, *ClientHello) bool {
 			return false
 		}
 	}
 	if p.Handler.URLProxy == nil {
-		p.Handler.URLProxy = func(hostWithPort string, path []byte) *superproxy.SuperProxy {
+		p.Handler.URLProxy = func(user, hostWithPort string, path []byte,
+			hello *ClientHello) *superproxy.SuperProxy {
 			return nil
 		}
 	}
+	for i := range p.Handler.ReverseProxyRules {
+		if err := p.Handler.ReverseProxyRules[i].validate(); err != nil {
+			return err
+		}
+	}
+	for i := range p.Handler.HeaderRules {
+		if err := p.Handler.HeaderRules[i].validate(); err != nil {
+			return err
+		}
+	}
+	if p.Handler.StrictParsing && p.Handler.RejectedRequests == nil {
+		p.Handler.RejectedRequests = &RejectedRequests{}
+	}
+	if p.ExceededLimits == nil {
+		p.ExceededLimits = &http.LimitCounter{}
+	}
+	if p.Client.ExceededResponseLimits == nil {
+		p.Client.ExceededResponseLimits = &http.LimitCounter{}
+	}
+	p.Handler.requestLimits = requestLimits{limits: &p.Limits, exceeded: p.ExceededLimits}
+	p.Handler.keepalive = keepalive{readTimeout: p.ReadTimeout, maxDuration: p.MaxKeepaliveDuration}
 	if p.Handler.MitmCACert == nil {
 		p.Handler.MitmCACert = x509.DefaultMitmCA
 	}
+	if p.Handler.MitmCertCache == nil {
+		p.Handler.MitmCertCache = &cert.Cache{}
+	}
+	if p.Handler.MitmCertCache.CA == nil {
+		p.Handler.MitmCertCache.CA = p.Handler.MitmCACert
+	}
 	if p.Client.BufioPool == nil {
 		p.Client.BufioPool = p.BufioPool
 	}
@@ -108,6 +162,12 @@ const DefaultConcurrency = 256 * 1024
 //
 // Serve blocks until the given listener returns permanent error.
 func (p *Proxy) Serve(ln net.Listener, maxWaitTime time.Duration) error {
+	return p.serve(ln, maxWaitTime, p.serveConn)
+}
+
+//serve serves incoming connections with serveConn
+func (p *Proxy) serve(ln net.Listener, maxWaitTime time.Duration,
+	serveConn func(c net.Conn) error) error {
 	if e := p.init(); e != nil {
 		return e
 	}
@@ -120,7 +180,7 @@ func (p *Proxy) Serve(ln net.Listener, maxWaitTime time.Duration) error {
 	gln := NewGracefulListener(ln, maxWaitTime)
 	maxWorkersCount := DefaultConcurrency
 	wp := &server.WorkerPool{
-		WorkerFunc:      p.serveConn,
+		WorkerFunc:      serveConn,
 		MaxWorkersCount: maxWorkersCount,
 		Logger:          p.ProxyLogger,
 	}
@@ -135,7 +195,7 @@ func (p *Proxy) Serve(ln net.Listener, maxWaitTime time.Duration) error {
 			return err
 		}
 		if !wp.Serve(c) {
-			p.writeFastError(c, http.StatusServiceUnavailable,
+			writeFastError(c, http.StatusServiceUnavailable,
 				"The connection cannot be served because Server.Concurrency limit exceeded")
 			c.Close()
 			if time.Since(lastOverflowErrorTime) > time.Minute {
@@ -182,14 +242,37 @@ func (p *Proxy) serveConn(c net.Conn) error {
 	if !p.Handler.ShouldAllowConnection(c.RemoteAddr()) {
 		return nil
 	}
-	//convert c into a http request
 	reader := p.BufioPool.AcquireReader(c)
-	req := p.reqPool.Acquire()
-	releaseReqAndReader := func() {
-		p.reqPool.Release(req)
-		p.BufioPool.ReleaseReader(reader)
+	defer p.BufioPool.ReleaseReader(reader)
+
+	//SOCKS5 clients always start with the version byte
+	if p.ServeSOCKS5 {
+		//the 1st byte is read within the handshake timeout,
+		//so an idle client doesn't hold the connection forever
+		if err := c.SetReadDeadline(time.Now().Add(p.socks5HandshakeTimeout())); err != nil {
+			return util.ErrWrapper(err, "fail to set read deadline of connection")
+		}
+		b, err := reader.Peek(1)
+		if err != nil {
+			return util.ErrWrapper(err, "fail to read the 1st byte of connection")
+		}
+		if b[0] == socks5Version {
+			return p.serveSOCKS5(c, reader)
+		}
+		//the read deadlines of http requests are set in serveRequests
+		c.SetReadDeadline(time.Time{})
 	}
-	defer releaseReqAndReader()
+
+	return p.serveRequests(c, reader, nil)
+}
+
+//serveRequests serves http requests read from reader of c,
+//originalDst is the original destination of a transparent connection,
+//which is dialed for every request of the connection
+func (p *Proxy) serveRequests(c net.Conn, reader *bufio.Reader, originalDst *net.TCPAddr) error {
+	//convert c into a http request
+	req := p.reqPool.Acquire()
+	defer p.reqPool.Release(req)
 
 	var (
 		connTime, currentTime time.Time
@@ -206,35 +289,78 @@ func (p *Proxy) serveConn(c net.Conn) error {
 			}
 		}
 
-		if err := req.ReadFrom(reader); err != nil {
+		if err := p.Handler.readRequest(c, req, reader); err != nil {
 			return util.ErrWrapper(err, "fail to read http request header")
 		}
 
-		if p.Usage != nil {
-			p.Usage.AddIncomingSize(uint64(req.GetReqLineSize()))
+		//origin-form requests are sent by clients not aware of the proxy,
+		//e.g. transparent or reverse proxy clients, so they are not authenticated
+		isOriginForm := len(req.HostInfo().HostWithPort()) == 0
+		user := ""
+		if p.Handler.Authenticator != nil && !isOriginForm {
+			var (
+				stale, ok bool
+			)
+			user, stale, ok = p.Handler.Authenticator.authenticate(req.Method(),
+				req.RequestURI(), req.Header().ProxyAuthorization())
+			if !ok {
+				if p.Usage != nil {
+					p.Usage.AddIncomingSize(uint64(req.GetReqLineSize() + req.GetReadSize()))
+				}
+				if e := p.writeProxyAuthRequired(c, stale); e != nil {
+					return util.ErrWrapper(e, "fail to response proxy auth challenge")
+				}
+				return nil
+			}
+		}
+		usage := p.usages(user)
+
+		if usage != nil {
+			usage.AddIncomingSize(uint64(req.GetReqLineSize()))
 		}
 
-		if len(req.HostInfo().HostWithPort()) == 0 {
-			if e := p.writeFastError(c, http.StatusBadRequest,
+		var reverseProxyRule *ReverseProxyRule
+		if originalDst != nil {
+			//the transparent requests are always sent to the original destination
+			setTransparentHost(req, originalDst)
+		} else if isOriginForm {
+			reverseProxyRule = p.Handler.matchReverseProxyRule(req)
+		}
+		//the request is reset once proxied, so whether to close is saved before
+		connectionClose := false
+		if reverseProxyRule != nil {
+			if err := p.Handler.handleReverseProxyConns(c, req, reverseProxyRule,
+				p.BufioPool, &p.Client, usage); err != nil {
+				return util.ErrWrapper(err, "error reverse proxy traffic %s ", reverseProxyRule.Backend)
+			}
+			connectionClose = req.ConnectionClose()
+			req.Reset()
+		} else if len(req.HostInfo().HostWithPort()) == 0 {
+			if e := writeFastError(c, http.StatusBadRequest,
 				"This is a proxy server. Does not respond to non-proxy requests.\n"); e != nil {
 				return util.ErrWrapper(e, "fail to response non-proxy request")
 			}
 			return nil
-		}
-
-		//handle http requests
-		if !http.IsMethodConnect(req.Method()) {
-			err := p.Handler.handleHTTPConns(c, req,
-				p.BufioPool, &p.Client, p.Usage)
+		} else if !http.IsMethodConnect(req.Method()) {
+			//handle http requests
+			err := p.Handler.handleHTTPConns(c, req, user,
+				p.BufioPool, &p.Client, usage)
 			if err != nil {
 				return util.ErrWrapper(err, "error HTTP traffic %s ", req.HostInfo().HostWithPort())
 			}
+			connectionClose = req.ConnectionClose()
 			req.Reset()
+		} else if originalDst != nil {
+			if e := writeFastError(c, http.StatusBadRequest,
+				"CONNECT is not served in transparent mode.\n"); e != nil {
+				return util.ErrWrapper(e, "fail to response transparent CONNECT request")
+			}
+			return nil
 		} else {
-			//some header may not be read, but buffered in reader, such as "Host", "Proxy-Connection",
-			//should add the buffered size to incoming size
-			if p.Usage != nil {
-				p.Usage.AddIncomingSize(uint64(reader.Buffered()))
+			//headers of the CONNECT request are read but not forwarded,
+			//should add the header size to incoming size
+			if usage != nil {
+				usage.AddIncomingSize(uint64(req.GetReadSize()))
 			}
 
 			//handle https proxy request
@@ -243,36 +369,65 @@ func (p *Proxy) serveConn(c net.Conn) error {
 			host := strings.Repeat(req.HostInfo().HostWithPort(), 1)
 			req.Reset()
 			//make the requests
-			if err := p.Handler.handleHTTPSConns(c, host,
-				p.BufioPool, &p.Client, p.Usage); err != nil {
+			//bytes sent right after the CONNECT request may be buffered in reader
+			if err := p.Handler.handleHTTPSConns(&bufferedConn{Conn: c, r: reader}, host, user,
+				p.BufioPool, &p.Client, usage); err != nil {
 				return util.ErrWrapper(err, "error HTTPS traffic "+host+" ")
 			}
 		}
 
-		if req.ConnectionClose() {
+		if connectionClose {
 			break
 		}
 
-		reader.Reset(c)
+		//the read deadline restored after watching the client in `do` may
+		//have passed, the bytes of the next request peeked then are kept in reader
+		lastReadDeadlineTime = time.Time{}
 		currentTime = servertime.CoarseTimeNow()
 	}
 
 	return nil
 }
 
-func (p *Proxy) writeFastError(w io.Writer, statusCode int, msg string) error {
+//usages returns the usages the traffic of user is accounted to
+func (p *Proxy) usages(user string) usages {
+	var u usages
+	if p.Usage != nil {
+		u = append(u, p.Usage)
+	}
+	if len(user) > 0 && p.UserUsage != nil {
+		if userUsage := p.UserUsage(user); userUsage != nil {
+			u = append(u, userUsage)
+		}
+	}
+	return u
+}
+
+func (p *Proxy) writeProxyAuthRequired(w io.Writer, stale bool) error {
+	return writeFastErrorWithHeader(w, http.StatusProxyAuthRequired,
+		p.Handler.Authenticator.challenges(stale), "Proxy authentication required.\n")
+}
+
+func writeFastError(w io.Writer, statusCode int, msg string) error {
+	return writeFastErrorWithHeader(w, statusCode, "", msg)
+}
+
+//writeFastErrorWithHeader writes the error response with extra header lines,
+//each line in header should end with CRLF
+func writeFastErrorWithHeader(w io.Writer, statusCode int, header, msg string) error {
 	var err error
 	_, err = w.Write(http.StatusLine(statusCode))
 	if err != nil {
 		return err
 	}
-	_, err = fmt.Fprintf(w, "Connection: close\r\n"+
+	_, err = fmt.Fprintf(w, "%s"+
+		"Connection: close\r\n"+
 		"Date: %s\r\n"+
 		"Content-Type: text/plain\r\n"+
 		"Content-Length: %d\r\n"+
 		"\r\n"+
 		"%s",
-		servertime.ServerDate(), len(msg), msg)
+		header, servertime.ServerDate(), len(msg), msg)
 	return err
 }
 
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	gohttp "net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/bufiopool"
+	"github.com/haxii/fastproxy/hijack"
+	"github.com/haxii/fastproxy/http"
+	"github.com/haxii/log"
+)
+
+//testHijacker hijacks nothing
+type testHijacker struct{}
+
+func (testHijacker) OnRequest(header http.Header, rawHeader []byte) io.Writer {
+	return nil
+}
+
+func (testHijacker) OnResponse(statusLine http.ResponseLine, header http.Header, rawHeader []byte) io.Writer {
+	return nil
+}
+
+func (testHijacker) HijackResponse() io.Reader {
+	return nil
+}
+
+type testHijackerPool struct{}
+
+func (testHijackerPool) Get(clientAddr net.Addr, user string, host string, method, path []byte) hijack.Hijacker {
+	return testHijacker{}
+}
+
+func (testHijackerPool) Put(hijack.Hijacker) {}
+
+//startTestProxy serves p on a local listener closed once the test ends,
+//the required fields not set in p are filled, then returns the address of p
+func startTestProxy(t *testing.T, p *Proxy) string {
+	return startTestProxyWith(t, p, p.serveConn)
+}
+
+//startTestProxyWith serves p like startTestProxy, the connections are served by serveConn
+func startTestProxyWith(t *testing.T, p *Proxy, serveConn func(c net.Conn) error) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("fail to listen: %s", err)
+	}
+	if p.BufioPool == nil {
+		p.BufioPool = &bufiopool.Pool{}
+	}
+	if p.ProxyLogger == nil {
+		p.ProxyLogger = &log.DefaultLogger{}
+	}
+	if p.Handler.HijackerPool == nil {
+		p.Handler.HijackerPool = testHijackerPool{}
+	}
+	if p.Handler.ShouldAllowConnection == nil {
+		p.Handler.ShouldAllowConnection = func(net.Addr) bool { return true }
+	}
+	go p.serve(ln, time.Second, serveConn)
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+func TestProxyCloseDelimitedResponse(t *testing.T) {
+	upstream := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		c, rw, _ := w.(gohttp.Hijacker).Hijack()
+		defer c.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n" + r.URL.Path)
+		rw.Flush()
+	}))
+	defer upstream.Close()
+	addr := startTestProxy(t, &Proxy{})
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("fail to dial proxy: %s", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "GET "+upstream.URL+"/a HTTP/1.1\r\nHost: "+upstream.Listener.Addr().String()+"\r\n\r\n")
+	//the response is delimited by closing the client's connection as well
+	resp, err := gohttp.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("fail to read response: %s", err)
+	}
+	if body, err := io.ReadAll(resp.Body); err != nil || string(body) != "/a" {
+		t.Fatalf("unexpected response %q delimited by closing: %v", body, err)
+	}
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/haxii/fastproxy/bufiopool"
+	"github.com/haxii/fastproxy/client"
+	"github.com/haxii/fastproxy/proxy/http"
+	"github.com/haxii/fastproxy/util"
+)
+
+//ReverseProxyRule maps origin-form requests, e.g. `GET /path HTTP/1.1`,
+//to an upstream backend, which makes the proxy a reverse proxy (gateway)
+type ReverseProxyRule struct {
+	//Host matches the `Host` header (port excluded) of the request,
+	//`*.example.com` matches all the sub domains of example.com,
+	//empty matches all the hosts
+	Host string
+
+	//PathPrefix matches the path of the request, empty matches all the paths
+	PathPrefix string
+
+	//Backend host with port of the upstream backend
+	Backend string
+
+	//BackendTLS connects the backend with TLS, and
+	//BackendServerName is used as the server name if set
+	BackendTLS        bool
+	BackendServerName string
+}
+
+func (rule *ReverseProxyRule) validate() error {
+	if _, _, err := net.SplitHostPort(rule.Backend); err != nil {
+		return util.ErrWrapper(err, "invalid reverse proxy backend "+rule.Backend)
+	}
+	return nil
+}
+
+//matchHost test if host (port excluded) matches the rule
+func (rule *ReverseProxyRule) matchHost(host string) bool {
+	if len(rule.Host) == 0 {
+		return true
+	}
+	if strings.HasPrefix(rule.Host, "*.") {
+		return len(host) > len(rule.Host)-1 &&
+			strings.HasSuffix(strings.ToLower(host), strings.ToLower(rule.Host[1:]))
+	}
+	return strings.EqualFold(rule.Host, host)
+}
+
+//matchReverseProxyRule finds the rule for the request,
+//the rule with the longest path prefix wins, rules are checked in order on ties
+func (h *Handler) matchReverseProxyRule(req *http.Request) *ReverseProxyRule {
+	host := hostWithoutPort(req.Header().Host())
+	path := req.PathWithQueryFragment()
+	var matched *ReverseProxyRule
+	for i := range h.ReverseProxyRules {
+		rule := &h.ReverseProxyRules[i]
+		if !rule.matchHost(host) || !bytes.HasPrefix(path, []byte(rule.PathPrefix)) {
+			continue
+		}
+		if matched == nil || len(rule.PathPrefix) > len(matched.PathPrefix) {
+			matched = rule
+		}
+	}
+	return matched
+}
+
+//handleReverseProxyConns proxies the origin-form request to the backend of rule,
+//the client is not a proxy client, so there is no proxy user
+func (h *Handler) handleReverseProxyConns(c net.Conn, req *http.Request, rule *ReverseProxyRule,
+	bufioPool *bufiopool.Pool, client *client.Client, usage usages) error {
+	host := req.Header().Host()
+	if len(host) == 0 {
+		return errors.New("no host provided in reverse proxy request")
+	}
+	proto := "http"
+	if isTLSConn(c) {
+		proto = "https"
+	}
+
+	req.SetHostWithPort(rule.Backend)
+	if rule.BackendTLS {
+		serverName := rule.BackendServerName
+		if len(serverName) == 0 {
+			serverName = req.HostInfo().Domain()
+		}
+		req.SetTLS(serverName)
+	}
+	addForwardedHeaders(req, c.RemoteAddr(), host, proto)
+
+	return h.do(c, req, "", bufioPool, client, usage,
+		&doOptions{rewriteLocation: makeLocationRewriter(rule, proto, host)})
+}
+
+//addForwardedHeaders adds `X-Forwarded-For`, `X-Forwarded-Proto` and
+//`Forwarded` (RFC 7239) headers, the client ip is appended if already forwarded,
+//while the proto of client replaces the one sent, so it can't be spoofed
+func addForwardedHeaders(req *http.Request, clientAddr net.Addr, host, proto string) {
+	clientIP := clientAddr.String()
+	if tcpAddr, ok := clientAddr.(*net.TCPAddr); ok {
+		clientIP = tcpAddr.IP.String()
+	}
+	forwardedFor := clientIP
+	if strings.IndexByte(clientIP, ':') >= 0 {
+		//IPv6 address must be bracketed and quoted
+		forwardedFor = `"[` + clientIP + `]"`
+	}
+	req.AddHeaderValue("X-Forwarded-For", clientIP)
+	req.DelHeader("X-Forwarded-Proto")
+	req.AddHeaderValue("X-Forwarded-Proto", proto)
+	req.AddHeaderValue("Forwarded", "for="+forwardedFor+
+		";host="+quoteForwardedValue(host)+";proto="+proto)
+}
+
+//quoteForwardedValue quotes value which is not a token, e.g. host with port
+func quoteForwardedValue(value string) string {
+	if strings.ContainsAny(value, `:[]"`) {
+		return `"` + strings.Replace(value, `"`, `\"`, -1) + `"`
+	}
+	return value
+}
+
+//makeLocationRewriter rewrites the absolute `Location` pointing to the backend,
+//so the redirection goes to the reverse proxy instead of the backend
+func makeLocationRewriter(rule *ReverseProxyRule, proto, host string) func([]byte) []byte {
+	backendScheme := "http"
+	if rule.BackendTLS {
+		backendScheme = "https"
+	}
+	return func(location []byte) []byte {
+		u, err := url.Parse(string(location))
+		if err != nil || !u.IsAbs() || !strings.EqualFold(u.Scheme, backendScheme) {
+			return nil
+		}
+		if !sameHostWithPort(u, rule.Backend) {
+			return nil
+		}
+		u.Scheme = proto
+		u.Host = host
+		return []byte(u.String())
+	}
+}
+
+//sameHostWithPort test if the host of u is hostWithPort, the default port may be omitted
+func sameHostWithPort(u *url.URL, hostWithPort string) bool {
+	host, port, _ := net.SplitHostPort(hostWithPort)
+	urlPort := u.Port()
+	if len(urlPort) == 0 {
+		urlPort = "80"
+		if strings.EqualFold(u.Scheme, "https") {
+			urlPort = "443"
+		}
+	}
+	return strings.EqualFold(u.Hostname(), host) && urlPort == port
+}
+
+//hostWithoutPort strips the port of host if any
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+//isTLSConn test if c is a tls connection
+func isTLSConn(c net.Conn) bool {
+	for {
+		switch conn := c.(type) {
+		case *tls.Conn:
+			return true
+		case *gracefulConn:
+			c = conn.Conn
+		case *bufferedConn:
+			c = conn.Conn
+		default:
+			return false
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	gohttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	proxyhttp "github.com/haxii/fastproxy/proxy/http"
+)
+
+func TestReverseProxyRuleMatchHost(t *testing.T) {
+	tests := []struct {
+		ruleHost string
+		host     string
+		expMatch bool
+	}{
+		{"", "www.example.com", true},
+		{"", "", true},
+		{"www.example.com", "www.example.com", true},
+		{"www.example.com", "WWW.Example.COM", true},
+		{"www.example.com", "example.com", false},
+		{"www.example.com", "www.example.com.evil.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.EXAMPLE.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", ".example.com", false},
+		{"*.example.com", "evilexample.com", false},
+		{"*.example.com", "www.example.com.evil.com", false},
+		{"::1", "::1", true},
+	}
+	for _, test := range tests {
+		rule := &ReverseProxyRule{Host: test.ruleHost}
+		if match := rule.matchHost(test.host); match != test.expMatch {
+			t.Fatalf("unexpected match %t of host %q with %q, expecting %t",
+				match, test.host, test.ruleHost, test.expMatch)
+		}
+	}
+}
+
+func TestMatchReverseProxyRule(t *testing.T) {
+	h := &Handler{ReverseProxyRules: []ReverseProxyRule{
+		{Host: "*.example.com", Backend: "wildcard:80"},
+		{Host: "www.example.com", PathPrefix: "/api", Backend: "api:80"},
+		{Host: "www.example.com", PathPrefix: "/api/v2", Backend: "api-v2:80"},
+		{PathPrefix: "/api/v2", Backend: "any-api-v2:80"},
+		{Host: "www.example.com", PathPrefix: "/api", Backend: "api-tie:80"},
+	}}
+	tests := []struct {
+		host       string
+		path       string
+		expBackend string
+	}{
+		{"www.example.com", "/", "wildcard:80"},
+		{"img.example.com", "/api", "wildcard:80"},
+		{"www.example.com", "/api", "api:80"},
+		{"www.example.com:8080", "/api/users?id=1", "api:80"},
+		{"www.example.com", "/api/v2/users", "api-v2:80"},
+		{"other.org", "/api/v2/users", "any-api-v2:80"},
+		{"other.org", "/api", ""},
+		{"", "/", ""},
+	}
+	for _, test := range tests {
+		raw := "GET " + test.path + " HTTP/1.1\r\n"
+		if len(test.host) > 0 {
+			raw += "Host: " + test.host + "\r\n"
+		}
+		req := &proxyhttp.Request{}
+		if err := req.ReadFrom(bufio.NewReader(strings.NewReader(raw + "\r\n"))); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		backend := ""
+		if rule := h.matchReverseProxyRule(req); rule != nil {
+			backend = rule.Backend
+		}
+		if backend != test.expBackend {
+			t.Fatalf("unexpected backend %q of %s%s, expecting %q",
+				backend, test.host, test.path, test.expBackend)
+		}
+	}
+}
+
+func TestMakeLocationRewriter(t *testing.T) {
+	tests := []struct {
+		backend     string
+		backendTLS  bool
+		proto       string
+		host        string
+		location    string
+		expLocation string
+	}{
+		{"10.0.0.1:8080", false, "http", "www.example.com",
+			"http://10.0.0.1:8080/a?b=c#d", "http://www.example.com/a?b=c#d"},
+		{"10.0.0.1:8080", false, "https", "www.example.com:8443",
+			"http://10.0.0.1:8080/a", "https://www.example.com:8443/a"},
+		//the default port of the backend may be omitted
+		{"10.0.0.1:80", false, "https", "www.example.com",
+			"http://10.0.0.1/a", "https://www.example.com/a"},
+		{"backend.local:443", true, "http", "www.example.com",
+			"https://BACKEND.local/a", "http://www.example.com/a"},
+		{"[::1]:8080", false, "http", "www.example.com",
+			"http://[::1]:8080/a", "http://www.example.com/a"},
+		//not pointing to the backend
+		{"10.0.0.1:8080", false, "http", "www.example.com", "http://10.0.0.1:8081/a", ""},
+		{"10.0.0.1:8080", false, "http", "www.example.com", "http://10.0.0.1/a", ""},
+		{"10.0.0.1:8080", false, "http", "www.example.com", "http://10.0.0.2:8080/a", ""},
+		{"10.0.0.1:8080", false, "http", "www.example.com", "https://10.0.0.1:8080/a", ""},
+		{"10.0.0.1:443", true, "http", "www.example.com", "http://10.0.0.1:443/a", ""},
+		{"10.0.0.1:8080", false, "http", "www.example.com", "/a", ""},
+		{"10.0.0.1:8080", false, "http", "www.example.com", "http://[::1/a", ""},
+	}
+	for _, test := range tests {
+		rule := &ReverseProxyRule{Backend: test.backend, BackendTLS: test.backendTLS}
+		location := makeLocationRewriter(rule, test.proto, test.host)([]byte(test.location))
+		if string(location) != test.expLocation {
+			t.Fatalf("unexpected location %q rewritten from %q, expecting %q",
+				location, test.location, test.expLocation)
+		}
+	}
+}
+
+func TestReverseProxy(t *testing.T) {
+	var header gohttp.Header
+	backend := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		header = r.Header.Clone()
+		if r.URL.Path == "/api/redirect" {
+			gohttp.Redirect(w, r, "http://"+r.Context().Value(gohttp.LocalAddrContextKey).(net.Addr).String()+
+				"/api/target", gohttp.StatusFound)
+			return
+		}
+		io.WriteString(w, r.Host+r.URL.RequestURI())
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	addr := startTestProxy(t, &Proxy{Handler: Handler{ReverseProxyRules: []ReverseProxyRule{
+		{Host: "*.example.com", PathPrefix: "/api", Backend: backendURL.Host},
+	}}})
+	c := &gohttp.Client{
+		Timeout: 5 * time.Second,
+		Transport: &gohttp.Transport{Dial: func(network, a string) (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		}},
+		CheckRedirect: func(*gohttp.Request, []*gohttp.Request) error {
+			return gohttp.ErrUseLastResponse
+		},
+	}
+
+	req, _ := gohttp.NewRequest("GET", "http://www.example.com:8080/api/a?b=c", nil)
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	//the `Host` header is kept for the backend
+	if string(body) != "www.example.com:8080/api/a?b=c" {
+		t.Fatalf("unexpected response %q", body)
+	}
+	if forwardedFor := header.Get("X-Forwarded-For"); forwardedFor != "10.0.0.1, 127.0.0.1" {
+		t.Fatalf("unexpected X-Forwarded-For %q", forwardedFor)
+	}
+	if proto := header.Get("X-Forwarded-Proto"); proto != "http" {
+		t.Fatalf("unexpected X-Forwarded-Proto %q", proto)
+	}
+	if forwarded := header.Get("Forwarded"); forwarded != `for=127.0.0.1;host="www.example.com:8080";proto=http` {
+		t.Fatalf("unexpected Forwarded %q", forwarded)
+	}
+
+	resp, err = c.Get("http://www.example.com:8080/api/redirect")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	resp.Body.Close()
+	if location := resp.Header.Get("Location"); location != "http://www.example.com:8080/api/target" {
+		t.Fatalf("unexpected location %q", location)
+	}
+
+	//no rule matched
+	resp, err = c.Get("http://www.example.com:8080/other")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != gohttp.StatusBadRequest {
+		t.Fatalf("unexpected status %d of request matching no rule", resp.StatusCode)
+	}
+}
+
+func TestAddForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		clientAddr   net.Addr
+		host         string
+		proto        string
+		expForwarded string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}, "www.example.com", "https",
+			"for=10.0.0.1;host=www.example.com;proto=https"},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1234}, "www.example.com:8080", "http",
+			`for="[::1]";host="www.example.com:8080";proto=http`},
+	}
+	for _, test := range tests {
+		req := &proxyhttp.Request{}
+		//the X-Forwarded-Proto sent by client is replaced
+		raw := "GET / HTTP/1.1\r\nX-Forwarded-Proto: https\r\nX-Forwarded-Proto: ftp\r\n\r\n"
+		if err := req.ReadFrom(bufio.NewReader(strings.NewReader(raw))); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		addForwardedHeaders(req, test.clientAddr, test.host, test.proto)
+		req.SetHijacker(testHijacker{})
+		var b strings.Builder
+		w := bufio.NewWriter(&b)
+		if err := req.WriteHeaderTo(w); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		w.Flush()
+		if !strings.Contains(b.String(), "\r\nForwarded: "+test.expForwarded+"\r\n") ||
+			!strings.Contains(b.String(), "\r\nX-Forwarded-Proto: "+test.proto+"\r\n") ||
+			strings.Count(b.String(), "X-Forwarded-Proto") != 1 {
+			t.Fatalf("unexpected header %q, expecting Forwarded %q", b.String(), test.expForwarded)
+		}
+	}
+}
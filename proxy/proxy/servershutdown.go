@@ -3,6 +3,7 @@ package proxy
 import (
 	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -94,6 +95,24 @@ func (ln *GracefulNetListener) closeConn() {
 type gracefulConn struct {
 	net.Conn
 	ln *GracefulNetListener
+
+	//readDeadline the read deadline last set, see readDeadlineOf
+	lock         sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *gracefulConn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline = t
+	c.lock.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *gracefulConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline = t
+	c.lock.Unlock()
+	return c.Conn.SetReadDeadline(t)
 }
 
 func (c *gracefulConn) Close() error {
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/haxii/fastproxy/util"
+)
+
+// SOCKS5 server side, see RFC 1928 & RFC 1929
+
+const socks5Version = 5
+
+//DefaultSOCKS5HandshakeTimeout max duration of the SOCKS5 handshake
+//if the ReadTimeout of proxy is not set
+const DefaultSOCKS5HandshakeTimeout = 10 * time.Second
+
+const (
+	socks5AuthNone         = 0
+	socks5AuthPassword     = 2
+	socks5AuthNoAcceptable = 0xff
+
+	socks5AuthPasswordVersion = 1
+	socks5AuthPasswordOK      = 0
+	socks5AuthPasswordFailure = 1
+)
+
+const socks5Connect = 1
+
+const (
+	socks5IP4    = 1
+	socks5Domain = 3
+	socks5IP6    = 4
+)
+
+const (
+	socks5ReplySucceeded               = 0
+	socks5ReplyGeneralFailure          = 1
+	socks5ReplyCommandNotSupported     = 7
+	socks5ReplyAddressTypeNotSupported = 8
+)
+
+//serveSOCKS5 serves a SOCKS5 client connection,
+//the CONNECT request is handled as same as a HTTP CONNECT one
+func (p *Proxy) serveSOCKS5(c net.Conn, reader *bufio.Reader) error {
+	user, readSize, writeSize, err := p.socks5Handshake(c, reader)
+	usage := p.usages(user)
+	if usage != nil {
+		usage.AddIncomingSize(uint64(readSize))
+		usage.AddOutgoingSize(uint64(writeSize))
+	}
+	if err != nil {
+		return util.ErrWrapper(err, "fail to handshake with SOCKS5 client")
+	}
+
+	hostWithPort, readSize, err := p.socks5ReadRequest(c, reader)
+	if usage != nil {
+		usage.AddIncomingSize(uint64(readSize))
+	}
+	if err != nil {
+		return util.ErrWrapper(err, "fail to read SOCKS5 request")
+	}
+	//the tunnel is not limited by the handshake timeout
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		return util.ErrWrapper(err, "fail to clear read deadline of SOCKS5 connection")
+	}
+
+	//bytes sent right after the request may be buffered in reader
+	if err := p.Handler.handleTunnelConns(&bufferedConn{Conn: c, r: reader},
+		hostWithPort, user, socks5TunnelReplier{},
+		p.BufioPool, &p.Client, usage); err != nil {
+		return util.ErrWrapper(err, "error SOCKS5 traffic "+hostWithPort+" ")
+	}
+	return nil
+}
+
+//socks5HandshakeTimeout max duration of detecting the SOCKS5 client
+//and reading its handshake & request, which starts once the client connects
+func (p *Proxy) socks5HandshakeTimeout() time.Duration {
+	if p.ReadTimeout > 0 {
+		return p.ReadTimeout
+	}
+	return DefaultSOCKS5HandshakeTimeout
+}
+
+//socks5Handshake negotiates the auth method then authenticates the user if needed
+func (p *Proxy) socks5Handshake(c net.Conn,
+	reader *bufio.Reader) (user string, readSize, writeSize int, err error) {
+	//greeting: VER NMETHODS METHODS
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return
+	}
+	readSize += len(header)
+	methods := make([]byte, header[1])
+	if _, err = io.ReadFull(reader, methods); err != nil {
+		return
+	}
+	readSize += len(methods)
+
+	authenticator := p.Handler.Authenticator
+	method := byte(socks5AuthNoAcceptable)
+	for _, m := range methods {
+		if authenticator == nil && m == socks5AuthNone {
+			method = socks5AuthNone
+			break
+		}
+		if authenticator != nil && m == socks5AuthPassword {
+			method = socks5AuthPassword
+			break
+		}
+	}
+	if err = util.WriteWithValidation(c, []byte{socks5Version, method}); err != nil {
+		return
+	}
+	writeSize += 2
+	switch method {
+	case socks5AuthNone:
+		return
+	case socks5AuthNoAcceptable:
+		err = errors.New("no acceptable auth method provided")
+		return
+	}
+
+	//username/password: VER ULEN UNAME PLEN PASSWD
+	readString := func() (string, error) {
+		l, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, l)
+		if _, err := io.ReadFull(reader, b); err != nil {
+			return "", err
+		}
+		readSize += 1 + len(b)
+		return string(b), nil
+	}
+	var ver byte
+	if ver, err = reader.ReadByte(); err != nil {
+		return
+	}
+	readSize++
+	if ver != socks5AuthPasswordVersion {
+		err = errors.New("unexpected username/password auth version " + strconv.Itoa(int(ver)))
+		return
+	}
+	var pass string
+	if user, err = readString(); err != nil {
+		return
+	}
+	if pass, err = readString(); err != nil {
+		return
+	}
+	status := byte(socks5AuthPasswordOK)
+	if !authenticator.validatePassword(user, pass) {
+		status = socks5AuthPasswordFailure
+	}
+	if err = util.WriteWithValidation(c, []byte{socks5AuthPasswordVersion, status}); err != nil {
+		return
+	}
+	writeSize += 2
+	if status != socks5AuthPasswordOK {
+		err = errors.New("SOCKS5 user " + user + " fails to authenticate")
+	}
+	return
+}
+
+//socks5ReadRequest reads the CONNECT request then returns the target host with port
+func (p *Proxy) socks5ReadRequest(c net.Conn,
+	reader *bufio.Reader) (hostWithPort string, readSize int, err error) {
+	//request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return
+	}
+	readSize += len(header)
+	if header[0] != socks5Version {
+		err = errors.New("unexpected SOCKS version " + strconv.Itoa(int(header[0])))
+		return
+	}
+
+	var addr []byte
+	switch header[3] {
+	case socks5IP4:
+		addr = make([]byte, net.IPv4len+2)
+	case socks5IP6:
+		addr = make([]byte, net.IPv6len+2)
+	case socks5Domain:
+		var l byte
+		if l, err = reader.ReadByte(); err != nil {
+			return
+		}
+		readSize++
+		addr = make([]byte, int(l)+2)
+	default:
+		socks5Reply(c, socks5ReplyAddressTypeNotSupported)
+		err = errors.New("unsupported address type " + strconv.Itoa(int(header[3])))
+		return
+	}
+	if _, err = io.ReadFull(reader, addr); err != nil {
+		return
+	}
+	readSize += len(addr)
+
+	if header[1] != socks5Connect {
+		socks5Reply(c, socks5ReplyCommandNotSupported)
+		err = errors.New("unsupported command " + strconv.Itoa(int(header[1])))
+		return
+	}
+
+	host := string(addr[:len(addr)-2])
+	if header[3] != socks5Domain {
+		host = net.IP(addr[:len(addr)-2]).String()
+	}
+	port := int(addr[len(addr)-2])<<8 | int(addr[len(addr)-1])
+	hostWithPort = net.JoinHostPort(host, strconv.Itoa(port))
+	return
+}
+
+//socks5TunnelReplier replies SOCKS5 CONNECT requests
+type socks5TunnelReplier struct{}
+
+func (socks5TunnelReplier) replyOK(c net.Conn) (uint64, error) {
+	return socks5Reply(c, socks5ReplySucceeded)
+}
+
+func (socks5TunnelReplier) replyError(c net.Conn) (uint64, error) {
+	return socks5Reply(c, socks5ReplyGeneralFailure)
+}
+
+//socks5Reply replies: VER REP RSV ATYP BND.ADDR BND.PORT,
+//bound address is always set as 0.0.0.0:0 which is not used in CONNECT
+func socks5Reply(c net.Conn, rep byte) (uint64, error) {
+	reply := []byte{socks5Version, rep, 0, socks5IP4, 0, 0, 0, 0, 0, 0}
+	return uint64(len(reply)), util.WriteWithValidation(c, reply)
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/bufiopool"
+)
+
+func TestSOCKS5Handshake(t *testing.T) {
+	authenticator := &ProxyAuthenticator{
+		Basic: func(user, password string) bool {
+			return user == "user" && password == "pass"
+		},
+	}
+	tests := []struct {
+		name          string
+		authenticator *ProxyAuthenticator
+		input         []byte
+		expReply      []byte
+		expUser       string
+		expErr        bool
+	}{
+		{"no auth", nil, []byte{5, 1, 0}, []byte{5, 0}, "", false},
+		{"no auth in methods", nil, []byte{5, 2, 1, 0}, []byte{5, 0}, "", false},
+		{"no acceptable method", nil, []byte{5, 1, 2}, []byte{5, 0xff}, "", true},
+		{"password required", authenticator, []byte{5, 1, 0}, []byte{5, 0xff}, "", true},
+		{"password", authenticator,
+			[]byte{5, 2, 0, 2, 1, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'},
+			[]byte{5, 2, 1, 0}, "user", false},
+		{"wrong password", authenticator,
+			[]byte{5, 1, 2, 1, 4, 'u', 's', 'e', 'r', 5, 'w', 'r', 'o', 'n', 'g'},
+			[]byte{5, 2, 1, 1}, "user", true},
+		{"bad password auth version", authenticator,
+			[]byte{5, 1, 2, 5, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'},
+			[]byte{5, 2}, "", true},
+		{"truncated password", authenticator,
+			[]byte{5, 1, 2, 1, 4, 'u', 's'}, []byte{5, 2}, "", true},
+		{"truncated greeting", nil, []byte{5, 3, 0}, nil, "", true},
+	}
+	for _, test := range tests {
+		p := &Proxy{}
+		p.Handler.Authenticator = test.authenticator
+		var user string
+		reply, err := testSOCKS5Serve(test.input, func(c net.Conn, reader *bufio.Reader) error {
+			var (
+				readSize, writeSize int
+				err                 error
+			)
+			user, readSize, writeSize, err = p.socks5Handshake(c, reader)
+			if err == nil && readSize != len(test.input) {
+				t.Fatalf("%s: unexpected read size %d, expecting %d", test.name, readSize, len(test.input))
+			}
+			if writeSize != len(test.expReply) {
+				t.Fatalf("%s: unexpected write size %d, expecting %d", test.name, writeSize, len(test.expReply))
+			}
+			return err
+		})
+		if (err != nil) != test.expErr {
+			t.Fatalf("%s: unexpected error %v, expecting error %t", test.name, err, test.expErr)
+		}
+		if !bytes.Equal(reply, test.expReply) {
+			t.Fatalf("%s: unexpected reply %v, expecting %v", test.name, reply, test.expReply)
+		}
+		if user != test.expUser {
+			t.Fatalf("%s: unexpected user %q, expecting %q", test.name, user, test.expUser)
+		}
+	}
+}
+
+func TestSOCKS5ReadRequest(t *testing.T) {
+	replyOf := func(rep byte) []byte {
+		return []byte{5, rep, 0, 1, 0, 0, 0, 0, 0, 0}
+	}
+	tests := []struct {
+		name            string
+		input           []byte
+		expHostWithPort string
+		expReply        []byte
+	}{
+		{"ipv4", []byte{5, 1, 0, 1, 1, 2, 3, 4, 0, 80}, "1.2.3.4:80", nil},
+		{"domain", append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 1, 187),
+			"example.com:443", nil},
+		{"ipv6", []byte{5, 1, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1f, 0x90},
+			"[::1]:8080", nil},
+		{"bad version", []byte{4, 1, 0, 1, 1, 2, 3, 4, 0, 80}, "", nil},
+		{"unsupported address type", []byte{5, 1, 0, 9, 1, 2, 3, 4, 0, 80}, "", replyOf(8)},
+		{"unsupported command", []byte{5, 2, 0, 1, 1, 2, 3, 4, 0, 80}, "", replyOf(7)},
+		{"truncated address", []byte{5, 1, 0, 1, 1, 2}, "", nil},
+		{"truncated domain", []byte{5, 1, 0, 3, 11, 'e'}, "", nil},
+	}
+	p := &Proxy{}
+	for _, test := range tests {
+		var hostWithPort string
+		reply, err := testSOCKS5Serve(test.input, func(c net.Conn, reader *bufio.Reader) error {
+			var err error
+			hostWithPort, _, err = p.socks5ReadRequest(c, reader)
+			return err
+		})
+		if (err != nil) != (len(test.expHostWithPort) == 0) {
+			t.Fatalf("%s: unexpected error %v", test.name, err)
+		}
+		if hostWithPort != test.expHostWithPort {
+			t.Fatalf("%s: unexpected target %q, expecting %q", test.name, hostWithPort, test.expHostWithPort)
+		}
+		if !bytes.Equal(reply, test.expReply) {
+			t.Fatalf("%s: unexpected reply %v, expecting %v", test.name, reply, test.expReply)
+		}
+	}
+}
+
+func TestSOCKS5HandshakeTimeout(t *testing.T) {
+	p := &Proxy{BufioPool: &bufiopool.Pool{}, ServeSOCKS5: true, ReadTimeout: 50 * time.Millisecond}
+	p.Handler.ShouldAllowConnection = func(net.Addr) bool { return true }
+	for _, input := range [][]byte{nil, {5, 1}} {
+		server, client := net.Pipe()
+		go client.Write(input)
+		done := make(chan error, 1)
+		go func() {
+			done <- p.serveConn(server)
+		}()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatalf("idle client with %v is served without error", input)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("idle client with %v is not timed out", input)
+		}
+		server.Close()
+		client.Close()
+	}
+}
+
+//testSOCKS5Serve serves the client sending input by serve over a pipe,
+//then returns what's replied to the client
+func testSOCKS5Serve(input []byte, serve func(c net.Conn, reader *bufio.Reader) error) ([]byte, error) {
+	server, client := net.Pipe()
+	defer client.Close()
+	//the client write is left blocked if the server stops reading early,
+	//which returns once the pipe is closed
+	go client.Write(input)
+	go func() {
+		//the client stops sending, so the truncated input is detected
+		time.Sleep(50 * time.Millisecond)
+		server.SetReadDeadline(time.Now())
+	}()
+	replied := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(client)
+		replied <- b
+	}()
+	err := serve(server, bufio.NewReader(server))
+	server.Close()
+	return <-replied, err
+}
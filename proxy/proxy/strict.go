@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"sync/atomic"
+
+	"github.com/haxii/fastproxy/http"
+
+	proxyhttp "github.com/haxii/fastproxy/proxy/http"
+)
+
+//RejectedRequests counts the requests rejected by the strict parsing per reason
+type RejectedRequests struct {
+	counts [http.NumRejectReasons]uint64
+}
+
+func (r *RejectedRequests) add(reason http.RejectReason) {
+	if r == nil || reason < 0 || reason >= http.NumRejectReasons {
+		return
+	}
+	atomic.AddUint64(&r.counts[reason], 1)
+}
+
+//Get number of the requests rejected for reason
+func (r *RejectedRequests) Get(reason http.RejectReason) uint64 {
+	if r == nil || reason < 0 || reason >= http.NumRejectReasons {
+		return 0
+	}
+	return atomic.LoadUint64(&r.counts[reason])
+}
+
+//Total number of the requests rejected for all the reasons
+func (r *RejectedRequests) Total() uint64 {
+	var total uint64
+	for reason := http.RejectReason(0); reason < http.NumRejectReasons; reason++ {
+		total += r.Get(reason)
+	}
+	return total
+}
+
+//readRequest reads req from reader in the parsing mode and limits of the handler,
+//the request rejected by the strict parsing or exceeding the limits is counted
+//then responded to w, nil w means the rejection is responded by the caller
+func (h *Handler) readRequest(w io.Writer, req *proxyhttp.Request, reader *bufio.Reader) error {
+	req.SetStrictParsing(h.StrictParsing)
+	req.SetLimits(h.requestLimits.limits)
+	err := req.ReadFrom(reader)
+	if rejectErr, ok := err.(*http.RejectError); ok {
+		h.RejectedRequests.add(rejectErr.Reason)
+		if w != nil {
+			writeFastError(w, http.StatusBadRequest,
+				"Bad Request: "+rejectErr.Reason.String()+".\n")
+		}
+	} else if limitErr := req.ExceededLimit(); limitErr != nil {
+		h.requestLimits.exceeded.Add(limitErr.Limit)
+		if w != nil {
+			writeFastError(w, requestLimitStatusCode(limitErr.Limit), limitErr.Error()+".\n")
+		}
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	proxyhttp "github.com/haxii/fastproxy/proxy/http"
+	"github.com/haxii/fastproxy/transport"
+	"github.com/haxii/fastproxy/util"
+)
+
+// ServeTransparent serves incoming connections redirected by iptables
+// REDIRECT or TPROXY from the given listener, i.e. works as a transparent proxy.
+//
+// The original destination is recovered from each connection and it is
+// always the one dialed. TLS traffic is named by the SNI in ClientHello,
+// then decrypted or tunneled as a CONNECT request does, HTTP traffic is
+// named by the `Host` header, and the original destination is used if
+// neither of them is provided. The names are only used for the hijackers,
+// the certificates and the headers sent, so a spoofed one can't pick
+// another upstream.
+//
+// A TPROXY listener must be made with IP_TRANSPARENT set.
+//
+// ServeTransparent blocks until the given listener returns permanent error.
+func (p *Proxy) ServeTransparent(ln net.Listener, maxWaitTime time.Duration) error {
+	return p.serve(ln, maxWaitTime, p.serveTransparentConn)
+}
+
+func (p *Proxy) serveTransparentConn(c net.Conn) error {
+	if !p.Handler.ShouldAllowConnection(c.RemoteAddr()) {
+		return nil
+	}
+	rawConn := c
+	if gc, ok := c.(*gracefulConn); ok {
+		rawConn = gc.Conn
+	}
+	originalDst, err := transport.OriginalDst(rawConn)
+	if err != nil {
+		return util.ErrWrapper(err, "fail to get original destination of transparent connection")
+	}
+	return p.serveTransparent(c, originalDst)
+}
+
+//serveTransparent serves the transparent connection c destined to originalDst
+func (p *Proxy) serveTransparent(c net.Conn, originalDst *net.TCPAddr) error {
+	reader := p.BufioPool.AcquireReader(c)
+	defer p.BufioPool.ReleaseReader(reader)
+	b, err := reader.Peek(1)
+	if err != nil {
+		return util.ErrWrapper(err, "fail to read the 1st byte of connection")
+	}
+	if b[0] != tlsRecordTypeHandshake {
+		return p.serveRequests(c, reader, originalDst)
+	}
+
+	//use SNI as the host name if provided, the original destination is dialed
+	hostWithPort := originalDst.String()
+	hello, err := peekClientHello(reader)
+	if err != nil {
+		hello = nil
+	} else if len(hello.ServerName) > 0 {
+		hostWithPort = net.JoinHostPort(hello.ServerName, strconv.Itoa(originalDst.Port))
+	}
+	if err := p.Handler.serveTunnel(&bufferedConn{Conn: c, r: reader},
+		hostWithPort, originalDst, "", hello, nopTunnelReplier{},
+		p.BufioPool, &p.Client, p.usages("")); err != nil {
+		return util.ErrWrapper(err, "error transparent TLS traffic "+hostWithPort+" ")
+	}
+	return nil
+}
+
+//setTransparentHost sets the request's host using the request line or `Host` header,
+//the original destination is used if neither is provided,
+//the target dialed is always pinned to the original destination
+func setTransparentHost(req *proxyhttp.Request, originalDst *net.TCPAddr) {
+	if len(req.HostInfo().HostWithPort()) > 0 {
+		req.HostInfo().SetTarget(originalDst)
+		return
+	}
+	port := strconv.Itoa(originalDst.Port)
+	host := req.Header().Host()
+	if len(host) == 0 {
+		req.SetHostWithPort(originalDst.String())
+		return
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		//the brackets of an IPv6 host are added back by JoinHostPort
+		host = net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), port)
+	}
+	req.SetHostWithPort(host)
+	req.HostInfo().SetTarget(originalDst)
+}
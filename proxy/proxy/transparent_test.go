@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	gohttp "net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	proxyhttp "github.com/haxii/fastproxy/proxy/http"
+)
+
+func TestSetTransparentHost(t *testing.T) {
+	originalDst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8080}
+	tests := []struct {
+		host            string
+		expHostWithPort string
+	}{
+		//the original destination is the target of every host
+		{"", "10.0.0.1:8080"},
+		{"www.example.com", "www.example.com:8080"},
+		{"www.example.com:80", "www.example.com:80"},
+		{"[::1]", "[::1]:8080"},
+		{"[::1]:80", "[::1]:80"},
+	}
+	for _, test := range tests {
+		raw := "GET / HTTP/1.1\r\n"
+		if len(test.host) > 0 {
+			raw += "Host: " + test.host + "\r\n"
+		}
+		req := &proxyhttp.Request{}
+		if err := req.ReadFrom(bufio.NewReader(strings.NewReader(raw + "\r\n"))); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		setTransparentHost(req, originalDst)
+		if hostWithPort := req.HostInfo().HostWithPort(); hostWithPort != test.expHostWithPort {
+			t.Fatalf("unexpected host %q of host %q, expecting %q",
+				hostWithPort, test.host, test.expHostWithPort)
+		}
+		if target := req.HostInfo().TargetWithPort(); target != "10.0.0.1:8080" {
+			t.Fatalf("unexpected target %q of host %q", target, test.host)
+		}
+	}
+}
+
+func TestTransparentOriginalDst(t *testing.T) {
+	var upstreamConns int32
+	upstream := httptest.NewUnstartedServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		io.WriteString(w, "upstream "+r.Host+r.URL.Path)
+	}))
+	upstream.Config.ConnState = func(c net.Conn, state gohttp.ConnState) {
+		if state == gohttp.StateNew {
+			atomic.AddInt32(&upstreamConns, 1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+	tlsUpstream := httptest.NewUnstartedServer(upstream.Config.Handler)
+	tlsUpstream.Config.ConnState = upstream.Config.ConnState
+	tlsUpstream.StartTLS()
+	defer tlsUpstream.Close()
+	decoy := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		io.WriteString(w, "decoy")
+	}))
+	defer decoy.Close()
+	decoyHost := decoy.Listener.Addr().String()
+
+	//the original destination is dialed whatever the host of request is
+	p := &Proxy{}
+	originalDst := upstream.Listener.Addr().(*net.TCPAddr)
+	addr := startTestProxyWith(t, p, func(c net.Conn) error {
+		return p.serveTransparent(c, originalDst)
+	})
+	for _, test := range []struct {
+		req     string
+		expResp string
+	}{
+		{"GET /a HTTP/1.1\r\nHost: " + decoyHost + "\r\n\r\n", "upstream " + decoyHost + "/a"},
+		{"GET http://" + decoyHost + "/b HTTP/1.1\r\nHost: " + decoyHost + "\r\n\r\n", "upstream " + decoyHost + "/b"},
+		{"CONNECT " + decoyHost + " HTTP/1.1\r\nHost: " + decoyHost + "\r\n\r\n", "400"},
+	} {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("fail to dial proxy: %s", err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(c, test.req)
+		resp, err := gohttp.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatalf("fail to read response of %q: %s", test.req, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != gohttp.StatusOK {
+			body = []byte(strconv.Itoa(resp.StatusCode))
+		}
+		if string(body) != test.expResp {
+			t.Fatalf("unexpected response %q of %q, expecting %q", body, test.req, test.expResp)
+		}
+		c.Close()
+	}
+
+	//the SNI names the TLS traffic only, both in tunnel and decrypted
+	dialTLS := func(addr string, config *tls.Config) string {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("fail to dial proxy: %s", err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		tlsConn := tls.Client(c, config)
+		io.WriteString(tlsConn, "GET /tls HTTP/1.1\r\nHost: decoy.invalid\r\n\r\n")
+		resp, err := gohttp.ReadResponse(bufio.NewReader(tlsConn), nil)
+		if err != nil {
+			return err.Error()
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	tlsDst := tlsUpstream.Listener.Addr().(*net.TCPAddr)
+	tunnelAddr := startTestProxyWith(t, p, func(c net.Conn) error {
+		return p.serveTransparent(c, tlsDst)
+	})
+	if resp := dialTLS(tunnelAddr, &tls.Config{ServerName: "decoy.invalid",
+		InsecureSkipVerify: true}); resp != "upstream decoy.invalid/tls" {
+		t.Fatalf("unexpected tunnel response %q", resp)
+	}
+
+	//the upstream is mimicked then requested in MITM,
+	//where the request fails as the upstream's certificate isn't for the SNI
+	mitm := &Proxy{Handler: Handler{
+		MitmCACert:        testCA(t),
+		MimicUpstreamCert: true,
+		ShouldDecryptHost: func(string, *ClientHello) bool { return true },
+	}}
+	atomic.StoreInt32(&upstreamConns, 0)
+	mitmAddr := startTestProxyWith(t, mitm, func(c net.Conn) error {
+		return mitm.serveTransparent(c, tlsDst)
+	})
+	dialTLS(mitmAddr, &tls.Config{ServerName: "decoy.invalid", InsecureSkipVerify: true})
+	if n := atomic.LoadInt32(&upstreamConns); n != 2 {
+		t.Fatalf("upstream is connected %d times, expecting twice for mimicking and requesting", n)
+	}
+}
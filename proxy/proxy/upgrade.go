@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haxii/fastproxy/client"
+	"github.com/haxii/fastproxy/hijack"
+	"github.com/haxii/fastproxy/proxy/http"
+	"github.com/haxii/fastproxy/superproxy"
+	"github.com/haxii/fastproxy/transport"
+	"github.com/haxii/fastproxy/util"
+)
+
+//doUpgrade proxies the upgrade request, e.g. a WebSocket handshake,
+//then forwards the traffic of both sides after the upstream switches protocols,
+//writer is the buffered writer of c which the response is written to
+func (h *Handler) doUpgrade(ctx context.Context, c net.Conn, writer *bufio.Writer, req *http.Request,
+	resp *http.Response, client *client.Client, superProxy *superproxy.SuperProxy,
+	usage usages) error {
+	//the hop-by-hop `Connection` header is removed in parsing,
+	//which is required by the upstream on upgrading
+	req.AddHeaderValue("Connection", req.Header().UpgradeConnection())
+	wsHijacker, ok := req.GetHijacker().(hijack.WebSocketHijacker)
+	if ok && strings.EqualFold(req.Header().Upgrade(), "websocket") {
+		//extensions e.g. permessage-deflate are not negotiated, so frames can be decoded
+		req.DelHeader("Sec-WebSocket-Extensions")
+	} else {
+		wsHijacker = nil
+	}
+	upstreamConn, err := client.DoUpgradeContext(ctx, req, resp)
+	if err != nil {
+		return err
+	}
+	defer upstreamConn.Close()
+	if err := writer.Flush(); err != nil {
+		return util.ErrWrapper(err, "fail to write upgrade response to client")
+	}
+	//the upgrade is refused by the upstream
+	if !resp.IsSwitchingProtocols() {
+		return nil
+	}
+
+	//the upgraded traffic has no deadline
+	c.SetReadDeadline(time.Time{})
+	var upstreamWriteErr, upstreamReadErr error
+	var upstreamOutgoingTrafficSize, upstreamIncomingTrafficSize int64
+	if wsHijacker != nil {
+		upstreamOutgoingTrafficSize, upstreamIncomingTrafficSize,
+			upstreamWriteErr, upstreamReadErr = forwardWebSocket(c, req.Reader(),
+			upstreamConn, wsHijacker, h.MaxWebSocketMessageSize)
+	} else {
+		upstreamOutgoingTrafficSize, upstreamIncomingTrafficSize,
+			upstreamWriteErr, upstreamReadErr = forwardUpgraded(c, req.Reader(), upstreamConn)
+	}
+
+	if upstreamOutgoingTrafficSize > 0 {
+		if usage != nil {
+			usage.AddIncomingSize(uint64(upstreamOutgoingTrafficSize))
+		}
+		if superProxy != nil && superProxy.Usage != nil {
+			superProxy.Usage.AddOutgoingSize(uint64(upstreamOutgoingTrafficSize))
+		}
+	}
+	if upstreamIncomingTrafficSize > 0 {
+		if usage != nil {
+			usage.AddOutgoingSize(uint64(upstreamIncomingTrafficSize))
+		}
+		if superProxy != nil && superProxy.Usage != nil {
+			superProxy.Usage.AddIncomingSize(uint64(upstreamIncomingTrafficSize))
+		}
+	}
+
+	if upstreamWriteErr != nil {
+		return util.ErrWrapper(upstreamWriteErr, "error occurred when forwarding upgraded traffic to upstream")
+	}
+	if upstreamReadErr != nil {
+		return util.ErrWrapper(upstreamReadErr, "error occurred when forwarding upgraded traffic to client")
+	}
+	return nil
+}
+
+//forwardUpgraded forwards the upgraded traffic of both sides as is,
+//clientReader is the buffered reader of c, returns the byte size written to
+//upstream and client with the errors of each direction
+func forwardUpgraded(c net.Conn, clientReader *bufio.Reader, upstreamConn net.Conn) (
+	upstreamOutgoing, upstreamIncoming int64, upstreamWriteErr, upstreamReadErr error) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		//bytes sent right after the request may be buffered in request's reader
+		upstreamOutgoing, upstreamWriteErr = transport.Forward(upstreamConn, clientReader)
+		//client is gone, stop reading upstream
+		upstreamConn.SetReadDeadline(time.Now())
+		wg.Done()
+	}()
+	upstreamIncoming, upstreamReadErr = transport.Forward(c, upstreamConn)
+	//upstream is gone, stop reading client
+	c.SetReadDeadline(time.Now())
+	wg.Wait()
+	return
+}
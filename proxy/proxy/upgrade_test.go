@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	gohttp "net/http"
+	"testing"
+	"time"
+)
+
+func TestProxyUpgrade(t *testing.T) {
+	//the upstream switches protocols with the Connection tokens of the request,
+	//then echoes the bytes of the upgraded traffic
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("fail to listen: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(c)
+		req, err := gohttp.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nConnection: "+
+			req.Header.Get("Connection")+"\r\nUpgrade: h2c\r\n\r\n")
+		io.Copy(c, r)
+	}()
+	upstreamAddr := ln.Addr().String()
+	addr := startTestProxy(t, &Proxy{})
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("fail to dial proxy: %s", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "GET http://"+upstreamAddr+"/ HTTP/1.1\r\nHost: "+upstreamAddr+"\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n")
+	r := bufio.NewReader(c)
+	resp, err := gohttp.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("fail to read response: %s", err)
+	}
+	//the Connection tokens other than Upgrade are kept both ways
+	if resp.StatusCode != gohttp.StatusSwitchingProtocols ||
+		resp.Header.Get("Connection") != "Upgrade, HTTP2-Settings" {
+		t.Fatalf("unexpected response %d with Connection %q", resp.StatusCode, resp.Header.Get("Connection"))
+	}
+	io.WriteString(c, "ping")
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil || string(b) != "ping" {
+		t.Fatalf("unexpected upgraded traffic %q: %v", b, err)
+	}
+}
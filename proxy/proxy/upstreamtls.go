@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	//upstreamTLSCacheTTL max duration a handshake result of the upstream is cached
+	upstreamTLSCacheTTL = 10 * time.Minute
+	//upstreamTLSCacheSize max number of the handshake results cached
+	upstreamTLSCacheSize = 4096
+)
+
+//upstreamTLSCache caches the results of handshaking with the upstreams in
+//MimicUpstreamCert mode, keyed by the host with port and the server name,
+//a handshake is made only once for the concurrent clients of the same key.
+//The results without certificates, e.g. the upstream is unreachable, are not
+//cached, so the next client handshakes with the upstream again
+type upstreamTLSCache struct {
+	lock    sync.Mutex
+	entries map[string]*upstreamTLSEntry
+	calls   map[string]*upstreamTLSCall
+}
+
+type upstreamTLSEntry struct {
+	result   *upstreamTLS
+	expireAt time.Time
+}
+
+//upstreamTLSCall an in-flight handshake with the upstream
+type upstreamTLSCall struct {
+	done   chan struct{}
+	result *upstreamTLS
+}
+
+//get returns the cached handshake result of the upstream,
+//handshake handshakes with the upstream if not cached or expired
+func (c *upstreamTLSCache) get(hostWithPort, serverName string,
+	handshake func() *upstreamTLS) *upstreamTLS {
+	key := hostWithPort + " " + serverName
+	now := time.Now()
+	c.lock.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]*upstreamTLSEntry)
+		c.calls = make(map[string]*upstreamTLSCall)
+	}
+	if entry, ok := c.entries[key]; ok {
+		if now.Before(entry.expireAt) {
+			c.lock.Unlock()
+			return entry.result
+		}
+		delete(c.entries, key)
+	}
+	//wait for the handshake in flight
+	if call, ok := c.calls[key]; ok {
+		c.lock.Unlock()
+		<-call.done
+		return call.result
+	}
+	call := &upstreamTLSCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.lock.Unlock()
+
+	call.result = handshake()
+	c.lock.Lock()
+	if len(call.result.certs) > 0 {
+		c.add(key, call.result, now)
+	}
+	delete(c.calls, key)
+	c.lock.Unlock()
+	close(call.done)
+	return call.result
+}
+
+//add caches the result until the upstream's certificate expires or the TTL,
+//the expired ones are evicted if the cache is full, then the arbitrary ones
+func (c *upstreamTLSCache) add(key string, result *upstreamTLS, now time.Time) {
+	expireAt := now.Add(upstreamTLSCacheTTL)
+	if notAfter := result.certs[0].NotAfter; notAfter.Before(expireAt) {
+		expireAt = notAfter
+	}
+	if len(c.entries) >= upstreamTLSCacheSize {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expireAt) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < upstreamTLSCacheSize {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = &upstreamTLSEntry{result: result, expireAt: expireAt}
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/haxii/fastproxy/hijack"
+	"github.com/haxii/fastproxy/websocket"
+)
+
+//DefaultMaxWebSocketMessageSize max size of a WebSocket message reassembled
+//for hijacker if Handler.MaxWebSocketMessageSize is not set
+const DefaultMaxWebSocketMessageSize = 1 << 20
+
+var (
+	errWebSocketContinuation = errors.New("unexpected continuation frame")
+	errWebSocketFragmented   = errors.New("unexpected data frame inside a fragmented message")
+	errWebSocketTooLarge     = errors.New("message too large")
+)
+
+//forwardWebSocket forwards the upgraded WebSocket traffic of both sides frame by frame,
+//so the frames are sniffed and modified by hijacker, the messages are limited by
+//maxMessageSize, returns the same as forwardUpgraded
+func forwardWebSocket(c net.Conn, clientReader *bufio.Reader, upstreamConn net.Conn,
+	hijacker hijack.WebSocketHijacker, maxMessageSize int64) (
+	upstreamOutgoing, upstreamIncoming int64, upstreamWriteErr, upstreamReadErr error) {
+	if maxMessageSize <= 0 {
+		maxMessageSize = DefaultMaxWebSocketMessageSize
+	}
+	//frames sent by client must be masked
+	upstream := &webSocketPeer{w: upstreamConn, masked: true}
+	client := &webSocketPeer{w: c}
+	hijacker.OnWebSocketOpen(func(direction hijack.WebSocketDirection, frame *websocket.Frame) error {
+		if direction == hijack.WebSocketClientToServer {
+			return upstream.write(frame)
+		}
+		return client.write(frame)
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		upstreamWriteErr = forwardWebSocketFrames(clientReader, upstream,
+			hijack.WebSocketClientToServer, hijacker, maxMessageSize)
+		//client is gone, stop reading upstream
+		upstreamConn.SetReadDeadline(time.Now())
+		wg.Done()
+	}()
+	upstreamReadErr = forwardWebSocketFrames(upstreamConn, client,
+		hijack.WebSocketServerToClient, hijacker, maxMessageSize)
+	//upstream is gone, stop reading client
+	c.SetReadDeadline(time.Now())
+	wg.Wait()
+	return upstream.size(), client.size(), upstreamWriteErr, upstreamReadErr
+}
+
+//forwardWebSocketFrames reads the frames from src, then writes the frames
+//returned by hijacker to dst, until src is closed
+func forwardWebSocketFrames(src io.Reader, dst *webSocketPeer,
+	direction hijack.WebSocketDirection, hijacker hijack.WebSocketHijacker,
+	maxMessageSize int64) error {
+	//message the fragmented message being reassembled
+	var message *websocket.Frame
+	for {
+		frame, err := websocket.ReadFrame(src, maxMessageSize)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return nil
+			}
+			return err
+		}
+		//control frames may be injected in the middle of a fragmented message
+		if !frame.IsControl() {
+			if frame.Opcode == websocket.OpContinuation {
+				if message == nil {
+					return errWebSocketContinuation
+				}
+				if int64(len(message.Payload)+len(frame.Payload)) > maxMessageSize {
+					return errWebSocketTooLarge
+				}
+				message.Payload = append(message.Payload, frame.Payload...)
+			} else {
+				if message != nil {
+					return errWebSocketFragmented
+				}
+				message = frame
+			}
+			if !frame.Fin {
+				continue
+			}
+			frame, message = message, nil
+			frame.Fin = true
+		}
+		if err := dst.write(hijacker.OnWebSocketFrame(direction, frame)...); err != nil {
+			return err
+		}
+	}
+}
+
+//webSocketPeer one side of the WebSocket connection which the frames are written to,
+//it's shared by the forwarding and the injection
+type webSocketPeer struct {
+	lock    sync.Mutex
+	w       io.Writer
+	masked  bool
+	written int64
+}
+
+func (p *webSocketPeer) write(frames ...*websocket.Frame) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, frame := range frames {
+		n, err := websocket.WriteFrame(p.w, frame, p.masked)
+		p.written += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *webSocketPeer) size() int64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.written
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haxii/fastproxy/hijack"
+	"github.com/haxii/fastproxy/websocket"
+)
+
+//testWebSocketHijacker drops the frames of `drop`, replaces the ones of `replace`
+//with 2 frames, and passes the others
+type testWebSocketHijacker struct {
+	lock   sync.Mutex
+	inject func(direction hijack.WebSocketDirection, frame *websocket.Frame) error
+}
+
+func (h *testWebSocketHijacker) OnWebSocketOpen(
+	inject func(direction hijack.WebSocketDirection, frame *websocket.Frame) error) {
+	h.lock.Lock()
+	h.inject = inject
+	h.lock.Unlock()
+}
+
+func (h *testWebSocketHijacker) OnWebSocketFrame(direction hijack.WebSocketDirection,
+	frame *websocket.Frame) []*websocket.Frame {
+	switch string(frame.Payload) {
+	case "drop":
+		return nil
+	case "replace":
+		return []*websocket.Frame{textFrame(true, "replaced"), textFrame(true, "more")}
+	}
+	return []*websocket.Frame{frame}
+}
+
+func textFrame(fin bool, payload string) *websocket.Frame {
+	return &websocket.Frame{Fin: fin, Opcode: websocket.OpText, Payload: []byte(payload)}
+}
+
+//readTestFrame reads a frame from r, returns if it's masked as well
+func readTestFrame(t *testing.T, r *bufio.Reader) (*websocket.Frame, bool) {
+	header, err := r.Peek(2)
+	if err != nil {
+		t.Fatalf("fail to read frame: %s", err)
+	}
+	masked := header[1]&0x80 != 0
+	frame, err := websocket.ReadFrame(r, 1<<20)
+	if err != nil {
+		t.Fatalf("fail to read frame: %s", err)
+	}
+	return frame, masked
+}
+
+//startForwardWebSocket forwards the WebSocket traffic between the client and the
+//upstream returned, the errors of both directions are sent to errs once it's done
+func startForwardWebSocket(t *testing.T, hijacker hijack.WebSocketHijacker,
+	maxMessageSize int64) (client, upstream net.Conn, errs chan [2]error) {
+	client, c := net.Pipe()
+	upstreamConn, upstream := net.Pipe()
+	for _, conn := range []net.Conn{client, upstream} {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+	errs = make(chan [2]error, 1)
+	go func() {
+		_, _, writeErr, readErr := forwardWebSocket(c, bufio.NewReader(c), upstreamConn,
+			hijacker, maxMessageSize)
+		c.Close()
+		upstreamConn.Close()
+		errs <- [2]error{writeErr, readErr}
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		upstream.Close()
+	})
+	return client, upstream, errs
+}
+
+func TestForwardWebSocket(t *testing.T) {
+	hijacker := &testWebSocketHijacker{}
+	client, upstream, errs := startForwardWebSocket(t, hijacker, 0)
+	clientReader, upstreamReader := bufio.NewReader(client), bufio.NewReader(upstream)
+
+	//the frames of client are passed, dropped, replaced and reassembled,
+	//then masked again for upstream
+	go func() {
+		for _, frame := range []*websocket.Frame{
+			textFrame(true, "pass"),
+			textFrame(true, "drop"),
+			textFrame(true, "replace"),
+			textFrame(false, "frag"),
+			{Fin: true, Opcode: websocket.OpContinuation, Payload: []byte("ment")},
+		} {
+			websocket.WriteFrame(client, frame, true)
+		}
+	}()
+	for _, expPayload := range []string{"pass", "replaced", "more", "fragment"} {
+		frame, masked := readTestFrame(t, upstreamReader)
+		if string(frame.Payload) != expPayload || !frame.Fin || frame.Opcode != websocket.OpText {
+			t.Fatalf("unexpected frame %q sent to upstream, expecting %q", frame.Payload, expPayload)
+		}
+		if !masked {
+			t.Fatalf("frame %q sent to upstream is not masked", frame.Payload)
+		}
+	}
+
+	//the frames of upstream are sent to client unmasked
+	go websocket.WriteFrame(upstream, textFrame(true, "pass"), false)
+	if frame, masked := readTestFrame(t, clientReader); string(frame.Payload) != "pass" || masked {
+		t.Fatalf("unexpected frame %q sent to client, masked %v", frame.Payload, masked)
+	}
+
+	//the frames injected are masked for upstream only
+	hijacker.lock.Lock()
+	inject := hijacker.inject
+	hijacker.lock.Unlock()
+	go inject(hijack.WebSocketServerToClient, textFrame(true, "to client"))
+	if frame, masked := readTestFrame(t, clientReader); string(frame.Payload) != "to client" || masked {
+		t.Fatalf("unexpected frame %q injected to client, masked %v", frame.Payload, masked)
+	}
+	go inject(hijack.WebSocketClientToServer, textFrame(true, "to upstream"))
+	if frame, masked := readTestFrame(t, upstreamReader); string(frame.Payload) != "to upstream" || !masked {
+		t.Fatalf("unexpected frame %q injected to upstream, masked %v", frame.Payload, masked)
+	}
+
+	//both directions end once client is gone
+	client.Close()
+	select {
+	case err := <-errs:
+		if err[0] != nil || err[1] != nil {
+			t.Fatalf("unexpected errors %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("forwarding is not done once client is gone")
+	}
+}
+
+func TestForwardWebSocketTooLarge(t *testing.T) {
+	for name, frames := range map[string][]*websocket.Frame{
+		"frame": {textFrame(true, "0123456789abcdefg")},
+		"message": {textFrame(false, "0123456789"),
+			{Fin: true, Opcode: websocket.OpContinuation, Payload: []byte("abcdefg")}},
+	} {
+		client, _, errs := startForwardWebSocket(t, &testWebSocketHijacker{}, 16)
+		go func() {
+			for _, frame := range frames {
+				websocket.WriteFrame(client, frame, true)
+			}
+		}()
+		select {
+		case err := <-errs:
+			if err[0] == nil {
+				t.Fatalf("%s: exceeding the max message size is not refused", name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: forwarding is not done once the max message size is exceeded", name)
+		}
+	}
+}
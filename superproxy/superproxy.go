@@ -1,6 +1,7 @@
 package superproxy
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -117,6 +118,13 @@ func (p *SuperProxy) HTTPProxyAuthHeaderWithCRLF() []byte {
 
 // MakeTunnel makes a TCP tunnel by making a connect request to proxy
 func (p *SuperProxy) MakeTunnel(pool *bufiopool.Pool,
+	targetHostWithPort string) (net.Conn, error) {
+	return p.MakeTunnelContext(context.Background(), pool, targetHostWithPort)
+}
+
+// MakeTunnelContext makes a TCP tunnel like MakeTunnel, the dialing and
+// the connect request are canceled once ctx is done, and limited by its deadline
+func (p *SuperProxy) MakeTunnelContext(ctx context.Context, pool *bufiopool.Pool,
 	targetHostWithPort string) (net.Conn, error) {
 	var (
 		c   net.Conn
@@ -126,43 +134,54 @@ func (p *SuperProxy) MakeTunnel(pool *bufiopool.Pool,
 	case ProxyTypeHTTP:
 		fallthrough
 	case ProxyTypeSOCKS5:
-		c, err = transport.Dial(p.hostWithPort)
+		c, err = transport.DialContext(ctx, p.hostWithPort)
 	case ProxyTypeHTTPS:
-		c, err = transport.DialTLS(p.hostWithPort, p.tlsConfig)
+		c, err = transport.DialTLSContext(ctx, p.hostWithPort, p.tlsConfig)
+	}
+
+	if err != nil {
+		return nil, err
 	}
 
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	stopWatching := transport.WatchContext(ctx, c)
+	err = p.connect(c, pool, targetHostWithPort)
+	if stopWatching() {
+		return nil, ctx.Err()
+	}
 	if err != nil {
+		c.Close()
 		return nil, err
 	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
 
+// connect makes the tunnel to target via the connection c to proxy
+func (p *SuperProxy) connect(c net.Conn, pool *bufiopool.Pool,
+	targetHostWithPort string) error {
 	if p.proxyType != ProxyTypeSOCKS5 {
 		// HTTP/HTTPS tunnel establishing
 		if err := p.writeHTTPProxyReq(c, []byte(targetHostWithPort)); err != nil {
-			c.Close()
-			return nil, err
-		}
-		if err = p.readHTTPProxyResp(c, pool); err != nil {
-			c.Close()
-			return nil, err
-		}
-	} else {
-		// SOCKS5 tunnel establishing
-		targetHost, targetPortStr, err := net.SplitHostPort(targetHostWithPort)
-		if err != nil {
-			return nil, err
-		}
-		targetPort, err := strconv.Atoi(targetPortStr)
-		if err != nil {
-			return nil, errors.New("proxy: failed to parse target port number: " + targetPortStr)
-		}
-		if targetPort < 1 || targetPort > 0xffff {
-			return nil, errors.New("proxy: target port number out of range: " + targetPortStr)
-		}
-		if err = p.connectSOCKS5Proxy(c, targetHost, targetPort); err != nil {
-			return nil, err
+			return err
 		}
+		return p.readHTTPProxyResp(c, pool)
 	}
-	return c, nil
+	// SOCKS5 tunnel establishing
+	targetHost, targetPortStr, err := net.SplitHostPort(targetHostWithPort)
+	if err != nil {
+		return err
+	}
+	targetPort, err := strconv.Atoi(targetPortStr)
+	if err != nil {
+		return errors.New("proxy: failed to parse target port number: " + targetPortStr)
+	}
+	if targetPort < 1 || targetPort > 0xffff {
+		return errors.New("proxy: target port number out of range: " + targetPortStr)
+	}
+	return p.connectSOCKS5Proxy(c, targetHost, targetPort)
 }
 
 //Release releases some resource
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net"
@@ -61,6 +62,17 @@ var (
 
 //AcquireConn acquire a connection
 func (c *ConnManager) AcquireConn(dialer func() (net.Conn, error)) (*Conn, error) {
+	return c.AcquireConnContext(context.Background(),
+		func(context.Context) (net.Conn, error) { return dialer() })
+}
+
+//AcquireConnContext acquire a connection, ctx is passed to dialer if a new
+//connection is dialed, ctx.Err() is returned if ctx is done before that
+func (c *ConnManager) AcquireConnContext(ctx context.Context,
+	dialer func(ctx context.Context) (net.Conn, error)) (*Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	var cc *Conn
 	createConn := false
 	startCleaner := false
@@ -90,6 +102,7 @@ func (c *ConnManager) AcquireConn(dialer func() (net.Conn, error)) (*Conn, error
 	c.connsLock.Unlock()
 
 	if cc != nil {
+		cc.reused = true
 		return cc, nil
 	}
 	if !createConn {
@@ -100,7 +113,7 @@ func (c *ConnManager) AcquireConn(dialer func() (net.Conn, error)) (*Conn, error
 		go c.connsCleaner()
 	}
 
-	conn, err := dialer()
+	conn, err := dialer(ctx)
 	if err != nil {
 		c.decConnsCount()
 		return nil, err
@@ -208,6 +221,8 @@ func acquireClientConn(conn net.Conn) *Conn {
 	cc := v.(*Conn)
 	cc.c = conn
 	cc.createdTime = servertime.CoarseTimeNow()
+	cc.lastUseTime = time.Time{}
+	cc.reused = false
 	return cc
 }
 
@@ -222,6 +237,8 @@ type Conn struct {
 
 	createdTime time.Time
 	lastUseTime time.Time
+	//reused if it's an idle one acquired from the pool
+	reused bool
 
 	//last read and write deadline time
 	LastReadDeadlineTime  time.Time
@@ -242,3 +259,8 @@ func (cc *Conn) CreatedTime() time.Time {
 func (cc *Conn) LastUseTime() time.Time {
 	return cc.lastUseTime
 }
+
+//Reused if the net conn is an idle one reused rather than a new one dialed
+func (cc *Conn) Reused() bool {
+	return cc.reused
+}
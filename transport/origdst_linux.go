@@ -0,0 +1,81 @@
+//go:build linux
+// +build linux
+
+package transport
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst SO_ORIGINAL_DST & IP6T_SO_ORIGINAL_DST in linux/netfilter_ipv4.h
+const soOriginalDst = 80
+
+// OriginalDst returns the original destination of a connection
+// redirected by iptables.
+//
+// The destination is read by SO_ORIGINAL_DST for REDIRECT/DNAT connections,
+// the local address is returned for TPROXY connections, as a socket
+// accepted by an IP_TRANSPARENT listener is bound to the original destination.
+func OriginalDst(c net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	localAddr, _ := tcpConn.LocalAddr().(*net.TCPAddr)
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		if localAddr != nil && localAddr.IP.To4() == nil {
+			dst, sockErr = getOriginalDst6(int(fd))
+		} else {
+			dst, sockErr = getOriginalDst4(int(fd))
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		//no conntrack entry, e.g. a TPROXY connection
+		if localAddr == nil {
+			return nil, sockErr
+		}
+		return localAddr, nil
+	}
+	return dst, nil
+}
+
+func getOriginalDst4(fd int) (*net.TCPAddr, error) {
+	//struct sockaddr_in fits in the 16 bytes multiaddr of IPv6Mreq
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	addr := mreq.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(addr[4], addr[5], addr[6], addr[7]),
+		Port: int(addr[2])<<8 | int(addr[3]),
+	}, nil
+}
+
+func getOriginalDst6(fd int) (*net.TCPAddr, error) {
+	//struct sockaddr_in6 is the 1st field of IPv6MTUInfo
+	info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.IPPROTO_IPV6, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	//port is in network byte order
+	port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, info.Addr.Addr[:])
+	return &net.TCPAddr{
+		IP:   ip,
+		Port: int(port[0])<<8 | int(port[1]),
+	}, nil
+}
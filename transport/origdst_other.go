@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package transport
+
+import (
+	"errors"
+	"net"
+)
+
+// OriginalDst returns the original destination of a connection
+// redirected by iptables, only supported on linux.
+func OriginalDst(c net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("original destination is only supported on linux")
+}
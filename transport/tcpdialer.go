@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"net"
@@ -23,7 +24,7 @@ import (
 //   - foobar.com:8080
 type DialFunc func(addr string) (net.Conn, error)
 
-// dial dials the given TCP addr using tcp4.
+// dial dials the given TCP addr using tcp4, the IPv6 literal one is dialed as is.
 //
 // This function has the following additional features comparing to net.Dial:
 //
@@ -47,7 +48,17 @@ type DialFunc func(addr string) (net.Conn, error)
 //     * foo.bar:80
 //     * aaa.com:8080
 func dial(addr string, isTLS bool, tlsConfig *tls.Config) (net.Conn, error) {
-	conn, err := getDialer(DefaultDialTimeout, false)(addr)
+	return dialContext(context.Background(), addr, isTLS, tlsConfig)
+}
+
+//dialContext dials like dial, the dialing is canceled once ctx is done,
+//the deadline of ctx is used rather than DefaultDialTimeout if it has one
+func dialContext(ctx context.Context, addr string, isTLS bool, tlsConfig *tls.Config) (net.Conn, error) {
+	timeout := DefaultDialTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	conn, err := dialerStd.dialContext(ctx, addr, timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -115,41 +126,48 @@ var ErrDialTimeout = errors.New("dialing to the given TCP address timed out")
 const DefaultDialTimeout = 5 * time.Second
 
 func (d *tcpDialer) newDial(timeout time.Duration) DialFunc {
+	return func(addr string) (net.Conn, error) {
+		return d.dialContext(context.Background(), addr, timeout)
+	}
+}
+
+//dialContext dials addr within timeout, the dialing is canceled once ctx is done
+func (d *tcpDialer) dialContext(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
 	d.once.Do(func() {
 		d.concurrencyCh = make(chan struct{}, maxDialConcurrency)
 		d.tcpAddrsMap = make(map[string]*tcpAddrEntry)
 		go d.tcpAddrsClean()
 	})
 
-	return func(addr string) (net.Conn, error) {
-		addrs, idx, err := d.getTCPAddrs(addr)
-		if err != nil {
-			return nil, err
-		}
+	addrs, idx, err := d.getTCPAddrs(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	n := uint32(len(addrs))
+	deadline := time.Now().Add(timeout)
+	for n > 0 {
+		//the IPv6 addresses are only the literal ones without DualStack
+		tcpAddr := &addrs[idx%n]
 		network := "tcp4"
-		if d.DualStack {
+		if d.DualStack || tcpAddr.IP.To4() == nil {
 			network = "tcp"
 		}
-
-		var conn net.Conn
-		n := uint32(len(addrs))
-		deadline := time.Now().Add(timeout)
-		for n > 0 {
-			conn, err = tryDial(network, &addrs[idx%n], deadline, d.concurrencyCh)
-			if err == nil {
-				return conn, nil
-			}
-			if err == ErrDialTimeout {
-				return nil, err
-			}
-			idx++
-			n--
+		conn, err = tryDial(ctx, network, tcpAddr, deadline, d.concurrencyCh)
+		if err == nil {
+			return conn, nil
 		}
-		return nil, err
+		if err == ErrDialTimeout || err == ctx.Err() {
+			return nil, err
+		}
+		idx++
+		n--
 	}
+	return nil, err
 }
 
-func tryDial(network string, addr *net.TCPAddr, deadline time.Time, concurrencyCh chan struct{}) (net.Conn, error) {
+func tryDial(ctx context.Context, network string, addr *net.TCPAddr, deadline time.Time,
+	concurrencyCh chan struct{}) (net.Conn, error) {
 	timeout := -time.Since(deadline)
 	if timeout <= 0 {
 		return nil, ErrDialTimeout
@@ -159,60 +177,35 @@ func tryDial(network string, addr *net.TCPAddr, deadline time.Time, concurrencyC
 	case concurrencyCh <- struct{}{}:
 	default:
 		tc := servertime.AcquireTimer(timeout)
-		isTimeout := false
+		var err error
 		select {
 		case concurrencyCh <- struct{}{}:
 		case <-tc.C:
-			isTimeout = true
+			err = ErrDialTimeout
+		case <-ctx.Done():
+			err = ctx.Err()
 		}
 		servertime.ReleaseTimer(tc)
-		if isTimeout {
-			return nil, ErrDialTimeout
+		if err != nil {
+			return nil, err
 		}
 	}
+	defer func() { <-concurrencyCh }()
 
-	timeout = -time.Since(deadline)
-	if timeout <= 0 {
-		<-concurrencyCh
-		return nil, ErrDialTimeout
-	}
-
-	chv := dialResultChanPool.Get()
-	if chv == nil {
-		chv = make(chan dialResult, 1)
-	}
-	ch := chv.(chan dialResult)
-	go func() {
-		var dr dialResult
-		dr.conn, dr.err = net.DialTCP(network, nil, addr)
-		ch <- dr
-		<-concurrencyCh
-	}()
-
-	var (
-		conn net.Conn
-		err  error
-	)
-
-	tc := servertime.AcquireTimer(timeout)
-	select {
-	case dr := <-ch:
-		conn = dr.conn
-		err = dr.err
-		dialResultChanPool.Put(ch)
-	case <-tc.C:
-		err = ErrDialTimeout
+	dialCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(dialCtx, network, addr.String())
+	if err != nil {
+		if dialCtx.Err() == context.DeadlineExceeded {
+			return nil, ErrDialTimeout
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
 	}
-	servertime.ReleaseTimer(tc)
-
-	return conn, err
-}
-
-var dialResultChanPool sync.Pool
-
-type dialResult struct {
-	conn net.Conn
-	err  error
+	return conn, nil
 }
 
 type tcpAddrEntry struct {
@@ -243,7 +236,7 @@ func (d *tcpDialer) tcpAddrsClean() {
 	}
 }
 
-func (d *tcpDialer) getTCPAddrs(addr string) ([]net.TCPAddr, uint32, error) {
+func (d *tcpDialer) getTCPAddrs(ctx context.Context, addr string) ([]net.TCPAddr, uint32, error) {
 	d.tcpAddrsLock.Lock()
 	e := d.tcpAddrsMap[addr]
 	if e != nil && !e.pending && time.Since(e.resolveTime) > DefaultDNSCacheDuration {
@@ -253,7 +246,7 @@ func (d *tcpDialer) getTCPAddrs(addr string) ([]net.TCPAddr, uint32, error) {
 	d.tcpAddrsLock.Unlock()
 
 	if e == nil {
-		addrs, err := resolveTCPAddrs(addr, d.DualStack)
+		addrs, err := resolveTCPAddrs(ctx, addr, d.DualStack)
 		if err != nil {
 			d.tcpAddrsLock.Lock()
 			e = d.tcpAddrsMap[addr]
@@ -278,7 +271,7 @@ func (d *tcpDialer) getTCPAddrs(addr string) ([]net.TCPAddr, uint32, error) {
 	return e.addrs, idx, nil
 }
 
-func resolveTCPAddrs(addr string, dualStack bool) ([]net.TCPAddr, error) {
+func resolveTCPAddrs(ctx context.Context, addr string, dualStack bool) ([]net.TCPAddr, error) {
 	host, portS, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
@@ -288,7 +281,12 @@ func resolveTCPAddrs(addr string, dualStack bool) ([]net.TCPAddr, error) {
 		return nil, err
 	}
 
-	ips, err := net.LookupIP(host)
+	//the ip literal is dialed as is, only the resolved IPv6 ones need DualStack
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.TCPAddr{{IP: ip, Port: port}}, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
 	if err != nil {
 		return nil, err
 	}
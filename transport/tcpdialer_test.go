@@ -0,0 +1,62 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestResolveTCPAddrsLiteral(t *testing.T) {
+	tests := []struct {
+		addr    string
+		expAddr string
+	}{
+		{"127.0.0.1:80", "127.0.0.1:80"},
+		//the IPv6 literal is kept without DualStack
+		{"[::1]:443", "[::1]:443"},
+		{"[2001:db8::1]:8080", "[2001:db8::1]:8080"},
+	}
+	for _, test := range tests {
+		addrs, err := resolveTCPAddrs(context.Background(), test.addr, false)
+		if err != nil {
+			t.Fatalf("fail to resolve %s: %s", test.addr, err)
+		}
+		if len(addrs) != 1 || addrs[0].String() != test.expAddr {
+			t.Fatalf("unexpected addresses %v of %s", addrs, test.addr)
+		}
+	}
+	if _, err := resolveTCPAddrs(context.Background(), "[::1]", false); err == nil {
+		t.Fatalf("address without port is resolved")
+	}
+}
+
+func TestDialContextLiteral(t *testing.T) {
+	for _, network := range []string{"tcp4", "tcp6"} {
+		addr := "127.0.0.1:0"
+		if network == "tcp6" {
+			addr = "[::1]:0"
+		}
+		ln, err := net.Listen(network, addr)
+		if err != nil {
+			if network == "tcp6" {
+				t.Skipf("IPv6 is not supported: %s", err)
+			}
+			t.Fatalf("fail to listen: %s", err)
+		}
+		accepted := make(chan struct{})
+		go func() {
+			if c, err := ln.Accept(); err == nil {
+				c.Close()
+			}
+			close(accepted)
+		}()
+		c, err := DialContext(context.Background(), ln.Addr().String())
+		if err != nil {
+			ln.Close()
+			t.Fatalf("fail to dial %s: %s", ln.Addr(), err)
+		}
+		c.Close()
+		<-accepted
+		ln.Close()
+	}
+}
@@ -1,10 +1,12 @@
 package transport
 
 import (
+	"context"
 	"crypto/tls"
 	"io"
 	"net"
 	"strings"
+	"sync"
 
 	"github.com/haxii/fastproxy/bytebufferpool"
 )
@@ -19,6 +21,49 @@ func Dial(addr string) (net.Conn, error) {
 	return dial(addr, false, nil)
 }
 
+//DialTLSContext dial tls without pool, the dialing is canceled once ctx is done,
+//the deadline of ctx is used rather than DefaultDialTimeout if it has one
+func DialTLSContext(ctx context.Context, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	return dialContext(ctx, addr, true, tlsConfig)
+}
+
+//DialContext dial without pool, the dialing is canceled once ctx is done,
+//the deadline of ctx is used rather than DefaultDialTimeout if it has one
+func DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	return dialContext(ctx, addr, false, nil)
+}
+
+//WatchContext closes conn once ctx is done, which interrupts its in-flight reads
+//and writes, stop stops watching and reports if conn is closed by then,
+//it's safe to call stop more than once
+func WatchContext(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+	stopCh := make(chan struct{})
+	closedCh := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			closedCh <- true
+		case <-stopCh:
+			closedCh <- false
+		}
+	}()
+	var (
+		once   sync.Once
+		closed bool
+	)
+	return func() bool {
+		once.Do(func() {
+			close(stopCh)
+			closed = <-closedCh
+		})
+		return closed
+	}
+}
+
 // Forward forward remote and local connection
 // It returns the number of bytes write to dst
 // and the first error encountered while writing, if any.
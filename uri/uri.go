@@ -54,6 +54,11 @@ func (uri *URI) PathWithQueryFragment() []byte {
 	return uri.pathWithQueryFragment
 }
 
+//Full the full request URI parsed, i.e. the request-target as sent
+func (uri *URI) Full() []byte {
+	return uri.full
+}
+
 //Path ...
 func (uri *URI) Path() []byte {
 	return uri.path
@@ -0,0 +1,197 @@
+package websocket
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+//Opcode opcode of a WebSocket frame, RFC 6455 5.2
+type Opcode byte
+
+const (
+	//OpContinuation continuation frame of a fragmented message
+	OpContinuation Opcode = 0x0
+	//OpText text frame
+	OpText Opcode = 0x1
+	//OpBinary binary frame
+	OpBinary Opcode = 0x2
+	//OpClose connection close frame
+	OpClose Opcode = 0x8
+	//OpPing ping frame
+	OpPing Opcode = 0x9
+	//OpPong pong frame
+	OpPong Opcode = 0xA
+)
+
+//IsControl if opcode is of a control frame, i.e. close, ping & pong
+func (op Opcode) IsControl() bool {
+	return op&0x8 != 0
+}
+
+//maxControlPayloadSize control frames' payload can't be longer than this
+const maxControlPayloadSize = 125
+
+//payloadChunkSize size of the buffer allocated before reading a payload,
+//which grows with the bytes read rather than the payload length claimed
+const payloadChunkSize = 4096
+
+//Frame a WebSocket frame with the payload unmasked
+type Frame struct {
+	//Fin if this is the final fragment of a message
+	Fin bool
+	//Opcode the frame's opcode
+	Opcode Opcode
+	//Payload the unmasked application data
+	Payload []byte
+}
+
+//IsControl if the frame is a control frame, i.e. close, ping & pong
+func (f *Frame) IsControl() bool {
+	return f.Opcode.IsControl()
+}
+
+var (
+	errReservedBits     = errors.New("reserved bits set, extensions are not supported")
+	errControlFrame     = errors.New("fragmented or too long control frame")
+	errPayloadTooLarge  = errors.New("frame payload too large")
+	errReservedOpcode   = errors.New("reserved opcode")
+	errInvalidFrameSize = errors.New("invalid frame payload length")
+)
+
+// ReadFrame reads a frame from r, the payload is unmasked if masked,
+// frames with payload longer than maxPayloadSize are refused. The payload
+// is read incrementally, so the memory used is limited by the bytes sent
+// rather than the length claimed.
+//
+// io.EOF is returned only if r ends before a new frame.
+func ReadFrame(r io.Reader, maxPayloadSize int64) (*Frame, error) {
+	var header [14]byte
+	if _, err := io.ReadFull(r, header[:2]); err != nil {
+		return nil, err
+	}
+	if header[0]&0x70 != 0 {
+		return nil, errReservedBits
+	}
+	frame := &Frame{
+		Fin:    header[0]&0x80 != 0,
+		Opcode: Opcode(header[0] & 0x0F),
+	}
+	switch frame.Opcode {
+	case OpContinuation, OpText, OpBinary, OpClose, OpPing, OpPong:
+	default:
+		return nil, errReservedOpcode
+	}
+	masked := header[1]&0x80 != 0
+
+	//extended payload length
+	var payloadSize int64
+	switch size := header[1] & 0x7F; size {
+	case 126:
+		if _, err := io.ReadFull(r, header[2:4]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		payloadSize = int64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		if _, err := io.ReadFull(r, header[2:10]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		payloadSize = int64(binary.BigEndian.Uint64(header[2:10]))
+		if payloadSize < 0 {
+			return nil, errInvalidFrameSize
+		}
+	default:
+		payloadSize = int64(size)
+	}
+	if frame.IsControl() && (!frame.Fin || payloadSize > maxControlPayloadSize) {
+		return nil, errControlFrame
+	}
+	if payloadSize > maxPayloadSize {
+		return nil, errPayloadTooLarge
+	}
+
+	var maskKey []byte
+	if masked {
+		maskKey = header[10:14]
+		if _, err := io.ReadFull(r, maskKey); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+	bufSize := payloadSize
+	if bufSize > payloadChunkSize {
+		bufSize = payloadChunkSize
+	}
+	payload := bytes.NewBuffer(make([]byte, 0, bufSize))
+	if _, err := io.CopyN(payload, r, payloadSize); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	frame.Payload = payload.Bytes()
+	if masked {
+		mask(maskKey, frame.Payload)
+	}
+	return frame, nil
+}
+
+// WriteFrame writes the frame to w, the payload is masked with a random key
+// if masked, which is required for the frames sent by client.
+//
+// The byte size written is returned.
+func WriteFrame(w io.Writer, frame *Frame, masked bool) (int, error) {
+	if frame.IsControl() && (!frame.Fin || len(frame.Payload) > maxControlPayloadSize) {
+		return 0, errControlFrame
+	}
+	var header [14]byte
+	header[0] = byte(frame.Opcode) & 0x0F
+	if frame.Fin {
+		header[0] |= 0x80
+	}
+	n := 2
+	switch payloadSize := len(frame.Payload); {
+	case payloadSize <= 125:
+		header[1] = byte(payloadSize)
+	case payloadSize <= 0xFFFF:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:4], uint16(payloadSize))
+		n = 4
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:10], uint64(payloadSize))
+		n = 10
+	}
+
+	payload := frame.Payload
+	if masked {
+		header[1] |= 0x80
+		maskKey := header[n : n+4]
+		if _, err := rand.Read(maskKey); err != nil {
+			return 0, err
+		}
+		n += 4
+		//mask a copy, the frame's payload is left untouched
+		payload = append([]byte(nil), frame.Payload...)
+		mask(maskKey, payload)
+	}
+	wn, err := w.Write(header[:n])
+	if err != nil {
+		return wn, err
+	}
+	pn, err := w.Write(payload)
+	return wn + pn, err
+}
+
+//mask masks or unmasks the payload with key
+func mask(key, payload []byte) {
+	for i := range payload {
+		payload[i] ^= key[i&3]
+	}
+}
+
+//unexpectedEOF the frame is truncated if r ends inside it
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		for _, masked := range []bool{false, true} {
+			payload := bytes.Repeat([]byte{'a'}, size)
+			var buf bytes.Buffer
+			n, err := WriteFrame(&buf, &Frame{Fin: true, Opcode: OpBinary, Payload: payload}, masked)
+			if err != nil {
+				t.Fatalf("fail to write frame of size %d: %s", size, err)
+			}
+			if n != buf.Len() {
+				t.Fatalf("unexpected written size %d, expecting %d", n, buf.Len())
+			}
+			if masked && size > 0 && bytes.Contains(buf.Bytes(), payload) {
+				t.Fatalf("payload of size %d is not masked", size)
+			}
+			frame, err := ReadFrame(&buf, 1<<20)
+			if err != nil {
+				t.Fatalf("fail to read frame of size %d: %s", size, err)
+			}
+			if !frame.Fin || frame.Opcode != OpBinary || !bytes.Equal(frame.Payload, payload) {
+				t.Fatalf("unexpected frame of size %d: %v %d", size, frame.Fin, frame.Opcode)
+			}
+			if _, err := ReadFrame(&buf, 1<<20); err != io.EOF {
+				t.Fatalf("unexpected error %v, expecting EOF", err)
+			}
+		}
+	}
+}
+
+func TestReadFrameInvalid(t *testing.T) {
+	for name, raw := range map[string][]byte{
+		"reserved bits":        {0xC1, 0x00},
+		"reserved opcode":      {0x83, 0x00},
+		"fragmented control":   {0x09, 0x00},
+		"long control":         {0x89, 0x7E, 0x00, 0x7E},
+		"payload too large":    {0x82, 0x7F, 0, 0, 0, 0, 0, 0x20, 0, 0},
+		"truncated payload":    {0x82, 0x05, 'a'},
+		"truncated ext length": {0x82, 0x7E, 0x01},
+	} {
+		if _, err := ReadFrame(bytes.NewReader(raw), 1<<20); err == nil || err == io.EOF {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+	}
+}
+
+func TestReadFrameClaimedSize(t *testing.T) {
+	//the frame claims 256MiB but sends only a byte
+	raw := []byte{0x82, 0x7F, 0, 0, 0, 0, 0x10, 0, 0, 0, 'a'}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := ReadFrame(bytes.NewReader(raw), 1<<30); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error %v, expecting unexpected EOF", err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("%d bytes allocated for the payload claimed", allocated)
+	}
+}